@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+)
+
+// bulkRequest is Prefix単位のCopy, MoveのRequest
+type bulkRequest struct {
+	Prefix    string
+	DstBucket string
+	Move      bool
+	Options   *encryption.BulkOptions
+}
+
+// parseBulkRequest is Prefix単位のCopy, MoveのRequest parameterを読み込む
+//
+//	prefix: Copy元のprefix (必須)
+//	dstBucket: Copy先のBucket. 指定しない場合はdstBuckets[0]. dstBuckets以外のBucketは指定できない
+//	dstPrefix: Copy先のprefix. 指定しない場合は同じObject名にCopyする
+//	move: trueの場合はCopy先を確認した後にCopy元を削除する
+//	overwrite: trueの場合はCopy先に存在するObjectを上書きする
+//	parallelism: 同時にCopyするObjectの数
+func parseBulkRequest(r *http.Request, dstBuckets ...string) (*bulkRequest, error) {
+	req := &bulkRequest{
+		Prefix:    r.FormValue("prefix"),
+		DstBucket: r.FormValue("dstBucket"),
+		Options:   &encryption.BulkOptions{DstPrefix: r.FormValue("dstPrefix")},
+	}
+	if req.Prefix == "" {
+		return nil, fmt.Errorf("prefix is required")
+	}
+	if req.DstBucket == "" {
+		req.DstBucket = dstBuckets[0]
+	}
+	// Service Accountが書き込める任意のBucketに持ち出せないように、設定したBucketだけに制限する
+	if !contains(dstBuckets, req.DstBucket) {
+		return nil, fmt.Errorf("dstBucket %q is not allowed", req.DstBucket)
+	}
+	var err error
+	if req.Move, err = parseBool(r, "move"); err != nil {
+		return nil, err
+	}
+	if req.Options.Overwrite, err = parseBool(r, "overwrite"); err != nil {
+		return nil, err
+	}
+	if v := r.FormValue("parallelism"); v != "" {
+		req.Options.Parallelism, err = strconv.Atoi(v)
+		if err != nil || req.Options.Parallelism < 1 {
+			return nil, fmt.Errorf("parallelism must be a positive integer but got %q", v)
+		}
+	}
+	return req, nil
+}
+
+func contains(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+func parseBool(r *http.Request, name string) (bool, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean but got %q", name, v)
+	}
+	return b, nil
+}
+
+// authorizeBulk is Copy元, Copy先のprefixに対して操作できるかを確認する
+// Moveの場合はCopy元に対してOperationMoveも必要になる
+func (handlers *Handlers) authorizeBulk(w http.ResponseWriter, r *http.Request, srcBucket string, req *bulkRequest) bool {
+	dstPrefix := req.Options.DstPrefix
+	if dstPrefix == "" {
+		dstPrefix = req.Prefix
+	}
+	if !handlers.authorize(w, r, srcBucket, req.Prefix, auth.OperationCopy) {
+		return false
+	}
+	if !handlers.authorize(w, r, req.DstBucket, dstPrefix, auth.OperationCopy) {
+		return false
+	}
+	if req.Move && !handlers.authorize(w, r, srcBucket, req.Prefix, auth.OperationMove) {
+		return false
+	}
+	return true
+}
+
+// CopyPrefixCSEKHandler
+// CSEKEncryptBucket1のprefix以下のObjectを、同じCSEKのままdstBucket (指定しない場合はCSEKEncryptBucket2) にCopy, Moveして、Objectごとの結果をJSONで返す
+// dstBucketはCSEKEncryptBucket1, CSEKEncryptBucket2のいずれか
+func (handlers *Handlers) CopyPrefixCSEKHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	srcBucket := handlers.Config.CSEKEncryptBucket1()
+	req, err := parseBulkRequest(r, handlers.Config.CSEKEncryptBucket2(), handlers.Config.CSEKEncryptBucket1())
+	if err != nil {
+		logging.Warningf(ctx, "invalid request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx = logging.WithObject(ctx, srcBucket, req.Prefix)
+	if !handlers.authorizeBulk(w, r, srcBucket, req) {
+		return
+	}
+
+	var report *encryption.BulkReport
+	if req.Move {
+		report, err = handlers.CSEKService.MovePrefix(ctx, handlers.Config.CloudKMSKeyName, req.DstBucket, srcBucket, req.Prefix, req.Options)
+	} else {
+		report, err = handlers.CSEKService.CopyPrefix(ctx, handlers.Config.CloudKMSKeyName, req.DstBucket, srcBucket, req.Prefix, req.Options)
+	}
+	handlers.writeBulkReport(w, r, report, err)
+}
+
+// CopyPrefixCMEKHandler
+// CMEKEncryptBucketのprefix以下のObjectを、CMEKEncryptBucketの中でdstPrefixにCopy, Moveして、Objectごとの結果をJSONで返す
+func (handlers *Handlers) CopyPrefixCMEKHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	srcBucket := handlers.Config.CMEKEncryptBucket()
+	req, err := parseBulkRequest(r, handlers.Config.CMEKEncryptBucket())
+	if err != nil {
+		logging.Warningf(ctx, "invalid request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx = logging.WithObject(ctx, srcBucket, req.Prefix)
+	if !handlers.authorizeBulk(w, r, srcBucket, req) {
+		return
+	}
+
+	var report *encryption.BulkReport
+	if req.Move {
+		report, err = handlers.CMEKService.MovePrefix(ctx, req.DstBucket, srcBucket, req.Prefix, req.Options)
+	} else {
+		report, err = handlers.CMEKService.CopyPrefix(ctx, req.DstBucket, srcBucket, req.Prefix, req.Options)
+	}
+	handlers.writeBulkReport(w, r, report, err)
+}
+
+// writeBulkReport is BulkReportをJSONで返す
+// 一覧の取得に失敗するなどして途中で止まった場合は、エラーのStatus Codeでそこまでの結果を返す
+func (handlers *Handlers) writeBulkReport(w http.ResponseWriter, r *http.Request, report *encryption.BulkReport, err error) {
+	ctx := r.Context()
+	if err != nil {
+		logging.Errorf(ctx, "failed bulk copy: %s", err)
+		if report == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(ctx, w, errorStatus(err), report)
+		return
+	}
+	for _, result := range report.Results {
+		if result.Status == encryption.BulkFailed {
+			logging.Warningf(ctx, "failed %s: %s", result.Object, result.Error)
+		}
+	}
+	writeJSON(ctx, w, http.StatusOK, report)
+}
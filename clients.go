@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/objstore"
+	metadatabox "github.com/sinmetalcraft/gcpbox/metadata"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// storageEmulatorHostEnv is fake-gcs-serverなどのCloud Storage Emulatorを指す環境変数
+// cloud.google.com/go/storageと同じものを見る
+const storageEmulatorHostEnv = "STORAGE_EMULATOR_HOST"
+
+// resolveProjectID is Config.ProjectIDが指定されていればそれを、なければMetadata ServerからProject IDを返す
+// GCP外で動かす時はConfig.ProjectIDを指定することで、Metadata Serverにアクセスしないようにする
+func resolveProjectID(cfg *Config) (string, error) {
+	if cfg.ProjectID != "" {
+		return cfg.ProjectID, nil
+	}
+	projectID, err := metadatabox.ProjectID()
+	if err != nil {
+		return "", fmt.Errorf("failed get project id from metadata server. set SINMETAL_PROJECTID when running outside GCP: %w", err)
+	}
+	return projectID, nil
+}
+
+// newObjectStore is Config.StorageBackendに応じたObjectStoreを作成する
+func newObjectStore(ctx context.Context, cfg *Config) (objstore.ObjectStore, error) {
+	switch cfg.StorageBackend {
+	case "", "gcs":
+		gcs, err := newStorageClient(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return objstore.NewGCS(gcs), nil
+	case "memory":
+		return objstore.NewMemory(), nil
+	case "filesystem":
+		return objstore.NewFilesystem(cfg.StorageRoot)
+	default:
+		return nil, fmt.Errorf("unsupported StorageBackend: %s", cfg.StorageBackend)
+	}
+}
+
+// newStorageClient is Config.GCSEndpoint, GCSCredentialsFileを反映したstorage.Clientを作成する
+// GCSEndpointを指定していない場合は、STORAGE_EMULATOR_HOSTを見る
+func newStorageClient(ctx context.Context, cfg *Config) (*storage.Client, error) {
+	endpoint := cfg.GCSEndpoint
+	if endpoint == "" {
+		endpoint = os.Getenv(storageEmulatorHostEnv)
+	}
+	if endpoint != "" {
+		var err error
+		endpoint, err = storageEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	opts := clientOptions(endpoint, cfg.GCSCredentialsFile)
+	hc, err := newTracingHTTPClient(ctx, append(opts, option.WithScopes(storage.ScopeFullControl))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed create gcs http client: %w", err)
+	}
+	copts := []option.ClientOption{option.WithHTTPClient(hc)}
+	if endpoint != "" {
+		copts = append(copts, option.WithEndpoint(endpoint))
+	}
+	gcs, err := storage.NewClient(ctx, copts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed storage.NewClient: %w", err)
+	}
+	return gcs, nil
+}
+
+// newKMSService is Config.KMSEndpoint, KMSCredentialsFileを反映したcloudkms.Serviceを作成する
+func newKMSService(ctx context.Context, cfg *Config) (*cloudkms.Service, error) {
+	opts := clientOptions(cfg.KMSEndpoint, cfg.KMSCredentialsFile)
+	hc, err := newTracingHTTPClient(ctx, append(opts, option.WithScopes(cloudkms.CloudPlatformScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed create kms http client: %w", err)
+	}
+	kopts := []option.ClientOption{option.WithHTTPClient(hc)}
+	if cfg.KMSEndpoint != "" {
+		kopts = append(kopts, option.WithEndpoint(cfg.KMSEndpoint))
+	}
+	kms, err := cloudkms.NewService(ctx, kopts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed cloudkms.NewService: %w", err)
+	}
+	return kms, nil
+}
+
+// clientOptions is endpointとcredentialsFileから、HTTP Clientの認証に関するOptionを返す
+// http://のEndpointはLocalのEmulatorなので、認証を行わない (平文でTokenを送らない)
+func clientOptions(endpoint string, credentialsFile string) []option.ClientOption {
+	if strings.HasPrefix(endpoint, "http://") {
+		return []option.ClientOption{option.WithoutAuthentication()}
+	}
+	if credentialsFile != "" {
+		return []option.ClientOption{option.WithCredentialsFile(credentialsFile)}
+	}
+	return nil
+}
+
+// storageEndpoint is STORAGE_EMULATOR_HOSTの形式 (host:port, http://host:port) も受け付けて、Cloud Storage JSON APIのEndpointを返す
+// Pathを省略した場合は /storage/v1/ を付ける
+func storageEndpoint(endpoint string) (string, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid gcs endpoint %q: %w", endpoint, err)
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("invalid gcs endpoint %q: host is empty", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/storage/v1/"
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,64 @@
+// Command audit-verify checks the hash chains of an audit log written by internal/audit.
+//
+// Usage:
+//
+//	audit-verify -file audit.log
+//	audit-verify -bucket my-audit-bucket -prefix audit/
+//
+// It exits with status 1 when a record was modified, removed or relinked.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func main() {
+	file := flag.String("file", "", "audit log file written by the file sink")
+	bucket := flag.String("bucket", "", "bucket written by the gcs sink")
+	prefix := flag.String("prefix", "audit/", "object name prefix written by the gcs sink")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	var records []audit.Record
+	var err error
+	switch {
+	case *file != "":
+		records, err = audit.ReadFile(*file)
+	case *bucket != "":
+		var gcs *storage.Client
+		gcs, err = storage.NewClient(ctx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed storage.NewClient: %s\n", err)
+			os.Exit(2)
+		}
+		records, err = audit.ReadGCS(ctx, objstore.NewGCS(gcs), *bucket, *prefix)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed read audit records: %s\n", err)
+		os.Exit(2)
+	}
+
+	chains := map[string]int{}
+	for _, r := range records {
+		chains[r.Chain]++
+	}
+	problems := audit.Verify(records)
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("verified %d records in %d chains: %d problems\n", len(records), len(chains), len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,54 @@
+// Command kms-emulator serves the subset of the Cloud KMS v1 REST API used by
+// encryption.CSEKService, keeping key material in a local file.
+//
+// Usage:
+//
+//	kms-emulator -addr :8081 -keystore kms-keystore.json \
+//	  -keys projects/local/locations/global/keyRings/gcs/cryptoKeys/sample
+//
+// Point the server at it with SINMETAL_KMSENDPOINT=http://localhost:8081/.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+
+	"github.com/sinmetal/gcs_sample/internal/kmsemu"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+)
+
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	keystore := flag.String("keystore", "kms-keystore.json", "file keeping the key material. empty keeps it in memory")
+	keys := flag.String("keys", "", "comma separated crypto key names to create when missing")
+	flag.Parse()
+
+	ctx := context.Background()
+
+	ks, err := kmsemu.OpenKeystore(*keystore)
+	if err != nil {
+		logging.Fatalf(ctx, "failed open keystore: %s", err)
+	}
+	for _, name := range strings.Split(*keys, ",") {
+		if name == "" {
+			continue
+		}
+		_, err := ks.CreateKey(name)
+		var e *kmsemu.Error
+		if errors.As(err, &e) && e.Status == "ALREADY_EXISTS" {
+			continue
+		}
+		if err != nil {
+			logging.Fatalf(ctx, "failed create key %s: %s", name, err)
+		}
+		logging.Infof(ctx, "created key %s", name)
+	}
+
+	logging.Infof(ctx, "kms emulator listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, kmsemu.NewServer(ks)); err != nil {
+		logging.Fatalf(ctx, "%s", err)
+	}
+}
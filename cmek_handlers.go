@@ -3,42 +3,94 @@ package main
 import (
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
+
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
 )
 
+// UploadCMEKHandler
+// BaseBucketから指定したObjectをDownloadした後、CMEKを設定したBucketにUploadする
+// PUTとform POST以外のPOSTの場合はRequest Body (raw stream or multipart/form-data) をCMEKを設定したBucketにUploadする
 func (handlers *Handlers) UploadCMEKHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	if isDirectUpload(r) {
+		handlers.uploadCMEKFromBody(w, r)
+		return
+	}
+
 	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	if !handlers.authorize(w, r, handlers.Config.CMEKEncryptBucket(), object, auth.OperationUpload) {
+		return
+	}
+	// BaseBucketのObjectを読み込んで書き込むので、読み込む権限も必要
+	if !handlers.authorize(w, r, handlers.Config.BaseBucket, object, auth.OperationDownload) {
+		return
+	}
 
-	file, err := handlers.GCS.Bucket(handlers.Config.BaseBucket).Object(object).NewReader(ctx)
+	file, opts, err := handlers.openBaseObject(ctx, object)
 	if err != nil {
-		fmt.Printf("failed object.NewReader: %s: %s\n", object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed object.NewReader: %s", err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
-	data, err := ioutil.ReadAll(file)
+	defer func() {
+		if err := file.Close(); err != nil {
+			logging.Warningf(ctx, "failed objectReader.Close: %s", err)
+		}
+	}()
+
+	size, err := handlers.CMEKService.UploadFrom(ctx, handlers.Config.CMEKEncryptBucket(), object, file, opts)
+	if err != nil {
+		logging.Errorf(ctx, "failed upload to gcs: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(fmt.Sprintf("finish.\nsize=%d", size)))
+	if err != nil {
+		logging.Warningf(ctx, "failed write response: %s", err)
+	}
+}
+
+// uploadCMEKFromBody is Request Bodyを一度もBaseBucketに置かずに、CMEKを設定したBucketにUploadする
+func (handlers *Handlers) uploadCMEKFromBody(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := readUploadBody(r, handlers.Config.MaxUploadSize)
 	if err != nil {
-		fmt.Printf("failed object read: %s\n", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Warningf(ctx, "failed read request body: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	object := r.URL.Query().Get("object")
+	if object == "" {
+		object = body.Filename
+	}
+	if object == "" {
+		logging.Warningf(ctx, "object is required")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if err := file.Close(); err != nil {
-		fmt.Printf("warn objectReader.Close: %s\n", err.Error())
+	ctx = logging.WithObject(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	if !handlers.authorize(w, r, handlers.Config.CMEKEncryptBucket(), object, auth.OperationUpload) {
+		return
 	}
 
-	size, err := handlers.CMEKService.Upload(ctx, handlers.Config.CMEKEncryptBucket(), object, data)
+	size, err := handlers.CMEKService.UploadFrom(ctx, handlers.Config.CMEKEncryptBucket(), object, body.Reader, body.Options)
 	if err != nil {
-		fmt.Printf("failed upload to gcs: kmsKey=%s, object=%s: %s\n", handlers.Config.CloudKMSKeyName, object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed upload to gcs: %s", err)
+		w.WriteHeader(uploadErrorStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(fmt.Sprintf("finish.\nsize=%d", size)))
 	if err != nil {
-		fmt.Printf("warn write response. %s", err)
+		logging.Warningf(ctx, "failed write response: %s", err)
 	}
 }
 
@@ -46,18 +98,34 @@ func (handlers *Handlers) DownloadCMEKHandler(w http.ResponseWriter, r *http.Req
 	ctx := r.Context()
 
 	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	generation, err := parseGeneration(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CMEKEncryptBucket(), object, auth.OperationDownload) {
+		return
+	}
 
-	reader, attrs, err := handlers.CMEKService.NewDownloader(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	reader, attrs, err := handlers.CMEKService.NewGenerationDownloader(ctx, handlers.Config.CMEKEncryptBucket(), object, generation)
 	if err != nil {
-		fmt.Printf("failed download fromt gcs: object=%s: %s\n", object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed download from gcs: %s", err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
+	// Closeした時に読み込んだbyte数を記録するので、必ずCloseする
+	defer func() {
+		if err := reader.Close(); err != nil {
+			logging.Warningf(ctx, "failed objectReader.Close: %s", err)
+		}
+	}()
 	w.Header().Set("Content-Type", attrs.ContentType)
 	w.WriteHeader(http.StatusOK)
 	_, err = io.Copy(w, reader)
 	if err != nil {
-		fmt.Printf("warn write response. %s", err)
+		logging.Warningf(ctx, "failed write response: %s", err)
 	}
 }
 
@@ -65,16 +133,20 @@ func (handlers *Handlers) ReEncryptCMEKHandler(w http.ResponseWriter, r *http.Re
 	ctx := r.Context()
 
 	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	if !handlers.authorize(w, r, handlers.Config.CMEKEncryptBucket(), object, auth.OperationReEncrypt) {
+		return
+	}
 
 	if err := handlers.CMEKService.ReEncrypt(ctx, handlers.Config.CMEKEncryptBucket(), object); err != nil {
-		fmt.Printf("failed copy object: kmsKey=%s, object=%s: %s\n", handlers.Config.CloudKMSKeyName, object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed copy object: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	_, err := w.Write([]byte("finish."))
 	if err != nil {
-		fmt.Printf("warn write response. %s", err)
+		logging.Warningf(ctx, "failed write response: %s", err)
 	}
 }
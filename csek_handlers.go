@@ -1,90 +1,284 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 
+	"cloud.google.com/go/storage"
 	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
 )
 
+// Cloud Storageと同じ、呼び出し元がCSEKを指定するRequest Header
+const (
+	headerEncryptionAlgorithm = "X-Goog-Encryption-Algorithm"
+	headerEncryptionKey       = "X-Goog-Encryption-Key"
+	headerEncryptionKeySHA256 = "X-Goog-Encryption-Key-Sha256"
+)
+
+// customerKey is Request HeaderでCSEKが指定されている場合に、長さとSHA-256を検証した鍵を返す
+// 指定されていない場合はnilを返す
+func customerKey(r *http.Request) ([]byte, error) {
+	key := r.Header.Get(headerEncryptionKey)
+	if key == "" {
+		return nil, nil
+	}
+	if alg := r.Header.Get(headerEncryptionAlgorithm); alg != "" && alg != "AES256" {
+		return nil, fmt.Errorf("unsupported %s %q: %w", headerEncryptionAlgorithm, alg, encryption.ErrInvalidCustomerKey)
+	}
+	return encryption.ParseCustomerKey(key, r.Header.Get(headerEncryptionKeySHA256))
+}
+
+// csekUploadKey is Uploadに使うCSEKと、その扱いを返す
+// Request HeaderでCSEKが指定されていない場合は生成して、CustomerKeyWrapと同じくwDEKとして保存する
+// keyMode=passthroughの場合は、Request HeaderでCSEKを指定する必要がある
+// Request BodyをUploadする場合にform値を読むとBodyを読み進めてしまうので、keyModeは呼び出し元が取り出して渡す
+func csekUploadKey(ctx context.Context, r *http.Request, keyMode string) ([]byte, encryption.CustomerKeyMode, error) {
+	mode, err := encryption.ParseCustomerKeyMode(keyMode)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", err, encryption.ErrInvalidCustomerKey)
+	}
+	key, err := customerKey(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if key != nil {
+		return key, mode, nil
+	}
+	if mode == encryption.CustomerKeyPassThrough {
+		return nil, "", fmt.Errorf("keyMode=%s requires %s: %w", mode, headerEncryptionKey, encryption.ErrInvalidCustomerKey)
+	}
+	key, err = encryption.GenerateEncryptionKey(ctx)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed generate encryption key: %w", err)
+	}
+	return key, encryption.CustomerKeyWrap, nil
+}
+
+// uploadCSEK is modeに応じてencKeyでCSEKEncryptBucket1にUploadする
+func (handlers *Handlers) uploadCSEK(ctx context.Context, object string, encKey []byte, mode encryption.CustomerKeyMode, r io.Reader, opts *encryption.UploadOptions) (int64, error) {
+	if mode == encryption.CustomerKeyPassThrough {
+		return handlers.CSEKService.UploadWithCustomerKey(ctx, handlers.Config.CSEKEncryptBucket1(), object, encKey, r, opts)
+	}
+	return handlers.CSEKService.UploadFrom(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object, encKey, r, opts)
+}
+
 // UploadCSEKHandler
 // BaseBucketから指定したObjectをDownloadした後、CSEKで暗号化して、Uploadする
+// PUTとform POST以外のPOSTの場合はRequest Body (raw stream or multipart/form-data) をCSEKで暗号化して、Uploadする
+// X-Goog-Encryption-Key, X-Goog-Encryption-Key-Sha256を指定した場合は、生成する代わりにその鍵をCSEKとして使う
+// keyMode=passthroughの場合は指定した鍵を保存せず、Downloadする時にも同じ鍵を指定する
 func (handlers *Handlers) UploadCSEKHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
+	if isDirectUpload(r) {
+		handlers.uploadCSEKFromBody(w, r)
+		return
+	}
+
 	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationUpload) {
+		return
+	}
+	// BaseBucketのObjectを読み込んで書き込むので、読み込む権限も必要
+	if !handlers.authorize(w, r, handlers.Config.BaseBucket, object, auth.OperationDownload) {
+		return
+	}
 
-	file, err := handlers.GCS.Bucket(handlers.Config.BaseBucket).Object(object).NewReader(ctx)
+	encKey, mode, err := csekUploadKey(ctx, r, r.FormValue("keyMode"))
 	if err != nil {
-		fmt.Printf("failed object.NewReader: %s: %s\n", object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Warningf(ctx, "invalid encryption key: %s", err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
-	data, err := ioutil.ReadAll(file)
+
+	file, opts, err := handlers.openBaseObject(ctx, object)
+	if err != nil {
+		logging.Errorf(ctx, "failed object.NewReader: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logging.Warningf(ctx, "failed objectReader.Close: %s", err)
+		}
+	}()
+
+	size, err := handlers.uploadCSEK(ctx, object, encKey, mode, file, opts)
 	if err != nil {
-		fmt.Printf("failed object read: %s\n", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed upload to gcs: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
-	if err := file.Close(); err != nil {
-		fmt.Printf("warn objectReader.Close: %s\n", err.Error())
+
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte(fmt.Sprintf("finish.\nsize=%d", size)))
+	if err != nil {
+		logging.Warningf(ctx, "failed write response: %s", err)
 	}
+}
 
-	encKey, err := encryption.GenerateEncryptionKey(ctx)
+// uploadCSEKFromBody is Request Bodyを一度もBaseBucketに置かずに、CSEKで暗号化してUploadする
+func (handlers *Handlers) uploadCSEKFromBody(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := readUploadBody(r, handlers.Config.MaxUploadSize)
 	if err != nil {
-		fmt.Printf("failed generate encryption: %s\n", err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Warningf(ctx, "failed read request body: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	object := r.URL.Query().Get("object")
+	if object == "" {
+		object = body.Filename
+	}
+	if object == "" {
+		logging.Warningf(ctx, "object is required")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	size, err := handlers.CSEKService.Upload(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object, encKey, data)
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationUpload) {
+		return
+	}
+
+	encKey, mode, err := csekUploadKey(ctx, r, r.URL.Query().Get("keyMode"))
+	if err != nil {
+		logging.Warningf(ctx, "invalid encryption key: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	size, err := handlers.uploadCSEK(ctx, object, encKey, mode, body.Reader, body.Options)
 	if err != nil {
-		fmt.Printf("failed upload to gcs: kmsKey=%s, object=%s: %s\n", handlers.Config.CloudKMSKeyName, object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed upload to gcs: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(uploadErrorStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write([]byte(fmt.Sprintf("finish.\nsize=%d", size)))
 	if err != nil {
-		fmt.Printf("warn write response. %s", err)
+		logging.Warningf(ctx, "failed write response: %s", err)
 	}
 }
 
+// DownloadCSEKHandler
+// CSEKEncryptBucket1のObjectを、Metadata[wDEK]から取得したCSEKで読み込んで返す
+// X-Goog-Encryption-Key, X-Goog-Encryption-Key-Sha256を指定した場合は、Metadata[wDEK]を使わずにその鍵で読み込む
 func (handlers *Handlers) DownloadCSEKHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	generation, err := parseGeneration(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationDownload) {
+		return
+	}
+
+	encKey, err := customerKey(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid encryption key: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
 
-	reader, attrs, err := handlers.CSEKService.NewDownloader(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object)
+	var reader io.ReadCloser
+	var attrs *storage.ObjectAttrs
+	if encKey != nil {
+		reader, attrs, err = handlers.CSEKService.NewCustomerKeyDownloader(ctx, handlers.Config.CSEKEncryptBucket1(), object, generation, encKey)
+	} else {
+		reader, attrs, err = handlers.CSEKService.NewGenerationDownloader(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object, generation)
+	}
 	if err != nil {
-		fmt.Printf("failed download fromt gcs: kmsKey=%s, object=%s: %s\n", handlers.Config.CloudKMSKeyName, object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+		logging.Errorf(ctx, "failed download from gcs: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
+	// Closeした時に読み込んだbyte数を記録するので、必ずCloseする
+	defer func() {
+		if err := reader.Close(); err != nil {
+			logging.Warningf(ctx, "failed objectReader.Close: %s", err)
+		}
+	}()
 	w.Header().Set("Content-Type", attrs.ContentType)
 	w.WriteHeader(http.StatusOK)
 	_, err = io.Copy(w, reader)
 	if err != nil {
-		fmt.Printf("warn write response. %s", err)
+		logging.Warningf(ctx, "failed write response: %s", err)
+	}
+}
+
+// DiagnoseCSEKHandler
+// CSEKEncryptBucket1のObjectをCloudKMSKeyNameで復号できるかを確認して、できない場合はその原因をJSONで返す
+// Objectの内容は読み込まない
+func (handlers *Handlers) DiagnoseCSEKHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	if object == "" {
+		logging.Warningf(ctx, "object is required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	generation, err := parseGeneration(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationDownload) {
+		return
+	}
+
+	diagnosis, err := handlers.CSEKService.Diagnose(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object, generation)
+	if err != nil {
+		logging.Errorf(ctx, "failed diagnose object: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	for _, p := range diagnosis.Problems {
+		logging.Infof(ctx, "diagnose %s: %s", p.Code, p.Message)
 	}
+	writeJSON(ctx, w, http.StatusOK, diagnosis)
 }
 
 func (handlers *Handlers) CopyCSEKHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	generation, err := parseGeneration(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationCopy) {
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket2(), object, auth.OperationCopy) {
+		return
+	}
 
-	if err := handlers.CSEKService.Copy(ctx, handlers.Config.CSEKEncryptBucket2(), handlers.Config.CSEKEncryptBucket1(), object, handlers.Config.CloudKMSKeyName); err != nil {
-		fmt.Printf("failed copy object: kmsKey=%s, object=%s: %s\n", handlers.Config.CloudKMSKeyName, object, err.Error())
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := handlers.CSEKService.CopyGeneration(ctx, handlers.Config.CSEKEncryptBucket2(), handlers.Config.CSEKEncryptBucket1(), object, generation, handlers.Config.CloudKMSKeyName); err != nil {
+		logging.Errorf(ctx, "failed copy object: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
-	_, err := w.Write([]byte("finish."))
+	_, err = w.Write([]byte("finish."))
 	if err != nil {
-		fmt.Printf("warn write response. %s", err)
+		logging.Warningf(ctx, "failed write response: %s", err)
 	}
 }
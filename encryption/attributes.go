@@ -0,0 +1,54 @@
+package encryption
+
+import (
+	"context"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+)
+
+// Span Attributeとして記録するKey
+// 鍵やwDEKの値は記録しない (internal/traceでもredactされる)
+const (
+	attrMode          = "encryption.mode"
+	attrBucket        = "gcs.bucket"
+	attrObject        = "gcs.object"
+	attrGeneration    = "gcs.generation"
+	attrBytes         = "gcs.bytes"
+	attrKMSKey        = "kms.key"
+	attrKMSKeyVersion = "kms.keyVersion"
+	attrKMSLatency    = "kms.latency"
+)
+
+// setObjectAttributes is 操作対象のObjectをSpanに記録する
+func setObjectAttributes(ctx context.Context, mode string, bucketName string, objectName string) {
+	trace.SetAttributesKV(ctx, map[string]interface{}{
+		attrMode:   mode,
+		attrBucket: bucketName,
+		attrObject: objectName,
+	})
+}
+
+// setStoredObjectAttributes is Cloud Storage上のObjectのgeneration, size, 暗号化に使ったKMS Key VersionをSpanに記録する
+func setStoredObjectAttributes(ctx context.Context, attrs *storage.ObjectAttrs) {
+	if attrs == nil {
+		return
+	}
+	kv := map[string]interface{}{
+		attrGeneration: attrs.Generation,
+		attrBytes:      attrs.Size,
+	}
+	if v := keyVersionOf(attrs); v != "" {
+		kv[attrKMSKeyVersion] = v
+	}
+	trace.SetAttributesKV(ctx, kv)
+}
+
+// keyVersionOf is Objectの暗号化に使ったCloud KMS Key Versionを返す
+// CMEKの場合はObjectAttrs.KMSKeyName, CSEKの場合はwDEKを暗号化したKeyVersionをMetadata[cryptKey]から取得する
+func keyVersionOf(attrs *storage.ObjectAttrs) string {
+	if attrs.KMSKeyName != "" {
+		return attrs.KMSKeyName
+	}
+	return attrs.Metadata["cryptKey"]
+}
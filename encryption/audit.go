@@ -0,0 +1,56 @@
+package encryption
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+)
+
+// auditTarget is Audit Logに記録する操作対象のObject
+// Encrypt, Decryptは呼び出し元からctxで受け取る
+type auditTarget struct {
+	bucket     string
+	object     string
+	generation int64
+	keyVersion string
+}
+
+type auditTargetKey struct{}
+
+func withAuditTarget(ctx context.Context, t auditTarget) context.Context {
+	return context.WithValue(ctx, auditTargetKey{}, t)
+}
+
+func auditTargetFrom(ctx context.Context) auditTarget {
+	t, _ := ctx.Value(auditTargetKey{}).(auditTarget)
+	return t
+}
+
+// audit is opの結果をAudit Logに記録する
+// 記録に失敗した場合はErrorを返すので、opが成功していても呼び出し元は失敗として扱う
+func (s *CSEKService) audit(ctx context.Context, op audit.Operation, keyName string, keyVersion string, opErr error) error {
+	t := auditTargetFrom(ctx)
+	if keyVersion == "" {
+		keyVersion = t.keyVersion
+	}
+	r := audit.Record{
+		Operation:  op,
+		Bucket:     t.bucket,
+		Object:     t.object,
+		Generation: t.generation,
+		KeyName:    keyName,
+		KeyVersion: keyVersion,
+		Outcome:    audit.OutcomeSuccess,
+	}
+	if opErr != nil {
+		r.Outcome = audit.OutcomeFailure
+		r.Error = opErr.Error()
+	}
+	if err := s.auditLog.Append(ctx, r); err != nil {
+		logging.Errorf(ctx, "failed audit %s: %s", op, err)
+		return fmt.Errorf("failed audit %s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// DefaultBulkParallelism is BulkOptions.Parallelismを指定しなかった時に、同時にCopyするObjectの数
+const DefaultBulkParallelism = 4
+
+// MaxBulkParallelism is 同時にCopy, 削除するObjectの数の上限
+// これより大きいParallelismを指定した場合はMaxBulkParallelismになる
+const MaxBulkParallelism = 32
+
+// BulkOptions is Prefix単位でCopy, Moveする時のOption
+type BulkOptions struct {
+	// Parallelism is 同時にCopyするObjectの数
+	// 0以下の場合はDefaultBulkParallelism, MaxBulkParallelismより大きい場合はMaxBulkParallelismになる
+	Parallelism int
+
+	// Overwrite is Copy先に同じ名前のObjectがある時に上書きするかどうか
+	// falseの場合はCopy先に存在しないことを前提条件にして、存在するObjectはBulkSkippedにする
+	Overwrite bool
+
+	// DeleteSource is Copyした後に、Copy先の内容がCopy元と一致することを確認してからCopy元を削除するかどうか
+	// Copy元は確認した時のGenerationを前提条件にして削除するので、途中で上書きされたObjectは削除しない
+	DeleteSource bool
+
+	// DstPrefix is Copy先のObject名のprefix
+	// 指定した場合はCopy元のprefixをDstPrefixに置き換える。空の場合は同じObject名にCopyする
+	DstPrefix string
+}
+
+func (o *BulkOptions) parallelism() int {
+	if o == nil {
+		return bulkParallelism(0)
+	}
+	return bulkParallelism(o.Parallelism)
+}
+
+// bulkParallelism is 0以下の場合はDefaultBulkParallelism, MaxBulkParallelismより大きい場合はMaxBulkParallelismを返す
+func bulkParallelism(parallelism int) int {
+	if parallelism <= 0 {
+		return DefaultBulkParallelism
+	}
+	if parallelism > MaxBulkParallelism {
+		return MaxBulkParallelism
+	}
+	return parallelism
+}
+
+// forEachObject is bucketのprefix以下のObjectを一覧して、parallelism個ずつ並列に処理する
+// scheduleは一覧の順に1つずつ呼び出すので、Reportへの追加など順序が必要な処理はscheduleで行い、
+// 並列に実行する処理を返す
+// 一覧の取得に失敗した場合やctxが終了した場合も、実行中の処理が終わるのを待ってからerrを返す
+func forEachObject(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, op string, bucketName string, prefix string, parallelism int, schedule func(attrs *storage.ObjectAttrs) func()) error {
+	sem := make(chan struct{}, bulkParallelism(parallelism))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	q := &objstore.Query{Prefix: prefix}
+	token := ""
+	for {
+		var page *objstore.ListPage
+		err := retry.Do(ctx, "gcs.list", func(ctx context.Context) error {
+			var err error
+			page, err = store.List(ctx, bucketName, q, 0, token)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed list objects: %w", gcsError(op, bucketName, prefix, err))
+		}
+		for _, attrs := range page.Objects {
+			work := schedule(attrs)
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				work()
+			}()
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// BulkStatus is Prefix単位のCopy, MoveでのObjectごとの結果
+type BulkStatus string
+
+const (
+	// BulkCopied is Copyした
+	BulkCopied BulkStatus = "copied"
+
+	// BulkMoved is Copyして、Copy元を削除した
+	BulkMoved BulkStatus = "moved"
+
+	// BulkSkipped is Copy先に既にObjectが存在するのでCopyしなかった
+	BulkSkipped BulkStatus = "skipped"
+
+	// BulkFailed is 失敗した。Copyした後にCopy元の削除に失敗した場合も含む
+	BulkFailed BulkStatus = "failed"
+)
+
+// BulkResult is Prefix単位のCopy, MoveでのObjectごとの結果
+type BulkResult struct {
+	Object        string     `json:"object"`
+	DstObject     string     `json:"dstObject"`
+	SrcGeneration int64      `json:"srcGeneration"`
+	DstGeneration int64      `json:"dstGeneration,omitempty"`
+	Status        BulkStatus `json:"status"`
+	Error         string     `json:"error,omitempty"`
+
+	err error
+}
+
+// Err is 失敗した時のerr
+func (r *BulkResult) Err() error {
+	return r.err
+}
+
+// BulkReport is Prefix単位のCopy, Moveの結果
+type BulkReport struct {
+	SrcBucket string        `json:"srcBucket"`
+	DstBucket string        `json:"dstBucket"`
+	Prefix    string        `json:"prefix"`
+	Results   []*BulkResult `json:"results"`
+	Copied    int           `json:"copied"`
+	Moved     int           `json:"moved"`
+	Skipped   int           `json:"skipped"`
+	Failed    int           `json:"failed"`
+}
+
+// copyFunc is srcをdstにCopyする
+// CSEK, CMEKで鍵の扱いが異なる部分
+// CSEKの場合はCopyに使った鍵も返す. Copy先を確認する時に、鍵を指定しないとCRC32Cを読めないため
+type copyFunc func(ctx context.Context, src *storage.ObjectAttrs, dst objstore.ObjectRef, conds *objstore.Conditions) (copied *storage.ObjectAttrs, key []byte, err error)
+
+// bulk is srcBucketのprefix以下のObjectを、dstBucketにcopyで並列にCopyする
+type bulk struct {
+	store objstore.ObjectStore
+	retry RetryPolicy
+	op    string
+	copy  copyFunc
+}
+
+func (b *bulk) run(ctx context.Context, dstBucket string, srcBucket string, prefix string, opts *BulkOptions) (*BulkReport, error) {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	if srcBucket == dstBucket && overlaps(prefix, opts.DstPrefix) {
+		return nil, fmt.Errorf("%s: source and destination must not overlap: gs://%s/%s", b.op, srcBucket, prefix)
+	}
+
+	report := &BulkReport{SrcBucket: srcBucket, DstBucket: dstBucket, Prefix: prefix}
+	var mu sync.Mutex
+	err := forEachObject(ctx, b.store, b.retry, b.op, srcBucket, prefix, opts.parallelism(), func(attrs *storage.ObjectAttrs) func() {
+		result := &BulkResult{Object: attrs.Name, DstObject: dstName(attrs.Name, prefix, opts.DstPrefix), SrcGeneration: attrs.Generation}
+		report.Results = append(report.Results, result)
+		return func() {
+			b.one(ctx, dstBucket, attrs, result, opts)
+			mu.Lock()
+			defer mu.Unlock()
+			switch result.Status {
+			case BulkCopied:
+				report.Copied++
+			case BulkMoved:
+				report.Moved++
+			case BulkSkipped:
+				report.Skipped++
+			default:
+				report.Failed++
+			}
+		}
+	})
+	return report, err
+}
+
+// one is 1つのObjectをCopyして、必要であればCopy元を削除する
+func (b *bulk) one(ctx context.Context, dstBucket string, src *storage.ObjectAttrs, result *BulkResult, opts *BulkOptions) {
+	fail := func(err error) {
+		result.Status = BulkFailed
+		result.Error = err.Error()
+		result.err = err
+	}
+
+	var conds *objstore.Conditions
+	if !opts.Overwrite {
+		conds = &objstore.Conditions{DoesNotExist: true}
+	}
+	dst := objstore.ObjectRef{Bucket: dstBucket, Name: result.DstObject}
+	copied, key, err := b.copy(ctx, src, dst, conds)
+	if errors.Is(err, ErrPreconditionFailed) && !opts.Overwrite {
+		result.Status = BulkSkipped
+		return
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	result.DstGeneration = copied.Generation
+	result.Status = BulkCopied
+	if !opts.DeleteSource {
+		return
+	}
+
+	if err := b.verify(ctx, src, copied, key); err != nil {
+		fail(err)
+		return
+	}
+	// 確認したGenerationのままの場合だけ削除する
+	err = b.retry.Do(ctx, "gcs.delete", func(ctx context.Context) error {
+		return b.store.Delete(ctx, src.Bucket, src.Name, &objstore.ObjectOptions{Conditions: &objstore.Conditions{GenerationMatch: src.Generation}})
+	})
+	if err != nil {
+		fail(fmt.Errorf("copied but failed delete source: %w", gcsError(b.op, src.Bucket, src.Name, err)))
+		return
+	}
+	result.Status = BulkMoved
+}
+
+// verify is Copy元とCopy先のGenerationを読み直して、内容が一致するかを確認する
+// CSEKで暗号化されたObjectは鍵を指定しないとCRC32Cが返ってこないので、keyを指定して読み込む
+func (b *bulk) verify(ctx context.Context, src *storage.ObjectAttrs, copied *storage.ObjectAttrs, key []byte) error {
+	var srcAttrs, dst *storage.ObjectAttrs
+	err := b.retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		srcAttrs, err = b.store.Attrs(ctx, src.Bucket, src.Name, &objstore.ObjectOptions{Generation: src.Generation, EncryptionKey: key})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed read source object.Attrs: %w", gcsError(b.op, src.Bucket, src.Name, err))
+	}
+	err = b.retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		dst, err = b.store.Attrs(ctx, copied.Bucket, copied.Name, &objstore.ObjectOptions{Generation: copied.Generation, EncryptionKey: key})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed read copied object.Attrs: %w", gcsError(b.op, copied.Bucket, copied.Name, err))
+	}
+	if dst.CustomerKeySHA256 != srcAttrs.CustomerKeySHA256 {
+		return &Error{Op: b.op, Bucket: dst.Bucket, Object: dst.Name, Kind: ErrIntegrity,
+			Err: fmt.Errorf("copied object is encrypted with a different customer-supplied key")}
+	}
+	if srcAttrs.CustomerKeySHA256 != "" && len(key) == 0 {
+		// 鍵無しではCRC32Cが返ってこないので、Sizeだけの比較になってしまう
+		return &Error{Op: b.op, Bucket: src.Bucket, Object: src.Name, Kind: ErrIntegrity,
+			Err: fmt.Errorf("customer-supplied key is required to verify the copied object")}
+	}
+	if dst.Size != srcAttrs.Size || dst.CRC32C != srcAttrs.CRC32C {
+		return &Error{Op: b.op, Bucket: dst.Bucket, Object: dst.Name, Kind: ErrIntegrity,
+			Err: fmt.Errorf("copied object differs from source: size=%d/%d crc32c=%d/%d", dst.Size, srcAttrs.Size, dst.CRC32C, srcAttrs.CRC32C)}
+	}
+	return nil
+}
+
+// overlaps is 同じBucketの中でCopyする時に、Copy元とCopy先のprefixが重なっているかを返す
+// 一方が他方のprefixになっている場合 (a/ → a/b/) は、Copy先のObjectが一覧に含まれてしまう
+// dstPrefixが空の場合は同じObject名にCopyするので、常に重なる
+func overlaps(prefix string, dstPrefix string) bool {
+	if dstPrefix == "" {
+		return true
+	}
+	return strings.HasPrefix(dstPrefix, prefix) || strings.HasPrefix(prefix, dstPrefix)
+}
+
+// dstName is Copy元のObject名のprefixをdstPrefixに置き換える
+func dstName(name string, prefix string, dstPrefix string) string {
+	if dstPrefix == "" {
+		return name
+	}
+	return dstPrefix + name[len(prefix):]
+}
+
+// CopyPrefix is srcBucketのprefix以下の全てのObjectを、同じCSEKのままdstBucketにCopyする
+// Objectごとの結果はBulkReportに記録し、一部のObjectが失敗しても残りのObjectのCopyは続ける
+// errを返すのはObjectの一覧を取得できなかった場合などで、その時もそれまでの結果を返す
+func (s *CSEKService) CopyPrefix(ctx context.Context, keyName string, dstBucket string, srcBucket string, prefix string, opts *BulkOptions) (report *BulkReport, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/copyPrefix")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, dstBucket, prefix)
+	trace.SetAttributesKV(ctx, map[string]interface{}{"gcs.srcBucket": srcBucket})
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "copyPrefix", dstBucket, err)
+	}()
+
+	b := &bulk{
+		store: s.store,
+		retry: s.retry,
+		op:    "csek.copyPrefix",
+		copy: func(ctx context.Context, src *storage.ObjectAttrs, dst objstore.ObjectRef, conds *objstore.Conditions) (*storage.ObjectAttrs, []byte, error) {
+			return s.copyObject(ctx, "csek.copyPrefix", keyName, src, dst, conds)
+		},
+	}
+	return b.run(ctx, dstBucket, srcBucket, prefix, opts)
+}
+
+// MovePrefix is CopyPrefixでCopyした後に、Copy先の内容を確認してからCopy元を削除する
+func (s *CSEKService) MovePrefix(ctx context.Context, keyName string, dstBucket string, srcBucket string, prefix string, opts *BulkOptions) (*BulkReport, error) {
+	return s.CopyPrefix(ctx, keyName, dstBucket, srcBucket, prefix, moveOptions(opts))
+}
+
+// CopyPrefix is srcBucketのprefix以下の全てのObjectを、dstBucketにCopyする
+// Copy先はdstBucketのBucket Default Keyで暗号化される
+// Objectごとの結果はBulkReportに記録し、一部のObjectが失敗しても残りのObjectのCopyは続ける
+func (s *CMEKService) CopyPrefix(ctx context.Context, dstBucket string, srcBucket string, prefix string, opts *BulkOptions) (report *BulkReport, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/copyPrefix")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, dstBucket, prefix)
+	trace.SetAttributesKV(ctx, map[string]interface{}{"gcs.srcBucket": srcBucket})
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "copyPrefix", dstBucket, err)
+	}()
+
+	b := &bulk{
+		store: s.store,
+		retry: s.retry,
+		op:    "cmek.copyPrefix",
+		copy: func(ctx context.Context, src *storage.ObjectAttrs, dst objstore.ObjectRef, conds *objstore.Conditions) (copied *storage.ObjectAttrs, key []byte, err error) {
+			copyOpts := &objstore.CopyOptions{
+				DstConditions: conds,
+				Attrs:         copyAttrs(src, s.preserveStorageClass),
+			}
+			srcRef := objstore.ObjectRef{Bucket: src.Bucket, Name: src.Name, Generation: src.Generation}
+			err = s.retry.Do(ctx, "gcs.copy", func(ctx context.Context) error {
+				var err error
+				copied, err = s.store.Copy(ctx, dst, srcRef, copyOpts)
+				return err
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed copier.Run: %w", gcsError("cmek.copyPrefix", dst.Bucket, dst.Name, err))
+			}
+			return copied, nil, nil
+		},
+	}
+	return b.run(ctx, dstBucket, srcBucket, prefix, opts)
+}
+
+// MovePrefix is CopyPrefixでCopyした後に、Copy先の内容を確認してからCopy元を削除する
+func (s *CMEKService) MovePrefix(ctx context.Context, dstBucket string, srcBucket string, prefix string, opts *BulkOptions) (*BulkReport, error) {
+	return s.CopyPrefix(ctx, dstBucket, srcBucket, prefix, moveOptions(opts))
+}
+
+func moveOptions(opts *BulkOptions) *BulkOptions {
+	o := BulkOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	o.DeleteSource = true
+	return &o
+}
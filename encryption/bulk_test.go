@@ -0,0 +1,90 @@
+package encryption_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func TestCSEKService_MovePrefix(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	for i := 0; i < 5; i++ {
+		upload(t, s, "src", fmt.Sprintf("tenant-a/%d.txt", i), fmt.Sprintf("data %d", i))
+	}
+	upload(t, s, "src", "tenant-b/0.txt", "other tenant")
+	// Copy先に既にあるObjectは上書きしない
+	upload(t, s, "dst", "tenant-a/0.txt", "existing")
+
+	report, err := s.MovePrefix(ctx, testKeyName, "dst", "src", "tenant-a/", &encryption.BulkOptions{Parallelism: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) != 5 || report.Moved != 4 || report.Skipped != 1 || report.Failed != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	for _, result := range report.Results {
+		if result.Object == "tenant-a/0.txt" {
+			if result.Status != encryption.BulkSkipped {
+				t.Errorf("want skipped but got %+v", result)
+			}
+			continue
+		}
+		if _, err := store.Attrs(ctx, "src", result.Object, nil); !errors.Is(err, objstore.ErrObjectNotExist) {
+			t.Errorf("want %s deleted from src but got %v", result.Object, err)
+		}
+		got, _, err := s.Download(ctx, testKeyName, "dst", result.Object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "data " + result.Object[len("tenant-a/"):len("tenant-a/")+1]; string(got) != want {
+			t.Errorf("want %q but got %q", want, got)
+		}
+	}
+
+	got, _, err := s.Download(ctx, testKeyName, "dst", "tenant-a/0.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "existing" {
+		t.Errorf("want existing object kept but got %q", got)
+	}
+	if _, err := store.Attrs(ctx, "src", "tenant-b/0.txt", nil); err != nil {
+		t.Errorf("want object outside the prefix kept but got %v", err)
+	}
+}
+
+func TestCMEKService_CopyPrefix(t *testing.T) {
+	ctx := context.Background()
+	s := newCMEKService(t)
+	for _, name := range []string{"logs/a", "logs/b"} {
+		if _, err := s.Upload(ctx, "bucket", name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.CopyPrefix(ctx, "bucket", "bucket", "logs/", &encryption.BulkOptions{DstPrefix: "archive/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Copied != 2 {
+		t.Fatalf("want 2 copied but got %+v", report)
+	}
+	got, _, err := s.Download(ctx, "bucket", "archive/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "logs/b" {
+		t.Errorf("want logs/b but got %q", got)
+	}
+
+	for _, dstPrefix := range []string{"", "logs/", "logs/nested/", "lo"} {
+		if _, err := s.CopyPrefix(ctx, "bucket", "bucket", "logs/", &encryption.BulkOptions{DstPrefix: dstPrefix}); err == nil {
+			t.Errorf("want error copying logs/ onto overlapping %q but got nil", dstPrefix)
+		}
+	}
+}
@@ -1,22 +1,33 @@
 package encryption
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 
 	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
 	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
 )
 
 type CMEKService struct {
-	gcs *storage.Client
+	store objstore.ObjectStore
+	retry RetryPolicy
+
+	preserveStorageClass bool
 }
 
-func NewCMEKService(ctx context.Context, gcs *storage.Client) (*CMEKService, error) {
+func NewCMEKService(ctx context.Context, store objstore.ObjectStore, opts ...Option) (*CMEKService, error) {
+	o := newOptions(opts)
 	return &CMEKService{
-		gcs: gcs,
+		store: store,
+		retry: o.retry,
+
+		preserveStorageClass: o.preserveStorageClass,
 	}, nil
 }
 
@@ -24,21 +35,49 @@ func NewCMEKService(ctx context.Context, gcs *storage.Client) (*CMEKService, err
 // CMEKとしてBucket Default Keyを指定しているので、コード上はただアップロードしてるだけ
 func (s *CMEKService) Upload(ctx context.Context, bucketName string, objectName string, file []byte) (size int, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/cmek/upload")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+
+	opts := &UploadOptions{ContentType: http.DetectContentType(file)}
+	n, err := s.UploadFrom(ctx, bucketName, objectName, bytes.NewReader(file), opts)
+	if err != nil {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// UploadFrom is rから読み込んだ内容をそのままCloud Storageにアップロードする
+// CMEKとしてBucket Default Keyを指定しているので、コード上はただStreamをアップロードしてるだけ
+// rの読み込みに失敗した場合はアップロードを中断し、Objectは作成されない
+func (s *CMEKService) UploadFrom(ctx context.Context, bucketName string, objectName string, r io.Reader, opts *UploadOptions) (size int64, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/uploadFrom")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "upload", bucketName, err)
+		metrics.RecordUploadedBytes(ctx, metrics.ModeCMEK, "upload", bucketName, size, err)
+	}()
+
+	// 途中で失敗した時にCloseせずにcancelすることで、中途半端なObjectが作成されないようにする
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// bucket default keyを指定してるので、普通にUploadしている
 	// https://cloud.google.com/storage/docs/encryption/using-customer-managed-keys?hl=en#add-default-key
-	obj := s.gcs.Bucket(bucketName).Object(objectName)
-	w := obj.NewWriter(ctx)
+	wopts := &objstore.WriteOptions{}
+	opts.apply(&wopts.Attrs)
+	wopts.Conditions = opts.conditions()
+	w := s.store.NewWriter(wctx, bucketName, objectName, wopts)
 
-	size, err = w.Write(file)
+	size, err = io.Copy(w, r)
 	if err != nil {
 		return 0, fmt.Errorf("failed gcs.write: %w", err)
 	}
 
 	if err := w.Close(); err != nil {
-		return size, fmt.Errorf("file writer close error: %w", err)
+		return size, fmt.Errorf("file writer close error: %w", gcsError("cmek.upload", bucketName, objectName, err))
 	}
+	setStoredObjectAttributes(ctx, w.Attrs())
 
 	return size, nil
 }
@@ -47,11 +86,18 @@ func (s *CMEKService) Upload(ctx context.Context, bucketName string, objectName
 // keyName format: "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s
 func (s *CMEKService) UploadWithKey(ctx context.Context, keyName string, bucketName string, objectName string, file []byte) (size int, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/cmek/uploadWithKey")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	trace.SetAttributesKV(ctx, map[string]interface{}{attrKMSKey: keyName})
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "uploadWithKey", bucketName, err)
+		metrics.RecordUploadedBytes(ctx, metrics.ModeCMEK, "uploadWithKey", bucketName, int64(size), err)
+	}()
 
-	obj := s.gcs.Bucket(bucketName).Object(objectName)
-	w := obj.NewWriter(ctx)
-	w.KMSKeyName = keyName
+	wopts := &objstore.WriteOptions{}
+	wopts.Attrs.ContentType = http.DetectContentType(file)
+	wopts.Attrs.KMSKeyName = keyName
+	w := s.store.NewWriter(ctx, bucketName, objectName, wopts)
 
 	size, err = w.Write(file)
 	if err != nil {
@@ -59,8 +105,9 @@ func (s *CMEKService) UploadWithKey(ctx context.Context, keyName string, bucketN
 	}
 
 	if err := w.Close(); err != nil {
-		return size, fmt.Errorf("file writer close error: %w", err)
+		return size, fmt.Errorf("file writer close error: %w", gcsError("cmek.upload", bucketName, objectName, err))
 	}
+	setStoredObjectAttributes(ctx, w.Attrs())
 
 	return size, nil
 }
@@ -68,10 +115,17 @@ func (s *CMEKService) UploadWithKey(ctx context.Context, keyName string, bucketN
 // Download is Cloud Storageからobjectをダウンロードする
 // CMEKとしてBucket Default Keyを指定しているので、コード上はただダウンロードしてるだけ
 func (s *CMEKService) Download(ctx context.Context, bucketName string, objectName string) (data []byte, attrs *storage.ObjectAttrs, err error) {
+	return s.DownloadGeneration(ctx, bucketName, objectName, 0)
+}
+
+// DownloadGeneration is Downloadと同じく、指定したGenerationをダウンロードする
+// generationが0の場合は最新のGenerationをダウンロードする
+func (s *CMEKService) DownloadGeneration(ctx context.Context, bucketName string, objectName string, generation int64) (data []byte, attrs *storage.ObjectAttrs, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/cmek/download")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
 
-	rc, attrs, err := s.NewDownloader(ctx, bucketName, objectName)
+	rc, attrs, err := s.NewGenerationDownloader(ctx, bucketName, objectName, generation)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed object.NewReader: %w", err)
 	}
@@ -91,36 +145,131 @@ func (s *CMEKService) Download(ctx context.Context, bucketName string, objectNam
 // Download is Cloud Storageからobjectをダウンロードする
 // CMEKとしてBucket Default Keyを指定しているので、コード上はただダウンロードしてるだけ
 func (s *CMEKService) NewDownloader(ctx context.Context, bucketName string, objectName string) (w io.ReadCloser, attrs *storage.ObjectAttrs, err error) {
+	return s.NewGenerationDownloader(ctx, bucketName, objectName, 0)
+}
+
+// NewGenerationDownloader is 指定したGenerationを読み込むReaderを返す
+// generationが0の場合は最新のGenerationを読み込む
+func (s *CMEKService) NewGenerationDownloader(ctx context.Context, bucketName string, objectName string, generation int64) (w io.ReadCloser, attrs *storage.ObjectAttrs, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/cmek/newDownloader")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "download", bucketName, err)
+	}()
 
-	obj := s.gcs.Bucket(bucketName).Object(objectName)
-	attrs, err = obj.Attrs(ctx)
+	err = s.retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		attrs, err = s.store.Attrs(ctx, bucketName, objectName, &objstore.ObjectOptions{Generation: generation})
+		return err
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed read object.Attrs: %w", err)
+		return nil, nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("cmek.download", bucketName, objectName, err))
 	}
-	rc, err := obj.NewReader(ctx)
+	setStoredObjectAttributes(ctx, attrs)
+	var rc io.ReadCloser
+	err = s.retry.Open(ctx, "gcs.newReader", func(ctx context.Context) error {
+		var err error
+		rc, err = s.store.NewReader(ctx, bucketName, objectName, &objstore.ObjectOptions{Generation: attrs.Generation})
+		return err
+	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed object.NewReader: %w", err)
+		return nil, nil, fmt.Errorf("failed object.NewReader: %w", gcsError("cmek.download", bucketName, objectName, err))
 	}
 
-	return rc, attrs, nil
+	return metrics.NewCountingReader(ctx, rc, metrics.ModeCMEK, "download", bucketName), attrs, nil
 }
 
 // ReEncrypt is KeyをRotateした後に、新しいKeyでEncryptし直す時に利用する
 // Bucket Default Keyとして設定しているKeyをRotationした後、実行することを想定しているので、実際やっていることはobjectを同じPathにCopyしているだけ
+// 途中で別の書き込みがあった場合は上書きせずにErrPreconditionFailedを返す
 func (s *CMEKService) ReEncrypt(ctx context.Context, bucketName string, objectName string) (err error) {
 	ctx = trace.StartSpan(ctx, "encryption/cmek/reEncrypt")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "reEncrypt", bucketName, err)
+	}()
 
-	src := s.gcs.Bucket(bucketName).Object(objectName)
+	var src *storage.ObjectAttrs
+	err = s.retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		src, err = s.store.Attrs(ctx, bucketName, objectName, nil)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed read object.Attrs: %w", gcsError("cmek.reEncrypt", bucketName, objectName, err))
+	}
+	obj := objstore.ObjectRef{Bucket: bucketName, Name: objectName}
+	srcRef := objstore.ObjectRef{Bucket: bucketName, Name: objectName, Generation: src.Generation}
+	// Attrsを読んだ後に別の書き込みがあった場合に、古い内容で上書きしないように最新のGenerationがsrcである時だけCopyする
+	copyOpts := &objstore.CopyOptions{
+		Attrs:         copyAttrs(src, s.preserveStorageClass),
+		DstConditions: &objstore.Conditions{GenerationMatch: src.Generation},
+	}
 
 	// 同じObject PathにCopyする
 	// Object Pathが同一でも実際には別のObjectになるので、Copyが成功すれば新しいObjectが返されるようになり、Copy中およびCopyが失敗した場合は元のObjectが返される状態が維持される
-	copier := s.gcs.Bucket(bucketName).Object(objectName).CopierFrom(src)
-	_, err = copier.Run(ctx)
-	if err != nil {
+	// 途中で別の書き込みがあった場合や、成功したCopyのResponseを受け取れずに再試行した場合はErrPreconditionFailedを返す
+	var attrs *storage.ObjectAttrs
+	err = s.retry.Do(ctx, "gcs.copy", func(ctx context.Context) error {
+		var err error
+		attrs, err = s.store.Copy(ctx, obj, srcRef, copyOpts)
 		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed copier.Run: %w", gcsError("cmek.reEncrypt", bucketName, objectName, err))
 	}
+	setStoredObjectAttributes(ctx, attrs)
 	return nil
 }
+
+// ListGenerations is bucket/objectの全てのGenerationを、暗号化の情報と共に古い順に返す
+func (s *CMEKService) ListGenerations(ctx context.Context, bucketName string, objectName string) (generations []*GenerationInfo, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/listGenerations")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "listGenerations", bucketName, err)
+	}()
+
+	return listGenerations(ctx, s.store, s.retry, "cmek.listGenerations", bucketName, objectName)
+}
+
+// RestoreGeneration is 指定したGenerationを、新しい最新のGenerationとしてCopyする
+// ReEncryptと同じく、Copy先はBucket Default Keyの現在のPrimary Versionで暗号化される
+// 指定したGenerationが既に最新の場合は何もしない
+// 途中で別の書き込みがあった場合は上書きせずにErrPreconditionFailedを返す
+func (s *CMEKService) RestoreGeneration(ctx context.Context, bucketName string, objectName string, generation int64) (attrs *storage.ObjectAttrs, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/restoreGeneration")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "restoreGeneration", bucketName, err)
+	}()
+
+	if generation == 0 {
+		return nil, fmt.Errorf("generation is required")
+	}
+	live, conds, err := restoreConditions(ctx, s.store, s.retry, bucketName, objectName)
+	if err != nil {
+		return nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("cmek.restore", bucketName, objectName, err))
+	}
+	if live != nil && live.Generation == generation {
+		return live, nil
+	}
+
+	obj := objstore.ObjectRef{Bucket: bucketName, Name: objectName}
+	src := objstore.ObjectRef{Bucket: bucketName, Name: objectName, Generation: generation}
+	copyOpts := &objstore.CopyOptions{DstConditions: conds}
+	err = s.retry.Do(ctx, "gcs.copy", func(ctx context.Context) error {
+		var err error
+		attrs, err = s.store.Copy(ctx, obj, src, copyOpts)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed copier.Run: %w", gcsError("cmek.restore", bucketName, objectName, err))
+	}
+	setStoredObjectAttributes(ctx, attrs)
+	return attrs, nil
+}
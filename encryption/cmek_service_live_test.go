@@ -0,0 +1,48 @@
+//go:build live
+// +build live
+
+package encryption_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func TestLiveCMEKService_UploadWithKey(t *testing.T) {
+	ctx := context.Background()
+
+	keyName := os.Getenv("CLOUDKMS_KEY")
+	bucketName := os.Getenv("BUCKET_NAME")
+	object := uuid.New().String()
+	t.Logf("keyName=%s,bucket=%s,object=%s\n", keyName, bucketName, object)
+
+	uploadText := []byte("Hello World")
+
+	s, gcs := newLiveCMEKService(ctx, t)
+	cleanupObject(t, gcs, bucketName, object)
+	size, err := s.UploadWithKey(ctx, keyName, bucketName, object, uploadText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 1 {
+		t.Fatal("Upload size is Zero")
+	}
+}
+
+func newLiveCMEKService(ctx context.Context, t *testing.T) (*encryption.CMEKService, *storage.Client) {
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := encryption.NewCMEKService(ctx, objstore.NewGCS(gcs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, gcs
+}
@@ -2,42 +2,119 @@ package encryption_test
 
 import (
 	"context"
-	"os"
+	"errors"
 	"testing"
 
-	"cloud.google.com/go/storage"
-	"github.com/google/uuid"
 	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
 )
 
-func TestCMEKService_UploadWithKey(t *testing.T) {
+func newCMEKService(t *testing.T) *encryption.CMEKService {
+	t.Helper()
+	s, err := encryption.NewCMEKService(context.Background(), objstore.NewMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCMEKService_UploadDownload(t *testing.T) {
 	ctx := context.Background()
+	s := newCMEKService(t)
 
-	keyName := os.Getenv("CLOUDKMS_KEY")
-	bucketName := os.Getenv("BUCKET_NAME")
-	object := uuid.New().String()
-	t.Logf("keyName=%s,bucket=%s,object=%s\n", keyName, bucketName, object)
+	if _, err := s.Upload(ctx, "bucket", "object", []byte("Hello World")); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := s.Download(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "Hello World" {
+		t.Errorf("want Hello World but got %q", data)
+	}
+
+	if _, _, err := s.Download(ctx, "bucket", "missing"); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
+}
+
+func TestCMEKService_ReEncrypt(t *testing.T) {
+	ctx := context.Background()
+	s := newCMEKService(t)
 
-	uploadText := []byte("Hello World")
+	if _, err := s.UploadWithKey(ctx, testKeyName, "bucket", "object", []byte("Hello World")); err != nil {
+		t.Fatal(err)
+	}
+	_, before, err := s.Download(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.KMSKeyName != testKeyName {
+		t.Errorf("want KMSKeyName %s but got %s", testKeyName, before.KMSKeyName)
+	}
 
-	s := newCMEKService(ctx, t)
-	size, err := s.UploadWithKey(ctx, keyName, bucketName, object, uploadText)
-	if size < 1 {
-		t.Fatal("Upload size is Zero")
+	if err := s.ReEncrypt(ctx, "bucket", "object"); err != nil {
+		t.Fatal(err)
 	}
+	data, after, err := s.Download(ctx, "bucket", "object")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if string(data) != "Hello World" {
+		t.Errorf("want Hello World but got %q", data)
+	}
+	if after.Generation <= before.Generation {
+		t.Errorf("want a new generation but got %d after %d", after.Generation, before.Generation)
+	}
+	// Bucket Default KeyでReEncryptするので、指定したKeyは引き継がれない
+	if after.KMSKeyName != "" {
+		t.Errorf("want bucket default key but got %s", after.KMSKeyName)
+	}
+
+	if err := s.ReEncrypt(ctx, "bucket", "missing"); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
 }
 
-func newCMEKService(ctx context.Context, t *testing.T) *encryption.CMEKService {
-	gcs, err := storage.NewClient(ctx)
+// racingStore is Attrsの直後に別の書き込みを行うObjectStore
+type racingStore struct {
+	objstore.ObjectStore
+	write func(ctx context.Context)
+}
+
+func (s *racingStore) Attrs(ctx context.Context, bucket string, name string, opts *objstore.ObjectOptions) (*objstore.ObjectAttrs, error) {
+	attrs, err := s.ObjectStore.Attrs(ctx, bucket, name, opts)
+	if s.write != nil {
+		s.write(ctx)
+		s.write = nil
+	}
+	return attrs, err
+}
+
+func TestCMEKService_ReEncryptConcurrentWrite(t *testing.T) {
+	ctx := context.Background()
+	store := &racingStore{ObjectStore: objstore.NewMemory()}
+	s, err := encryption.NewCMEKService(ctx, store)
 	if err != nil {
 		t.Fatal(err)
 	}
-	s, err := encryption.NewCMEKService(ctx, gcs)
+	if _, err := s.UploadWithKey(ctx, testKeyName, "bucket", "object", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	store.write = func(ctx context.Context) {
+		if _, err := s.UploadWithKey(ctx, testKeyName, "bucket", "object", []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.ReEncrypt(ctx, "bucket", "object"); !errors.Is(err, encryption.ErrPreconditionFailed) {
+		t.Fatalf("want ErrPreconditionFailed but got %v", err)
+	}
+	data, _, err := s.Download(ctx, "bucket", "object")
 	if err != nil {
 		t.Fatal(err)
 	}
-	return s
+	if string(data) != "new" {
+		t.Errorf("want new but got %q", data)
+	}
 }
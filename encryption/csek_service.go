@@ -1,27 +1,42 @@
 package encryption
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
 	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
 	"google.golang.org/api/cloudkms/v1"
 )
 
 // CSEKService is customer-supplied encryption keys Service
 type CSEKService struct {
-	gcs *storage.Client
-	kms *cloudkms.Service
+	store    objstore.ObjectStore
+	kms      *cloudkms.Service
+	retry    RetryPolicy
+	auditLog *audit.Logger
+
+	preserveStorageClass bool
 }
 
-func NewCSEKService(ctx context.Context, gcs *storage.Client, kms *cloudkms.Service) (*CSEKService, error) {
+func NewCSEKService(ctx context.Context, store objstore.ObjectStore, kms *cloudkms.Service, opts ...Option) (*CSEKService, error) {
+	o := newOptions(opts)
 	return &CSEKService{
-		gcs: gcs,
-		kms: kms,
+		store:    store,
+		kms:      kms,
+		retry:    o.retry,
+		auditLog: o.audit,
+
+		preserveStorageClass: o.preserveStorageClass,
 	}, nil
 }
 
@@ -29,27 +44,64 @@ func NewCSEKService(ctx context.Context, gcs *storage.Client, kms *cloudkms.Serv
 // keyName format: "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s
 func (s *CSEKService) Encrypt(ctx context.Context, keyName string, plaintext string) (ciphertext string, cryptoKey string, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/csek/encrypt")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	trace.SetAttributesKV(ctx, map[string]interface{}{
+		attrMode:   metrics.ModeCSEK,
+		attrKMSKey: keyName,
+	})
 
-	response, err := s.kms.Projects.Locations.KeyRings.CryptoKeys.Encrypt(keyName, &cloudkms.EncryptRequest{
-		Plaintext: plaintext,
-	}).Do()
+	var response *cloudkms.EncryptResponse
+	start := time.Now()
+	err = s.retry.Do(ctx, "kms.encrypt", func(ctx context.Context) error {
+		var err error
+		response, err = s.kms.Projects.Locations.KeyRings.CryptoKeys.Encrypt(keyName, &cloudkms.EncryptRequest{
+			Plaintext: plaintext,
+		}).Context(ctx).Do()
+		return err
+	})
+	metrics.RecordKMSLatency(ctx, "kms.encrypt", start, err)
+	trace.SetAttributesKV(ctx, map[string]interface{}{attrKMSLatency: time.Since(start)})
+	var keyVersion string
+	if response != nil {
+		keyVersion = response.Name
+	}
+	auditErr := s.audit(ctx, audit.OperationWrap, keyName, keyVersion, err)
 	if err != nil {
-		return "", "", fmt.Errorf("encrypt: failed to encrypt. CryptoKey=%s : %w", keyName, err)
+		return "", "", fmt.Errorf("encrypt: failed to encrypt. CryptoKey=%s : %w", keyName, kmsError("csek.encrypt", keyName, err))
+	}
+	if auditErr != nil {
+		return "", "", auditErr
 	}
 
+	trace.SetAttributesKV(ctx, map[string]interface{}{attrKMSKeyVersion: response.Name})
 	return response.Ciphertext, response.Name, nil
 }
 
 func (s *CSEKService) Decrypt(ctx context.Context, keyName string, ciphertext string) (plaintext string, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/csek/decrypt")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	trace.SetAttributesKV(ctx, map[string]interface{}{
+		attrMode:   metrics.ModeCSEK,
+		attrKMSKey: keyName,
+	})
 
-	response, err := s.kms.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyName, &cloudkms.DecryptRequest{
-		Ciphertext: ciphertext,
-	}).Do()
+	var response *cloudkms.DecryptResponse
+	start := time.Now()
+	err = s.retry.Do(ctx, "kms.decrypt", func(ctx context.Context) error {
+		var err error
+		response, err = s.kms.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyName, &cloudkms.DecryptRequest{
+			Ciphertext: ciphertext,
+		}).Context(ctx).Do()
+		return err
+	})
+	metrics.RecordKMSLatency(ctx, "kms.decrypt", start, err)
+	trace.SetAttributesKV(ctx, map[string]interface{}{attrKMSLatency: time.Since(start)})
+	auditErr := s.audit(ctx, audit.OperationUnwrap, keyName, "", err)
 	if err != nil {
-		return "", fmt.Errorf("decrypt: failed to decrypt. CryptoKey=%s : %w", keyName, err)
+		return "", fmt.Errorf("decrypt: failed to decrypt. CryptoKey=%s : %w", keyName, kmsError("csek.decrypt", keyName, err))
+	}
+	if auditErr != nil {
+		return "", auditErr
 	}
 
 	return response.Plaintext, nil
@@ -63,29 +115,56 @@ func (s *CSEKService) Decrypt(ctx context.Context, keyName string, ciphertext st
 // encryptionKey: 256 bit (32 byte) AES encryption key
 func (s *CSEKService) Upload(ctx context.Context, keyName string, bucketName string, objectName string, encryptionKey []byte, file []byte) (size int, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/csek/upload")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
 
-	obj := s.gcs.Bucket(bucketName).Object(objectName).Key(encryptionKey)
-	w := obj.NewWriter(ctx)
+	opts := &UploadOptions{ContentType: http.DetectContentType(file)}
+	n, err := s.UploadFrom(ctx, keyName, bucketName, objectName, encryptionKey, bytes.NewReader(file), opts)
+	if err != nil {
+		return int(n), err
+	}
+	return int(n), nil
+}
+
+// UploadFrom is rから読み込んだ内容をそのままCloud Storageにアップロードする
+// 一度Cloud Storageに平文を置くことなく、受け取ったStreamをcustomer-supplied encryption keyで暗号化して書き込む
+// rの読み込みに失敗した場合はアップロードを中断し、Objectは作成されない
+//
+// keyName format: "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s
+// encryptionKey: 256 bit (32 byte) AES encryption key
+func (s *CSEKService) UploadFrom(ctx context.Context, keyName string, bucketName string, objectName string, encryptionKey []byte, r io.Reader, opts *UploadOptions) (size int64, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/uploadFrom")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "upload", bucketName, err)
+		metrics.RecordUploadedBytes(ctx, metrics.ModeCSEK, "upload", bucketName, size, err)
+	}()
 
 	ekt := base64.StdEncoding.EncodeToString(encryptionKey)
-	chiphertext, cryptKey, err := s.Encrypt(ctx, keyName, ekt)
+	chiphertext, cryptKey, err := s.Encrypt(withAuditTarget(ctx, auditTarget{bucket: bucketName, object: objectName}), keyName, ekt)
 	if err != nil {
 		return 0, fmt.Errorf("failed encrypt: %w", err)
 	}
 
-	metadata := map[string]string{}
-	metadata["wDEK"] = chiphertext
-	metadata["cryptKey"] = cryptKey // keyVersionを保持するために入れる
-	w.Metadata = metadata
-	size, err = w.Write(file)
+	// 途中で失敗した時にCloseせずにcancelすることで、中途半端なObjectが作成されないようにする
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wopts := &objstore.WriteOptions{EncryptionKey: encryptionKey}
+	opts.apply(&wopts.Attrs)
+	wopts.Conditions = opts.conditions()
+	wopts.Attrs.Metadata = withEnvelope(wopts.Attrs.Metadata, chiphertext, cryptKey, objstore.KeySHA256(encryptionKey))
+	w := s.store.NewWriter(wctx, bucketName, objectName, wopts)
+	size, err = io.Copy(w, r)
 	if err != nil {
 		return 0, fmt.Errorf("failed gcs.write: %w", err)
 	}
 
 	if err := w.Close(); err != nil {
-		return size, fmt.Errorf("file writer close error: %w", err)
+		return size, fmt.Errorf("file writer close error: %w", gcsError("csek.upload", bucketName, objectName, err))
 	}
+	setStoredObjectAttributes(ctx, w.Attrs())
 
 	return size, nil
 }
@@ -95,10 +174,17 @@ func (s *CSEKService) Upload(ctx context.Context, keyName string, bucketName str
 //
 // keyName format: "projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s
 func (s *CSEKService) Download(ctx context.Context, keyName string, bucketName string, objectName string) (data []byte, attrs *storage.ObjectAttrs, err error) {
+	return s.DownloadGeneration(ctx, keyName, bucketName, objectName, 0)
+}
+
+// DownloadGeneration is Downloadと同じく、指定したGenerationをダウンロードする
+// generationが0の場合は最新のGenerationをダウンロードする
+func (s *CSEKService) DownloadGeneration(ctx context.Context, keyName string, bucketName string, objectName string, generation int64) (data []byte, attrs *storage.ObjectAttrs, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/csek/download")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
 
-	rc, attrs, err := s.NewDownloader(ctx, keyName, bucketName, objectName)
+	rc, attrs, err := s.NewGenerationDownloader(ctx, keyName, bucketName, objectName, generation)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed object.NewReader: %w", err)
 	}
@@ -116,69 +202,278 @@ func (s *CSEKService) Download(ctx context.Context, keyName string, bucketName s
 }
 
 func (s *CSEKService) NewDownloader(ctx context.Context, keyName string, bucketName string, objectName string) (w io.ReadCloser, attrs *storage.ObjectAttrs, err error) {
+	return s.NewGenerationDownloader(ctx, keyName, bucketName, objectName, 0)
+}
+
+// NewGenerationDownloader is 指定したGenerationを読み込むReaderを返す
+// noncurrentなGenerationも、そのGenerationのMetadata[wDEK]から取得したCSEKで読み込む
+// generationが0の場合は最新のGenerationを読み込む
+func (s *CSEKService) NewGenerationDownloader(ctx context.Context, keyName string, bucketName string, objectName string, generation int64) (w io.ReadCloser, attrs *storage.ObjectAttrs, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/csek/newDownloader")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "download", bucketName, err)
+	}()
 
-	obj := s.gcs.Bucket(bucketName).Object(objectName)
-	attrs, err = obj.Attrs(ctx)
+	attrs, err = s.attrs(ctx, bucketName, objectName, generation)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed read object.Attrs: %w", err)
+		return nil, nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("csek.download", bucketName, objectName, err))
 	}
-	encryptedSecretKey := attrs.Metadata["wDEK"]
-	if len(encryptedSecretKey) < 1 {
-		return nil, nil, fmt.Errorf("not found encryptedSecretKey from object.Metadata[wDEK]")
+	setStoredObjectAttributes(ctx, attrs)
+	ctx = withAuditTarget(ctx, auditTarget{bucket: bucketName, object: objectName, generation: attrs.Generation, keyVersion: keyVersionOf(attrs)})
+	secretKey, err := s.unwrapKey(ctx, "csek.download", keyName, attrs)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	plainttext, err := s.Decrypt(ctx, keyName, encryptedSecretKey)
+	var rc io.ReadCloser
+	err = s.retry.Open(ctx, "gcs.newReader", func(ctx context.Context) error {
+		var err error
+		rc, err = s.store.NewReader(ctx, bucketName, objectName, &objstore.ObjectOptions{Generation: attrs.Generation, EncryptionKey: secretKey})
+		return err
+	})
+	auditErr := s.audit(ctx, audit.OperationDecrypt, keyName, "", err)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed decrpyt encryptedSecretKey: %w", err)
+		return nil, nil, fmt.Errorf("failed object.NewReader: %w", gcsError("csek.download", bucketName, objectName, err))
 	}
-	secretKey, err := base64.StdEncoding.DecodeString(plainttext)
+	if auditErr != nil {
+		rc.Close()
+		return nil, nil, auditErr
+	}
+
+	return metrics.NewCountingReader(ctx, rc, metrics.ModeCSEK, "download", bucketName), attrs, nil
+}
+
+// Copy is src側,dst側それぞれにCSEKを渡して、向こうでCopyしてもらう
+func (s *CSEKService) Copy(ctx context.Context, dstBucket string, srcBucket string, objectName string, keyName string) (err error) {
+	return s.CopyGeneration(ctx, dstBucket, srcBucket, objectName, 0, keyName)
+}
+
+// CopyGeneration is Copyと同じく、srcの指定したGenerationをdstBucketにCopyする
+// generationが0の場合は最新のGenerationをCopyする
+func (s *CSEKService) CopyGeneration(ctx context.Context, dstBucket string, srcBucket string, objectName string, generation int64, keyName string) (err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/copy")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, dstBucket, objectName)
+	trace.SetAttributesKV(ctx, map[string]interface{}{"gcs.srcBucket": srcBucket})
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "copy", dstBucket, err)
+	}()
+
+	attrs, err := s.attrs(ctx, srcBucket, objectName, generation)
+	if err != nil {
+		return fmt.Errorf("failed read object.Attrs: %w", gcsError("csek.copy", srcBucket, objectName, err))
+	}
+	setStoredObjectAttributes(ctx, attrs)
+	copied, _, err := s.copyObject(ctx, "csek.copy", keyName, attrs, objstore.ObjectRef{Bucket: dstBucket, Name: objectName}, nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed base64.Decode encryptedSecretKey: %w", err)
+		return err
 	}
+	trace.SetAttributesKV(ctx, map[string]interface{}{"gcs.dstGeneration": copied.Generation})
+	return nil
+}
 
-	rc, err := obj.Key(secretKey).NewReader(ctx)
+// copyObject is srcのGenerationを、同じCSEKのままdstにCopyする
+// 同じCSEKでCopyするので、Metadata[wDEK]もそのまま引き継ぐ
+// Copy先の確認に使えるように、Copyに使ったCSEKも返す
+func (s *CSEKService) copyObject(ctx context.Context, op string, keyName string, src *storage.ObjectAttrs, dst objstore.ObjectRef, conds *objstore.Conditions) (*storage.ObjectAttrs, []byte, error) {
+	ctx = withAuditTarget(ctx, auditTarget{bucket: src.Bucket, object: src.Name, generation: src.Generation, keyVersion: keyVersionOf(src)})
+	secretKey, err := s.unwrapKey(ctx, op, keyName, src)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed object.NewReader: %w", err)
+		return nil, nil, err
+	}
+
+	dstAttrs := copyAttrs(src, s.preserveStorageClass)
+	cryptKey := src.Metadata["cryptKey"]
+	if cryptKey == "" {
+		cryptKey = keyName
+	}
+	dstAttrs.Metadata = withEnvelope(dstAttrs.Metadata, src.Metadata["wDEK"], cryptKey, objstore.KeySHA256(secretKey))
+	copyOpts := &objstore.CopyOptions{
+		SrcEncryptionKey: secretKey,
+		DstEncryptionKey: secretKey,
+		DstConditions:    conds,
+		Attrs:            dstAttrs,
+	}
+	srcRef := objstore.ObjectRef{Bucket: src.Bucket, Name: src.Name, Generation: src.Generation}
+	// 同じ内容を同じ鍵でCopyするだけなので、何度実行しても結果は変わらない
+	var copied *storage.ObjectAttrs
+	err = s.retry.Do(ctx, "gcs.copy", func(ctx context.Context) error {
+		var err error
+		copied, err = s.store.Copy(ctx, dst, srcRef, copyOpts)
+		return err
+	})
+	// Copy元のObjectはCloud Storage側でCSEKを使って復号される
+	auditErr := s.audit(ctx, audit.OperationDecrypt, keyName, "", err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed copier.Run: %w", gcsError(op, dst.Bucket, dst.Name, err))
+	}
+	if auditErr != nil {
+		return nil, nil, auditErr
+	}
+	return copied, secretKey, nil
+}
+
+// Rewrap is 指定したGenerationのMetadata[wDEK]を、keyNameの現在のPrimary Versionで暗号化し直す
+// Cloud KMS KeyをRotateした後に、古いKey Versionを無効にする前に実行することを想定している
+// Objectの内容とCSEKは変わらないので、Generationも変わらない (Metagenerationが増える)
+// generationが0の場合は最新のGenerationを対象にする
+func (s *CSEKService) Rewrap(ctx context.Context, keyName string, bucketName string, objectName string, generation int64) (attrs *storage.ObjectAttrs, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/rewrap")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "rewrap", bucketName, err)
+	}()
+
+	src, err := s.attrs(ctx, bucketName, objectName, generation)
+	if err != nil {
+		return nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("csek.rewrap", bucketName, objectName, err))
+	}
+	setStoredObjectAttributes(ctx, src)
+	ctx = withAuditTarget(ctx, auditTarget{bucket: bucketName, object: objectName, generation: src.Generation, keyVersion: keyVersionOf(src)})
+	secretKey, err := s.unwrapKey(ctx, "csek.rewrap", keyName, src)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, cryptKey, err := s.Encrypt(ctx, keyName, base64.StdEncoding.EncodeToString(secretKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed encrypt: %w", err)
 	}
 
-	return rc, attrs, nil
+	// 読んでから書くまでの間にwDEKが変更されていた場合は上書きしない
+	opts := &objstore.ObjectOptions{
+		Generation: src.Generation,
+		Conditions: &objstore.Conditions{MetagenerationMatch: src.Metageneration},
+	}
+	update := objstore.ObjectAttrsToUpdate{
+		Metadata: map[string]string{
+			"wDEK":      ciphertext,
+			"cryptKey":  cryptKey,
+			"dekSha256": objstore.KeySHA256(secretKey),
+		},
+	}
+	err = s.retry.Do(ctx, "gcs.update", func(ctx context.Context) error {
+		var err error
+		attrs, err = s.store.Update(ctx, bucketName, objectName, opts, update)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed object.Update: %w", gcsError("csek.rewrap", bucketName, objectName, err))
+	}
+	setStoredObjectAttributes(ctx, attrs)
+	return attrs, nil
 }
 
-// Copy is src側,dst側それぞれにCSEKを渡して、向こうでCopyしてもらう
-func (s *CSEKService) Copy(ctx context.Context, dstBucket string, srcBucket string, objectName string, keyName string) (err error) {
-	ctx = trace.StartSpan(ctx, "encryption/csek/copy")
-	defer trace.EndSpan(ctx, err)
+// ListGenerations is bucket/objectの全てのGenerationを、暗号化の情報と共に古い順に返す
+func (s *CSEKService) ListGenerations(ctx context.Context, bucketName string, objectName string) (generations []*GenerationInfo, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/listGenerations")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "listGenerations", bucketName, err)
+	}()
+
+	return listGenerations(ctx, s.store, s.retry, "csek.listGenerations", bucketName, objectName)
+}
 
-	obj := s.gcs.Bucket(srcBucket).Object(objectName)
-	attrs, err := obj.Attrs(ctx)
+// RestoreGeneration is 指定したGenerationを、同じCSEKのまま新しい最新のGenerationとしてCopyする
+// 指定したGenerationが既に最新の場合は何もしない
+// 途中で別の書き込みがあった場合は上書きせずにErrPreconditionFailedを返す
+func (s *CSEKService) RestoreGeneration(ctx context.Context, keyName string, bucketName string, objectName string, generation int64) (attrs *storage.ObjectAttrs, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/restoreGeneration")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "restoreGeneration", bucketName, err)
+	}()
+
+	if generation == 0 {
+		return nil, fmt.Errorf("generation is required")
+	}
+	live, conds, err := restoreConditions(ctx, s.store, s.retry, bucketName, objectName)
+	if err != nil {
+		return nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("csek.restore", bucketName, objectName, err))
+	}
+	if live != nil && live.Generation == generation {
+		return live, nil
+	}
+	src, err := s.attrs(ctx, bucketName, objectName, generation)
 	if err != nil {
-		return fmt.Errorf("failed read object.Attrs: %w", err)
+		return nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("csek.restore", bucketName, objectName, err))
 	}
+	setStoredObjectAttributes(ctx, src)
+	ctx = withAuditTarget(ctx, auditTarget{bucket: bucketName, object: objectName, generation: src.Generation, keyVersion: keyVersionOf(src)})
+	secretKey, err := s.unwrapKey(ctx, "csek.restore", keyName, src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Metadata[wDEK], Metadata[cryptKey]を含めてCopy元の属性を引き継ぐ
+	copyOpts := &objstore.CopyOptions{
+		SrcEncryptionKey: secretKey,
+		DstEncryptionKey: secretKey,
+		DstConditions:    conds,
+		Attrs:            copyAttrs(src, s.preserveStorageClass),
+	}
+	obj := objstore.ObjectRef{Bucket: bucketName, Name: objectName}
+	srcRef := objstore.ObjectRef{Bucket: bucketName, Name: objectName, Generation: src.Generation}
+	err = s.retry.Do(ctx, "gcs.copy", func(ctx context.Context) error {
+		var err error
+		attrs, err = s.store.Copy(ctx, obj, srcRef, copyOpts)
+		return err
+	})
+	auditErr := s.audit(ctx, audit.OperationDecrypt, keyName, "", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed copier.Run: %w", gcsError("csek.restore", bucketName, objectName, err))
+	}
+	if auditErr != nil {
+		return nil, auditErr
+	}
+	trace.SetAttributesKV(ctx, map[string]interface{}{"gcs.dstGeneration": attrs.Generation})
+	return attrs, nil
+}
+
+// unwrapKey is Object.Metadata[wDEK]をkeyNameで復号して、CSEKとして使うDEKを返す
+func (s *CSEKService) unwrapKey(ctx context.Context, op string, keyName string, attrs *storage.ObjectAttrs) ([]byte, error) {
 	encryptedSecretKey := attrs.Metadata["wDEK"]
 	if len(encryptedSecretKey) < 1 {
-		return fmt.Errorf("not found encryptedSecretKey from object.Metadata[wDEK]")
+		return nil, &Error{Op: op, Bucket: attrs.Bucket, Object: attrs.Name, Kind: ErrMissingWrappedKey}
+	}
+	if err := checkKEK(keyName, attrs); err != nil {
+		return nil, &Error{Op: op, Bucket: attrs.Bucket, Object: attrs.Name, KeyName: keyName, Kind: ErrKEKMismatch, Err: err}
+	}
+	// Cloud KMSを呼び出す前に、wDEKがこのObjectの鍵を暗号化したものであることを確認する
+	if err := checkRecordedDEK(attrs); err != nil {
+		return nil, &Error{Op: op, Bucket: attrs.Bucket, Object: attrs.Name, Kind: ErrDEKMismatch, Err: err}
 	}
 
 	plainttext, err := s.Decrypt(ctx, keyName, encryptedSecretKey)
 	if err != nil {
-		return fmt.Errorf("failed decrpyt encryptedSecretKey: %w", err)
+		return nil, fmt.Errorf("failed decrpyt encryptedSecretKey: %w", err)
 	}
 	secretKey, err := base64.StdEncoding.DecodeString(plainttext)
 	if err != nil {
-		return fmt.Errorf("failed base64.Decode encryptedSecretKey: %w", err)
+		return nil, &Error{Op: op, Bucket: attrs.Bucket, Object: attrs.Name, Kind: ErrIntegrity, Err: fmt.Errorf("failed base64.Decode encryptedSecretKey: %w", err)}
 	}
+	if len(secretKey) != 32 {
+		return nil, &Error{Op: op, Bucket: attrs.Bucket, Object: attrs.Name, Kind: ErrIntegrity, Err: fmt.Errorf("invalid encryption key length %d", len(secretKey))}
+	}
+	// Cloud Storageで読み込む前に確認して、鍵が異なる時の400の代わりに原因の分かるErrorを返す
+	if err := checkUnwrappedDEK(attrs, secretKey); err != nil {
+		return nil, &Error{Op: op, Bucket: attrs.Bucket, Object: attrs.Name, Kind: ErrDEKMismatch, Err: err}
+	}
+	return secretKey, nil
+}
 
-	src := obj.Key(secretKey)
-	copier := s.gcs.Bucket(dstBucket).Object(objectName).Key(secretKey).CopierFrom(src)
-	metadata := map[string]string{}
-	metadata["wDEK"] = encryptedSecretKey
-	metadata["cryptKey"] = keyName // keyVersionを保持するために入れる
-	copier.Metadata = metadata
-	_, err = copier.Run(ctx)
-	if err != nil {
+// attrs is retry付きでobject.Attrsを取得する
+// generationが0の場合は最新のGenerationを取得する
+func (s *CSEKService) attrs(ctx context.Context, bucketName string, objectName string, generation int64) (attrs *storage.ObjectAttrs, err error) {
+	err = s.retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		attrs, err = s.store.Attrs(ctx, bucketName, objectName, &objstore.ObjectOptions{Generation: generation})
 		return err
-	}
-	return nil
+	})
+	return attrs, err
 }
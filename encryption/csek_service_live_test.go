@@ -0,0 +1,110 @@
+//go:build live
+// +build live
+
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/cloudkms/v1"
+)
+
+func TestLiveCSEKService_Download(t *testing.T) {
+	ctx := context.Background()
+
+	s, gcs := newLiveCSEKService(ctx, t)
+
+	keyName := os.Getenv("CLOUDKMS_KEY")
+	bucketName := os.Getenv("BUCKET_NAME")
+	object := uuid.New().String()
+	encryptionKey, err := encryption.GenerateEncryptionKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("keyName=%s,bucket=%s,object=%s\n", keyName, bucketName, object)
+	cleanupObject(t, gcs, bucketName, object)
+
+	uploadText := []byte("Hello World")
+	size, err := s.Upload(ctx, keyName, bucketName, object, encryptionKey, uploadText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 1 {
+		t.Fatal("Upload size is Zero")
+	}
+
+	got, _, err := s.Download(ctx, keyName, bucketName, object)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, g := uploadText, got; bytes.Compare(e, g) != 0 {
+		t.Errorf("want %s but got %s", string(e), string(g))
+	}
+}
+
+func TestLiveCSEKService_Copy(t *testing.T) {
+	ctx := context.Background()
+
+	s, gcs := newLiveCSEKService(ctx, t)
+
+	keyName := os.Getenv("CLOUDKMS_KEY")
+	bucketName := os.Getenv("BUCKET_NAME")
+	object := uuid.New().String()
+	encryptionKey, err := encryption.GenerateEncryptionKey(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("keyName=%s,bucket=%s,object=%s\n", keyName, bucketName, object)
+	dstBucketName := fmt.Sprintf("%s-encrypt", bucketName)
+	cleanupObject(t, gcs, bucketName, object)
+	cleanupObject(t, gcs, dstBucketName, object)
+
+	uploadText := []byte("Hello World")
+	size, err := s.Upload(ctx, keyName, bucketName, object, encryptionKey, uploadText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size < 1 {
+		t.Fatal("Upload size is Zero")
+	}
+
+	if err := s.Copy(ctx, dstBucketName, bucketName, object, keyName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newLiveCSEKService(ctx context.Context, t *testing.T) (*encryption.CSEKService, *storage.Client) {
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kms, err := cloudkms.NewService(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := encryption.NewCSEKService(ctx, objstore.NewGCS(gcs), kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, gcs
+}
+
+// cleanupObject is test終了時にbucket/objectを削除する
+// 作成に失敗している場合もあるので、ErrObjectNotExistは無視する
+func cleanupObject(t *testing.T, gcs *storage.Client, bucket string, object string) {
+	t.Cleanup(func() {
+		err := gcs.Bucket(bucket).Object(object).Delete(context.Background())
+		if err != nil && err != storage.ErrObjectNotExist {
+			t.Errorf("failed cleanup gs://%s/%s: %s", bucket, object, err)
+		}
+	})
+}
@@ -1,92 +1,148 @@
 package encryption_test
 
 import (
-	"bytes"
 	"context"
-	"fmt"
-	"os"
+	"errors"
 	"testing"
 
-	"cloud.google.com/go/storage"
-	"github.com/google/uuid"
 	"github.com/sinmetal/gcs_sample/encryption"
-	"google.golang.org/api/cloudkms/v1"
+	"github.com/sinmetal/gcs_sample/objstore"
 )
 
-func TestCSEKService_Download(t *testing.T) {
-	ctx := context.Background()
-
-	s := newCSEKService(ctx, t)
-
-	keyName := os.Getenv("CLOUDKMS_KEY")
-	bucketName := os.Getenv("BUCKET_NAME")
-	object := uuid.New().String()
-	encryptionKey, err := encryption.GenerateEncryptionKey(ctx)
+func newCSEKService(t *testing.T) (*encryption.CSEKService, objstore.ObjectStore) {
+	t.Helper()
+	kms, _ := newLocalKMS(t)
+	store := objstore.NewMemory()
+	s, err := encryption.NewCSEKService(context.Background(), store, kms)
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("keyName=%s,bucket=%s,object=%s\n", keyName, bucketName, object)
+	return s, store
+}
 
-	uploadText := []byte("Hello World")
-	size, err := s.Upload(ctx, keyName, bucketName, object, encryptionKey, uploadText)
+func upload(t *testing.T, s *encryption.CSEKService, bucket string, object string, data string) {
+	t.Helper()
+	ctx := context.Background()
+	encryptionKey, err := encryption.GenerateEncryptionKey(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if size < 1 {
-		t.Fatal("Upload size is Zero")
+	if _, err := s.Upload(ctx, testKeyName, bucket, object, encryptionKey, []byte(data)); err != nil {
+		t.Fatal(err)
 	}
+}
+
+func TestCSEKService_UploadDownload(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	upload(t, s, "bucket", "object", "Hello World")
 
-	got, _, err := s.Download(ctx, keyName, bucketName, object)
+	got, attrs, err := s.Download(ctx, testKeyName, "bucket", "object")
 	if err != nil {
 		t.Fatal(err)
 	}
+	if string(got) != "Hello World" {
+		t.Errorf("want Hello World but got %q", got)
+	}
+	if attrs.CustomerKeySHA256 == "" || attrs.Metadata["wDEK"] == "" {
+		t.Errorf("want object encrypted with a wrapped CSEK but got %+v", attrs)
+	}
 
-	if e, g := uploadText, got; bytes.Compare(e, g) != 0 {
-		t.Errorf("want %s but got %s", string(e), string(g))
+	// 鍵無しでは読めない
+	if _, err := store.NewReader(ctx, "bucket", "object", nil); err == nil {
+		t.Error("want error reading without the key but got nil")
 	}
 }
 
 func TestCSEKService_Copy(t *testing.T) {
 	ctx := context.Background()
+	s, _ := newCSEKService(t)
+	upload(t, s, "bucket", "object", "Hello World")
 
-	s := newCSEKService(ctx, t)
-
-	keyName := os.Getenv("CLOUDKMS_KEY")
-	bucketName := os.Getenv("BUCKET_NAME")
-	object := uuid.New().String()
-	encryptionKey, err := encryption.GenerateEncryptionKey(ctx)
-	if err != nil {
+	if err := s.Copy(ctx, "bucket-copy", "bucket", "object", testKeyName); err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("keyName=%s,bucket=%s,object=%s\n", keyName, bucketName, object)
-
-	uploadText := []byte("Hello World")
-	size, err := s.Upload(ctx, keyName, bucketName, object, encryptionKey, uploadText)
+	got, _, err := s.Download(ctx, testKeyName, "bucket-copy", "object")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if size < 1 {
-		t.Fatal("Upload size is Zero")
+	if string(got) != "Hello World" {
+		t.Errorf("want Hello World but got %q", got)
 	}
 
-	dstBucketName := fmt.Sprintf("%s-encrypt", bucketName)
-	if err := s.Copy(ctx, dstBucketName, bucketName, object, keyName); err != nil {
+	if err := s.Copy(ctx, "bucket-copy", "bucket", "missing", testKeyName); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
+}
+
+func TestCSEKService_MissingWrappedKey(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+
+	w := store.NewWriter(ctx, "bucket", "object", &objstore.WriteOptions{EncryptionKey: make([]byte, 32)})
+	if _, err := w.Write([]byte("Hello World")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
 		t.Fatal(err)
 	}
+
+	if _, _, err := s.Download(ctx, testKeyName, "bucket", "object"); !errors.Is(err, encryption.ErrMissingWrappedKey) {
+		t.Errorf("want ErrMissingWrappedKey but got %v", err)
+	}
+}
+
+func TestCSEKService_WrongKey(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newCSEKService(t)
+	upload(t, s, "bucket", "object", "Hello World")
+
+	_, _, err := s.Download(ctx, testOtherKeyName, "bucket", "object")
+	if !errors.Is(err, encryption.ErrKEKMismatch) {
+		t.Errorf("want ErrKEKMismatch but got %v", err)
+	}
+	var mismatch *encryption.KEKMismatchError
+	if !errors.As(err, &mismatch) || mismatch.KeyName != testOtherKeyName {
+		t.Errorf("want KEKMismatchError for %s but got %v", testOtherKeyName, err)
+	}
+
+	if _, _, err := s.Download(ctx, testKeyName, "bucket", "missing"); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
 }
 
-func newCSEKService(ctx context.Context, t *testing.T) *encryption.CSEKService {
-	gcs, err := storage.NewClient(ctx)
+func TestCSEKService_Rotation(t *testing.T) {
+	ctx := context.Background()
+	kms, ks := newLocalKMS(t)
+	s, err := encryption.NewCSEKService(ctx, objstore.NewMemory(), kms)
 	if err != nil {
 		t.Fatal(err)
 	}
-	kms, err := cloudkms.NewService(ctx)
+	upload(t, s, "bucket", "old", "old version")
+
+	v2, err := ks.CreateVersion(testKeyName)
 	if err != nil {
 		t.Fatal(err)
 	}
-	s, err := encryption.NewCSEKService(ctx, gcs, kms)
+	if _, err := ks.UpdatePrimaryVersion(testKeyName, "2"); err != nil {
+		t.Fatal(err)
+	}
+	upload(t, s, "bucket", "new", "new version")
+
+	for object, want := range map[string]string{"old": "old version", "new": "new version"} {
+		got, _, err := s.Download(ctx, testKeyName, "bucket", object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("want %q but got %q", want, got)
+		}
+	}
+	_, attrs, err := s.Download(ctx, testKeyName, "bucket", "new")
 	if err != nil {
 		t.Fatal(err)
 	}
-	return s
+	if attrs.Metadata["cryptKey"] != v2.Name {
+		t.Errorf("want cryptKey %s but got %s", v2.Name, attrs.Metadata["cryptKey"])
+	}
 }
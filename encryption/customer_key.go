@@ -0,0 +1,170 @@
+package encryption
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+var (
+	// ErrInvalidCustomerKey is 呼び出し元が指定したCSEKが256 bitのAES Keyでない、またはSHA-256が一致しない
+	ErrInvalidCustomerKey = errors.New("invalid customer-supplied encryption key")
+
+	// ErrCustomerKeyMismatch is 呼び出し元が指定したCSEKと、Objectを暗号化したCSEKが一致しない
+	ErrCustomerKeyMismatch = errors.New("customer-supplied encryption key does not match object")
+)
+
+// CustomerKeyMode is 呼び出し元が指定したCSEKの扱い
+type CustomerKeyMode string
+
+const (
+	// CustomerKeyWrap is 生成したCSEKと同じく、Cloud KMS Keyで暗号化してMetadata[wDEK]に保存する
+	// 読み込む時に鍵を指定する必要はない
+	CustomerKeyWrap CustomerKeyMode = "wrap"
+
+	// CustomerKeyPassThrough is CSEKとしてCloud Storageに渡すだけで、どこにも保存しない
+	// 読み込む時は呼び出し元が同じ鍵を指定する
+	CustomerKeyPassThrough CustomerKeyMode = "passthrough"
+)
+
+// ParseCustomerKeyMode is CustomerKeyModeの文字列を読み込む. 空の場合はCustomerKeyWrapになる
+func ParseCustomerKeyMode(s string) (CustomerKeyMode, error) {
+	switch CustomerKeyMode(s) {
+	case "", CustomerKeyWrap:
+		return CustomerKeyWrap, nil
+	case CustomerKeyPassThrough:
+		return CustomerKeyPassThrough, nil
+	default:
+		return "", fmt.Errorf("unsupported key mode %q", s)
+	}
+}
+
+// ParseCustomerKey is base64で表した256 bit (32 byte) のAES Keyと、そのSHA-256 (base64) を検証して鍵を返す
+// Cloud StorageのX-Goog-Encryption-Key, X-Goog-Encryption-Key-Sha256と同じ形式
+func ParseCustomerKey(key string, keySHA256 string) ([]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("key is not base64: %w", ErrInvalidCustomerKey)
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("key must be 256 bit but got %d bit: %w", len(raw)*8, ErrInvalidCustomerKey)
+	}
+	want, err := base64.StdEncoding.DecodeString(keySHA256)
+	if err != nil || len(want) != sha256.Size {
+		return nil, fmt.Errorf("key sha256 is not a base64 SHA-256 digest: %w", ErrInvalidCustomerKey)
+	}
+	sum := sha256.Sum256(raw)
+	if subtle.ConstantTimeCompare(sum[:], want) != 1 {
+		return nil, fmt.Errorf("key sha256 does not match the key: %w", ErrInvalidCustomerKey)
+	}
+	return raw, nil
+}
+
+// UploadWithCustomerKey is rから読み込んだ内容を、呼び出し元が指定したencryptionKeyをCSEKとしてアップロードする
+// encryptionKeyはCloud KMS Keyで暗号化せず、Metadata[wDEK]も保存しない (CustomerKeyPassThrough)
+// 読み込む時はNewCustomerKeyDownloaderに同じ鍵を指定する
+//
+// encryptionKey: 256 bit (32 byte) AES encryption key
+func (s *CSEKService) UploadWithCustomerKey(ctx context.Context, bucketName string, objectName string, encryptionKey []byte, r io.Reader, opts *UploadOptions) (size int64, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/uploadWithCustomerKey")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "uploadWithCustomerKey", bucketName, err)
+		metrics.RecordUploadedBytes(ctx, metrics.ModeCSEK, "uploadWithCustomerKey", bucketName, size, err)
+	}()
+
+	const op = "csek.uploadWithCustomerKey"
+	if len(encryptionKey) != 32 {
+		return 0, &Error{Op: op, Bucket: bucketName, Object: objectName, Kind: ErrInvalidCustomerKey}
+	}
+
+	size, attrs, err := s.writeWithCustomerKey(ctx, op, bucketName, objectName, encryptionKey, r, opts)
+	// Download時と同じく、Cloud KMS Keyを使わない鍵の利用も記録する
+	target := auditTarget{bucket: bucketName, object: objectName}
+	if attrs != nil {
+		target.generation = attrs.Generation
+	}
+	auditErr := s.audit(withAuditTarget(ctx, target), audit.OperationEncrypt, "", "", err)
+	if err != nil {
+		return size, err
+	}
+	if auditErr != nil {
+		return size, auditErr
+	}
+	setStoredObjectAttributes(ctx, attrs)
+
+	return size, nil
+}
+
+// writeWithCustomerKey is rから読み込んだ内容をencryptionKeyで暗号化して書き込み、書き込んだObjectのAttrsを返す
+func (s *CSEKService) writeWithCustomerKey(ctx context.Context, op string, bucketName string, objectName string, encryptionKey []byte, r io.Reader, opts *UploadOptions) (int64, *storage.ObjectAttrs, error) {
+	// 途中で失敗した時にCloseせずにcancelすることで、中途半端なObjectが作成されないようにする
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	wopts := &objstore.WriteOptions{EncryptionKey: encryptionKey}
+	opts.apply(&wopts.Attrs)
+	wopts.Conditions = opts.conditions()
+	w := s.store.NewWriter(wctx, bucketName, objectName, wopts)
+	size, err := io.Copy(w, r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed gcs.write: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return size, nil, fmt.Errorf("file writer close error: %w", gcsError(op, bucketName, objectName, err))
+	}
+	return size, w.Attrs(), nil
+}
+
+// NewCustomerKeyDownloader is 呼び出し元が指定したencryptionKeyで、指定したGenerationを読み込むReaderを返す
+// Metadata[wDEK]は使わないので、CustomerKeyWrapでアップロードしたObjectも元の鍵で読み込める
+// Objectを暗号化した鍵と異なる場合はErrCustomerKeyMismatchを返す
+// generationが0の場合は最新のGenerationを読み込む
+func (s *CSEKService) NewCustomerKeyDownloader(ctx context.Context, bucketName string, objectName string, generation int64, encryptionKey []byte) (rc io.ReadCloser, attrs *storage.ObjectAttrs, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/newCustomerKeyDownloader")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "downloadWithCustomerKey", bucketName, err)
+	}()
+
+	const op = "csek.downloadWithCustomerKey"
+	attrs, err = s.attrs(ctx, bucketName, objectName, generation)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed read object.Attrs: %w", gcsError(op, bucketName, objectName, err))
+	}
+	setStoredObjectAttributes(ctx, attrs)
+	// 鍵が異なる場合のCloud StorageのErrorは他の400と区別しにくいので、先に確認する
+	if attrs.CustomerKeySHA256 != objstore.KeySHA256(encryptionKey) {
+		return nil, nil, &Error{Op: op, Bucket: bucketName, Object: objectName, Kind: ErrCustomerKeyMismatch}
+	}
+
+	ctx = withAuditTarget(ctx, auditTarget{bucket: bucketName, object: objectName, generation: attrs.Generation})
+	err = s.retry.Open(ctx, "gcs.newReader", func(ctx context.Context) error {
+		var err error
+		rc, err = s.store.NewReader(ctx, bucketName, objectName, &objstore.ObjectOptions{Generation: attrs.Generation, EncryptionKey: encryptionKey})
+		return err
+	})
+	auditErr := s.audit(ctx, audit.OperationDecrypt, "", "", err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed object.NewReader: %w", gcsError(op, bucketName, objectName, err))
+	}
+	if auditErr != nil {
+		rc.Close()
+		return nil, nil, auditErr
+	}
+
+	return metrics.NewCountingReader(ctx, rc, metrics.ModeCSEK, "download", bucketName), attrs, nil
+}
@@ -0,0 +1,161 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func encodeKey(key []byte) (string, string) {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(key), base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestParseCustomerKey(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+	encoded, sum := encodeKey(key)
+	short, shortSum := encodeKey(key[:16])
+	_, otherSum := encodeKey([]byte(strings.Repeat("x", 32)))
+
+	cases := []struct {
+		name    string
+		key     string
+		sha256  string
+		wantErr bool
+	}{
+		{"valid", encoded, sum, false},
+		{"not base64", "!!!", sum, true},
+		{"128 bit", short, shortSum, true},
+		{"missing sha256", encoded, "", true},
+		{"sha256 mismatch", encoded, otherSum, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := encryption.ParseCustomerKey(tc.key, tc.sha256)
+			if tc.wantErr {
+				if !errors.Is(err, encryption.ErrInvalidCustomerKey) {
+					t.Errorf("want ErrInvalidCustomerKey but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(key) {
+				t.Errorf("unexpected key %x", got)
+			}
+		})
+	}
+}
+
+func TestCSEKService_CustomerKey(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	key := []byte(strings.Repeat("k", 32))
+
+	// passthrough: 鍵はどこにも保存しない
+	if _, err := s.UploadWithCustomerKey(ctx, "bucket", "passthrough.txt", key, strings.NewReader("pass"), nil); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := store.Attrs(ctx, "bucket", "passthrough.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Metadata["wDEK"] != "" {
+		t.Errorf("want no wDEK but got %v", attrs.Metadata)
+	}
+	if _, _, err := s.Download(ctx, testKeyName, "bucket", "passthrough.txt"); !errors.Is(err, encryption.ErrMissingWrappedKey) {
+		t.Errorf("want ErrMissingWrappedKey but got %v", err)
+	}
+	rc, _, err := s.NewCustomerKeyDownloader(ctx, "bucket", "passthrough.txt", 0, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "pass" {
+		t.Errorf("want pass but got %q", got)
+	}
+	if _, _, err := s.NewCustomerKeyDownloader(ctx, "bucket", "passthrough.txt", 0, []byte(strings.Repeat("x", 32))); !errors.Is(err, encryption.ErrCustomerKeyMismatch) {
+		t.Errorf("want ErrCustomerKeyMismatch but got %v", err)
+	}
+
+	// wrap: 指定した鍵をwDEKとして保存するので、鍵を指定しなくても読める
+	if _, err := s.UploadFrom(ctx, testKeyName, "bucket", "wrap.txt", key, strings.NewReader("wrap"), nil); err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := s.Download(ctx, testKeyName, "bucket", "wrap.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "wrap" {
+		t.Errorf("want wrap but got %q", data)
+	}
+	if _, _, err := s.NewCustomerKeyDownloader(ctx, "bucket", "wrap.txt", 0, key); err != nil {
+		t.Errorf("want wrapped object readable with the customer key but got %v", err)
+	}
+}
+
+func TestCSEKService_CustomerKeyAudit(t *testing.T) {
+	ctx := context.Background()
+	kms, _ := newLocalKMS(t)
+	var buf bytes.Buffer
+	auditLog, err := audit.New(ctx, audit.NewWriterSink(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := encryption.NewCSEKService(ctx, objstore.NewMemory(), kms, encryption.WithAuditLogger(auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte(strings.Repeat("k", 32))
+
+	if _, err := s.UploadWithCustomerKey(ctx, "bucket", "passthrough.txt", key, strings.NewReader("pass"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// 既に存在するので失敗する
+	opts := &encryption.UploadOptions{Conditions: &objstore.Conditions{DoesNotExist: true}}
+	if _, err := s.UploadWithCustomerKey(ctx, "bucket", "passthrough.txt", key, strings.NewReader("again"), opts); !errors.Is(err, encryption.ErrPreconditionFailed) {
+		t.Fatalf("want ErrPreconditionFailed but got %v", err)
+	}
+	rc, attrs, err := s.NewCustomerKeyDownloader(ctx, "bucket", "passthrough.txt", 0, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+
+	records, err := audit.ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		op         audit.Operation
+		outcome    audit.Outcome
+		generation int64
+	}{
+		{audit.OperationEncrypt, audit.OutcomeSuccess, attrs.Generation},
+		{audit.OperationEncrypt, audit.OutcomeFailure, 0},
+		{audit.OperationDecrypt, audit.OutcomeSuccess, attrs.Generation},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("want %d audit records but got %+v", len(want), records)
+	}
+	for i, w := range want {
+		r := records[i]
+		if r.Operation != w.op || r.Outcome != w.outcome || r.Generation != w.generation || r.Bucket != "bucket" || r.Object != "passthrough.txt" {
+			t.Errorf("record %d: want %s %s generation=%d but got %+v", i, w.op, w.outcome, w.generation, r)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// DeleteStatus is Prefix単位のDeleteでのObjectごとの結果
+type DeleteStatus string
+
+const (
+	// DeleteDeleted is 削除した
+	DeleteDeleted DeleteStatus = "deleted"
+
+	// DeleteSkipped is 一覧を取得した後に上書き, 削除されていたので削除しなかった
+	DeleteSkipped DeleteStatus = "skipped"
+
+	// DeleteFailed is 失敗した
+	DeleteFailed DeleteStatus = "failed"
+)
+
+// DeleteResult is Prefix単位のDeleteでのObjectごとの結果
+type DeleteResult struct {
+	Object     string       `json:"object"`
+	Generation int64        `json:"generation"`
+	Status     DeleteStatus `json:"status"`
+	Error      string       `json:"error,omitempty"`
+
+	err error
+}
+
+// Err is 失敗した時のerr
+func (r *DeleteResult) Err() error {
+	return r.err
+}
+
+// DeleteReport is Prefix単位のDeleteの結果
+type DeleteReport struct {
+	Bucket  string          `json:"bucket"`
+	Prefix  string          `json:"prefix"`
+	Results []*DeleteResult `json:"results"`
+	Deleted int             `json:"deleted"`
+	Skipped int             `json:"skipped"`
+	Failed  int             `json:"failed"`
+}
+
+// deleteObject is bucket/objectを削除する
+// generationを指定した場合は、最新のGenerationがgenerationの時だけ削除し、異なる場合はErrPreconditionFailedを返す
+// Object Versioningが有効なBucketでは、削除したGenerationはnoncurrentとして残る
+func deleteObject(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, op string, bucketName string, objectName string, generation int64) error {
+	opts := &objstore.ObjectOptions{}
+	if generation > 0 {
+		opts.Conditions = &objstore.Conditions{GenerationMatch: generation}
+	}
+	err := retry.Do(ctx, "gcs.delete", func(ctx context.Context) error {
+		return store.Delete(ctx, bucketName, objectName, opts)
+	})
+	if err != nil {
+		return fmt.Errorf("failed delete object: %w", gcsError(op, bucketName, objectName, err))
+	}
+	return nil
+}
+
+// deletePrefix is bucketのprefix以下のObjectを並列に削除する
+// 一覧を取得した時のGenerationを前提条件にするので、途中で上書きされたObjectは削除しない
+func deletePrefix(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, op string, bucketName string, prefix string, parallelism int) (*DeleteReport, error) {
+	if prefix == "" {
+		return nil, fmt.Errorf("%s: prefix is required to delete gs://%s recursively", op, bucketName)
+	}
+
+	report := &DeleteReport{Bucket: bucketName, Prefix: prefix}
+	var mu sync.Mutex
+	err := forEachObject(ctx, store, retry, op, bucketName, prefix, parallelism, func(attrs *storage.ObjectAttrs) func() {
+		result := &DeleteResult{Object: attrs.Name, Generation: attrs.Generation}
+		report.Results = append(report.Results, result)
+		return func() {
+			err := deleteObject(ctx, store, retry, op, bucketName, result.Object, result.Generation)
+			switch {
+			case err == nil:
+				result.Status = DeleteDeleted
+			case errors.Is(err, ErrPreconditionFailed), errors.Is(err, ErrObjectNotFound):
+				result.Status = DeleteSkipped
+			default:
+				result.Status = DeleteFailed
+				result.Error = err.Error()
+				result.err = err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			switch result.Status {
+			case DeleteDeleted:
+				report.Deleted++
+			case DeleteSkipped:
+				report.Skipped++
+			default:
+				report.Failed++
+			}
+		}
+	})
+	return report, err
+}
+
+// Delete is bucket/objectを削除する
+// generationを指定した場合は、最新のGenerationがgenerationの時だけ削除し、異なる場合はErrPreconditionFailedを返す
+func (s *CSEKService) Delete(ctx context.Context, bucketName string, objectName string, generation int64) (err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/delete")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "delete", bucketName, err)
+	}()
+
+	return deleteObject(ctx, s.store, s.retry, "csek.delete", bucketName, objectName, generation)
+}
+
+// DeletePrefix is bucketのprefix以下のObjectを、parallelism個ずつ並列に削除して、Objectごとの結果を返す
+// parallelismは0以下の場合はDefaultBulkParallelism, MaxBulkParallelismより大きい場合はMaxBulkParallelismになる
+// 一覧の取得に失敗した場合は、それまでの結果とerrを返す
+func (s *CSEKService) DeletePrefix(ctx context.Context, bucketName string, prefix string, parallelism int) (report *DeleteReport, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/deletePrefix")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, prefix)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "deletePrefix", bucketName, err)
+	}()
+
+	return deletePrefix(ctx, s.store, s.retry, "csek.deletePrefix", bucketName, prefix, parallelism)
+}
+
+// Delete is bucket/objectを削除する
+// generationを指定した場合は、最新のGenerationがgenerationの時だけ削除し、異なる場合はErrPreconditionFailedを返す
+func (s *CMEKService) Delete(ctx context.Context, bucketName string, objectName string, generation int64) (err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/delete")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "delete", bucketName, err)
+	}()
+
+	return deleteObject(ctx, s.store, s.retry, "cmek.delete", bucketName, objectName, generation)
+}
+
+// DeletePrefix is bucketのprefix以下のObjectを、parallelism個ずつ並列に削除して、Objectごとの結果を返す
+// parallelismは0以下の場合はDefaultBulkParallelism, MaxBulkParallelismより大きい場合はMaxBulkParallelismになる
+// 一覧の取得に失敗した場合は、それまでの結果とerrを返す
+func (s *CMEKService) DeletePrefix(ctx context.Context, bucketName string, prefix string, parallelism int) (report *DeleteReport, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/deletePrefix")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, prefix)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "deletePrefix", bucketName, err)
+	}()
+
+	return deletePrefix(ctx, s.store, s.retry, "cmek.deletePrefix", bucketName, prefix, parallelism)
+}
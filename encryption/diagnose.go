@@ -0,0 +1,153 @@
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// ProblemCode is Diagnoseで見つかった、Objectを復号できない原因
+type ProblemCode string
+
+const (
+	// ProblemNotCSEK is ObjectがCSEKで暗号化されていない
+	// このServiceで鍵を扱う必要はないので、CMEK or Google-managed keyとして読み込む
+	ProblemNotCSEK ProblemCode = "not_csek"
+
+	// ProblemMissingWrappedKey is Metadata[wDEK]が存在しない
+	// 別の手段でUploadしたか、keyMode=passthroughでUploadしたObjectで、元の鍵を指定しないと読み込めない
+	ProblemMissingWrappedKey ProblemCode = "missing_wrapped_key"
+
+	// ProblemKEKMismatch is wDEKを暗号化したCloud KMS Keyが、指定したCloud KMS Keyと異なる
+	ProblemKEKMismatch ProblemCode = "kek_mismatch"
+
+	// ProblemRecordedDEKMismatch is Metadata[dekSha256]がObjectのCSEKと一致しない
+	// 別のObjectのMetadataをCopyした場合などで、wDEKはこのObjectの鍵ではない
+	ProblemRecordedDEKMismatch ProblemCode = "recorded_dek_mismatch"
+
+	// ProblemKMSPermissionDenied is Cloud KMS Keyで復号する権限が無い
+	ProblemKMSPermissionDenied ProblemCode = "kms_permission_denied"
+
+	// ProblemUnwrapFailed is wDEKを復号した結果が256 bitの鍵ではない
+	// wDEKが壊れている場合
+	ProblemUnwrapFailed ProblemCode = "unwrap_failed"
+
+	// ProblemUnwrappedDEKMismatch is wDEKを復号した鍵がObjectのCSEKと一致しない
+	ProblemUnwrappedDEKMismatch ProblemCode = "unwrapped_dek_mismatch"
+)
+
+// Problem is Diagnoseで見つかった問題と、その説明
+type Problem struct {
+	Code    ProblemCode `json:"code"`
+	Message string      `json:"message"`
+}
+
+// Diagnosis is Objectを復号できるかを確認した結果
+type Diagnosis struct {
+	Bucket     string `json:"bucket"`
+	Object     string `json:"object"`
+	Generation int64  `json:"generation"`
+
+	// Mode is 暗号化方式. EncryptionModeCSEK, EncryptionModeCMEK, EncryptionModeGoogleのいずれか
+	Mode string `json:"mode"`
+
+	CustomerKeySHA256 string `json:"customerKeySha256,omitempty"`
+	CryptKey          string `json:"cryptKey,omitempty"`
+	WrappedKey        bool   `json:"wrappedKey"`
+
+	// RecordedDEKSHA256 is Metadata[dekSha256]
+	RecordedDEKSHA256 string `json:"recordedDekSha256,omitempty"`
+
+	// UnwrappedDEKSHA256 is wDEKを復号した鍵のSHA-256. 復号できなかった場合は空
+	UnwrappedDEKSHA256 string `json:"unwrappedDekSha256,omitempty"`
+
+	// Decryptable is keyNameを使ってNewDownloaderで読み込めるか
+	Decryptable bool `json:"decryptable"`
+
+	// Problems is 読み込めない原因. Decryptableの場合は空
+	Problems []*Problem `json:"problems,omitempty"`
+}
+
+func (d *Diagnosis) problem(code ProblemCode, format string, args ...interface{}) {
+	d.Problems = append(d.Problems, &Problem{Code: code, Message: fmt.Sprintf(format, args...)})
+}
+
+// Diagnose is keyNameを使ってObjectを復号できるかを確認し、できない場合はその原因を返す
+// Objectの内容は読み込まず、Metadataの確認とCloud KMSでのwDEKの復号だけを行う
+// generationが0の場合は最新のGenerationを確認する
+// Cloud KMSが一時的に使えないなど、Objectの問題ではない理由で確認できない場合はerrを返す
+func (s *CSEKService) Diagnose(ctx context.Context, keyName string, bucketName string, objectName string, generation int64) (diagnosis *Diagnosis, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/diagnose")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "diagnose", bucketName, err)
+	}()
+
+	attrs, err := s.attrs(ctx, bucketName, objectName, generation)
+	if err != nil {
+		return nil, fmt.Errorf("failed read object.Attrs: %w", gcsError("csek.diagnose", bucketName, objectName, err))
+	}
+	setStoredObjectAttributes(ctx, attrs)
+	info := newObjectInfo(attrs)
+	d := &Diagnosis{
+		Bucket:            bucketName,
+		Object:            objectName,
+		Generation:        attrs.Generation,
+		Mode:              info.Mode,
+		CustomerKeySHA256: attrs.CustomerKeySHA256,
+		CryptKey:          attrs.Metadata["cryptKey"],
+		WrappedKey:        info.WrappedKey,
+		RecordedDEKSHA256: attrs.Metadata["dekSha256"],
+	}
+
+	if attrs.CustomerKeySHA256 == "" {
+		d.problem(ProblemNotCSEK, "object is encrypted with a %s key, not a customer-supplied key", info.Mode)
+		return d, nil
+	}
+	if !d.WrappedKey {
+		d.problem(ProblemMissingWrappedKey, "object has no wDEK. it can be read only with the original key (sha256 %s)", attrs.CustomerKeySHA256)
+		return d, nil
+	}
+	if err := checkKEK(keyName, attrs); err != nil {
+		d.problem(ProblemKEKMismatch, "%s", err)
+	}
+	if err := checkRecordedDEK(attrs); err != nil {
+		d.problem(ProblemRecordedDEKMismatch, "%s", err)
+	}
+	if len(d.Problems) > 0 {
+		// 復号しても読み込めないことが分かっているので、Cloud KMSは呼び出さない
+		return d, nil
+	}
+
+	ctx = withAuditTarget(ctx, auditTarget{bucket: bucketName, object: objectName, generation: attrs.Generation, keyVersion: keyVersionOf(attrs)})
+	plaintext, err := s.Decrypt(ctx, keyName, attrs.Metadata["wDEK"])
+	switch {
+	case errors.Is(err, ErrKMSPermissionDenied):
+		d.problem(ProblemKMSPermissionDenied, "permission denied to decrypt wDEK with %s: %s", keyName, err)
+		return d, nil
+	case errors.Is(err, ErrKEKMismatch):
+		d.problem(ProblemKEKMismatch, "wDEK cannot be decrypted with %s: %s", keyName, err)
+		return d, nil
+	case err != nil:
+		// Cloud KMSの障害やcancelはObjectの問題ではないので、診断結果にしない
+		return nil, fmt.Errorf("failed decrypt wDEK: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil || len(key) != 32 {
+		d.problem(ProblemUnwrapFailed, "wDEK does not decrypt to a 256 bit key")
+		return d, nil
+	}
+	d.UnwrappedDEKSHA256 = objstore.KeySHA256(key)
+	if err := checkUnwrappedDEK(attrs, key); err != nil {
+		d.problem(ProblemUnwrappedDEKMismatch, "%s", err)
+		return d, nil
+	}
+	d.Decryptable = true
+	return d, nil
+}
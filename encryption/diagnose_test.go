@@ -0,0 +1,108 @@
+package encryption_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+func TestCSEKService_Diagnose(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	upload(t, s, "bucket", "a.txt", "a")
+	upload(t, s, "bucket", "b.txt", "b")
+	upload(t, s, "bucket", "c.txt", "c")
+	a, err := store.Attrs(ctx, "bucket", "a.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Metadata["dekSha256"] != a.CustomerKeySHA256 {
+		t.Fatalf("want dekSha256 %s but got %s", a.CustomerKeySHA256, a.Metadata["dekSha256"])
+	}
+
+	d, err := s.Diagnose(ctx, testKeyName, "bucket", "a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !d.Decryptable || len(d.Problems) != 0 || d.UnwrappedDEKSHA256 != a.CustomerKeySHA256 {
+		t.Errorf("unexpected diagnosis %+v", d)
+	}
+
+	// b.txtにa.txtのMetadataをそのままCopyすると、dekSha256が一致しない
+	if _, err := store.Update(ctx, "bucket", "b.txt", nil, objstore.ObjectAttrsToUpdate{Metadata: a.Metadata}); err != nil {
+		t.Fatal(err)
+	}
+	// c.txtにa.txtのwDEKだけをCopyすると、復号した鍵が一致しない
+	if _, err := store.Update(ctx, "bucket", "c.txt", nil, objstore.ObjectAttrsToUpdate{Metadata: map[string]string{"wDEK": a.Metadata["wDEK"]}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		object string
+		code   encryption.ProblemCode
+	}{
+		{"b.txt", encryption.ProblemRecordedDEKMismatch},
+		{"c.txt", encryption.ProblemUnwrappedDEKMismatch},
+	} {
+		_, _, err := s.Download(ctx, testKeyName, "bucket", tt.object)
+		var mismatch *encryption.DEKMismatchError
+		if !errors.Is(err, encryption.ErrDEKMismatch) || !errors.As(err, &mismatch) {
+			t.Errorf("%s: want DEKMismatchError but got %v", tt.object, err)
+		}
+
+		d, err := s.Diagnose(ctx, testKeyName, "bucket", tt.object, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Decryptable || len(d.Problems) != 1 || d.Problems[0].Code != tt.code {
+			t.Errorf("%s: want %s but got %+v", tt.object, tt.code, d.Problems)
+		}
+	}
+
+	d, err = s.Diagnose(ctx, testOtherKeyName, "bucket", "a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Decryptable || len(d.Problems) != 1 || d.Problems[0].Code != encryption.ProblemKEKMismatch {
+		t.Errorf("want %s but got %+v", encryption.ProblemKEKMismatch, d.Problems)
+	}
+
+	if _, err := s.Diagnose(ctx, testKeyName, "bucket", "missing", 0); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
+}
+
+func TestCSEKService_DiagnoseKMSUnavailable(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	upload(t, s, "bucket", "a.txt", "a")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	kms, err := cloudkms.NewService(ctx, option.WithEndpoint(srv.URL+"/"), option.WithoutAuthentication(), option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable, err := encryption.NewCSEKService(ctx, store, kms, encryption.WithRetryPolicy(encryption.RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cloud KMSの障害はObjectの問題として診断しない
+	if d, err := unavailable.Diagnose(ctx, testKeyName, "bucket", "a.txt", 0); err == nil {
+		t.Errorf("want error but got diagnosis %+v", d)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if d, err := s.Diagnose(canceled, testKeyName, "bucket", "a.txt", 0); err == nil {
+		t.Errorf("want error for a canceled context but got diagnosis %+v", d)
+	}
+}
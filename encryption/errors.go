@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// ErrMissingWrappedKey is Object.Metadata[wDEK]が存在しない
+	ErrMissingWrappedKey = errors.New("wrapped key not found in object metadata")
+
+	// ErrKEKMismatch is wDEKを暗号化したCloud KMS Keyと、指定されたCloud KMS Keyが一致しない
+	ErrKEKMismatch = errors.New("key encryption key mismatch")
+
+	// ErrKMSPermissionDenied is Cloud KMS Keyに対する権限が無い
+	ErrKMSPermissionDenied = errors.New("permission denied on cloud kms key")
+
+	// ErrObjectNotFound is 対象のObjectが存在しない
+	ErrObjectNotFound = errors.New("object not found")
+
+	// ErrPreconditionFailed is Generationなどの前提条件を満たさなかった
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	// ErrIntegrity is 復号したDEKやObjectの内容が壊れている
+	ErrIntegrity = errors.New("integrity check failed")
+
+	// ErrDEKMismatch is wDEKを復号した鍵 (DEK) が、Objectを暗号化したCSEKと一致しない
+	ErrDEKMismatch = errors.New("data encryption key mismatch")
+)
+
+// Error is encryption packageの操作が失敗した時のError
+// Kindに上記のsentinel errorを持つので、errors.Is(err, encryption.ErrObjectNotFound) のように分岐できる
+// 元のErrorはErrで保持しているので、errors.As(err, &googleapi.Error{}) も引き続き利用できる
+type Error struct {
+	Op      string // "csek.download" など
+	Bucket  string
+	Object  string
+	KeyName string
+	Kind    error
+	Err     error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Op)
+	b.WriteString(": ")
+	b.WriteString(e.Kind.Error())
+	if e.Bucket != "" || e.Object != "" {
+		fmt.Fprintf(&b, ". object=gs://%s/%s", e.Bucket, e.Object)
+	}
+	if e.KeyName != "" {
+		fmt.Fprintf(&b, ", CryptoKey=%s", e.KeyName)
+	}
+	if e.Err != nil {
+		b.WriteString(" : ")
+		b.WriteString(e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is is errors.Isで Kind と比較できるようにする
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// KEKMismatchError is Objectに記録されているCloud KMS Keyと、指定されたCloud KMS Keyが異なる
+type KEKMismatchError struct {
+	KeyName   string // 指定されたCloud KMS Key
+	StoredKey string // Object.Metadata[cryptKey]
+}
+
+func (e *KEKMismatchError) Error() string {
+	return fmt.Sprintf("object is wrapped by %s but %s is specified", e.StoredKey, e.KeyName)
+}
+
+// checkKEK is Object.Metadata[cryptKey]がkeyNameまたはそのkeyVersionであることを確認する
+// cryptKeyを持たないObjectは判断できないので、そのまま通してCloud KMSに判断させる
+func checkKEK(keyName string, attrs *storage.ObjectAttrs) error {
+	stored := attrs.Metadata["cryptKey"]
+	if stored == "" || stored == keyName || strings.HasPrefix(stored, keyName+"/cryptoKeyVersions/") {
+		return nil
+	}
+	return &KEKMismatchError{KeyName: keyName, StoredKey: stored}
+}
+
+// DEKMismatchError is wDEKを復号した鍵 (DEK) やMetadata[dekSha256]が、Objectを暗号化したCSEKと一致しない
+// いずれもbase64で表したSHA-256
+type DEKMismatchError struct {
+	ObjectSHA256    string // ObjectAttrs.CustomerKeySHA256
+	RecordedSHA256  string // Metadata[dekSha256]
+	UnwrappedSHA256 string // wDEKを復号した鍵. 復号する前に分かった場合は空
+}
+
+func (e *DEKMismatchError) Error() string {
+	switch {
+	case e.ObjectSHA256 == "":
+		return "object has wDEK but is not encrypted with a customer-supplied key"
+	case e.UnwrappedSHA256 == "":
+		return fmt.Sprintf("wDEK is recorded for key sha256 %s but the object is encrypted with key sha256 %s. the metadata may have been copied from another object", e.RecordedSHA256, e.ObjectSHA256)
+	default:
+		return fmt.Sprintf("wDEK decrypts to key sha256 %s but the object is encrypted with key sha256 %s", e.UnwrappedSHA256, e.ObjectSHA256)
+	}
+}
+
+// checkRecordedDEK is Metadata[dekSha256]がObjectのCSEKのSHA-256と一致することを確認する
+// dekSha256を持たない (記録する前にUploadした) Objectは、復号した後のcheckUnwrappedDEKだけで確認する
+func checkRecordedDEK(attrs *storage.ObjectAttrs) error {
+	recorded := attrs.Metadata["dekSha256"]
+	if attrs.CustomerKeySHA256 == "" || (recorded != "" && recorded != attrs.CustomerKeySHA256) {
+		return &DEKMismatchError{ObjectSHA256: attrs.CustomerKeySHA256, RecordedSHA256: recorded}
+	}
+	return nil
+}
+
+// checkUnwrappedDEK is wDEKを復号した鍵が、ObjectのCSEKであることを確認する
+func checkUnwrappedDEK(attrs *storage.ObjectAttrs, key []byte) error {
+	sum := objstore.KeySHA256(key)
+	if sum != attrs.CustomerKeySHA256 {
+		return &DEKMismatchError{ObjectSHA256: attrs.CustomerKeySHA256, RecordedSHA256: attrs.Metadata["dekSha256"], UnwrappedSHA256: sum}
+	}
+	return nil
+}
+
+// gcsError is Cloud Storageから返ってきたerrを分類してErrorにする
+// 分類できないerrはそのまま返す
+func gcsError(op string, bucket string, object string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	var kind error
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+		kind = ErrObjectNotFound
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound:
+		kind = ErrObjectNotFound
+	case errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		kind = ErrPreconditionFailed
+	default:
+		return err
+	}
+	return &Error{Op: op, Bucket: bucket, Object: object, Kind: kind, Err: err}
+}
+
+// kmsError is Cloud KMSから返ってきたerrを分類してErrorにする
+// Decryptで400が返ってくるのは、wDEKを暗号化した鍵と異なる鍵で復号しようとした時
+func kmsError(op string, keyName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	var kind error
+	switch {
+	case apiErr.Code == http.StatusForbidden:
+		kind = ErrKMSPermissionDenied
+	case apiErr.Code == http.StatusBadRequest && strings.HasSuffix(op, ".decrypt"):
+		kind = ErrKEKMismatch
+	default:
+		return err
+	}
+	return &Error{Op: op, KeyName: keyName, Kind: kind, Err: err}
+}
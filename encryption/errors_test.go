@@ -0,0 +1,36 @@
+package encryption_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"google.golang.org/api/googleapi"
+)
+
+func TestError(t *testing.T) {
+	apiErr := &googleapi.Error{Code: 412, Message: "conditionNotMet"}
+	err := fmt.Errorf("failed copier.Run: %w", &encryption.Error{
+		Op:     "csek.copy",
+		Bucket: "bucket",
+		Object: "object",
+		Kind:   encryption.ErrPreconditionFailed,
+		Err:    apiErr,
+	})
+
+	if !errors.Is(err, encryption.ErrPreconditionFailed) {
+		t.Errorf("want errors.Is ErrPreconditionFailed but false: %s", err)
+	}
+	if errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want not errors.Is ErrObjectNotFound but true: %s", err)
+	}
+	var gotAPIErr *googleapi.Error
+	if !errors.As(err, &gotAPIErr) || gotAPIErr.Code != 412 {
+		t.Errorf("want errors.As googleapi.Error 412 but got %v", gotAPIErr)
+	}
+	var e *encryption.Error
+	if !errors.As(err, &e) || e.Object != "object" {
+		t.Errorf("want errors.As encryption.Error but got %v", e)
+	}
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// GenerationInfo is ObjectのGenerationと、その暗号化の情報
+// Object Versioningが有効なBucketでは、上書きや削除の後も古いGenerationがnoncurrentとして残る
+type GenerationInfo struct {
+	Generation     int64      `json:"generation"`
+	Metageneration int64      `json:"metageneration"`
+	Live           bool       `json:"live"`
+	Size           int64      `json:"size"`
+	Created        time.Time  `json:"created"`
+	Deleted        *time.Time `json:"deleted,omitempty"`
+
+	// KMSKeyName is CMEKで暗号化されている場合のCloud KMS Key Version
+	KMSKeyName string `json:"kmsKeyName,omitempty"`
+
+	// CustomerKeySHA256 is CSEKで暗号化されている場合の鍵のSHA-256
+	CustomerKeySHA256 string `json:"customerKeySha256,omitempty"`
+
+	// WrappedKey is Metadata[wDEK]を持っているか
+	WrappedKey bool `json:"wrappedKey"`
+
+	// CryptKey is Metadata[cryptKey]. wDEKを暗号化したCloud KMS Key Version
+	CryptKey string `json:"cryptKey,omitempty"`
+}
+
+func newGenerationInfo(attrs *objstore.ObjectAttrs) *GenerationInfo {
+	info := &GenerationInfo{
+		Generation:        attrs.Generation,
+		Metageneration:    attrs.Metageneration,
+		Live:              attrs.Deleted.IsZero(),
+		Size:              attrs.Size,
+		Created:           attrs.Created,
+		KMSKeyName:        attrs.KMSKeyName,
+		CustomerKeySHA256: attrs.CustomerKeySHA256,
+		WrappedKey:        attrs.Metadata["wDEK"] != "",
+		CryptKey:          attrs.Metadata["cryptKey"],
+	}
+	if !attrs.Deleted.IsZero() {
+		deleted := attrs.Deleted
+		info.Deleted = &deleted
+	}
+	return info
+}
+
+// listGenerations is bucket/objectの全てのGenerationを古い順に返す
+func listGenerations(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, op string, bucketName string, objectName string) ([]*GenerationInfo, error) {
+	var generations []*GenerationInfo
+	// [objectName, objectName+"\x00") の範囲にはobjectNameしか含まれないので、
+	// Prefixが一致する別のObjectをListせずに済む
+	q := &objstore.Query{StartOffset: objectName, EndOffset: objectName + "\x00", Versions: true}
+	token := ""
+	for {
+		var page *objstore.ListPage
+		err := retry.Do(ctx, "gcs.list", func(ctx context.Context) error {
+			var err error
+			page, err = store.List(ctx, bucketName, q, 0, token)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed list generations: %w", gcsError(op, bucketName, objectName, err))
+		}
+		for _, attrs := range page.Objects {
+			generations = append(generations, newGenerationInfo(attrs))
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	if len(generations) < 1 {
+		return nil, &Error{Op: op, Bucket: bucketName, Object: objectName, Kind: ErrObjectNotFound, Err: objstore.ErrObjectNotExist}
+	}
+	return generations, nil
+}
+
+// restoreConditions is Generationをliveに戻すCopyの前提条件
+// 戻している間に別の書き込みがあった場合に上書きしないように、現在のliveなGenerationを指定する
+// liveなGenerationがない (削除されている) 場合は、存在しないことを条件にする
+func restoreConditions(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, bucketName string, objectName string) (live *objstore.ObjectAttrs, conds *objstore.Conditions, err error) {
+	err = retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		live, err = store.Attrs(ctx, bucketName, objectName, nil)
+		return err
+	})
+	if errors.Is(err, objstore.ErrObjectNotExist) {
+		return nil, &objstore.Conditions{DoesNotExist: true}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return live, &objstore.Conditions{GenerationMatch: live.Generation}, nil
+}
@@ -0,0 +1,120 @@
+package encryption_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func TestCSEKService_Generations(t *testing.T) {
+	ctx := context.Background()
+	kms, ks := newLocalKMS(t)
+	s, err := encryption.NewCSEKService(ctx, objstore.NewMemory(), kms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload(t, s, "bucket", "object", "v1")
+	upload(t, s, "bucket", "object", "v2")
+	// 名前がobjectで始まる別のObjectは含まない
+	upload(t, s, "bucket", "object-2", "other")
+	upload(t, s, "bucket", "object/child", "other")
+
+	generations, err := s.ListGenerations(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 2 || generations[0].Live || !generations[1].Live || !generations[0].WrappedKey {
+		t.Fatalf("want a noncurrent and a live generation with wrapped keys but got %+v", generations)
+	}
+	v1 := generations[0]
+
+	// 上書きされた後も、そのGenerationのwDEKで読める
+	got, _, err := s.DownloadGeneration(ctx, testKeyName, "bucket", "object", v1.Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "v1" {
+		t.Errorf("want v1 but got %q", got)
+	}
+
+	version, err := ks.CreateVersion(testKeyName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.UpdatePrimaryVersion(testKeyName, "2"); err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, err := s.Rewrap(ctx, testKeyName, "bucket", "object", v1.Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewrapped.Generation != v1.Generation || rewrapped.Metadata["cryptKey"] != version.Name {
+		t.Errorf("want generation %d wrapped by %s but got %d, %s", v1.Generation, version.Name, rewrapped.Generation, rewrapped.Metadata["cryptKey"])
+	}
+
+	restored, err := s.RestoreGeneration(ctx, testKeyName, "bucket", "object", v1.Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Generation <= generations[1].Generation {
+		t.Errorf("want a new live generation but got %d", restored.Generation)
+	}
+	got, _, err = s.Download(ctx, testKeyName, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "v1" {
+		t.Errorf("want restored v1 but got %q", got)
+	}
+
+	// 既に最新のGenerationを戻しても、新しいGenerationは作られない
+	again, err := s.RestoreGeneration(ctx, testKeyName, "bucket", "object", restored.Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Generation != restored.Generation {
+		t.Errorf("want generation %d but got %d", restored.Generation, again.Generation)
+	}
+
+	if _, err := s.ListGenerations(ctx, "bucket", "missing"); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
+}
+
+func TestCMEKService_RestoreGeneration(t *testing.T) {
+	ctx := context.Background()
+	s := newCMEKService(t)
+	for _, v := range []string{"v1", "v2"} {
+		if _, err := s.Upload(ctx, "bucket", "object", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generations, err := s.ListGenerations(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(generations) != 2 {
+		t.Fatalf("want 2 generations but got %d", len(generations))
+	}
+
+	if _, err := s.RestoreGeneration(ctx, "bucket", "object", generations[0].Generation); err != nil {
+		t.Fatal(err)
+	}
+	got, _, err := s.Download(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "v1" {
+		t.Errorf("want restored v1 but got %q", got)
+	}
+	got, _, err = s.DownloadGeneration(ctx, "bucket", "object", generations[1].Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "v2" {
+		t.Errorf("want noncurrent v2 but got %q", got)
+	}
+}
@@ -14,7 +14,7 @@ import (
 // prints the base64 representation.
 func GenerateEncryptionKeyToWrite(ctx context.Context, w io.Writer) (err error) {
 	ctx = trace.StartSpan(ctx, "encryption/GenerateEncryptionKeyToWrite")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
 
 	// This is included for demonstration purposes. You should generate your own
 	// key. Please remember that encryption keys should be handled with a
@@ -32,7 +32,7 @@ func GenerateEncryptionKeyToWrite(ctx context.Context, w io.Writer) (err error)
 // prints the base64 representation.
 func GenerateEncryptionKey(ctx context.Context) (key []byte, err error) {
 	ctx = trace.StartSpan(ctx, "encryption/GenerateEncryptionKeyToWrite")
-	defer trace.EndSpan(ctx, err)
+	defer func() { trace.EndSpan(ctx, err) }()
 	// This is included for demonstration purposes. You should generate your own
 	// key. Please remember that encryption keys should be handled with a
 	// comprehensive security policy.
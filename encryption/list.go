@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// 暗号化方式
+const (
+	// EncryptionModeCSEK is Customer-Supplied Encryption Keyで暗号化されている
+	EncryptionModeCSEK = "csek"
+
+	// EncryptionModeCMEK is Cloud KMS Key (Customer-Managed Encryption Key) で暗号化されている
+	EncryptionModeCMEK = "cmek"
+
+	// EncryptionModeGoogle is Google-managed keyで暗号化されている
+	EncryptionModeGoogle = "google"
+)
+
+// DefaultListPageSize is ListOptions.PageSizeを指定しなかった時に、1回で返すObjectの数
+const DefaultListPageSize = 100
+
+// ListOptions is Listの条件
+type ListOptions struct {
+	// Prefix is 返すObjectの名前のprefix
+	Prefix string
+
+	// Delimiter is 指定した場合は、Prefixの後にDelimiterを含むObjectをObjectList.Prefixesにまとめる
+	Delimiter string
+
+	// PageSize is 1回で返すObjectとPrefixの数の上限
+	// 0以下の場合はDefaultListPageSizeになる
+	PageSize int
+
+	// PageToken is 前回のObjectList.NextPageToken
+	PageToken string
+}
+
+// ObjectInfo is Objectと、その暗号化の情報
+type ObjectInfo struct {
+	Name        string    `json:"name"`
+	Generation  int64     `json:"generation"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType,omitempty"`
+	Updated     time.Time `json:"updated"`
+
+	// Mode is 暗号化方式. EncryptionModeCSEK, EncryptionModeCMEK, EncryptionModeGoogleのいずれか
+	Mode string `json:"mode"`
+
+	// KeyVersion is 暗号化に使ったCloud KMS Key Version
+	// CMEKの場合はObjectを暗号化したKey Version, CSEKの場合はwDEKを暗号化したKey Version (Metadata[cryptKey])
+	KeyVersion string `json:"keyVersion,omitempty"`
+
+	// CustomerKeySHA256 is CSEKで暗号化されている場合の鍵のSHA-256
+	CustomerKeySHA256 string `json:"customerKeySha256,omitempty"`
+
+	// WrappedKey is Metadata[wDEK]を持っているか
+	// CSEKで暗号化されていてwDEKを持たないObjectは、このServiceでは復号できない
+	WrappedKey bool `json:"wrappedKey"`
+}
+
+func newObjectInfo(attrs *objstore.ObjectAttrs) *ObjectInfo {
+	info := &ObjectInfo{
+		Name:              attrs.Name,
+		Generation:        attrs.Generation,
+		Size:              attrs.Size,
+		ContentType:       attrs.ContentType,
+		Updated:           attrs.Updated,
+		Mode:              EncryptionModeGoogle,
+		CustomerKeySHA256: attrs.CustomerKeySHA256,
+		WrappedKey:        attrs.Metadata["wDEK"] != "",
+	}
+	switch {
+	case attrs.CustomerKeySHA256 != "":
+		info.Mode = EncryptionModeCSEK
+		info.KeyVersion = attrs.Metadata["cryptKey"]
+	case attrs.KMSKeyName != "":
+		info.Mode = EncryptionModeCMEK
+		info.KeyVersion = attrs.KMSKeyName
+	}
+	return info
+}
+
+// ObjectList is Listの結果
+type ObjectList struct {
+	Objects []*ObjectInfo `json:"objects"`
+
+	// Prefixes is ListOptions.Delimiterを指定した時に、まとめられたprefix
+	Prefixes []string `json:"prefixes,omitempty"`
+
+	// NextPageToken is 続きがある場合に、次のListOptions.PageTokenに指定する
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// listObjects is bucketのObjectを名前順に1 page分返す
+func listObjects(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, op string, bucketName string, opts *ListOptions) (*ObjectList, error) {
+	if opts == nil {
+		opts = &ListOptions{}
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	q := &objstore.Query{Prefix: opts.Prefix, Delimiter: opts.Delimiter}
+	var page *objstore.ListPage
+	err := retry.Do(ctx, "gcs.list", func(ctx context.Context) error {
+		var err error
+		page, err = store.List(ctx, bucketName, q, pageSize, opts.PageToken)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed list objects: %w", gcsError(op, bucketName, opts.Prefix, err))
+	}
+	list := &ObjectList{Objects: []*ObjectInfo{}, NextPageToken: page.NextPageToken}
+	for _, attrs := range page.Objects {
+		if attrs.Prefix != "" {
+			list.Prefixes = append(list.Prefixes, attrs.Prefix)
+			continue
+		}
+		list.Objects = append(list.Objects, newObjectInfo(attrs))
+	}
+	return list, nil
+}
+
+// List is bucketのObjectを暗号化の情報と共に名前順に返す
+// 続きがある場合はObjectList.NextPageTokenをopts.PageTokenに指定して呼び出す
+func (s *CSEKService) List(ctx context.Context, bucketName string, opts *ListOptions) (list *ObjectList, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/list")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, opts.prefix())
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "list", bucketName, err)
+	}()
+
+	return listObjects(ctx, s.store, s.retry, "csek.list", bucketName, opts)
+}
+
+// List is bucketのObjectを暗号化の情報と共に名前順に返す
+// 続きがある場合はObjectList.NextPageTokenをopts.PageTokenに指定して呼び出す
+func (s *CMEKService) List(ctx context.Context, bucketName string, opts *ListOptions) (list *ObjectList, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/list")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, opts.prefix())
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "list", bucketName, err)
+	}()
+
+	return listObjects(ctx, s.store, s.retry, "cmek.list", bucketName, opts)
+}
+
+// statObject is bucketのObjectの暗号化の情報を返す
+func statObject(ctx context.Context, store objstore.ObjectStore, retry RetryPolicy, op string, bucketName string, objectName string) (*ObjectInfo, error) {
+	var attrs *objstore.ObjectAttrs
+	err := retry.Do(ctx, "gcs.attrs", func(ctx context.Context) error {
+		var err error
+		attrs, err = store.Attrs(ctx, bucketName, objectName, nil)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed get object attrs: %w", gcsError(op, bucketName, objectName, err))
+	}
+	return newObjectInfo(attrs), nil
+}
+
+// Stat is bucketのObjectを読み込まずに、暗号化の情報を返す
+func (s *CSEKService) Stat(ctx context.Context, bucketName string, objectName string) (info *ObjectInfo, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/csek/stat")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCSEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCSEK, "stat", bucketName, err)
+	}()
+
+	return statObject(ctx, s.store, s.retry, "csek.stat", bucketName, objectName)
+}
+
+// Stat is bucketのObjectを読み込まずに、暗号化の情報を返す
+func (s *CMEKService) Stat(ctx context.Context, bucketName string, objectName string) (info *ObjectInfo, err error) {
+	ctx = trace.StartSpan(ctx, "encryption/cmek/stat")
+	defer func() { trace.EndSpan(ctx, err) }()
+	setObjectAttributes(ctx, metrics.ModeCMEK, bucketName, objectName)
+	defer func() {
+		metrics.RecordOperation(ctx, metrics.ModeCMEK, "stat", bucketName, err)
+	}()
+
+	return statObject(ctx, s.store, s.retry, "cmek.stat", bucketName, objectName)
+}
+
+func (o *ListOptions) prefix() string {
+	if o == nil {
+		return ""
+	}
+	return o.Prefix
+}
@@ -0,0 +1,171 @@
+package encryption_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func TestCSEKService_List(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	upload(t, s, "bucket", "a/1.txt", "one")
+	upload(t, s, "bucket", "a/2.txt", "two")
+	upload(t, s, "bucket", "a/sub/3.txt", "three")
+	// wDEKを持たないObject
+	w := store.NewWriter(ctx, "bucket", "a/nowdek.txt", &objstore.WriteOptions{EncryptionKey: make([]byte, 32)})
+	w.Write([]byte("x"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.List(ctx, "bucket", &encryption.ListOptions{Prefix: "a/", Delimiter: "/", PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Objects) != 2 || list.NextPageToken == "" {
+		t.Fatalf("unexpected first page %+v", list)
+	}
+	got := list.Objects[0]
+	if got.Name != "a/1.txt" || got.Mode != encryption.EncryptionModeCSEK || !got.WrappedKey || got.KeyVersion == "" || got.Size != 3 {
+		t.Errorf("unexpected object %+v", got)
+	}
+
+	list, err = s.List(ctx, "bucket", &encryption.ListOptions{Prefix: "a/", Delimiter: "/", PageSize: 2, PageToken: list.NextPageToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Objects) != 1 || list.Objects[0].WrappedKey || list.Objects[0].Mode != encryption.EncryptionModeCSEK {
+		t.Errorf("unexpected second page %+v", list.Objects)
+	}
+	if len(list.Prefixes) != 1 || list.Prefixes[0] != "a/sub/" || list.NextPageToken != "" {
+		t.Errorf("unexpected second page %+v", list)
+	}
+}
+
+func TestCMEKService_List(t *testing.T) {
+	ctx := context.Background()
+	s := newCMEKService(t)
+	if _, err := s.UploadWithKey(ctx, testKeyName, "bucket", "cmek.txt", []byte("cmek")); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.List(ctx, "bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Objects) != 1 || list.Objects[0].Mode != encryption.EncryptionModeCMEK || list.Objects[0].KeyVersion == "" {
+		t.Errorf("unexpected list %+v", list.Objects)
+	}
+}
+
+func TestCSEKService_Delete(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	upload(t, s, "bucket", "a.txt", "a")
+	attrs, err := store.Attrs(ctx, "bucket", "a.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Delete(ctx, "bucket", "a.txt", attrs.Generation+1); !errors.Is(err, encryption.ErrPreconditionFailed) {
+		t.Fatalf("want ErrPreconditionFailed but got %v", err)
+	}
+	if err := s.Delete(ctx, "bucket", "a.txt", attrs.Generation); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(ctx, "bucket", "a.txt", 0); !errors.Is(err, encryption.ErrObjectNotFound) {
+		t.Errorf("want ErrObjectNotFound but got %v", err)
+	}
+}
+
+func TestCSEKService_DeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	s, store := newCSEKService(t)
+	for i := 0; i < 5; i++ {
+		upload(t, s, "bucket", fmt.Sprintf("tmp/%d.txt", i), "data")
+	}
+	upload(t, s, "bucket", "keep.txt", "data")
+
+	report, err := s.DeletePrefix(ctx, "bucket", "tmp/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 5 || report.Failed != 0 || len(report.Results) != 5 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	page, err := store.List(ctx, "bucket", nil, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Objects) != 1 || page.Objects[0].Name != "keep.txt" {
+		t.Errorf("want only keep.txt left but got %d objects", len(page.Objects))
+	}
+
+	if _, err := s.DeletePrefix(ctx, "bucket", "", 0); err == nil {
+		t.Error("want error deleting a whole bucket but got nil")
+	}
+}
+
+// concurrencyStore is 同時に実行されているDeleteの最大数を記録する
+type concurrencyStore struct {
+	objstore.ObjectStore
+
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (s *concurrencyStore) Delete(ctx context.Context, bucket string, name string, opts *objstore.ObjectOptions) error {
+	s.mu.Lock()
+	s.inflight++
+	if s.inflight > s.max {
+		s.max = s.inflight
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inflight--
+		s.mu.Unlock()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	return s.ObjectStore.Delete(ctx, bucket, name, opts)
+}
+
+func TestCMEKService_DeletePrefix_Parallelism(t *testing.T) {
+	ctx := context.Background()
+	store := &concurrencyStore{ObjectStore: objstore.NewMemory()}
+	s, err := encryption.NewCMEKService(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := encryption.MaxBulkParallelism * 2
+	for i := 0; i < n; i++ {
+		w := store.NewWriter(ctx, "bucket", fmt.Sprintf("tmp/%d.txt", i), nil)
+		if _, err := w.Write([]byte("data")); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := s.DeletePrefix(ctx, "bucket", "tmp/", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != n || len(report.Results) != n {
+		t.Errorf("unexpected report %+v", report)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.max > encryption.MaxBulkParallelism {
+		t.Errorf("want at most %d deletes at once but got %d", encryption.MaxBulkParallelism, store.max)
+	}
+}
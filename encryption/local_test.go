@@ -0,0 +1,41 @@
+package encryption_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/internal/kmsemu"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	testKeyName      = "projects/local/locations/global/keyRings/gcs/cryptoKeys/sample"
+	testOtherKeyName = "projects/local/locations/global/keyRings/gcs/cryptoKeys/other"
+)
+
+// newLocalKMS is kmsemuにtestKeyName, testOtherKeyNameを作成して、接続したcloudkms.Serviceを返す
+func newLocalKMS(t *testing.T) (*cloudkms.Service, *kmsemu.Keystore) {
+	t.Helper()
+	ks, err := kmsemu.OpenKeystore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{testKeyName, testOtherKeyName} {
+		if _, err := ks.CreateKey(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(kmsemu.NewServer(ks))
+	t.Cleanup(srv.Close)
+
+	kms, err := cloudkms.NewService(context.Background(),
+		option.WithEndpoint(srv.URL+"/"),
+		option.WithoutAuthentication(),
+		option.WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kms, ks
+}
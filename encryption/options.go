@@ -0,0 +1,57 @@
+package encryption
+
+import (
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/internal/retry"
+)
+
+// RetryPolicy is KMS, Cloud Storageへの呼び出しを再試行する時のPolicy
+type RetryPolicy = retry.Policy
+
+// DefaultRetryPolicy is 指定しなかった場合に利用されるRetryPolicy
+func DefaultRetryPolicy() RetryPolicy {
+	return retry.DefaultPolicy()
+}
+
+// Option is Serviceの挙動を変更するOption
+type Option func(*options)
+
+type options struct {
+	retry RetryPolicy
+	audit *audit.Logger
+
+	preserveStorageClass bool
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		retry: DefaultRetryPolicy(),
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithRetryPolicy is KMSの呼び出しと冪等なCloud Storageの操作に利用するRetryPolicyを指定する
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *options) {
+		o.retry = p
+	}
+}
+
+// WithAuditLogger is CSEKServiceがCloud KMS Keyでwrap, unwrapした時と、CSEKでObjectを復号した時にlに記録する
+// Audit Logに記録できなかった場合は、操作自体を失敗として扱う
+func WithAuditLogger(l *audit.Logger) Option {
+	return func(o *options) {
+		o.audit = l
+	}
+}
+
+// WithPreserveStorageClass is Copy, ReEncryptでCopy元のStorage Classを引き継ぐ
+// 指定しない場合はCopy先のBucketのDefault Storage Classになる
+func WithPreserveStorageClass() Option {
+	return func(o *options) {
+		o.preserveStorageClass = true
+	}
+}
@@ -0,0 +1,139 @@
+package encryption
+
+import (
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// UploadOptions is Upload時にObjectに設定する属性
+type UploadOptions struct {
+	// ContentType is ObjectのContent-Type
+	// 空の場合はCloud Storage側で判定される
+	ContentType string
+
+	// ContentEncoding is ObjectのContent-Encoding
+	ContentEncoding string
+
+	// ContentLanguage is ObjectのContent-Language
+	ContentLanguage string
+
+	// ContentDisposition is ObjectのContent-Disposition
+	ContentDisposition string
+
+	// CacheControl is ObjectのCache-Control
+	CacheControl string
+
+	// StorageClass is ObjectのStorage Class
+	// 空の場合はBucketのDefault Storage Classになる
+	StorageClass string
+
+	// Metadata is Objectに設定するCustom Metadata
+	Metadata map[string]string
+
+	// Conditions is 指定した場合は、Upload先のObjectが条件を満たす時だけUploadする
+	// 満たさない場合はErrPreconditionFailedを返す
+	Conditions *objstore.Conditions
+}
+
+// UploadOptionsFromAttrs is 既存のObjectの属性を、別のObjectにUploadする時に引き継ぐUploadOptionsを返す
+// Metadata[wDEK], Metadata[cryptKey]はUpload時の鍵で設定し直すので引き継がない
+// StorageClassはBucketのDefaultに任せることが多いので引き継がない。引き継ぐ場合は呼び出し側で設定する
+func UploadOptionsFromAttrs(attrs *storage.ObjectAttrs) *UploadOptions {
+	o := &UploadOptions{
+		ContentType:        attrs.ContentType,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentDisposition: attrs.ContentDisposition,
+		CacheControl:       attrs.CacheControl,
+	}
+	for k, v := range attrs.Metadata {
+		if isEnvelopeKey(k) {
+			continue
+		}
+		if o.Metadata == nil {
+			o.Metadata = map[string]string{}
+		}
+		o.Metadata[k] = v
+	}
+	return o
+}
+
+// apply is UploadOptionsの内容を作成するObjectの属性に設定する
+func (o *UploadOptions) apply(w *objstore.ObjectAttrs) {
+	if o == nil {
+		return
+	}
+	if o.ContentType != "" {
+		w.ContentType = o.ContentType
+	}
+	if o.ContentEncoding != "" {
+		w.ContentEncoding = o.ContentEncoding
+	}
+	if o.ContentLanguage != "" {
+		w.ContentLanguage = o.ContentLanguage
+	}
+	if o.ContentDisposition != "" {
+		w.ContentDisposition = o.ContentDisposition
+	}
+	if o.CacheControl != "" {
+		w.CacheControl = o.CacheControl
+	}
+	if o.StorageClass != "" {
+		w.StorageClass = o.StorageClass
+	}
+	if len(o.Metadata) > 0 {
+		metadata := map[string]string{}
+		for k, v := range o.Metadata {
+			metadata[k] = v
+		}
+		w.Metadata = metadata
+	}
+}
+
+// conditions is Upload先のObjectに対するPrecondition
+func (o *UploadOptions) conditions() *objstore.Conditions {
+	if o == nil {
+		return nil
+	}
+	return o.Conditions
+}
+
+// isEnvelopeKey is CSEKServiceがwrapした鍵の管理に使うMetadataのKeyかどうか
+func isEnvelopeKey(key string) bool {
+	return key == "wDEK" || key == "cryptKey" || key == "dekSha256"
+}
+
+// withEnvelope is metadataのコピーにwDEK, cryptKey, dekSha256を追加する
+// 元のmetadataにあるCustom Metadataはそのまま残す
+func withEnvelope(metadata map[string]string, wrappedKey string, cryptKey string, dekSHA256 string) map[string]string {
+	merged := make(map[string]string, len(metadata)+3)
+	for k, v := range metadata {
+		merged[k] = v
+	}
+	merged["wDEK"] = wrappedKey
+	merged["cryptKey"] = cryptKey   // keyVersionを保持するために入れる
+	merged["dekSha256"] = dekSHA256 // 復号する前に、wDEKがこのObjectの鍵であることを確認するために入れる
+	return merged
+}
+
+// copyAttrs is Copy先に設定する属性として、Copy元の属性を引き継いだObjectAttrsを返す
+// Copy先に属性を指定すると、Cloud StorageはCopy元の属性を引き継がないので、明示的に全て指定する
+func copyAttrs(src *storage.ObjectAttrs, preserveStorageClass bool) *objstore.ObjectAttrs {
+	attrs := &objstore.ObjectAttrs{
+		ContentType:        src.ContentType,
+		ContentEncoding:    src.ContentEncoding,
+		ContentLanguage:    src.ContentLanguage,
+		ContentDisposition: src.ContentDisposition,
+		CacheControl:       src.CacheControl,
+	}
+	if preserveStorageClass {
+		attrs.StorageClass = src.StorageClass
+	}
+	if len(src.Metadata) > 0 {
+		attrs.Metadata = make(map[string]string, len(src.Metadata))
+		for k, v := range src.Metadata {
+			attrs.Metadata[k] = v
+		}
+	}
+	return attrs
+}
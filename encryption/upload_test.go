@@ -0,0 +1,109 @@
+package encryption_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+var testUploadOptions = &encryption.UploadOptions{
+	ContentType:        "text/csv",
+	ContentEncoding:    "identity",
+	ContentLanguage:    "ja",
+	ContentDisposition: `attachment; filename="report.csv"`,
+	CacheControl:       "no-store",
+	StorageClass:       "NEARLINE",
+	Metadata:           map[string]string{"owner": "sinmetal"},
+}
+
+func assertAttributes(t *testing.T, attrs *objstore.ObjectAttrs, storageClass string) {
+	t.Helper()
+	want := testUploadOptions
+	if attrs.ContentType != want.ContentType || attrs.ContentEncoding != want.ContentEncoding || attrs.ContentLanguage != want.ContentLanguage ||
+		attrs.ContentDisposition != want.ContentDisposition || attrs.CacheControl != want.CacheControl {
+		t.Errorf("want attributes of %+v but got %+v", want, attrs)
+	}
+	if attrs.Metadata["owner"] != "sinmetal" {
+		t.Errorf("want custom metadata kept but got %+v", attrs.Metadata)
+	}
+	if attrs.StorageClass != storageClass {
+		t.Errorf("want storage class %s but got %s", storageClass, attrs.StorageClass)
+	}
+}
+
+func TestCSEKService_CopyKeepsAttributes(t *testing.T) {
+	ctx := context.Background()
+	kms, _ := newLocalKMS(t)
+	for _, preserve := range []bool{false, true} {
+		var opts []encryption.Option
+		wantStorageClass := "STANDARD"
+		if preserve {
+			opts = append(opts, encryption.WithPreserveStorageClass())
+			wantStorageClass = testUploadOptions.StorageClass
+		}
+		s, err := encryption.NewCSEKService(ctx, objstore.NewMemory(), kms, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := encryption.GenerateEncryptionKey(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UploadFrom(ctx, testKeyName, "bucket", "object", key, bytes.NewReader([]byte("a,b")), testUploadOptions); err != nil {
+			t.Fatal(err)
+		}
+		_, src, err := s.Download(ctx, testKeyName, "bucket", "object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAttributes(t, src, testUploadOptions.StorageClass)
+
+		if err := s.Copy(ctx, "bucket-copy", "bucket", "object", testKeyName); err != nil {
+			t.Fatal(err)
+		}
+		_, dst, err := s.Download(ctx, testKeyName, "bucket-copy", "object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAttributes(t, dst, wantStorageClass)
+		if dst.Metadata["wDEK"] != src.Metadata["wDEK"] || dst.Metadata["cryptKey"] != src.Metadata["cryptKey"] {
+			t.Errorf("want envelope %+v but got %+v", src.Metadata, dst.Metadata)
+		}
+	}
+}
+
+func TestCMEKService_ReEncryptKeepsAttributes(t *testing.T) {
+	ctx := context.Background()
+	s, err := encryption.NewCMEKService(ctx, objstore.NewMemory(), encryption.WithPreserveStorageClass())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.UploadFrom(ctx, "bucket", "object", bytes.NewReader([]byte("a,b")), testUploadOptions); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReEncrypt(ctx, "bucket", "object"); err != nil {
+		t.Fatal(err)
+	}
+	_, attrs, err := s.Download(ctx, "bucket", "object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAttributes(t, attrs, testUploadOptions.StorageClass)
+}
+
+func TestUploadOptionsFromAttrs(t *testing.T) {
+	opts := encryption.UploadOptionsFromAttrs(&objstore.ObjectAttrs{
+		ContentType:  "image/png",
+		StorageClass: "COLDLINE",
+		Metadata:     map[string]string{"wDEK": "x", "cryptKey": "y", "owner": "sinmetal"},
+	})
+	if opts.ContentType != "image/png" || opts.StorageClass != "" {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if len(opts.Metadata) != 1 || opts.Metadata["owner"] != "sinmetal" {
+		t.Errorf("want envelope keys dropped but got %+v", opts.Metadata)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"cloud.google.com/go/storage"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+)
+
+// parseGeneration is Requestのgeneration parameterを読み込む
+// 指定されていない場合は最新のGenerationを表す0を返す
+func parseGeneration(r *http.Request) (int64, error) {
+	v := r.FormValue("generation")
+	if v == "" {
+		return 0, nil
+	}
+	generation, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || generation < 1 {
+		return 0, fmt.Errorf("generation must be a positive integer but got %q", v)
+	}
+	return generation, nil
+}
+
+// ListCSEKGenerationsHandler
+// CSEKEncryptBucket1のObjectの全てのGenerationを、暗号化の情報と共にJSONで返す
+func (handlers *Handlers) ListCSEKGenerationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationList) {
+		return
+	}
+
+	generations, err := handlers.CSEKService.ListGenerations(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	if err != nil {
+		logging.Errorf(ctx, "failed list generations: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, generations)
+}
+
+// RewrapCSEKHandler
+// ObjectのMetadata[wDEK]を、Cloud KMS Keyの現在のPrimary Versionで暗号化し直す
+func (handlers *Handlers) RewrapCSEKHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	generation, err := parseGeneration(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationReEncrypt) {
+		return
+	}
+
+	attrs, err := handlers.CSEKService.Rewrap(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object, generation)
+	if err != nil {
+		logging.Errorf(ctx, "failed rewrap: kmsKey=%s: %s", handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	writeGenerationResponse(ctx, w, attrs)
+}
+
+// RestoreCSEKHandler
+// 指定したGenerationを、CSEKEncryptBucket1の最新のGenerationとして戻す
+func (handlers *Handlers) RestoreCSEKHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CSEKEncryptBucket1(), object)
+	generation, ok := requireGeneration(ctx, w, r)
+	if !ok {
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CSEKEncryptBucket1(), object, auth.OperationRestore) {
+		return
+	}
+
+	attrs, err := handlers.CSEKService.RestoreGeneration(ctx, handlers.Config.CloudKMSKeyName, handlers.Config.CSEKEncryptBucket1(), object, generation)
+	if err != nil {
+		logging.Errorf(ctx, "failed restore generation %d: kmsKey=%s: %s", generation, handlers.Config.CloudKMSKeyName, err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	writeGenerationResponse(ctx, w, attrs)
+}
+
+// ListCMEKGenerationsHandler
+// CMEKEncryptBucketのObjectの全てのGenerationを、暗号化の情報と共にJSONで返す
+func (handlers *Handlers) ListCMEKGenerationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	if !handlers.authorize(w, r, handlers.Config.CMEKEncryptBucket(), object, auth.OperationList) {
+		return
+	}
+
+	generations, err := handlers.CMEKService.ListGenerations(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	if err != nil {
+		logging.Errorf(ctx, "failed list generations: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, generations)
+}
+
+// RestoreCMEKHandler
+// 指定したGenerationを、CMEKEncryptBucketの最新のGenerationとして戻す
+func (handlers *Handlers) RestoreCMEKHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, handlers.Config.CMEKEncryptBucket(), object)
+	generation, ok := requireGeneration(ctx, w, r)
+	if !ok {
+		return
+	}
+	if !handlers.authorize(w, r, handlers.Config.CMEKEncryptBucket(), object, auth.OperationRestore) {
+		return
+	}
+
+	attrs, err := handlers.CMEKService.RestoreGeneration(ctx, handlers.Config.CMEKEncryptBucket(), object, generation)
+	if err != nil {
+		logging.Errorf(ctx, "failed restore generation %d: %s", generation, err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	writeGenerationResponse(ctx, w, attrs)
+}
+
+// requireGeneration is generation parameterが必須のHandlerで、指定されていない場合は400を返してfalseを返す
+func requireGeneration(ctx context.Context, w http.ResponseWriter, r *http.Request) (int64, bool) {
+	generation, err := parseGeneration(r)
+	if err == nil && generation == 0 {
+		err = fmt.Errorf("generation is required")
+	}
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return 0, false
+	}
+	return generation, true
+}
+
+// generationResponse is Rewrap, Restoreの結果のObjectのGeneration
+type generationResponse struct {
+	Generation     int64 `json:"generation"`
+	Metageneration int64 `json:"metageneration"`
+}
+
+func writeGenerationResponse(ctx context.Context, w http.ResponseWriter, attrs *storage.ObjectAttrs) {
+	writeJSON(ctx, w, http.StatusOK, &generationResponse{Generation: attrs.Generation, Metageneration: attrs.Metageneration})
+}
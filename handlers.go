@@ -1,13 +1,103 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
 	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/jobs"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/notify"
+	"github.com/sinmetal/gcs_sample/objstore"
 )
 
 type Handlers struct {
 	Config      *Config
-	GCS         *storage.Client
+	Store       objstore.ObjectStore
 	CSEKService *encryption.CSEKService
 	CMEKService *encryption.CMEKService
+	Policy      *auth.Policy
+
+	// Jobs is Jobを実行するManager. JobsBucketを指定していない場合はnil
+	Jobs *jobs.Manager
+
+	// Claims is 処理したNotificationを記録する. NotificationBucketを指定していない場合はnil
+	Claims *notify.Claims
+}
+
+// authorize is RequestのPrincipalがbucket/objectに対してopを実行できるかを確認する
+// 許可されていない場合はResponseを書き込んでfalseを返すので、呼び出し側はそのままreturnする
+func (handlers *Handlers) authorize(w http.ResponseWriter, r *http.Request, bucket string, object string, op auth.Operation) bool {
+	ctx := logging.WithObject(r.Context(), bucket, object)
+	p, ok := auth.FromContext(ctx)
+	if !ok {
+		logging.Errorf(ctx, "not found principal: op=%s", op)
+		w.WriteHeader(http.StatusUnauthorized)
+		return false
+	}
+	if err := handlers.Policy.Authorize(p, bucket, object, op); err != nil {
+		logging.Warningf(ctx, "failed authorize: %s", err)
+		if errors.Is(err, auth.ErrPermissionDenied) {
+			w.WriteHeader(http.StatusForbidden)
+			return false
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// errorStatus is Serviceから返ってきたerrからResponseのStatus Codeを決める
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, encryption.ErrObjectNotFound), errors.Is(err, objstore.ErrObjectNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, encryption.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, encryption.ErrKMSPermissionDenied):
+		return http.StatusForbidden
+	case errors.Is(err, encryption.ErrInvalidCustomerKey):
+		return http.StatusBadRequest
+	case errors.Is(err, encryption.ErrMissingWrappedKey), errors.Is(err, encryption.ErrKEKMismatch), errors.Is(err, encryption.ErrDEKMismatch), errors.Is(err, encryption.ErrCustomerKeyMismatch):
+		// Objectは存在するが、指定された鍵では復号できない
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// openBaseObject is BaseBucketのObjectを読み込むReaderと、その属性を引き継ぐUploadOptionsを返す
+func (handlers *Handlers) openBaseObject(ctx context.Context, object string) (io.ReadCloser, *encryption.UploadOptions, error) {
+	return handlers.openBaseGeneration(ctx, object, 0)
+}
+
+// openBaseGeneration is BaseBucketのObjectの指定したGenerationを読み込むReaderと、その属性を引き継ぐUploadOptionsを返す
+// generationが0の場合は最新のGenerationを読み込む
+func (handlers *Handlers) openBaseGeneration(ctx context.Context, object string, generation int64) (io.ReadCloser, *encryption.UploadOptions, error) {
+	attrs, err := handlers.Store.Attrs(ctx, handlers.Config.BaseBucket, object, &objstore.ObjectOptions{Generation: generation})
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := encryption.UploadOptionsFromAttrs(attrs)
+	if handlers.Config.PreserveStorageClass {
+		opts.StorageClass = attrs.StorageClass
+	}
+	rc, err := handlers.Store.NewReader(ctx, handlers.Config.BaseBucket, object, &objstore.ObjectOptions{Generation: attrs.Generation})
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, opts, nil
+}
+
+// writeJSON is vをJSONにしてstatusで返す
+func writeJSON(ctx context.Context, w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Warningf(ctx, "failed write response: %s", err)
+	}
 }
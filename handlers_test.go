@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/jobs"
+	"github.com/sinmetal/gcs_sample/internal/kmsemu"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	"github.com/sinmetal/gcs_sample/internal/notify"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"go.opencensus.io/stats/view"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+const testKeyName = "projects/local/locations/global/keyRings/gcs/cryptoKeys/sample"
+
+type testEnv struct {
+	srv   *httptest.Server
+	cfg   *Config
+	store objstore.ObjectStore
+	jobs  *jobs.Manager
+	csek  *encryption.CSEKService
+
+	// auditFile is CSEKServiceのAudit Logを記録するFile
+	auditFile string
+}
+
+// newTestEnv is memoryのObjectStoreとkmsemuを使って、main.goと同じRouteを持つServerを起動する
+func newTestEnv(t *testing.T, policy *auth.Policy) *testEnv {
+	t.Helper()
+	ctx := context.Background()
+	logging.SetDefault(logging.New(ioutil.Discard, logging.FormatText, ""))
+
+	ks, err := kmsemu.OpenKeystore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ks.CreateKey(testKeyName); err != nil {
+		t.Fatal(err)
+	}
+	kmsServer := httptest.NewServer(kmsemu.NewServer(ks))
+	t.Cleanup(kmsServer.Close)
+	kms, err := cloudkms.NewService(ctx, option.WithEndpoint(kmsServer.URL+"/"), option.WithoutAuthentication(), option.WithHTTPClient(kmsServer.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{BaseBucket: "base", CloudKMSKeyName: testKeyName, MaxUploadSize: 32}
+	store := objstore.NewMemory()
+	auditFile := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := audit.OpenFileSink(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sink.Close() })
+	auditLog, err := audit.New(ctx, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csekService, err := encryption.NewCSEKService(ctx, store, kms, encryption.WithAuditLogger(auditLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmekService, err := encryption.NewCMEKService(ctx, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handlers := &Handlers{
+		Config:      cfg,
+		Store:       store,
+		CSEKService: csekService,
+		CMEKService: cmekService,
+		Policy:      policy,
+		Jobs:        jobs.NewManager(jobs.NewStore(store, "jobs", "jobs/"), jobs.WithPollInterval(time.Hour)),
+		Claims:      notify.NewClaims(store, "notifications", "notifications/", time.Minute),
+	}
+	for kind, w := range newJobWorkers(handlers) {
+		handlers.Jobs.Register(kind, w)
+	}
+
+	authn := auth.Middleware(auth.AnonymousAuthenticator{})
+	mux := http.NewServeMux()
+	for route, h := range map[string]http.HandlerFunc{
+		"/encryption/csek/upload":      handlers.UploadCSEKHandler,
+		"/encryption/csek/download":    handlers.DownloadCSEKHandler,
+		"/encryption/csek/copy":        handlers.CopyCSEKHandler,
+		"/encryption/cmek/upload":      handlers.UploadCMEKHandler,
+		"/encryption/cmek/download":    handlers.DownloadCMEKHandler,
+		"/encryption/cmek/re-encrypt":  handlers.ReEncryptCMEKHandler,
+		"/encryption/csek/generations": handlers.ListCSEKGenerationsHandler,
+		"/encryption/csek/rewrap":      handlers.RewrapCSEKHandler,
+		"/encryption/csek/restore":     handlers.RestoreCSEKHandler,
+		"/encryption/cmek/generations": handlers.ListCMEKGenerationsHandler,
+		"/encryption/cmek/restore":     handlers.RestoreCMEKHandler,
+		"/encryption/csek/copy-prefix": handlers.CopyPrefixCSEKHandler,
+		"/encryption/cmek/copy-prefix": handlers.CopyPrefixCMEKHandler,
+		"/encryption/csek/list":        handlers.ListCSEKHandler,
+		"/encryption/csek/delete":      handlers.DeleteCSEKHandler,
+		"/encryption/csek/diagnose":    handlers.DiagnoseCSEKHandler,
+		"/encryption/cmek/list":        handlers.ListCMEKHandler,
+		"/encryption/cmek/delete":      handlers.DeleteCMEKHandler,
+		"/jobs/submit":                 handlers.SubmitJobHandler,
+		"/jobs/status":                 handlers.JobStatusHandler,
+		"/jobs/cancel":                 handlers.CancelJobHandler,
+		"/jobs/results":                handlers.JobResultsHandler,
+		"/notifications/gcs":           handlers.ObjectFinalizeHandler,
+	} {
+		mux.Handle(route, logging.Middleware(authn(h)))
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	env := &testEnv{srv: srv, cfg: cfg, store: store, jobs: handlers.Jobs, csek: csekService, auditFile: auditFile}
+	env.put(t, cfg.BaseBucket, "hello.txt", "Hello World", nil)
+	return env
+}
+
+func (env *testEnv) put(t *testing.T, bucket string, object string, data string, key []byte) {
+	t.Helper()
+	w := env.store.NewWriter(context.Background(), bucket, object, &objstore.WriteOptions{EncryptionKey: key})
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (env *testEnv) do(t *testing.T, method string, path string, body string) (int, string) {
+	t.Helper()
+	return env.doWithHeader(t, method, path, body, nil)
+}
+
+func (env *testEnv) doWithHeader(t *testing.T, method string, path string, body string, header map[string]string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, env.srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	res, err := env.srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(b)
+}
+
+func TestHandlers(t *testing.T) {
+	env := newTestEnv(t, auth.AllowAll())
+	// wDEKを持たないObject
+	env.put(t, env.cfg.CSEKEncryptBucket1(), "nowdek.txt", "Hello World", make([]byte, 32))
+
+	// 前のstepで作成したObjectを使うので、順番に実行する
+	steps := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		wantCode int
+		wantBody string
+	}{
+		{"csek upload from base", http.MethodGet, "/encryption/csek/upload?object=hello.txt", "", http.StatusOK, ""},
+		{"csek upload missing base object", http.MethodGet, "/encryption/csek/upload?object=missing", "", http.StatusNotFound, ""},
+		{"csek upload body without object", http.MethodPost, "/encryption/csek/upload", "Hello World", http.StatusBadRequest, ""},
+		{"csek upload body too large", http.MethodPost, "/encryption/csek/upload?object=large.txt", strings.Repeat("a", 33), http.StatusRequestEntityTooLarge, ""},
+		{"csek upload body", http.MethodPost, "/encryption/csek/upload?object=direct.txt", "Direct", http.StatusOK, ""},
+		{"csek download", http.MethodGet, "/encryption/csek/download?object=hello.txt", "", http.StatusOK, "Hello World"},
+		{"csek download body", http.MethodGet, "/encryption/csek/download?object=direct.txt", "", http.StatusOK, "Direct"},
+		{"csek download missing", http.MethodGet, "/encryption/csek/download?object=missing", "", http.StatusNotFound, ""},
+		{"csek download without wDEK", http.MethodGet, "/encryption/csek/download?object=nowdek.txt", "", http.StatusUnprocessableEntity, ""},
+		{"csek copy", http.MethodGet, "/encryption/csek/copy?object=hello.txt", "", http.StatusOK, "finish."},
+		{"csek copy missing", http.MethodGet, "/encryption/csek/copy?object=missing", "", http.StatusNotFound, ""},
+		{"cmek upload from base", http.MethodGet, "/encryption/cmek/upload?object=hello.txt", "", http.StatusOK, ""},
+		{"cmek upload body", http.MethodPut, "/encryption/cmek/upload?object=direct.txt", "Direct", http.StatusOK, ""},
+		{"cmek download", http.MethodGet, "/encryption/cmek/download?object=direct.txt", "", http.StatusOK, "Direct"},
+		{"cmek download missing", http.MethodGet, "/encryption/cmek/download?object=missing", "", http.StatusNotFound, ""},
+		{"cmek re-encrypt", http.MethodGet, "/encryption/cmek/re-encrypt?object=hello.txt", "", http.StatusOK, "finish."},
+		{"cmek re-encrypt missing", http.MethodGet, "/encryption/cmek/re-encrypt?object=missing", "", http.StatusNotFound, ""},
+		{"csek download invalid generation", http.MethodGet, "/encryption/csek/download?object=hello.txt&generation=x", "", http.StatusBadRequest, ""},
+		{"csek download missing generation", http.MethodGet, "/encryption/csek/download?object=hello.txt&generation=999999", "", http.StatusNotFound, ""},
+		{"csek generations", http.MethodGet, "/encryption/csek/generations?object=hello.txt", "", http.StatusOK, ""},
+		{"csek generations missing", http.MethodGet, "/encryption/csek/generations?object=missing", "", http.StatusNotFound, ""},
+		{"csek rewrap", http.MethodPost, "/encryption/csek/rewrap?object=hello.txt", "", http.StatusOK, ""},
+		{"csek restore without generation", http.MethodPost, "/encryption/csek/restore?object=hello.txt", "", http.StatusBadRequest, ""},
+		{"cmek generations", http.MethodGet, "/encryption/cmek/generations?object=hello.txt", "", http.StatusOK, ""},
+		{"cmek restore without generation", http.MethodPost, "/encryption/cmek/restore?object=hello.txt", "", http.StatusBadRequest, ""},
+		{"csek copy-prefix without prefix", http.MethodPost, "/encryption/csek/copy-prefix", "", http.StatusBadRequest, ""},
+		{"csek copy-prefix to another bucket", http.MethodPost, "/encryption/csek/copy-prefix?prefix=direct&dstBucket=attacker", "", http.StatusBadRequest, ""},
+		{"csek move-prefix", http.MethodPost, "/encryption/csek/copy-prefix?prefix=direct&move=true", "", http.StatusOK, ""},
+		{"csek download moved", http.MethodGet, "/encryption/csek/download?object=direct.txt", "", http.StatusNotFound, ""},
+		{"cmek copy-prefix onto itself", http.MethodPost, "/encryption/cmek/copy-prefix?prefix=direct", "", http.StatusBadRequest, ""},
+		{"cmek copy-prefix", http.MethodPost, "/encryption/cmek/copy-prefix?prefix=direct&dstPrefix=archive/direct", "", http.StatusOK, ""},
+		{"cmek download copied", http.MethodGet, "/encryption/cmek/download?object=archive/direct.txt", "", http.StatusOK, "Direct"},
+		{"csek list invalid pageSize", http.MethodGet, "/encryption/csek/list?pageSize=0", "", http.StatusBadRequest, ""},
+		{"csek list", http.MethodGet, "/encryption/csek/list?prefix=nowdek", "", http.StatusOK, ""},
+		{"csek diagnose without object", http.MethodGet, "/encryption/csek/diagnose", "", http.StatusBadRequest, ""},
+		{"csek diagnose", http.MethodGet, "/encryption/csek/diagnose?object=hello.txt", "", http.StatusOK, ""},
+		{"csek diagnose missing", http.MethodGet, "/encryption/csek/diagnose?object=missing", "", http.StatusNotFound, ""},
+		{"cmek list", http.MethodGet, "/encryption/cmek/list?prefix=archive/&delimiter=/", "", http.StatusOK, ""},
+		{"csek delete without object", http.MethodPost, "/encryption/csek/delete", "", http.StatusBadRequest, ""},
+		{"csek delete generation mismatch", http.MethodPost, "/encryption/csek/delete?object=nowdek.txt&generation=999999", "", http.StatusPreconditionFailed, ""},
+		{"csek delete", http.MethodDelete, "/encryption/csek/delete?object=nowdek.txt", "", http.StatusNoContent, ""},
+		{"csek delete missing", http.MethodDelete, "/encryption/csek/delete?object=nowdek.txt", "", http.StatusNotFound, ""},
+		{"cmek delete recursive without prefix", http.MethodPost, "/encryption/cmek/delete?recursive=true", "", http.StatusBadRequest, ""},
+		{"cmek delete recursive", http.MethodPost, "/encryption/cmek/delete?recursive=true&prefix=archive/", "", http.StatusOK, ""},
+		{"cmek download deleted", http.MethodGet, "/encryption/cmek/download?object=archive/direct.txt", "", http.StatusNotFound, ""},
+	}
+	for _, step := range steps {
+		code, body := env.do(t, step.method, step.path, step.body)
+		if code != step.wantCode {
+			t.Errorf("%s: want %d but got %d", step.name, step.wantCode, code)
+		}
+		if step.wantBody != "" && body != step.wantBody {
+			t.Errorf("%s: want body %q but got %q", step.name, step.wantBody, body)
+		}
+	}
+
+	// Copy先のObjectも同じKeyで読める
+	attrs, err := env.store.Attrs(context.Background(), env.cfg.CSEKEncryptBucket2(), "hello.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Metadata["wDEK"] == "" {
+		t.Errorf("want copied object to keep wDEK but got %+v", attrs.Metadata)
+	}
+}
+
+func TestHandlers_PermissionDenied(t *testing.T) {
+	env := newTestEnv(t, &auth.Policy{})
+
+	for _, path := range []string{
+		"/encryption/csek/upload?object=hello.txt",
+		"/encryption/csek/download?object=hello.txt",
+		"/encryption/csek/copy?object=hello.txt",
+		"/encryption/cmek/upload?object=hello.txt",
+		"/encryption/cmek/download?object=hello.txt",
+		"/encryption/cmek/re-encrypt?object=hello.txt",
+		"/encryption/csek/generations?object=hello.txt",
+		"/encryption/csek/rewrap?object=hello.txt",
+		"/encryption/csek/restore?object=hello.txt&generation=1",
+		"/encryption/cmek/generations?object=hello.txt",
+		"/encryption/cmek/restore?object=hello.txt&generation=1",
+		"/encryption/csek/copy-prefix?prefix=hello",
+		"/encryption/cmek/copy-prefix?prefix=hello&dstPrefix=archive/",
+		"/encryption/csek/list?prefix=hello",
+		"/encryption/cmek/list",
+		"/encryption/csek/delete?object=hello.txt",
+		"/encryption/csek/diagnose?object=hello.txt",
+		"/encryption/cmek/delete?recursive=true&prefix=hello",
+		"/jobs/submit?kind=csek.rewrap&prefix=hello",
+	} {
+		method := http.MethodGet
+		if strings.HasPrefix(path, "/jobs/") || strings.Contains(path, "/delete") {
+			method = http.MethodPost
+		}
+		if code, _ := env.do(t, method, path, ""); code != http.StatusForbidden {
+			t.Errorf("%s: want 403 but got %d", path, code)
+		}
+	}
+}
+
+func TestHandlers_UploadRequiresBaseBucketRead(t *testing.T) {
+	// 暗号化するBucketへの書き込みだけを許可して、BaseBucketの読み込みは許可しない
+	env := newTestEnv(t, &auth.Policy{Rules: []auth.Rule{
+		{Principals: []string{"*"}, Bucket: "*", Operations: []auth.Operation{auth.OperationUpload}},
+	}})
+
+	for _, path := range []string{
+		"/encryption/csek/upload?object=hello.txt",
+		"/encryption/cmek/upload?object=hello.txt",
+	} {
+		if code, _ := env.do(t, http.MethodGet, path, ""); code != http.StatusForbidden {
+			t.Errorf("%s: want 403 but got %d", path, code)
+		}
+	}
+	// Request BodyをUploadする場合はBaseBucketを読まないので許可する
+	if code, body := env.do(t, http.MethodPut, "/encryption/cmek/upload?object=direct.txt", "Direct"); code != http.StatusOK {
+		t.Errorf("want 200 but got %d: %s", code, body)
+	}
+}
+
+func TestHandlers_UploadMethods(t *testing.T) {
+	env := newTestEnv(t, auth.AllowAll())
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	fw, err := mw.CreateFormFile("file", "multipart.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("Multipart")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	form := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	raw := map[string]string{"Content-Type": "application/octet-stream"}
+	cases := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		header   map[string]string
+		download string
+		want     string
+	}{
+		{"csek get", http.MethodGet, "/encryption/csek/upload?object=hello.txt", "", nil, "/encryption/csek/download?object=hello.txt", "Hello World"},
+		{"csek form post", http.MethodPost, "/encryption/csek/upload", "object=hello.txt", form, "/encryption/csek/download?object=hello.txt", "Hello World"},
+		{"cmek form post", http.MethodPost, "/encryption/cmek/upload", "object=hello.txt", form, "/encryption/cmek/download?object=hello.txt", "Hello World"},
+		{"csek raw post", http.MethodPost, "/encryption/csek/upload?object=raw.txt", "Raw", raw, "/encryption/csek/download?object=raw.txt", "Raw"},
+		{"csek post without content type", http.MethodPost, "/encryption/csek/upload?object=plain.txt", "Plain", nil, "/encryption/csek/download?object=plain.txt", "Plain"},
+		{"csek multipart post", http.MethodPost, "/encryption/csek/upload", multipartBody.String(), map[string]string{"Content-Type": mw.FormDataContentType()}, "/encryption/csek/download?object=multipart.txt", "Multipart"},
+		{"cmek put with form content type", http.MethodPut, "/encryption/cmek/upload?object=put.txt", "object=hello.txt", form, "/encryption/cmek/download?object=put.txt", "object=hello.txt"},
+		{"csek put with form content type", http.MethodPut, "/encryption/csek/upload?object=put.txt&keyMode=wrap", "object=hello.txt", form, "/encryption/csek/download?object=put.txt", "object=hello.txt"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := env.doWithHeader(t, tt.method, tt.path, tt.body, tt.header)
+			if code != http.StatusOK {
+				t.Fatalf("want 200 but got %d: %s", code, body)
+			}
+			if wantSize := fmt.Sprintf("size=%d", len(tt.want)); !strings.Contains(body, wantSize) {
+				t.Errorf("want %s but got %q", wantSize, body)
+			}
+			if code, body := env.do(t, http.MethodGet, tt.download, ""); code != http.StatusOK || body != tt.want {
+				t.Errorf("want %q but got %d: %q", tt.want, code, body)
+			}
+		})
+	}
+
+	// form Content-TypeのPUTでも、Request Bodyを読み進めずにそのままUploadする
+	attrs, err := env.store.Attrs(context.Background(), env.cfg.CSEKEncryptBucket1(), "put.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != int64(len("object=hello.txt")) {
+		t.Errorf("want size %d but got %d", len("object=hello.txt"), attrs.Size)
+	}
+}
+
+func TestHandlers_DownloadMetrics(t *testing.T) {
+	if err := view.Register(metrics.BytesDownloadedView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(metrics.BytesDownloadedView)
+
+	env := newTestEnv(t, auth.AllowAll())
+	for _, path := range []string{
+		"/encryption/csek/upload?object=hello.txt",
+		"/encryption/cmek/upload?object=hello.txt",
+	} {
+		if code, body := env.do(t, http.MethodGet, path, ""); code != http.StatusOK {
+			t.Fatalf("failed upload %s: %d %s", path, code, body)
+		}
+	}
+	for _, path := range []string{
+		"/encryption/csek/download?object=hello.txt",
+		"/encryption/cmek/download?object=hello.txt",
+	} {
+		if code, body := env.do(t, http.MethodGet, path, ""); code != http.StatusOK || body != "Hello World" {
+			t.Fatalf("failed download %s: %d %s", path, code, body)
+		}
+	}
+
+	// Responseを返した後にCloseして記録するので、記録されるまで待つ
+	downloaded := func() map[string]float64 {
+		rows, err := view.RetrieveData(metrics.BytesDownloadedView.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := map[string]float64{}
+		for _, row := range rows {
+			for _, tag := range row.Tags {
+				if tag.Key == metrics.KeyBucket {
+					got[tag.Value] += row.Data.(*view.SumData).Value
+				}
+			}
+		}
+		return got
+	}
+	want := map[string]float64{
+		env.cfg.CSEKEncryptBucket1(): float64(len("Hello World")),
+		env.cfg.CMEKEncryptBucket():  float64(len("Hello World")),
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	got := downloaded()
+	for !reflect.DeepEqual(got, want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		got = downloaded()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want downloaded bytes %v but got %v", want, got)
+	}
+}
+
+func TestJobsHandlers(t *testing.T) {
+	env := newTestEnv(t, auth.AllowAll())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		env.jobs.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, object := range []string{"batch/a.txt", "batch/b.txt"} {
+		if code, body := env.do(t, http.MethodPost, "/encryption/csek/upload?object="+object, object); code != http.StatusOK {
+			t.Fatalf("failed upload %s: %d %s", object, code, body)
+		}
+	}
+	// wDEKを持たないObjectは失敗として結果に残る
+	env.put(t, env.cfg.CSEKEncryptBucket1(), "batch/nowdek.txt", "Hello World", make([]byte, 32))
+
+	runJob := func(kind string) *jobs.Job {
+		t.Helper()
+		code, body := env.do(t, http.MethodPost, "/jobs/submit?kind="+kind+"&prefix=batch/", "")
+		if code != http.StatusAccepted {
+			t.Fatalf("want 202 but got %d %s", code, body)
+		}
+		var job jobs.Job
+		if err := json.Unmarshal([]byte(body), &job); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !job.State.Done() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			_, body = env.do(t, http.MethodGet, "/jobs/status?id="+job.ID, "")
+			if err := json.Unmarshal([]byte(body), &job); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return &job
+	}
+	results := func(job *jobs.Job) map[string]*jobs.Result {
+		t.Helper()
+		code, body := env.do(t, http.MethodGet, "/jobs/results?id="+job.ID, "")
+		var res struct {
+			Job     *jobs.Job      `json:"job"`
+			Results []*jobs.Result `json:"results"`
+		}
+		if err := json.Unmarshal([]byte(body), &res); code != http.StatusOK || err != nil {
+			t.Fatalf("unexpected results %d %s: %v", code, body, err)
+		}
+		m := map[string]*jobs.Result{}
+		for _, r := range res.Results {
+			m[r.Item] = r
+		}
+		return m
+	}
+
+	job := runJob("csek.copy")
+	if job.State != jobs.StateSucceeded || job.Processed != 3 || job.Failed != 1 {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if r := results(job)["batch/nowdek.txt"]; r == nil || !r.Failed() {
+		t.Errorf("want batch/nowdek.txt failed but got %+v", r)
+	}
+	if _, err := env.store.Attrs(context.Background(), env.cfg.CSEKEncryptBucket2(), "batch/a.txt", nil); err != nil {
+		t.Errorf("want copied object but got %v", err)
+	}
+	// Jobでの鍵の利用は、Jobを投入したPrincipalの操作として記録する
+	records, err := audit.ReadFile(env.auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied int
+	for _, r := range records {
+		if r.Principal != "anonymous" {
+			t.Errorf("want principal anonymous but got %+v", r)
+		}
+		// Jobでの利用はRequestに紐付かない
+		if r.Operation == audit.OperationUnwrap && r.RequestID == "" {
+			copied++
+		}
+	}
+	if copied != 2 {
+		t.Errorf("want 2 unwraps for the copied objects but got %d in %+v", copied, records)
+	}
+
+	inventory := runJob("csek.inventory")
+	if inventory.State != jobs.StateSucceeded || inventory.Processed != 3 || inventory.Failed != 0 {
+		t.Fatalf("unexpected job %+v", inventory)
+	}
+	got := results(inventory)
+	if r := got["batch/a.txt"]; r == nil || r.Details["mode"] != "csek" || r.Details["wrappedKey"] != "true" || r.Details["keyVersion"] == "" {
+		t.Errorf("unexpected inventory of batch/a.txt %+v", r)
+	}
+	if r := got["batch/nowdek.txt"]; r == nil || r.Details["wrappedKey"] != "false" || r.Details["customerKeySha256"] == "" {
+		t.Errorf("unexpected inventory of batch/nowdek.txt %+v", r)
+	}
+
+	for _, step := range []struct {
+		name     string
+		method   string
+		path     string
+		wantCode int
+	}{
+		{"cancel finished job", http.MethodPost, "/jobs/cancel?id=" + job.ID, http.StatusConflict},
+		{"missing job", http.MethodGet, "/jobs/status?id=missing", http.StatusNotFound},
+		{"unknown kind", http.MethodPost, "/jobs/submit?kind=unknown&prefix=batch/", http.StatusBadRequest},
+		{"submit without prefix", http.MethodPost, "/jobs/submit?kind=csek.copy", http.StatusBadRequest},
+	} {
+		if code, body := env.do(t, step.method, step.path, ""); code != step.wantCode {
+			t.Errorf("%s: want %d but got %d %s", step.name, step.wantCode, code, body)
+		}
+	}
+}
+
+func TestObjectFinalizeHandler(t *testing.T) {
+	env := newTestEnv(t, auth.AllowAll())
+	env.cfg.NotificationDeleteSource = true
+	ctx := context.Background()
+	attrs, err := env.store.Attrs(ctx, env.cfg.BaseBucket, "hello.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cloudEvent := func(bucket string, generation int64) string {
+		return fmt.Sprintf(`{"id":"1","type":"%s","data":{"bucket":"%s","name":"hello.txt","generation":"%d"}}`, notify.EventTypeFinalized, bucket, generation)
+	}
+	post := func(body string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, env.srv.URL+"/notifications/gcs", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/cloudevents+json")
+		res, err := env.srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, string(b)
+	}
+
+	if code, body := post(cloudEvent("other", attrs.Generation)); code != http.StatusNoContent {
+		t.Errorf("want other bucket ignored but got %d %s", code, body)
+	}
+	if code, body := post(cloudEvent(env.cfg.BaseBucket, attrs.Generation)); code != http.StatusOK || !strings.Contains(body, `"sourceDeleted":"true"`) {
+		t.Fatalf("unexpected response %d %s", code, body)
+	}
+	if code, body := env.do(t, http.MethodGet, "/encryption/csek/download?object=hello.txt", ""); code != http.StatusOK || body != "Hello World" {
+		t.Errorf("want encrypted object but got %d %q", code, body)
+	}
+	if _, err := env.store.Attrs(ctx, env.cfg.BaseBucket, "hello.txt", nil); !errors.Is(err, objstore.ErrObjectNotExist) {
+		t.Errorf("want source deleted but got %v", err)
+	}
+
+	// 再送されたNotificationは処理しない
+	before, err := env.store.Attrs(ctx, env.cfg.CSEKEncryptBucket1(), "hello.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, body := post(cloudEvent(env.cfg.BaseBucket, attrs.Generation)); code != http.StatusOK || !strings.Contains(body, `"status":"encrypted"`) {
+		t.Errorf("unexpected response for duplicate %d %s", code, body)
+	}
+	after, err := env.store.Attrs(ctx, env.cfg.CSEKEncryptBucket1(), "hello.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Generation != after.Generation {
+		t.Errorf("want duplicate skipped but the object was uploaded again")
+	}
+
+	// Pub/SubでNotificationが届く前に削除されたGeneration
+	push := fmt.Sprintf(`{"message":{"messageId":"2","attributes":{"eventType":"OBJECT_FINALIZE","bucketId":"%s","objectId":"gone.txt","objectGeneration":"1"}}}`, env.cfg.BaseBucket)
+	if code, body := env.do(t, http.MethodPost, "/notifications/gcs", push); code != http.StatusOK || !strings.Contains(body, `"status":"skipped"`) {
+		t.Errorf("unexpected response %d %s", code, body)
+	}
+	if code, _ := env.do(t, http.MethodPost, "/notifications/gcs", "{}"); code != http.StatusBadRequest {
+		t.Errorf("want 400 for invalid notification but got %d", code)
+	}
+
+	// 順番が前後して届いた古いGenerationで、新しいGenerationを上書きしない
+	env.cfg.NotificationDeleteSource = false
+	var generations []int64
+	for _, data := range []string{"v1", "v2"} {
+		env.put(t, env.cfg.BaseBucket, "hello.txt", data, nil)
+		attrs, err := env.store.Attrs(ctx, env.cfg.BaseBucket, "hello.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		generations = append(generations, attrs.Generation)
+	}
+	if code, body := post(cloudEvent(env.cfg.BaseBucket, generations[1])); code != http.StatusOK || !strings.Contains(body, `"status":"encrypted"`) {
+		t.Fatalf("unexpected response %d %s", code, body)
+	}
+	if code, body := post(cloudEvent(env.cfg.BaseBucket, generations[0])); code != http.StatusOK || !strings.Contains(body, `"status":"superseded"`) {
+		t.Errorf("unexpected response for an older generation %d %s", code, body)
+	}
+	if code, body := env.do(t, http.MethodGet, "/encryption/csek/download?object=hello.txt", ""); code != http.StatusOK || body != "v2" {
+		t.Errorf("want the newer generation kept but got %d %q", code, body)
+	}
+}
+
+func TestCSEKHandlers_CustomerKey(t *testing.T) {
+	env := newTestEnv(t, auth.AllowAll())
+	key := []byte(strings.Repeat("k", 32))
+	sum := sha256.Sum256(key)
+	keyHeaders := map[string]string{
+		"X-Goog-Encryption-Algorithm":  "AES256",
+		"X-Goog-Encryption-Key":        base64.StdEncoding.EncodeToString(key),
+		"X-Goog-Encryption-Key-Sha256": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+	wrongSum := map[string]string{
+		"X-Goog-Encryption-Key":        keyHeaders["X-Goog-Encryption-Key"],
+		"X-Goog-Encryption-Key-Sha256": base64.StdEncoding.EncodeToString(make([]byte, 32)),
+	}
+	formKeyHeaders := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	for k, v := range keyHeaders {
+		formKeyHeaders[k] = v
+	}
+	otherSum := sha256.Sum256(make([]byte, 32))
+	otherKey := map[string]string{
+		"X-Goog-Encryption-Key":        base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"X-Goog-Encryption-Key-Sha256": base64.StdEncoding.EncodeToString(otherSum[:]),
+	}
+	steps := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		header   map[string]string
+		wantCode int
+		wantBody string
+	}{
+		{"passthrough without key", http.MethodPost, "/encryption/csek/upload?object=p.txt&keyMode=passthrough", "Pass", nil, http.StatusBadRequest, ""},
+		{"sha256 mismatch", http.MethodPost, "/encryption/csek/upload?object=p.txt", "Pass", wrongSum, http.StatusBadRequest, ""},
+		{"unknown key mode", http.MethodPost, "/encryption/csek/upload?object=p.txt&keyMode=plain", "Pass", keyHeaders, http.StatusBadRequest, ""},
+		{"passthrough upload", http.MethodPost, "/encryption/csek/upload?object=p.txt&keyMode=passthrough", "Pass", keyHeaders, http.StatusOK, ""},
+		{"passthrough download without key", http.MethodGet, "/encryption/csek/download?object=p.txt", "", nil, http.StatusUnprocessableEntity, ""},
+		{"passthrough download other key", http.MethodGet, "/encryption/csek/download?object=p.txt", "", otherKey, http.StatusUnprocessableEntity, ""},
+		{"passthrough download", http.MethodGet, "/encryption/csek/download?object=p.txt", "", keyHeaders, http.StatusOK, "Pass"},
+		{"wrap upload from base", http.MethodGet, "/encryption/csek/upload?object=hello.txt&keyMode=wrap", "", keyHeaders, http.StatusOK, ""},
+		{"wrap download without key", http.MethodGet, "/encryption/csek/download?object=hello.txt", "", nil, http.StatusOK, "Hello World"},
+		{"wrap download with key", http.MethodGet, "/encryption/csek/download?object=hello.txt", "", keyHeaders, http.StatusOK, "Hello World"},
+		// form POSTではkeyModeもRequest Bodyで送られてくる
+		{"passthrough form post", http.MethodPost, "/encryption/csek/upload", "object=hello.txt&keyMode=passthrough", formKeyHeaders, http.StatusOK, ""},
+		{"passthrough form post download without key", http.MethodGet, "/encryption/csek/download?object=hello.txt", "", nil, http.StatusUnprocessableEntity, ""},
+		{"passthrough form post download", http.MethodGet, "/encryption/csek/download?object=hello.txt", "", keyHeaders, http.StatusOK, "Hello World"},
+	}
+	for _, step := range steps {
+		code, body := env.doWithHeader(t, step.method, step.path, step.body, step.header)
+		if code != step.wantCode {
+			t.Errorf("%s: want %d but got %d", step.name, step.wantCode, code)
+		}
+		if step.wantBody != "" && body != step.wantBody {
+			t.Errorf("%s: want body %q but got %q", step.name, step.wantBody, body)
+		}
+	}
+}
+
+// blockingStore is releaseがcloseされるまでListを止めて、呼び出された回数を数える
+type blockingStore struct {
+	objstore.ObjectStore
+	release chan struct{}
+
+	mu    sync.Mutex
+	lists int
+}
+
+func (s *blockingStore) List(ctx context.Context, bucket string, q *objstore.Query, pageSize int, pageToken string) (*objstore.ListPage, error) {
+	s.mu.Lock()
+	s.lists++
+	s.mu.Unlock()
+	<-s.release
+	return s.ObjectStore.List(ctx, bucket, q, pageSize, pageToken)
+}
+
+func TestHealthChecker_Check(t *testing.T) {
+	env := newTestEnv(t, auth.AllowAll())
+	store := &blockingStore{ObjectStore: env.store, release: make(chan struct{})}
+	h := &HealthChecker{
+		Store:       store,
+		CSEKService: env.csek,
+		Buckets:     []string{env.cfg.BaseBucket},
+		KeyName:     testKeyName,
+		TTL:         time.Minute,
+		Timeout:     5 * time.Second,
+		Readiness:   &readiness{},
+	}
+
+	// probeを待たずに切断したRequestは失敗するが、その失敗はキャッシュしない
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if checks, _ := h.check(ctx); len(checks) != 1 || checks[0].OK {
+		t.Errorf("want the canceled request failed but got %+v", checks)
+	}
+	close(store.release)
+	for i := 0; i < 2; i++ {
+		checks, _ := h.check(context.Background())
+		if len(checks) != 2 || !checks[0].OK || !checks[1].OK {
+			t.Fatalf("want all checks ok but got %+v", checks)
+		}
+	}
+	// 切断されたRequestのprobeを続けた結果をキャッシュしている
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lists != 1 {
+		t.Errorf("want the bucket probed once but got %d", store.lists)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// kmsProbeValue is KMSで暗号化, 復号化できることを確認するための値
+const kmsProbeValue = "gcs_sample readiness probe"
+
+// checkResult is 1つの依存先に対するCheck結果
+type checkResult struct {
+	Name      string `json:"name"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latencyMs"`
+
+	// canceled is Checkが依存先の問題ではなくcancelで失敗したか. キャッシュしない
+	canceled bool
+}
+
+// healthResponse is /healthz, /readyzのResponse
+type healthResponse struct {
+	Status    string        `json:"status"`
+	CheckedAt *time.Time    `json:"checkedAt,omitempty"`
+	Checks    []checkResult `json:"checks,omitempty"`
+}
+
+// HealthChecker is 設定されたBucketとCloud KMS Keyが利用できるかを確認する
+// 結果はTTLの間キャッシュするので、readiness probeが頻繁に来てもCloud Storage, Cloud KMSへのRequestは増えない
+// 確認はRequestから切り離したTimeoutまでのContextで1つずつ行い、同時に来たRequestはその結果を待つ
+type HealthChecker struct {
+	Store       objstore.ObjectStore
+	CSEKService *encryption.CSEKService
+	Buckets     []string
+	KeyName     string
+	TTL         time.Duration
+	Timeout     time.Duration
+	Readiness   *readiness
+
+	mu        sync.Mutex
+	checks    []checkResult
+	checkedAt time.Time
+	flight    *healthFlight
+}
+
+// healthFlight is 実行中の確認. doneをcloseした後にchecks, checkedAtを読む
+type healthFlight struct {
+	done      chan struct{}
+	checks    []checkResult
+	checkedAt time.Time
+}
+
+// LiveHandler is liveness probe
+// Processが生きていれば常に200を返す
+func (h *HealthChecker) LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthResponse(r.Context(), w, http.StatusOK, &healthResponse{Status: "ok"})
+}
+
+// ReadyHandler is readiness probe
+// Shutdown中、もしくはいずれかの依存先が利用できない場合は503を返す
+func (h *HealthChecker) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.Readiness.ShuttingDown() {
+		writeHealthResponse(r.Context(), w, http.StatusServiceUnavailable, &healthResponse{Status: "shutting down"})
+		return
+	}
+
+	checks, checkedAt := h.check(r.Context())
+	res := &healthResponse{
+		Status:    "ok",
+		CheckedAt: &checkedAt,
+		Checks:    checks,
+	}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			res.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeHealthResponse(r.Context(), w, status, res)
+}
+
+// check is キャッシュが有効であればキャッシュを、そうでなければ全ての依存先をCheckした結果を返す
+// 確認が終わる前にctxが終わった場合は、確認を続けたまま失敗した結果を返す
+func (h *HealthChecker) check(ctx context.Context) ([]checkResult, time.Time) {
+	h.mu.Lock()
+	if h.checks != nil && time.Since(h.checkedAt) < h.TTL {
+		defer h.mu.Unlock()
+		return h.checks, h.checkedAt
+	}
+	f := h.flight
+	if f == nil {
+		f = &healthFlight{done: make(chan struct{})}
+		h.flight = f
+		go h.refresh(f)
+	}
+	h.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.checks, f.checkedAt
+	case <-ctx.Done():
+		return []checkResult{{Name: "readiness", Error: ctx.Err().Error(), canceled: true}}, time.Now()
+	}
+}
+
+// refresh is 全ての依存先をCheckしてfに結果を設定し、cancelされていなければキャッシュする
+// probeを送ったRequestが切断されても確認を続けるように、Requestとは別のContextを使う
+func (h *HealthChecker) refresh(f *healthFlight) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	checks := make([]checkResult, len(h.Buckets)+1)
+	var wg sync.WaitGroup
+	for i, bucket := range h.Buckets {
+		i, bucket := i, bucket
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i] = runCheck(fmt.Sprintf("gcs:%s", bucket), func() error {
+				return h.checkBucket(ctx, bucket)
+			})
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		checks[len(h.Buckets)] = runCheck(fmt.Sprintf("kms:%s", h.KeyName), func() error {
+			return h.checkKMS(ctx)
+		})
+	}()
+	wg.Wait()
+	f.checks = checks
+	f.checkedAt = time.Now()
+
+	h.mu.Lock()
+	h.flight = nil
+	if cacheable(checks) {
+		h.checks = checks
+		h.checkedAt = f.checkedAt
+	}
+	h.mu.Unlock()
+	close(f.done)
+}
+
+// cacheable is cancelで失敗したCheckが無いか
+func cacheable(checks []checkResult) bool {
+	for _, c := range checks {
+		if c.canceled {
+			return false
+		}
+	}
+	return true
+}
+
+// checkBucket is BucketのObjectをListできることを確認する
+// buckets.getの権限を持っていなくても確認できるように、Bucket.Attrsではなく、Object Listを使っている
+func (h *HealthChecker) checkBucket(ctx context.Context, bucket string) error {
+	_, err := h.Store.List(ctx, bucket, nil, 1, "")
+	return err
+}
+
+// checkKMS is Cloud KMS Keyでprobe valueを暗号化, 復号化できることを確認する
+// cryptoKeys.getの権限を持っていなくても、実際に鍵を使えることを確認できるように、暗号化, 復号化を行う
+// 利用者の操作ではないので、Principalが空のAudit Logとして記録される
+func (h *HealthChecker) checkKMS(ctx context.Context) error {
+	probe := base64.StdEncoding.EncodeToString([]byte(kmsProbeValue))
+	ciphertext, _, err := h.CSEKService.Encrypt(ctx, h.KeyName, probe)
+	if err != nil {
+		return err
+	}
+	plaintext, err := h.CSEKService.Decrypt(ctx, h.KeyName, ciphertext)
+	if err != nil {
+		return err
+	}
+	if plaintext != probe {
+		return fmt.Errorf("decrypted probe value does not match")
+	}
+	return nil
+}
+
+func runCheck(name string, fn func() error) checkResult {
+	start := time.Now()
+	err := fn()
+	res := checkResult{
+		Name:      name,
+		OK:        err == nil,
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		res.Error = err.Error()
+		res.canceled = errors.Is(err, context.Canceled)
+	}
+	return res
+}
+
+func writeHealthResponse(ctx context.Context, w http.ResponseWriter, status int, res *healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logging.Warningf(ctx, "failed write response: %s", err)
+	}
+}
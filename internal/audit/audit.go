@@ -0,0 +1,170 @@
+// Package audit records every use of an encryption key in a tamper-evident,
+// hash-chained log.
+//
+// Each Record carries the SHA-256 hash of the previous record of the same chain,
+// so removing, reordering or rewriting a record breaks the chain and is detected by Verify.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+)
+
+// Operation is the kind of key use recorded.
+type Operation string
+
+const (
+	// OperationWrap is the encryption of a DEK with a Cloud KMS key.
+	OperationWrap Operation = "kms.wrap"
+
+	// OperationUnwrap is the decryption of a wrapped DEK with a Cloud KMS key.
+	OperationUnwrap Operation = "kms.unwrap"
+
+	// OperationDecrypt is a read of an object with its customer-supplied encryption key.
+	OperationDecrypt Operation = "gcs.decrypt"
+
+	// OperationEncrypt is a write of an object with a customer-supplied encryption key
+	// which is not wrapped with a Cloud KMS key.
+	OperationEncrypt Operation = "gcs.encrypt"
+)
+
+// Outcome is the result of the recorded operation.
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+)
+
+// Record is a single entry of the audit log.
+type Record struct {
+	// Chain identifies the hash chain the record belongs to.
+	Chain string `json:"chain"`
+
+	// Seq is the position of the record in the chain, starting at 1.
+	Seq uint64 `json:"seq"`
+
+	Time time.Time `json:"time"`
+
+	// Principal is the authenticated caller which triggered the operation.
+	// It is empty when the service used the key on its own, e.g. for /readyz.
+	Principal string `json:"principal"`
+
+	RequestID  string    `json:"requestId,omitempty"`
+	Operation  Operation `json:"operation"`
+	Bucket     string    `json:"bucket,omitempty"`
+	Object     string    `json:"object,omitempty"`
+	Generation int64     `json:"generation,omitempty"`
+
+	// KeyName is the Cloud KMS key used as KEK.
+	KeyName string `json:"keyName,omitempty"`
+
+	// KeyVersion is the Cloud KMS key version used as KEK, when known.
+	KeyVersion string `json:"keyVersion,omitempty"`
+
+	Outcome Outcome `json:"outcome"`
+	Error   string  `json:"error,omitempty"`
+
+	// PrevHash is the Hash of the previous record of the chain, empty for the first record.
+	PrevHash string `json:"prevHash"`
+
+	// Hash is the hex encoded SHA-256 of the record with Hash itself left empty.
+	Hash string `json:"hash"`
+}
+
+// ComputeHash returns the hash of r, ignoring r.Hash.
+func (r Record) ComputeHash() (string, error) {
+	r.Hash = ""
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", fmt.Errorf("failed json.Marshal audit record: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Sink stores audit records.
+type Sink interface {
+	// Write appends r to the sink.
+	Write(ctx context.Context, r *Record) error
+
+	// Last returns the last record of the chain the sink continues, or nil to start a new chain.
+	Last(ctx context.Context) (*Record, error)
+}
+
+// Logger appends records to a Sink, chaining each record to the previous one.
+// A nil *Logger discards every record.
+type Logger struct {
+	mu    sync.Mutex
+	sink  Sink
+	chain string
+	seq   uint64
+	prev  string
+	now   func() time.Time
+}
+
+// New returns a Logger appending to sink.
+// When sink already holds records, the chain is continued from the last one.
+func New(ctx context.Context, sink Sink) (*Logger, error) {
+	l := &Logger{
+		sink: sink,
+		now:  time.Now,
+	}
+	last, err := sink.Last(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed read last audit record: %w", err)
+	}
+	if last == nil {
+		l.chain = uuid.New().String()
+		return l, nil
+	}
+	l.chain = last.Chain
+	l.seq = last.Seq
+	l.prev = last.Hash
+	return l, nil
+}
+
+// Append records r. Chain, Seq, Time, PrevHash and Hash are set by Append.
+// Principal and RequestID are taken from ctx unless already set.
+// Records are written one at a time, so that the order in the sink matches the chain.
+func (l *Logger) Append(ctx context.Context, r Record) error {
+	if l == nil {
+		return nil
+	}
+	if r.Principal == "" {
+		if p, ok := auth.FromContext(ctx); ok {
+			r.Principal = p.ID
+		}
+	}
+	if r.RequestID == "" {
+		r.RequestID = logging.RequestID(ctx)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.Chain = l.chain
+	r.Seq = l.seq + 1
+	r.Time = l.now().UTC()
+	r.PrevHash = l.prev
+	hash, err := r.ComputeHash()
+	if err != nil {
+		return err
+	}
+	r.Hash = hash
+	if err := l.sink.Write(ctx, &r); err != nil {
+		return fmt.Errorf("failed write audit record: %w", err)
+	}
+	l.seq = r.Seq
+	l.prev = r.Hash
+	return nil
+}
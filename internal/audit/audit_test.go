@@ -0,0 +1,152 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func appendRecords(t *testing.T, l *Logger, n int) {
+	t.Helper()
+	ctx := auth.NewContext(context.Background(), &auth.Principal{ID: "alice@example.com", Method: "apikey"})
+	for i := 0; i < n; i++ {
+		err := l.Append(ctx, Record{
+			Operation: OperationUnwrap,
+			Bucket:    "bucket",
+			Object:    "object",
+			KeyName:   "projects/p/locations/l/keyRings/r/cryptoKeys/k",
+			Outcome:   OutcomeSuccess,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	var buf bytes.Buffer
+	l, err := New(ctx, NewWriterSink(&buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendRecords(t, l, 5)
+
+	records, err := ReadRecords(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Fatalf("want 5 records but got %d", len(records))
+	}
+	if records[0].Principal != "alice@example.com" {
+		t.Errorf("want principal alice@example.com but got %q", records[0].Principal)
+	}
+	if problems := Verify(records); len(problems) != 0 {
+		t.Fatalf("want no problems but got %v", problems)
+	}
+
+	cases := []struct {
+		name   string
+		tamper func([]Record) []Record
+		reason string
+	}{
+		{"modified", func(rs []Record) []Record {
+			rs[2].Principal = "mallory@example.com"
+			return rs
+		}, "hash does not match"},
+		{"removed from the middle", func(rs []Record) []Record {
+			return append(rs[:2], rs[3:]...)
+		}, "records 3..3 are missing"},
+		{"removed from the head", func(rs []Record) []Record {
+			return rs[1:]
+		}, "records 1..1 are missing"},
+		{"relinked", func(rs []Record) []Record {
+			rs[3].PrevHash = rs[1].Hash
+			h, _ := rs[3].ComputeHash()
+			rs[3].Hash = h
+			return rs
+		}, "prevHash does not match"},
+		{"duplicated", func(rs []Record) []Record {
+			return append(rs, rs[4])
+		}, "duplicate record"},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := tt.tamper(append([]Record(nil), records...))
+			problems := Verify(rs)
+			if len(problems) == 0 {
+				t.Fatal("want problems but got none")
+			}
+			if !strings.Contains(problems[0].Reason, tt.reason) {
+				t.Errorf("want reason %q but got %v", tt.reason, problems)
+			}
+		})
+	}
+}
+
+func TestFileSink_Resume(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for i := 0; i < 2; i++ {
+		sink, err := OpenFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := New(ctx, sink)
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendRecords(t, l, 3)
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("want 6 records but got %d", len(records))
+	}
+	if records[5].Seq != 6 || records[5].Chain != records[0].Chain {
+		t.Errorf("want the chain to be resumed but got chain=%s seq=%d", records[5].Chain, records[5].Seq)
+	}
+	if problems := Verify(records); len(problems) != 0 {
+		t.Fatalf("want no problems but got %v", problems)
+	}
+}
+
+func TestGCSSink(t *testing.T) {
+	ctx := context.Background()
+	store := objstore.NewMemory()
+
+	for i := 0; i < 2; i++ {
+		l, err := New(ctx, NewGCSSink(store, "audit-bucket", "audit/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		appendRecords(t, l, 3)
+	}
+
+	records, err := ReadGCS(ctx, store, "audit-bucket", "audit/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 6 {
+		t.Fatalf("want 6 records but got %d", len(records))
+	}
+	if records[0].Chain == records[5].Chain {
+		t.Errorf("want every logger to start its own chain but got %s", records[0].Chain)
+	}
+	if problems := Verify(records); len(problems) != 0 {
+		t.Fatalf("want no problems but got %v", problems)
+	}
+}
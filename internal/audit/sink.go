@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// WriterSink writes records as JSON lines to an io.Writer such as os.Stdout.
+// It always starts a new chain.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriterSink returns a WriterSink writing to w.
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write implements Sink.
+func (s *WriterSink) Write(ctx context.Context, r *Record) error {
+	b, err := marshalLine(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(b)
+	return err
+}
+
+// Last implements Sink.
+func (s *WriterSink) Last(ctx context.Context) (*Record, error) {
+	return nil, nil
+}
+
+// FileSink appends records as JSON lines to a local file.
+// The chain is continued across restarts from the last record in the file.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenFileSink opens or creates the file at path.
+func OpenFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed open audit file %s: %w", path, err)
+	}
+	return &FileSink{path: path, f: f}, nil
+}
+
+// Write implements Sink. Every record is synced to disk before Write returns.
+func (s *FileSink) Write(ctx context.Context, r *Record) error {
+	b, err := marshalLine(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(b); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Last implements Sink.
+func (s *FileSink) Last(ctx context.Context) (*Record, error) {
+	records, err := ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) < 1 {
+		return nil, nil
+	}
+	return &records[len(records)-1], nil
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	return s.f.Close()
+}
+
+// GCSSink writes every record as its own Cloud Storage object named
+// {prefix}{chain}/{seq}.json. Objects are created only if they do not exist yet,
+// so an existing record can not be overwritten through the sink.
+// Every Logger writing to a GCSSink starts its own chain, so that instances running
+// side by side never share a chain.
+type GCSSink struct {
+	store  objstore.ObjectStore
+	bucket string
+	prefix string
+}
+
+// NewGCSSink returns a GCSSink writing under gs://bucket/prefix of store.
+func NewGCSSink(store objstore.ObjectStore, bucket string, prefix string) *GCSSink {
+	return &GCSSink{store: store, bucket: bucket, prefix: prefix}
+}
+
+// Write implements Sink.
+func (s *GCSSink) Write(ctx context.Context, r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed json.Marshal audit record: %w", err)
+	}
+	name := fmt.Sprintf("%s%s/%020d.json", s.prefix, r.Chain, r.Seq)
+	w := s.store.NewWriter(ctx, s.bucket, name, &objstore.WriteOptions{
+		Attrs:      objstore.ObjectAttrs{ContentType: "application/json"},
+		Conditions: &objstore.Conditions{DoesNotExist: true},
+	})
+	if _, err := w.Write(b); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed write audit object gs://%s/%s: %w", s.bucket, name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed write audit object gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return nil
+}
+
+// Last implements Sink.
+func (s *GCSSink) Last(ctx context.Context) (*Record, error) {
+	return nil, nil
+}
+
+// ReadRecords reads JSON line records from r.
+func ReadRecords(r io.Reader) ([]Record, error) {
+	var records []Record
+	dec := json.NewDecoder(r)
+	for {
+		var rec Record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed decode audit record %d: %w", len(records)+1, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// ReadFile reads the records written by a FileSink to path.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed open audit file %s: %w", path, err)
+	}
+	defer f.Close()
+	return ReadRecords(f)
+}
+
+// ReadGCS reads the records written by a GCSSink under gs://bucket/prefix of store.
+func ReadGCS(ctx context.Context, store objstore.ObjectStore, bucket string, prefix string) ([]Record, error) {
+	var names []string
+	token := ""
+	for {
+		page, err := store.List(ctx, bucket, &objstore.Query{Prefix: prefix}, 0, token)
+		if err != nil {
+			return nil, fmt.Errorf("failed list audit objects gs://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, attrs := range page.Objects {
+			if strings.HasSuffix(attrs.Name, ".json") {
+				names = append(names, attrs.Name)
+			}
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	sort.Strings(names)
+
+	records := make([]Record, 0, len(names))
+	for _, name := range names {
+		rc, err := store.NewReader(ctx, bucket, name, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed read audit object gs://%s/%s: %w", bucket, name, err)
+		}
+		var rec Record
+		err = json.NewDecoder(rc).Decode(&rec)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed decode audit object gs://%s/%s: %w", bucket, name, err)
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+func marshalLine(r *Record) ([]byte, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed json.Marshal audit record: %w", err)
+	}
+	return append(b, '\n'), nil
+}
@@ -0,0 +1,78 @@
+package audit
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Problem is an inconsistency found in an audit chain.
+type Problem struct {
+	Chain  string
+	Seq    uint64
+	Reason string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("chain=%s seq=%d: %s", p.Chain, p.Seq, p.Reason)
+}
+
+// Verify checks every chain in records and returns the problems found.
+// records may hold several chains in any order.
+//
+// Verify detects records which were modified, removed from the head or the middle of
+// a chain, duplicated, or whose link to the previous record was rewritten.
+// Records removed from the tail of a chain can not be detected from the chain alone.
+func Verify(records []Record) []Problem {
+	chains := map[string][]Record{}
+	var order []string
+	for _, r := range records {
+		if _, ok := chains[r.Chain]; !ok {
+			order = append(order, r.Chain)
+		}
+		chains[r.Chain] = append(chains[r.Chain], r)
+	}
+
+	var problems []Problem
+	for _, chain := range order {
+		problems = append(problems, verifyChain(chain, chains[chain])...)
+	}
+	return problems
+}
+
+func verifyChain(chain string, records []Record) []Problem {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+
+	var problems []Problem
+	add := func(seq uint64, format string, args ...interface{}) {
+		problems = append(problems, Problem{Chain: chain, Seq: seq, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	var prev *Record
+	for i := range records {
+		r := &records[i]
+
+		hash, err := r.ComputeHash()
+		if err != nil {
+			add(r.Seq, "%s", err)
+		} else if hash != r.Hash {
+			add(r.Seq, "hash does not match the record content")
+		}
+
+		switch {
+		case prev == nil && r.Seq != 1:
+			add(r.Seq, "records 1..%d are missing", r.Seq-1)
+		case prev == nil && r.PrevHash != "":
+			add(r.Seq, "first record has prevHash %s", r.PrevHash)
+		case prev != nil && r.Seq == prev.Seq:
+			add(r.Seq, "duplicate record")
+		case prev != nil && r.Seq != prev.Seq+1:
+			add(r.Seq, "records %d..%d are missing", prev.Seq+1, r.Seq-1)
+		case prev != nil && r.PrevHash != prev.Hash:
+			add(r.Seq, "prevHash does not match the hash of record %d", prev.Seq)
+		}
+		prev = r
+	}
+	return problems
+}
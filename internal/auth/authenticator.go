@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+)
+
+// ErrUnauthenticated is returned when a request carries no valid credential.
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+// Authenticator verifies the credential of an incoming request.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Principal, error)
+}
+
+// AnonymousAuthenticator accepts every request as the "anonymous" principal.
+// It is meant for local development only.
+type AnonymousAuthenticator struct{}
+
+// Authenticate implements Authenticator.
+func (AnonymousAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	return &Principal{ID: "anonymous", Method: "none"}, nil
+}
+
+// IDTokenAuthenticator verifies a Google-signed ID token sent as
+// "Authorization: Bearer <token>".
+type IDTokenAuthenticator struct {
+	// Audience is the expected aud claim, usually the URL of the service.
+	Audience string
+}
+
+// Authenticate implements Authenticator.
+func (a *IDTokenAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return nil, fmt.Errorf("not found bearer token: %w", ErrUnauthenticated)
+	}
+	token := strings.TrimPrefix(h, "Bearer ")
+
+	payload, err := idtoken.Validate(r.Context(), token, a.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %s: %w", err, ErrUnauthenticated)
+	}
+	return &Principal{ID: subjectOf(payload), Method: "idtoken"}, nil
+}
+
+// IAPAuthenticator verifies the JWT assertion added by Identity-Aware Proxy.
+type IAPAuthenticator struct {
+	// Audience is the expected aud claim.
+	// format: /projects/%s/global/backendServices/%s or /projects/%s/apps/%s
+	Audience string
+}
+
+// iapAssertionHeader is the header which carries the IAP signed JWT.
+const iapAssertionHeader = "X-Goog-IAP-JWT-Assertion"
+
+// Authenticate implements Authenticator.
+func (a *IAPAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	token := r.Header.Get(iapAssertionHeader)
+	if token == "" {
+		return nil, fmt.Errorf("not found %s: %w", iapAssertionHeader, ErrUnauthenticated)
+	}
+
+	payload, err := idtoken.Validate(r.Context(), token, a.Audience)
+	if err != nil {
+		return nil, fmt.Errorf("invalid iap jwt: %s: %w", err, ErrUnauthenticated)
+	}
+	return &Principal{ID: subjectOf(payload), Method: "iap"}, nil
+}
+
+// APIKeyHeader is the header which carries a static API key.
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAuthenticator accepts static API keys. It is meant for local development.
+type APIKeyAuthenticator struct {
+	// Keys maps an API key to the ID of its principal.
+	Keys map[string]string
+}
+
+// Authenticate implements Authenticator.
+func (a *APIKeyAuthenticator) Authenticate(r *http.Request) (*Principal, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return nil, fmt.Errorf("not found %s: %w", APIKeyHeader, ErrUnauthenticated)
+	}
+	for k, id := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return &Principal{ID: id, Method: "apikey"}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown api key: %w", ErrUnauthenticated)
+}
+
+// subjectOf prefers the email claim and falls back to sub.
+func subjectOf(payload *idtoken.Payload) string {
+	if email, ok := payload.Claims["email"].(string); ok && email != "" {
+		return email
+	}
+	return payload.Subject
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+)
+
+// Middleware returns a wrapper which authenticates every request with a.
+// Requests which fail authentication are rejected with 401.
+// The authenticated Principal is stored in the request context and recorded on trace spans and log entries.
+func Middleware(a Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := a.Authenticate(r)
+			if err != nil {
+				logging.Warningf(r.Context(), "failed authenticate: %s", err)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			attrs := map[string]interface{}{
+				"principal":       p.ID,
+				"principalMethod": p.Method,
+			}
+			ctx := NewContext(r.Context(), p)
+			trace.SetAttributesKV(ctx, attrs)
+			ctx = trace.WithAttributes(ctx, attrs)
+			ctx = logging.WithFields(ctx, map[string]interface{}{"principal": p.ID})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/internal/auth"
+)
+
+func TestMiddleware(t *testing.T) {
+	var got *auth.Principal
+	h := auth.Middleware(&auth.APIKeyAuthenticator{Keys: map[string]string{"key": "alice@example.com"}})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = auth.FromContext(r.Context())
+	}))
+
+	cases := []struct {
+		name      string
+		key       string
+		code      int
+		principal string
+	}{
+		{"valid key", "key", http.StatusOK, "alice@example.com"},
+		{"unknown key", "other", http.StatusUnauthorized, ""},
+		{"no key", "", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.key != "" {
+				r.Header.Set(auth.APIKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.code {
+				t.Errorf("want %d but got %d", tt.code, w.Code)
+			}
+			switch {
+			case tt.principal == "" && got != nil:
+				t.Errorf("want next handler not called but got principal %s", got.ID)
+			case tt.principal != "" && (got == nil || got.ID != tt.principal):
+				t.Errorf("want principal %s but got %+v", tt.principal, got)
+			}
+		})
+	}
+}
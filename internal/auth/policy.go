@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrPermissionDenied is returned when the policy does not allow an operation.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Operation is a kind of access to an object.
+type Operation string
+
+const (
+	OperationUpload    Operation = "upload"
+	OperationDownload  Operation = "download"
+	OperationCopy      Operation = "copy"
+	OperationReEncrypt Operation = "re-encrypt"
+	OperationList      Operation = "list"
+	OperationRestore   Operation = "restore"
+	OperationMove      Operation = "move"
+	OperationDelete    Operation = "delete"
+)
+
+// wildcard matches any principal, bucket or operation.
+const wildcard = "*"
+
+// Rule allows Principals to run Operations on objects under Bucket/Prefix.
+//
+// Principals accepts an exact principal ID, "domain:example.com" or "*".
+// Bucket and Operations accept "*".
+type Rule struct {
+	Principals []string    `json:"principals"`
+	Bucket     string      `json:"bucket"`
+	Prefix     string      `json:"prefix"`
+	Operations []Operation `json:"operations"`
+}
+
+// Policy is a list of allow rules. Anything not allowed by a rule is denied.
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+// AllowAll returns a Policy which allows every operation to every principal.
+func AllowAll() *Policy {
+	return &Policy{
+		Rules: []Rule{
+			{
+				Principals: []string{wildcard},
+				Bucket:     wildcard,
+				Operations: []Operation{wildcard},
+			},
+		},
+	}
+}
+
+// LoadPolicy reads a JSON encoded Policy from path.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed read policy file %s: %w", path, err)
+	}
+	var p Policy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed parse policy file %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Authorize returns ErrPermissionDenied unless a rule allows principal to run op on bucket/object.
+func (p *Policy) Authorize(principal *Principal, bucket string, object string, op Operation) error {
+	if principal == nil {
+		return fmt.Errorf("no principal: %w", ErrPermissionDenied)
+	}
+	for _, rule := range p.Rules {
+		if rule.allows(principal, bucket, object, op) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not allowed to %s gs://%s/%s: %w", principal.ID, op, bucket, object, ErrPermissionDenied)
+}
+
+func (r *Rule) allows(principal *Principal, bucket string, object string, op Operation) bool {
+	if r.Bucket != wildcard && r.Bucket != bucket {
+		return false
+	}
+	if !strings.HasPrefix(object, r.Prefix) {
+		return false
+	}
+	return r.matchOperation(op) && r.matchPrincipal(principal)
+}
+
+func (r *Rule) matchOperation(op Operation) bool {
+	for _, v := range r.Operations {
+		if v == wildcard || v == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchPrincipal(principal *Principal) bool {
+	for _, v := range r.Principals {
+		switch {
+		case v == wildcard:
+			return true
+		case strings.HasPrefix(v, "domain:"):
+			if strings.HasSuffix(principal.ID, "@"+strings.TrimPrefix(v, "domain:")) {
+				return true
+			}
+		case v == principal.ID:
+			return true
+		}
+	}
+	return false
+}
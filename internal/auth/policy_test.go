@@ -0,0 +1,53 @@
+package auth_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/internal/auth"
+)
+
+func TestPolicy_Authorize(t *testing.T) {
+	policy := &auth.Policy{
+		Rules: []auth.Rule{
+			{
+				Principals: []string{"alice@example.com"},
+				Bucket:     "bucket",
+				Prefix:     "alice/",
+				Operations: []auth.Operation{auth.OperationUpload, auth.OperationDownload},
+			},
+			{
+				Principals: []string{"domain:example.org"},
+				Bucket:     "*",
+				Operations: []auth.Operation{"*"},
+			},
+		},
+	}
+
+	cases := []struct {
+		name      string
+		principal string
+		bucket    string
+		object    string
+		op        auth.Operation
+		allowed   bool
+	}{
+		{"match prefix", "alice@example.com", "bucket", "alice/a.txt", auth.OperationDownload, true},
+		{"other prefix", "alice@example.com", "bucket", "bob/a.txt", auth.OperationDownload, false},
+		{"other operation", "alice@example.com", "bucket", "alice/a.txt", auth.OperationCopy, false},
+		{"other bucket", "alice@example.com", "other", "alice/a.txt", auth.OperationDownload, false},
+		{"domain", "bob@example.org", "other", "x", auth.OperationReEncrypt, true},
+		{"domain suffix only", "bob@evilexample.org", "other", "x", auth.OperationReEncrypt, false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.Authorize(&auth.Principal{ID: tt.principal}, tt.bucket, tt.object, tt.op)
+			if tt.allowed && err != nil {
+				t.Errorf("want allowed but got %s", err)
+			}
+			if !tt.allowed && !errors.Is(err, auth.ErrPermissionDenied) {
+				t.Errorf("want ErrPermissionDenied but got %v", err)
+			}
+		})
+	}
+}
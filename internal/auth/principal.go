@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"context"
+)
+
+// Principal is an authenticated caller of the service.
+type Principal struct {
+	// ID identifies the caller, e.g. an email address or an API key owner.
+	ID string
+
+	// Method is the authentication method which verified the caller.
+	Method string
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx that carries p.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// FromContext returns the Principal stored in ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok && p != nil
+}
@@ -0,0 +1,374 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/internal/retry"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+const bucket = "jobs"
+
+// testWorker processes the objects under the prefix param of a job in bucket "data".
+type testWorker struct {
+	objs objstore.ObjectStore
+
+	mu        sync.Mutex
+	processed []string
+	// block, when not nil, is received from before processing each item
+	block chan struct{}
+}
+
+func (w *testWorker) Next(ctx context.Context, job *Job, cursor string, limit int) ([]string, error) {
+	return ListObjects(ctx, w.objs, "data", job.Params["prefix"], cursor, limit)
+}
+
+func (w *testWorker) Process(ctx context.Context, job *Job, item string) *Result {
+	if w.block != nil {
+		select {
+		case <-w.block:
+		case <-ctx.Done():
+			return &Result{Item: item, Error: ctx.Err().Error()}
+		}
+	}
+	w.mu.Lock()
+	w.processed = append(w.processed, item)
+	w.mu.Unlock()
+	if item == "p/3" {
+		return &Result{Item: item, Error: "broken"}
+	}
+	return &Result{Item: item, Details: map[string]string{"size": "1"}}
+}
+
+func newTestStore(t *testing.T, n int) objstore.ObjectStore {
+	t.Helper()
+	objs := objstore.NewMemory()
+	for i := 0; i < n; i++ {
+		w := objs.NewWriter(context.Background(), "data", fmt.Sprintf("p/%d", i), nil)
+		w.Write([]byte("x"))
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return objs
+}
+
+func waitFor(t *testing.T, m *Manager, id string, cond func(*Job) bool) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cond(job) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not reach the expected state", id)
+	return nil
+}
+
+func TestManager_RunToCompletion(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objs := newTestStore(t, 5)
+	w := &testWorker{objs: objs}
+	m := NewManager(NewStore(objs, bucket, "jobs/"), WithBatchSize(2), WithPollInterval(time.Hour))
+	m.Register("test", w)
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx)
+		close(done)
+	}()
+
+	job, err := m.Submit(ctx, "test", map[string]string{"prefix": "p/"}, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitFor(t, m, job.ID, func(j *Job) bool { return j.State.Done() })
+	if job.State != StateSucceeded || job.Processed != 5 || job.Failed != 1 || job.ResultParts != 3 || job.Cursor != "p/4" {
+		t.Errorf("unexpected job %+v", job)
+	}
+	var results []*Result
+	err = m.EachResult(ctx, job, func(r *Result) error {
+		results = append(results, r)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 5 || results[3].Error != "broken" || results[0].Details["size"] != "1" {
+		t.Errorf("unexpected results %+v", results)
+	}
+
+	if _, err := m.Submit(ctx, "unknown", nil, ""); err == nil {
+		t.Error("want error for an unknown kind but got nil")
+	}
+	if _, err := m.Cancel(ctx, job.ID); err == nil {
+		t.Error("want error canceling a finished job but got nil")
+	}
+	cancel()
+	<-done
+}
+
+func TestManager_ResumeFromCheckpoint(t *testing.T) {
+	objs := newTestStore(t, 5)
+	store := NewStore(objs, bucket, "jobs/")
+
+	// the first instance processes one batch and stops
+	ctx1, stop1 := context.WithCancel(context.Background())
+	w1 := &testWorker{objs: objs, block: make(chan struct{})}
+	m1 := NewManager(store, WithOwner("first"), WithBatchSize(2), WithLease(time.Millisecond), WithPollInterval(time.Hour))
+	m1.Register("test", w1)
+	job, err := m1.Submit(context.Background(), "test", map[string]string{"prefix": "p/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done1 := make(chan struct{})
+	go func() {
+		m1.Run(ctx1)
+		close(done1)
+	}()
+	w1.block <- struct{}{}
+	w1.block <- struct{}{}
+	waitFor(t, m1, job.ID, func(j *Job) bool { return j.ResultParts == 1 })
+	stop1()
+	<-done1
+
+	// the second instance takes over after the lease expired
+	ctx2, stop2 := context.WithCancel(context.Background())
+	defer stop2()
+	w2 := &testWorker{objs: objs}
+	m2 := NewManager(store, WithOwner("second"), WithBatchSize(2), WithPollInterval(10*time.Millisecond))
+	m2.Register("test", w2)
+	go m2.Run(ctx2)
+
+	job = waitFor(t, m2, job.ID, func(j *Job) bool { return j.State.Done() })
+	if job.State != StateSucceeded || job.Processed != 5 {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if len(w2.processed) != 3 || w2.processed[0] != "p/2" {
+		t.Errorf("want the second instance to resume from p/2 but processed %v", w2.processed)
+	}
+}
+
+func TestManager_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	objs := newTestStore(t, 5)
+	w := &testWorker{objs: objs, block: make(chan struct{})}
+	m := NewManager(NewStore(objs, bucket, "jobs/"), WithBatchSize(10), WithPollInterval(time.Hour))
+	m.Register("test", w)
+
+	// a queued job is canceled at once
+	queued, err := m.Submit(ctx, "test", map[string]string{"prefix": "p/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := m.Cancel(ctx, queued.ID); err != nil || job.State != StateCanceled {
+		t.Fatalf("want canceled but got %+v, %v", job, err)
+	}
+
+	running, err := m.Submit(ctx, "test", map[string]string{"prefix": "p/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Run(ctx)
+	w.block <- struct{}{}
+	if _, err := m.Cancel(ctx, running.ID); err != nil {
+		t.Fatal(err)
+	}
+	job := waitFor(t, m, running.ID, func(j *Job) bool { return j.State.Done() })
+	if job.State != StateCanceled || job.Processed > 2 {
+		t.Errorf("unexpected job %+v", job)
+	}
+	if _, err := m.Get(ctx, "missing"); err == nil {
+		t.Error("want ErrNotFound but got nil")
+	}
+}
+
+func TestManager_HeartbeatKeepsLease(t *testing.T) {
+	objs := newTestStore(t, 3)
+	store := NewStore(objs, bucket, "jobs/")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the first instance takes much longer than the lease to process one batch
+	w1 := &testWorker{objs: objs, block: make(chan struct{})}
+	m1 := NewManager(store, WithOwner("first"), WithBatchSize(10), WithLease(30*time.Millisecond), WithPollInterval(time.Hour))
+	m1.Register("test", w1)
+	job, err := m1.Submit(ctx, "test", map[string]string{"prefix": "p/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m1.Run(ctx)
+	waitFor(t, m1, job.ID, func(j *Job) bool { return j.State == StateRunning })
+
+	w2 := &testWorker{objs: objs}
+	m2 := NewManager(store, WithOwner("second"), WithBatchSize(10), WithPollInterval(5*time.Millisecond))
+	m2.Register("test", w2)
+	go m2.Run(ctx)
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(60 * time.Millisecond)
+		w1.block <- struct{}{}
+	}
+	job = waitFor(t, m1, job.ID, func(j *Job) bool { return j.State.Done() })
+	if job.State != StateSucceeded || job.Processed != 3 || job.ResultParts != 1 {
+		t.Errorf("unexpected job %+v", job)
+	}
+	w2.mu.Lock()
+	defer w2.mu.Unlock()
+	if len(w2.processed) != 0 {
+		t.Errorf("want the lease kept by the first instance but the second processed %v", w2.processed)
+	}
+}
+
+func TestManager_CancelFromAnotherInstance(t *testing.T) {
+	objs := newTestStore(t, 3)
+	store := NewStore(objs, bucket, "jobs/")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &testWorker{objs: objs, block: make(chan struct{})}
+	m1 := NewManager(store, WithOwner("first"), WithBatchSize(10), WithLease(30*time.Millisecond), WithPollInterval(time.Hour))
+	m1.Register("test", w)
+	job, err := m1.Submit(ctx, "test", map[string]string{"prefix": "p/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m1.Run(ctx)
+	w.block <- struct{}{}
+
+	// the heartbeat of the first instance stops the batch
+	m2 := NewManager(store, WithOwner("second"))
+	if _, err := m2.Cancel(ctx, job.ID); err != nil {
+		t.Fatal(err)
+	}
+	job = waitFor(t, m1, job.ID, func(j *Job) bool { return j.State.Done() })
+	if job.State != StateCanceled || job.Processed != 1 {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
+
+// flakyWorker fails listing the items the first failures times with a transient error.
+type flakyWorker struct {
+	*testWorker
+	failures int
+}
+
+func (w *flakyWorker) Next(ctx context.Context, job *Job, cursor string, limit int) ([]string, error) {
+	w.mu.Lock()
+	if w.failures > 0 {
+		w.failures--
+		w.mu.Unlock()
+		return nil, &googleapi.Error{Code: http.StatusServiceUnavailable}
+	}
+	w.mu.Unlock()
+	return w.testWorker.Next(ctx, job, cursor, limit)
+}
+
+func TestManager_TransientNextError(t *testing.T) {
+	objs := newTestStore(t, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &flakyWorker{testWorker: &testWorker{objs: objs}, failures: 3}
+	m := NewManager(NewStore(objs, bucket, "jobs/"), WithBatchSize(10), WithLease(10*time.Millisecond),
+		WithPollInterval(5*time.Millisecond), WithRetry(retry.Policy{MaxAttempts: 2}))
+	m.Register("test", w)
+	job, err := m.Submit(ctx, "test", map[string]string{"prefix": "p/"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Run(ctx)
+
+	// the retries of the first run are exhausted, and the job is resumed after the lease expired
+	job = waitFor(t, m, job.ID, func(j *Job) bool { return j.State.Done() })
+	if job.State != StateSucceeded || job.Processed != 3 || job.Error != "" {
+		t.Errorf("unexpected job %+v", job)
+	}
+}
+
+func TestManager_ReplaceOrphanResults(t *testing.T) {
+	ctx := context.Background()
+	objs := newTestStore(t, 0)
+	store := NewStore(objs, bucket, "jobs/")
+	m := NewManager(store, WithOwner("second"))
+	m.Register("test", &testWorker{objs: objs})
+	job, err := m.Submit(ctx, "test", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.State = StateRunning
+	job.LeaseOwner = "second"
+	if err := store.update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+
+	// an instance which lost the lease wrote the next part but not the job
+	if err := store.writeResults(ctx, job.ID, 1, []*Result{{Item: "stale"}}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.writeResults(ctx, job.ID, 1, []*Result{{Item: "stale"}}, 0); err == nil {
+		t.Fatal("want conflict writing an existing part but got nil")
+	}
+
+	if err := m.checkpoint(ctx, job, []*Result{{Item: "a"}, {Item: "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	var items []string
+	err = m.EachResult(ctx, job, func(r *Result) error {
+		items = append(items, r.Item)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ResultParts != 1 || fmt.Sprint(items) != "[a b]" {
+		t.Errorf("want the orphan part replaced but got %+v %v", job, items)
+	}
+}
+
+func TestStore_ListActive(t *testing.T) {
+	ctx := context.Background()
+	objs := newTestStore(t, 0)
+	store := NewStore(objs, bucket, "jobs/")
+	m := NewManager(store)
+	m.Register("test", &testWorker{objs: objs})
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		job, err := m.Submit(ctx, "test", nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	if _, err := m.Cancel(ctx, ids[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := store.ListActive(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := map[string]bool{}
+	for _, job := range jobs {
+		active[job.ID] = true
+	}
+	if len(jobs) != 2 || !active[ids[0]] || !active[ids[2]] {
+		t.Errorf("want the jobs which are not done but got %+v", jobs)
+	}
+	if _, err := objs.Attrs(ctx, bucket, "jobs/active/"+ids[1], nil); err == nil {
+		t.Error("want the marker of the canceled job removed")
+	}
+}
@@ -0,0 +1,566 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/retry"
+)
+
+// Worker runs the jobs of one kind as a sequence of items, such as the objects under a prefix.
+type Worker interface {
+	// Next returns up to limit items which sort after cursor. An empty cursor
+	// asks for the first items, and no items means the job is complete.
+	Next(ctx context.Context, job *Job, cursor string, limit int) ([]string, error)
+
+	// Process runs the unit of work for item. A failure is recorded in the
+	// Result and does not stop the job.
+	Process(ctx context.Context, job *Job, item string) *Result
+}
+
+// Manager submits jobs and runs the jobs of its Store with the registered Workers.
+//
+// A running job is leased to one instance, which renews the lease while it
+// processes a batch and at every checkpoint. When an instance stops, its jobs are resumed from their last
+// checkpoint by the first instance seeing the lease expired, so an item may be
+// processed again after a restart and units of work have to be idempotent.
+type Manager struct {
+	store   *Store
+	workers map[string]Worker
+
+	owner        string
+	lease        time.Duration
+	batchSize    int
+	pollInterval time.Duration
+	retry        retry.Policy
+	now          func() time.Time
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+	wg      sync.WaitGroup
+	kick    chan struct{}
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithOwner sets the name of the instance used for leases. It defaults to the
+// hostname followed by a random suffix.
+func WithOwner(owner string) Option {
+	return func(m *Manager) {
+		m.owner = owner
+	}
+}
+
+// WithLease sets how long a job stays leased to an instance without a checkpoint.
+func WithLease(d time.Duration) Option {
+	return func(m *Manager) {
+		m.lease = d
+	}
+}
+
+// WithBatchSize sets the number of items processed between checkpoints.
+func WithBatchSize(n int) Option {
+	return func(m *Manager) {
+		m.batchSize = n
+	}
+}
+
+// WithPollInterval sets how often Run looks for queued and abandoned jobs.
+func WithPollInterval(d time.Duration) Option {
+	return func(m *Manager) {
+		m.pollInterval = d
+	}
+}
+
+// WithRetry sets the policy for retrying transient errors listing the items of a job.
+func WithRetry(p retry.Policy) Option {
+	return func(m *Manager) {
+		m.retry = p
+	}
+}
+
+// NewManager returns a Manager keeping jobs in store.
+func NewManager(store *Store, opts ...Option) *Manager {
+	host, _ := os.Hostname()
+	m := &Manager{
+		store:        store,
+		workers:      map[string]Worker{},
+		owner:        fmt.Sprintf("%s-%s", host, uuid.New().String()[:8]),
+		lease:        time.Minute,
+		batchSize:    100,
+		pollInterval: 10 * time.Second,
+		retry:        retry.DefaultPolicy(),
+		now:          time.Now,
+		running:      map[string]context.CancelFunc{},
+		kick:         make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Register makes w run the jobs of kind. It must be called before Run.
+func (m *Manager) Register(kind string, w Worker) {
+	m.workers[kind] = w
+}
+
+// Worker returns the Worker registered for kind.
+func (m *Manager) Worker(kind string) (Worker, bool) {
+	w, ok := m.workers[kind]
+	return w, ok
+}
+
+// Submit queues a new job of kind and wakes Run up to start it.
+func (m *Manager) Submit(ctx context.Context, kind string, params map[string]string, principal string) (*Job, error) {
+	if _, ok := m.workers[kind]; !ok {
+		return nil, fmt.Errorf("%q: %w", kind, ErrUnknownKind)
+	}
+	now := m.now().UTC()
+	job := &Job{
+		ID:        uuid.New().String(),
+		Kind:      kind,
+		Params:    params,
+		Principal: principal,
+		State:     StateQueued,
+		Created:   now,
+		Updated:   now,
+	}
+	if err := m.store.create(ctx, job); err != nil {
+		return nil, err
+	}
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+// Get returns the job with id.
+func (m *Manager) Get(ctx context.Context, id string) (*Job, error) {
+	return m.store.Get(ctx, id)
+}
+
+// EachResult calls fn with each result of job recorded up to its last checkpoint.
+// It stops at the first error returned by fn.
+func (m *Manager) EachResult(ctx context.Context, job *Job, fn func(*Result) error) error {
+	return m.store.EachResult(ctx, job, fn)
+}
+
+// Cancel cancels the job with id. A queued job is canceled at once. A running
+// job is stopped by the instance running it, and keeps the results recorded
+// until it stopped.
+func (m *Manager) Cancel(ctx context.Context, id string) (*Job, error) {
+	for {
+		job, err := m.store.Get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.State.Done() {
+			return job, fmt.Errorf("job %s is %s: %w", id, job.State, ErrFinished)
+		}
+		if job.State == StateQueued {
+			job.State = StateCanceled
+		}
+		job.CancelRequested = true
+		job.Updated = m.now().UTC()
+		err = m.store.update(ctx, job)
+		if errors.Is(err, errConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.mu.Lock()
+		if cancel, ok := m.running[id]; ok {
+			cancel()
+		}
+		m.mu.Unlock()
+		return job, nil
+	}
+}
+
+// Run starts queued jobs and resumes abandoned ones until ctx is done. Jobs
+// stopped by ctx record their progress and stay leased, so that they are
+// resumed after the lease expires. Run returns once all its jobs stopped.
+func (m *Manager) Run(ctx context.Context) {
+	defer m.wg.Wait()
+	ticker := time.NewTicker(m.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := m.poll(ctx); err != nil {
+			logging.Warningf(ctx, "failed poll jobs: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-m.kick:
+		}
+	}
+}
+
+// poll claims the jobs which are queued or whose lease expired, and starts them.
+func (m *Manager) poll(ctx context.Context) error {
+	jobs, err := m.store.ListActive(ctx)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if job.State.Done() || m.isRunning(job.ID) {
+			continue
+		}
+		if job.State == StateRunning && m.now().Before(job.LeaseExpires) {
+			continue
+		}
+		w, ok := m.workers[job.Kind]
+		if !ok {
+			// another version of the server may know the kind
+			continue
+		}
+		if job.State == StateRunning {
+			logging.Infof(ctx, "resume job %s from %q: previous owner %s", job.ID, job.Cursor, job.LeaseOwner)
+		}
+		job.State = StateRunning
+		job.LeaseOwner = m.owner
+		job.LeaseExpires = m.now().Add(m.lease)
+		job.Updated = m.now().UTC()
+		err := m.store.update(ctx, job)
+		if errors.Is(err, errConflict) {
+			// claimed or canceled by someone else
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		m.start(ctx, job, w)
+	}
+	return nil
+}
+
+func (m *Manager) isRunning(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.running[id]
+	return ok
+}
+
+func (m *Manager) start(ctx context.Context, job *Job, w Worker) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	m.mu.Lock()
+	m.running[job.ID] = cancel
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go func() {
+		defer func() {
+			cancel()
+			m.mu.Lock()
+			delete(m.running, job.ID)
+			m.mu.Unlock()
+			m.wg.Done()
+		}()
+		m.run(jobCtx, job, w)
+	}()
+}
+
+// persistTimeout bounds the writes recording the progress of a job after its context is done.
+const persistTimeout = 30 * time.Second
+
+// run processes the items of job in batches, recording a checkpoint after each batch.
+func (m *Manager) run(ctx context.Context, job *Job, w Worker) {
+	ctx = logging.WithFields(ctx, map[string]interface{}{"job": job.ID, "principal": job.Principal})
+	if job.Principal != "" {
+		// the worker acts for the principal which submitted the job, so that its key use is audited as theirs
+		ctx = auth.NewContext(ctx, &auth.Principal{ID: job.Principal, Method: "job"})
+	}
+	for {
+		if ctx.Err() != nil {
+			m.stop(job)
+			return
+		}
+		results, complete, err := m.batch(ctx, job, w)
+		if job.State.Done() || job.LeaseOwner != m.owner {
+			// another instance took the job over or finished it during the batch
+			return
+		}
+		if ctx.Err() != nil && len(results) == 0 {
+			m.stop(job)
+			return
+		}
+		if err != nil {
+			if retry.IsRetryable(err) {
+				// the job stays leased, and is resumed from its cursor once the lease expires
+				logging.Warningf(ctx, "failed list items of job %s, resume later: %s", job.ID, err)
+				return
+			}
+			m.finish(ctx, job, StateFailed, err)
+			return
+		}
+		if complete {
+			m.finish(ctx, job, StateSucceeded, nil)
+			return
+		}
+
+		pctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+		err = m.checkpoint(pctx, job, results)
+		cancel()
+		if err != nil {
+			logging.Errorf(ctx, "failed checkpoint job %s: %s", job.ID, err)
+			return
+		}
+		if job.State.Done() || job.LeaseOwner != m.owner {
+			return
+		}
+	}
+}
+
+// batch processes the next items of job while a heartbeat renews its lease.
+// The batch is interrupted when the heartbeat finds that the job was canceled or
+// taken over, and returns the results so far. complete is true when no items are left.
+func (m *Manager) batch(ctx context.Context, job *Job, w Worker) (results []*Result, complete bool, err error) {
+	bctx, interrupt := context.WithCancel(ctx)
+	lease := *job
+	beating := make(chan struct{})
+	go func() {
+		defer close(beating)
+		m.heartbeat(bctx, &lease, interrupt)
+	}()
+	defer func() {
+		interrupt()
+		<-beating
+		if lease.LeaseOwner != m.owner || lease.State.Done() {
+			*job = lease
+			return
+		}
+		job.CancelRequested = lease.CancelRequested
+		job.LeaseExpires = lease.LeaseExpires
+		job.Updated = lease.Updated
+		job.generation = lease.generation
+	}()
+
+	var items []string
+	err = m.retry.Do(bctx, "jobs.next", func(ctx context.Context) error {
+		var err error
+		items, err = w.Next(ctx, job, job.Cursor, m.batchSize)
+		return err
+	})
+	if bctx.Err() != nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(items) == 0 {
+		return nil, true, nil
+	}
+	for _, item := range items {
+		result := w.Process(bctx, job, item)
+		if bctx.Err() != nil {
+			// the item was interrupted, and is processed again when the job is resumed
+			break
+		}
+		results = append(results, result)
+	}
+	return results, false, nil
+}
+
+// heartbeat renews the lease of job until ctx is done, and calls interrupt
+// when the job was canceled or is no longer leased to this instance.
+func (m *Manager) heartbeat(ctx context.Context, job *Job, interrupt context.CancelFunc) {
+	ticker := time.NewTicker(m.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		leased, err := m.renew(ctx, job)
+		if err != nil {
+			if ctx.Err() == nil {
+				logging.Warningf(ctx, "failed renew lease of job %s: %s", job.ID, err)
+			}
+			continue
+		}
+		if !leased {
+			interrupt()
+			return
+		}
+	}
+}
+
+// renew extends the lease of job. It returns false when the job was canceled,
+// or when it is no longer leased to this instance in which case job is replaced
+// with the latest stored job.
+func (m *Manager) renew(ctx context.Context, job *Job) (bool, error) {
+	for {
+		if job.CancelRequested {
+			return false, nil
+		}
+		job.LeaseExpires = m.now().Add(m.lease)
+		job.Updated = m.now().UTC()
+		err := m.store.update(ctx, job)
+		if !errors.Is(err, errConflict) {
+			return true, err
+		}
+
+		latest, err := m.store.Get(ctx, job.ID)
+		if err != nil {
+			return true, err
+		}
+		if latest.LeaseOwner != m.owner || latest.State.Done() {
+			*job = *latest
+			return false, nil
+		}
+		// only Cancel updates a job leased to this instance
+		job.CancelRequested = latest.CancelRequested
+		job.generation = latest.generation
+	}
+}
+
+// checkpoint records results and moves the cursor of job past them.
+// When the job was canceled meanwhile it is marked as canceled, and when another
+// instance took it over the results are left to that instance.
+func (m *Manager) checkpoint(ctx context.Context, job *Job, results []*Result) error {
+	if len(results) > 0 {
+		if err := m.writeResults(ctx, job, results); err != nil {
+			return err
+		}
+		if job.State.Done() || job.LeaseOwner != m.owner {
+			return nil
+		}
+		job.ResultParts++
+		job.Cursor = results[len(results)-1].Item
+		job.Processed += len(results)
+		for _, r := range results {
+			if r.Failed() {
+				job.Failed++
+			}
+		}
+	}
+	for {
+		if job.CancelRequested {
+			job.State = StateCanceled
+			job.LeaseOwner = ""
+			job.LeaseExpires = time.Time{}
+		} else {
+			job.LeaseExpires = m.now().Add(m.lease)
+		}
+		job.Updated = m.now().UTC()
+		err := m.store.update(ctx, job)
+		if !errors.Is(err, errConflict) {
+			return err
+		}
+
+		latest, err := m.store.Get(ctx, job.ID)
+		if err != nil {
+			return err
+		}
+		if latest.LeaseOwner != m.owner || latest.State.Done() {
+			*job = *latest
+			return nil
+		}
+		// only Cancel updates a job leased to this instance
+		job.CancelRequested = latest.CancelRequested
+		job.generation = latest.generation
+	}
+}
+
+// writeResults stores results as the next part of the results of job.
+// A part already there was left by an instance which lost the lease before
+// committing it, and is replaced as long as job is still leased to this instance.
+// Otherwise job is replaced with the latest stored job and nothing is written.
+func (m *Manager) writeResults(ctx context.Context, job *Job, results []*Result) error {
+	part := job.ResultParts + 1
+	err := m.store.writeResults(ctx, job.ID, part, results, 0)
+	if !errors.Is(err, errConflict) {
+		return err
+	}
+	latest, err := m.store.Get(ctx, job.ID)
+	if err != nil {
+		return err
+	}
+	if latest.LeaseOwner != m.owner || latest.State.Done() {
+		*job = *latest
+		return nil
+	}
+	generation, err := m.store.resultGeneration(ctx, job.ID, part)
+	if err != nil {
+		return err
+	}
+	return m.store.writeResults(ctx, job.ID, part, results, generation)
+}
+
+// stop records that job stopped with its context. A canceled job is marked as
+// canceled, otherwise it stays leased to be resumed later.
+func (m *Manager) stop(job *Job) {
+	if !m.isCancelRequested(job) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := m.checkpoint(ctx, job, nil); err != nil {
+		logging.Errorf(ctx, "failed cancel job %s: %s", job.ID, err)
+	}
+}
+
+func (m *Manager) isCancelRequested(job *Job) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	latest, err := m.store.Get(ctx, job.ID)
+	if err != nil {
+		return false
+	}
+	if latest.CancelRequested && latest.LeaseOwner == m.owner {
+		job.CancelRequested = true
+		job.generation = latest.generation
+		return true
+	}
+	return false
+}
+
+// finish marks job as done with state.
+func (m *Manager) finish(ctx context.Context, job *Job, state State, jobErr error) {
+	for {
+		job.State = state
+		if job.CancelRequested {
+			job.State = StateCanceled
+		}
+		if jobErr != nil {
+			job.Error = jobErr.Error()
+		}
+		job.LeaseOwner = ""
+		job.LeaseExpires = time.Time{}
+		job.Updated = m.now().UTC()
+		err := m.store.update(ctx, job)
+		if errors.Is(err, errConflict) {
+			latest, err := m.store.Get(ctx, job.ID)
+			if err != nil {
+				logging.Errorf(ctx, "failed finish job %s: %s", job.ID, err)
+				return
+			}
+			if latest.LeaseOwner != m.owner || latest.State.Done() {
+				return
+			}
+			job.CancelRequested = latest.CancelRequested
+			job.generation = latest.generation
+			continue
+		}
+		if err != nil {
+			logging.Errorf(ctx, "failed finish job %s: %s", job.ID, err)
+		}
+		logging.Infof(ctx, "job %s %s: processed=%d failed=%d", job.ID, job.State, job.Processed, job.Failed)
+		return
+	}
+}
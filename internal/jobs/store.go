@@ -0,0 +1,378 @@
+// Package jobs runs long-running batch operations in the background and keeps
+// their state in Cloud Storage, so that a restarted instance resumes them from
+// the last checkpoint.
+package jobs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// ErrNotFound is returned when there is no job with the ID.
+	ErrNotFound = errors.New("job not found")
+
+	// ErrUnknownKind is returned when no Worker is registered for the kind of a job.
+	ErrUnknownKind = errors.New("unknown job kind")
+
+	// ErrFinished is returned when canceling a job which has already finished.
+	ErrFinished = errors.New("job already finished")
+
+	// errConflict is returned when the job was updated since it was read.
+	errConflict = errors.New("job updated concurrently")
+)
+
+// State is the lifecycle state of a job.
+type State string
+
+const (
+	StateQueued    State = "QUEUED"
+	StateRunning   State = "RUNNING"
+	StateSucceeded State = "SUCCEEDED"
+	StateFailed    State = "FAILED"
+	StateCanceled  State = "CANCELED"
+)
+
+// Done reports whether a job in the state will not run anymore.
+func (s State) Done() bool {
+	return s == StateSucceeded || s == StateFailed || s == StateCanceled
+}
+
+// Job is a batch operation and its progress.
+type Job struct {
+	ID        string            `json:"id"`
+	Kind      string            `json:"kind"`
+	Params    map[string]string `json:"params,omitempty"`
+	Principal string            `json:"principal,omitempty"`
+	State     State             `json:"state"`
+	Error     string            `json:"error,omitempty"`
+
+	// CancelRequested is set by Cancel while the job is running. The instance
+	// running the job stops it at the next checkpoint.
+	CancelRequested bool `json:"cancelRequested,omitempty"`
+
+	// Cursor is the last item processed at the last checkpoint. A resumed job
+	// continues with the items after it.
+	Cursor string `json:"cursor,omitempty"`
+
+	Processed   int `json:"processed"`
+	Failed      int `json:"failed"`
+	ResultParts int `json:"resultParts"`
+
+	// LeaseOwner is the instance running the job until LeaseExpires.
+	LeaseOwner   string    `json:"leaseOwner,omitempty"`
+	LeaseExpires time.Time `json:"leaseExpires,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// generation is the generation of the stored job, to update it only if unchanged.
+	generation int64
+}
+
+// Result is the outcome of the unit of work for one item of a job.
+type Result struct {
+	Item    string            `json:"item"`
+	Error   string            `json:"error,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Failed reports whether the unit of work failed.
+func (r *Result) Failed() bool {
+	return r.Error != ""
+}
+
+// Store keeps jobs as objects under gs://bucket/prefix:
+//
+//	{prefix}{id}/job.json            the Job
+//	{prefix}{id}/results/{part}.json the Results of each checkpoint
+//	{prefix}active/{id}              a marker for each job which is not done yet
+//
+// Jobs are updated only if they have not changed since they were read, so that
+// instances sharing the bucket never overwrite each other. The markers keep
+// polling for runnable jobs independent of the number of finished jobs.
+type Store struct {
+	objs   objstore.ObjectStore
+	bucket string
+	prefix string
+}
+
+// NewStore returns a Store keeping jobs under gs://bucket/prefix of objs.
+func NewStore(objs objstore.ObjectStore, bucket string, prefix string) *Store {
+	return &Store{objs: objs, bucket: bucket, prefix: prefix}
+}
+
+func (s *Store) jobName(id string) string {
+	return fmt.Sprintf("%s%s/job.json", s.prefix, id)
+}
+
+func (s *Store) resultName(id string, part int) string {
+	return fmt.Sprintf("%s%s/results/%08d.json", s.prefix, id, part)
+}
+
+func (s *Store) activePrefix() string {
+	return s.prefix + "active/"
+}
+
+// create stores a new job and marks it active.
+// The marker is written first, so that a job is never stored without it.
+func (s *Store) create(ctx context.Context, job *Job) error {
+	name := s.activePrefix() + job.ID
+	w := s.objs.NewWriter(ctx, s.bucket, name, &objstore.WriteOptions{Conditions: &objstore.Conditions{DoesNotExist: true}})
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed write job marker gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return s.write(ctx, job, &objstore.Conditions{DoesNotExist: true})
+}
+
+// update stores job if it has not changed since it was read, and returns errConflict otherwise.
+// A job which is done is no longer marked active.
+func (s *Store) update(ctx context.Context, job *Job) error {
+	if err := s.write(ctx, job, &objstore.Conditions{GenerationMatch: job.generation}); err != nil {
+		return err
+	}
+	if job.State.Done() {
+		// a marker left behind is removed by ListActive
+		_ = s.deactivate(ctx, job.ID)
+	}
+	return nil
+}
+
+func (s *Store) deactivate(ctx context.Context, id string) error {
+	err := s.objs.Delete(ctx, s.bucket, s.activePrefix()+id, nil)
+	if err != nil && !errors.Is(err, objstore.ErrObjectNotExist) {
+		return fmt.Errorf("failed delete job marker gs://%s/%s%s: %w", s.bucket, s.activePrefix(), id, err)
+	}
+	return nil
+}
+
+func (s *Store) write(ctx context.Context, job *Job, conds *objstore.Conditions) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed json.Marshal job: %w", err)
+	}
+	name := s.jobName(job.ID)
+	w := s.objs.NewWriter(ctx, s.bucket, name, &objstore.WriteOptions{
+		Attrs:      objstore.ObjectAttrs{ContentType: "application/json"},
+		Conditions: conds,
+	})
+	if _, err := w.Write(b); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed write job gs://%s/%s: %w", s.bucket, name, err)
+	}
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("failed write job gs://%s/%s: %w", s.bucket, name, errConflict)
+		}
+		return fmt.Errorf("failed write job gs://%s/%s: %w", s.bucket, name, err)
+	}
+	job.generation = w.Attrs().Generation
+	return nil
+}
+
+// Get returns the job with id.
+func (s *Store) Get(ctx context.Context, id string) (*Job, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid job id %q: %w", id, ErrNotFound)
+	}
+	name := s.jobName(id)
+	attrs, err := s.objs.Attrs(ctx, s.bucket, name, nil)
+	if errors.Is(err, objstore.ErrObjectNotExist) {
+		return nil, fmt.Errorf("job %s: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed read job gs://%s/%s: %w", s.bucket, name, err)
+	}
+	b, err := s.read(ctx, name, attrs.Generation)
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(b, &job); err != nil {
+		return nil, fmt.Errorf("failed json.Unmarshal job gs://%s/%s: %w", s.bucket, name, err)
+	}
+	job.generation = attrs.Generation
+	return &job, nil
+}
+
+// staleMarker is how old a marker without its job has to be before ListActive
+// removes it, so that a job being created is not mistaken for a failed create.
+const staleMarker = 10 * time.Minute
+
+// ListActive returns the jobs which are not done yet, ordered by creation time.
+func (s *Store) ListActive(ctx context.Context) ([]*Job, error) {
+	var jobs []*Job
+	q := &objstore.Query{Prefix: s.activePrefix()}
+	token := ""
+	for {
+		page, err := s.objs.List(ctx, s.bucket, q, 0, token)
+		if err != nil {
+			return nil, fmt.Errorf("failed list jobs gs://%s/%s: %w", s.bucket, s.activePrefix(), err)
+		}
+		for _, attrs := range page.Objects {
+			id := strings.TrimPrefix(attrs.Name, s.activePrefix())
+			job, err := s.Get(ctx, id)
+			if errors.Is(err, ErrNotFound) {
+				// the create of the job failed after its marker was written
+				if time.Since(attrs.Updated) > staleMarker {
+					_ = s.deactivate(ctx, id)
+				}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if job.State.Done() {
+				// the instance finishing the job failed to remove the marker
+				_ = s.deactivate(ctx, id)
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs, nil
+}
+
+// writeResults stores the results of a checkpoint as part of the job.
+//
+// A part is written only if it does not exist yet, and errConflict is returned
+// otherwise. An existing part was written either by the instance holding the
+// lease now, or by an instance which lost the lease before committing the part
+// to the job. In the latter case the owner replaces it by passing its generation
+// as replace, which an instance that lost the lease never does.
+func (s *Store) writeResults(ctx context.Context, id string, part int, results []*Result, replace int64) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, r := range results {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("failed json.Marshal result: %w", err)
+		}
+	}
+	conds := &objstore.Conditions{DoesNotExist: true}
+	if replace != 0 {
+		conds = &objstore.Conditions{GenerationMatch: replace}
+	}
+	name := s.resultName(id, part)
+	w := s.objs.NewWriter(ctx, s.bucket, name, &objstore.WriteOptions{
+		Attrs:      objstore.ObjectAttrs{ContentType: "application/x-ndjson"},
+		Conditions: conds,
+	})
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed write results gs://%s/%s: %w", s.bucket, name, err)
+	}
+	if err := w.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("failed write results gs://%s/%s: %w", s.bucket, name, errConflict)
+		}
+		return fmt.Errorf("failed write results gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return nil
+}
+
+// resultGeneration returns the generation of a part of the results of the job with id.
+func (s *Store) resultGeneration(ctx context.Context, id string, part int) (int64, error) {
+	name := s.resultName(id, part)
+	attrs, err := s.objs.Attrs(ctx, s.bucket, name, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed read results gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return attrs.Generation, nil
+}
+
+// EachResult calls fn with each result of job recorded up to its last checkpoint,
+// reading one part at a time so that the results of a large job are not held in memory.
+// It stops at the first error returned by fn.
+func (s *Store) EachResult(ctx context.Context, job *Job, fn func(*Result) error) error {
+	for part := 1; part <= job.ResultParts; part++ {
+		if err := s.eachResultOf(ctx, job.ID, part, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) eachResultOf(ctx context.Context, id string, part int, fn func(*Result) error) error {
+	name := s.resultName(id, part)
+	r, err := s.objs.NewReader(ctx, s.bucket, name, nil)
+	if err != nil {
+		return fmt.Errorf("failed read gs://%s/%s: %w", s.bucket, name, err)
+	}
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var result Result
+		if err := dec.Decode(&result); err != nil {
+			return fmt.Errorf("failed decode results of job %s part %d: %w", id, part, err)
+		}
+		if err := fn(&result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) read(ctx context.Context, name string, generation int64) ([]byte, error) {
+	r, err := s.objs.NewReader(ctx, s.bucket, name, &objstore.ObjectOptions{Generation: generation})
+	if err != nil {
+		return nil, fmt.Errorf("failed read gs://%s/%s: %w", s.bucket, name, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed read gs://%s/%s: %w", s.bucket, name, err)
+	}
+	return b, nil
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// ListObjects returns the names of up to limit live objects in bucket under
+// prefix which sort after cursor. It is the usual Worker.Next for jobs walking a prefix.
+func ListObjects(ctx context.Context, objs objstore.ObjectStore, bucket string, prefix string, cursor string, limit int) ([]string, error) {
+	q := &objstore.Query{Prefix: prefix}
+	if cursor != "" {
+		// StartOffset is inclusive, and "\x00" is the smallest suffix making the name greater than cursor
+		q.StartOffset = cursor + "\x00"
+	}
+	var names []string
+	token := ""
+	for len(names) < limit {
+		page, err := objs.List(ctx, bucket, q, limit-len(names), token)
+		if err != nil {
+			return nil, fmt.Errorf("failed list objects gs://%s/%s: %w", bucket, prefix, err)
+		}
+		for _, attrs := range page.Objects {
+			names = append(names, attrs.Name)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		token = page.NextPageToken
+	}
+	if len(names) > limit {
+		names = names[:limit]
+	}
+	return names, nil
+}
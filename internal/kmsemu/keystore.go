@@ -0,0 +1,511 @@
+// Package kmsemu is a local stand-in for the subset of the Cloud KMS v1 REST API
+// used by encryption.CSEKService: symmetric encrypt and decrypt, key versions,
+// primary version rotation, and disabling or destroying versions.
+//
+// Point the real cloudkms.Service at a Server with option.WithEndpoint and
+// option.WithoutAuthentication to run rotation and disabled-key scenarios offline.
+//
+// It differs from Cloud KMS in a few deliberate ways:
+//   - key rings are implicit, creating a key creates its key ring
+//   - destroying a version erases its key material immediately instead of
+//     scheduling the destruction
+//   - the ciphertext format is specific to the emulator
+//
+// Key material is kept in plain text in the keystore file. Never use it for real data.
+package kmsemu
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the state of a CryptoKeyVersion.
+type State string
+
+const (
+	StateEnabled   State = "ENABLED"
+	StateDisabled  State = "DISABLED"
+	StateDestroyed State = "DESTROYED"
+)
+
+const (
+	// purposeEncryptDecrypt is the only purpose the emulator supports.
+	purposeEncryptDecrypt = "ENCRYPT_DECRYPT"
+
+	// algorithmSymmetric is the algorithm of every version.
+	algorithmSymmetric = "GOOGLE_SYMMETRIC_ENCRYPTION"
+
+	// maxPlaintextSize is the plaintext limit Cloud KMS applies to symmetric encryption.
+	maxPlaintextSize = 64 * 1024
+
+	// ciphertextFormat is the first byte of every ciphertext, followed by the
+	// big endian version ID, the GCM nonce and the sealed plaintext.
+	ciphertextFormat = 1
+)
+
+// CryptoKey is a key as returned by the REST API.
+type CryptoKey struct {
+	Name       string            `json:"name"`
+	Primary    *CryptoKeyVersion `json:"primary,omitempty"`
+	Purpose    string            `json:"purpose"`
+	CreateTime string            `json:"createTime"`
+}
+
+// CryptoKeyVersion is a key version as returned by the REST API.
+type CryptoKeyVersion struct {
+	Name        string `json:"name"`
+	State       State  `json:"state"`
+	Algorithm   string `json:"algorithm"`
+	CreateTime  string `json:"createTime"`
+	DestroyTime string `json:"destroyTime,omitempty"`
+}
+
+// Error is an error in the shape Cloud KMS returns it.
+type Error struct {
+	// Code is the HTTP status code.
+	Code int
+	// Status is the canonical gRPC code name, such as FAILED_PRECONDITION.
+	Status  string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kmsemu: %s: %s", e.Status, e.Message)
+}
+
+func errNotFound(name string) error {
+	return &Error{Code: http.StatusNotFound, Status: "NOT_FOUND", Message: fmt.Sprintf("%s not found.", name)}
+}
+
+func errInvalidArgument(format string, a ...interface{}) error {
+	return &Error{Code: http.StatusBadRequest, Status: "INVALID_ARGUMENT", Message: fmt.Sprintf(format, a...)}
+}
+
+func errFailedPrecondition(format string, a ...interface{}) error {
+	return &Error{Code: http.StatusBadRequest, Status: "FAILED_PRECONDITION", Message: fmt.Sprintf(format, a...)}
+}
+
+func errAlreadyExists(name string) error {
+	return &Error{Code: http.StatusConflict, Status: "ALREADY_EXISTS", Message: fmt.Sprintf("%s already exists.", name)}
+}
+
+// storedKey is a key as persisted in the keystore file.
+type storedKey struct {
+	Name     string           `json:"name"`
+	Primary  int              `json:"primary"`
+	Created  time.Time        `json:"created"`
+	Versions []*storedVersion `json:"versions"`
+}
+
+// storedVersion is a key version as persisted in the keystore file.
+type storedVersion struct {
+	ID        int        `json:"id"`
+	State     State      `json:"state"`
+	Material  []byte     `json:"material,omitempty"`
+	Created   time.Time  `json:"created"`
+	Destroyed *time.Time `json:"destroyed,omitempty"`
+}
+
+// Keystore holds the keys of the emulator.
+// Every change is written to its file before it returns, so a restarted emulator
+// can still decrypt what it encrypted.
+type Keystore struct {
+	mu   sync.Mutex
+	path string
+	keys map[string]*storedKey
+	now  func() time.Time
+}
+
+// OpenKeystore opens the keystore kept in path, creating it on the first change.
+// An empty path keeps the keys in memory only.
+func OpenKeystore(path string) (*Keystore, error) {
+	ks := &Keystore{path: path, keys: map[string]*storedKey{}, now: time.Now}
+	if path == "" {
+		return ks, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed read keystore %s: %w", path, err)
+	}
+	var keys []*storedKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("failed decode keystore %s: %w", path, err)
+	}
+	for _, k := range keys {
+		ks.keys[k.Name] = k
+	}
+	return ks, nil
+}
+
+// CreateKey creates the key name with an enabled primary version 1.
+// name has the form projects/*/locations/*/keyRings/*/cryptoKeys/*.
+func (ks *Keystore) CreateKey(name string) (*CryptoKey, error) {
+	if !isKeyName(name) {
+		return nil, errInvalidArgument("invalid crypto key name %q", name)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.keys[name]; ok {
+		return nil, errAlreadyExists(name)
+	}
+	k := &storedKey{Name: name, Created: ks.now().UTC()}
+	v, err := ks.newVersion(k)
+	if err != nil {
+		return nil, err
+	}
+	k.Primary = v.ID
+	ks.keys[name] = k
+	if err := ks.save(); err != nil {
+		delete(ks.keys, name)
+		return nil, err
+	}
+	return ks.cryptoKey(k), nil
+}
+
+// GetKey returns the key name.
+func (ks *Keystore) GetKey(name string) (*CryptoKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[name]
+	if !ok {
+		return nil, errNotFound(name)
+	}
+	return ks.cryptoKey(k), nil
+}
+
+// CreateVersion adds an enabled version to keyName. The primary version does not change.
+func (ks *Keystore) CreateVersion(keyName string) (*CryptoKeyVersion, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[keyName]
+	if !ok {
+		return nil, errNotFound(keyName)
+	}
+	v, err := ks.newVersion(k)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.save(); err != nil {
+		k.Versions = k.Versions[:len(k.Versions)-1]
+		return nil, err
+	}
+	return versionOf(k, v), nil
+}
+
+// ListVersions returns every version of keyName in ID order.
+func (ks *Keystore) ListVersions(keyName string) ([]*CryptoKeyVersion, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[keyName]
+	if !ok {
+		return nil, errNotFound(keyName)
+	}
+	versions := make([]*CryptoKeyVersion, 0, len(k.Versions))
+	for _, v := range k.Versions {
+		versions = append(versions, versionOf(k, v))
+	}
+	return versions, nil
+}
+
+// GetVersion returns the version versionName.
+func (ks *Keystore) GetVersion(versionName string) (*CryptoKeyVersion, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, v, err := ks.version(versionName)
+	if err != nil {
+		return nil, err
+	}
+	return versionOf(k, v), nil
+}
+
+// UpdatePrimaryVersion makes versionID the primary version of keyName.
+// Like Cloud KMS, only an enabled version can become the primary.
+func (ks *Keystore) UpdatePrimaryVersion(keyName string, versionID string) (*CryptoKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, v, err := ks.version(keyName + "/cryptoKeyVersions/" + versionID)
+	if err != nil {
+		return nil, err
+	}
+	if v.State != StateEnabled {
+		return nil, errFailedPrecondition("%s is not enabled, current state is: %s.", versionOf(k, v).Name, v.State)
+	}
+	prev := k.Primary
+	k.Primary = v.ID
+	if err := ks.save(); err != nil {
+		k.Primary = prev
+		return nil, err
+	}
+	return ks.cryptoKey(k), nil
+}
+
+// SetVersionState enables or disables versionName.
+// A destroyed version can not be enabled again.
+func (ks *Keystore) SetVersionState(versionName string, state State) (*CryptoKeyVersion, error) {
+	if state != StateEnabled && state != StateDisabled {
+		return nil, errInvalidArgument("invalid state %q, only ENABLED and DISABLED can be set", state)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, v, err := ks.version(versionName)
+	if err != nil {
+		return nil, err
+	}
+	if v.State == StateDestroyed {
+		return nil, errFailedPrecondition("%s is destroyed.", versionName)
+	}
+	prev := v.State
+	v.State = state
+	if err := ks.save(); err != nil {
+		v.State = prev
+		return nil, err
+	}
+	return versionOf(k, v), nil
+}
+
+// DestroyVersion erases the key material of versionName.
+// Data encrypted with the version can never be decrypted again.
+func (ks *Keystore) DestroyVersion(versionName string) (*CryptoKeyVersion, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, v, err := ks.version(versionName)
+	if err != nil {
+		return nil, err
+	}
+	if v.State == StateDestroyed {
+		return nil, errFailedPrecondition("%s is already destroyed.", versionName)
+	}
+	now := ks.now().UTC()
+	v.State = StateDestroyed
+	v.Material = nil
+	v.Destroyed = &now
+	if err := ks.save(); err != nil {
+		return nil, err
+	}
+	return versionOf(k, v), nil
+}
+
+// Encrypt encrypts plaintext with the primary version of the key name, or with
+// the version name. It returns the name of the version used.
+func (ks *Keystore) Encrypt(name string, plaintext []byte, aad []byte) (versionName string, ciphertext []byte, err error) {
+	if len(plaintext) > maxPlaintextSize {
+		return "", nil, errInvalidArgument("The plaintext must be at most %d bytes.", maxPlaintextSize)
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var k *storedKey
+	var v *storedVersion
+	if isKeyName(name) {
+		var ok bool
+		k, ok = ks.keys[name]
+		if !ok {
+			return "", nil, errNotFound(name)
+		}
+		v = findVersion(k, k.Primary)
+	} else {
+		k, v, err = ks.version(name)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	versionName = versionOf(k, v).Name
+	if v.State != StateEnabled {
+		return "", nil, errFailedPrecondition("%s is not enabled, current state is: %s.", versionName, v.State)
+	}
+
+	aead, err := newAEAD(v.Material)
+	if err != nil {
+		return "", nil, err
+	}
+	header := make([]byte, 5, 5+aead.NonceSize())
+	header[0] = ciphertextFormat
+	binary.BigEndian.PutUint32(header[1:], uint32(v.ID))
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, fmt.Errorf("failed generate nonce: %w", err)
+	}
+	ciphertext = aead.Seal(append(header, nonce...), nonce, plaintext, aad)
+	return versionName, ciphertext, nil
+}
+
+// Decrypt decrypts ciphertext produced by Encrypt with any version of keyName.
+// usedPrimary reports whether the version is the current primary.
+func (ks *Keystore) Decrypt(keyName string, ciphertext []byte, aad []byte) (plaintext []byte, usedPrimary bool, err error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[keyName]
+	if !ok {
+		return nil, false, errNotFound(keyName)
+	}
+	invalid := errInvalidArgument("Decryption failed: the ciphertext is invalid.")
+	if len(ciphertext) < 5 || ciphertext[0] != ciphertextFormat {
+		return nil, false, invalid
+	}
+	v := findVersion(k, int(binary.BigEndian.Uint32(ciphertext[1:5])))
+	if v == nil {
+		return nil, false, invalid
+	}
+	if v.State != StateEnabled {
+		return nil, false, errFailedPrecondition("%s is not enabled, current state is: %s.", versionOf(k, v).Name, v.State)
+	}
+	aead, err := newAEAD(v.Material)
+	if err != nil {
+		return nil, false, err
+	}
+	body := ciphertext[5:]
+	if len(body) < aead.NonceSize() {
+		return nil, false, invalid
+	}
+	plaintext, err = aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, false, invalid
+	}
+	return plaintext, v.ID == k.Primary, nil
+}
+
+// newVersion appends a new enabled version with fresh key material to k.
+func (ks *Keystore) newVersion(k *storedKey) (*storedVersion, error) {
+	material := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, material); err != nil {
+		return nil, fmt.Errorf("failed generate key material: %w", err)
+	}
+	id := 1
+	if n := len(k.Versions); n > 0 {
+		id = k.Versions[n-1].ID + 1
+	}
+	v := &storedVersion{ID: id, State: StateEnabled, Material: material, Created: ks.now().UTC()}
+	k.Versions = append(k.Versions, v)
+	return v, nil
+}
+
+// version looks up versionName, which has the form {key}/cryptoKeyVersions/{id}.
+func (ks *Keystore) version(versionName string) (*storedKey, *storedVersion, error) {
+	i := strings.LastIndex(versionName, "/cryptoKeyVersions/")
+	if i < 0 {
+		return nil, nil, errInvalidArgument("invalid crypto key version name %q", versionName)
+	}
+	k, ok := ks.keys[versionName[:i]]
+	if !ok {
+		return nil, nil, errNotFound(versionName)
+	}
+	id, err := strconv.Atoi(versionName[i+len("/cryptoKeyVersions/"):])
+	if err != nil {
+		return nil, nil, errInvalidArgument("invalid crypto key version name %q", versionName)
+	}
+	v := findVersion(k, id)
+	if v == nil {
+		return nil, nil, errNotFound(versionName)
+	}
+	return k, v, nil
+}
+
+// save writes every key to the keystore file through a temporary file, so that
+// a crash never leaves a truncated keystore behind.
+func (ks *Keystore) save() error {
+	if ks.path == "" {
+		return nil
+	}
+	keys := make([]*storedKey, 0, len(ks.keys))
+	for _, k := range ks.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	b, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed encode keystore: %w", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(ks.path), filepath.Base(ks.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed create keystore %s: %w", ks.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed write keystore %s: %w", ks.path, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed write keystore %s: %w", ks.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed write keystore %s: %w", ks.path, err)
+	}
+	if err := os.Rename(tmp.Name(), ks.path); err != nil {
+		return fmt.Errorf("failed write keystore %s: %w", ks.path, err)
+	}
+	return nil
+}
+
+func (ks *Keystore) cryptoKey(k *storedKey) *CryptoKey {
+	return &CryptoKey{
+		Name:       k.Name,
+		Primary:    versionOf(k, findVersion(k, k.Primary)),
+		Purpose:    purposeEncryptDecrypt,
+		CreateTime: k.Created.Format(time.RFC3339Nano),
+	}
+}
+
+func versionOf(k *storedKey, v *storedVersion) *CryptoKeyVersion {
+	if v == nil {
+		return nil
+	}
+	cv := &CryptoKeyVersion{
+		Name:       fmt.Sprintf("%s/cryptoKeyVersions/%d", k.Name, v.ID),
+		State:      v.State,
+		Algorithm:  algorithmSymmetric,
+		CreateTime: v.Created.Format(time.RFC3339Nano),
+	}
+	if v.Destroyed != nil {
+		cv.DestroyTime = v.Destroyed.Format(time.RFC3339Nano)
+	}
+	return cv
+}
+
+func findVersion(k *storedKey, id int) *storedVersion {
+	for _, v := range k.Versions {
+		if v.ID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func newAEAD(material []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(material)
+	if err != nil {
+		return nil, fmt.Errorf("failed aes.NewCipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// isKeyName reports whether name has the form projects/*/locations/*/keyRings/*/cryptoKeys/*.
+func isKeyName(name string) bool {
+	s := strings.Split(name, "/")
+	if len(s) != 8 {
+		return false
+	}
+	for i, c := range []string{"projects", "locations", "keyRings", "cryptoKeys"} {
+		if s[i*2] != c || s[i*2+1] == "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,136 @@
+package kmsemu
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const keyName = "projects/p/locations/global/keyRings/r/cryptoKeys/k"
+
+type apiError struct {
+	Error struct {
+		Code   int    `json:"code"`
+		Status string `json:"status"`
+		Errors []struct {
+			Reason string `json:"reason"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+func call(t *testing.T, srv *httptest.Server, method string, path string, req interface{}, resp interface{}) int {
+	t.Helper()
+	b, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest(method, srv.URL+"/v1/"+path, bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := srv.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func encrypt(t *testing.T, srv *httptest.Server, plaintext string) *encryptResponse {
+	t.Helper()
+	var resp encryptResponse
+	if code := call(t, srv, http.MethodPost, keyName+":encrypt", &encryptRequest{Plaintext: base64.StdEncoding.EncodeToString([]byte(plaintext))}, &resp); code != http.StatusOK {
+		t.Fatalf("want 200 but got %d", code)
+	}
+	return &resp
+}
+
+func TestServer_Rotation(t *testing.T) {
+	srv := httptest.NewServer(NewServer(mustOpen(t, "")))
+	defer srv.Close()
+
+	var key CryptoKey
+	if code := call(t, srv, http.MethodPost, "projects/p/locations/global/keyRings/r/cryptoKeys?cryptoKeyId=k", struct{}{}, &key); code != http.StatusOK {
+		t.Fatalf("want 200 but got %d", code)
+	}
+	v1 := encrypt(t, srv, "hello")
+	if v1.Name != keyName+"/cryptoKeyVersions/1" {
+		t.Errorf("want version 1 but got %s", v1.Name)
+	}
+
+	var v2 CryptoKeyVersion
+	call(t, srv, http.MethodPost, keyName+"/cryptoKeyVersions", struct{}{}, &v2)
+	call(t, srv, http.MethodPost, keyName+":updatePrimaryVersion", &updatePrimaryVersionRequest{CryptoKeyVersionID: "2"}, &key)
+	if key.Primary.Name != v2.Name {
+		t.Errorf("want primary %s but got %s", v2.Name, key.Primary.Name)
+	}
+	if got := encrypt(t, srv, "hello"); got.Name != v2.Name {
+		t.Errorf("want %s but got %s", v2.Name, got.Name)
+	}
+
+	var dec decryptResponse
+	if code := call(t, srv, http.MethodPost, keyName+":decrypt", &decryptRequest{Ciphertext: v1.Ciphertext}, &dec); code != http.StatusOK {
+		t.Fatalf("want 200 but got %d", code)
+	}
+	if dec.Plaintext != base64.StdEncoding.EncodeToString([]byte("hello")) || dec.UsedPrimary {
+		t.Errorf("want hello with a non primary version but got %+v", dec)
+	}
+
+	var e apiError
+	call(t, srv, http.MethodPatch, keyName+"/cryptoKeyVersions/1?updateMask=state", &CryptoKeyVersion{State: StateDisabled}, &struct{}{})
+	if code := call(t, srv, http.MethodPost, keyName+":decrypt", &decryptRequest{Ciphertext: v1.Ciphertext}, &e); code != http.StatusBadRequest || e.Error.Status != "FAILED_PRECONDITION" || e.Error.Errors[0].Reason != "failedPrecondition" {
+		t.Errorf("want FAILED_PRECONDITION for a disabled version but got %d %+v", code, e)
+	}
+
+	call(t, srv, http.MethodPost, keyName+"/cryptoKeyVersions/1:destroy", struct{}{}, &struct{}{})
+	if code := call(t, srv, http.MethodPatch, keyName+"/cryptoKeyVersions/1?updateMask=state", &CryptoKeyVersion{State: StateEnabled}, &e); code != http.StatusBadRequest {
+		t.Errorf("want 400 when enabling a destroyed version but got %d", code)
+	}
+
+	tampered, _ := base64.StdEncoding.DecodeString(v1.Ciphertext)
+	tampered[len(tampered)-1] ^= 1
+	tampered[4] = 2
+	if code := call(t, srv, http.MethodPost, keyName+":decrypt", &decryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(tampered)}, &e); code != http.StatusBadRequest || e.Error.Status != "INVALID_ARGUMENT" {
+		t.Errorf("want INVALID_ARGUMENT for a tampered ciphertext but got %d %+v", code, e)
+	}
+}
+
+func TestKeystore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	ks := mustOpen(t, path)
+	if _, err := ks.CreateKey(keyName); err != nil {
+		t.Fatal(err)
+	}
+	_, ciphertext, err := ks.Encrypt(keyName, []byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks = mustOpen(t, path)
+	plaintext, usedPrimary, err := ks.Decrypt(keyName, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "hello" || !usedPrimary {
+		t.Errorf("want hello with the primary version but got %q, %v", plaintext, usedPrimary)
+	}
+	if _, _, err := ks.Decrypt(keyName, ciphertext, []byte("aad")); err == nil {
+		t.Error("want error with different additional authenticated data but got nil")
+	}
+}
+
+func mustOpen(t *testing.T, path string) *Keystore {
+	t.Helper()
+	ks, err := OpenKeystore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
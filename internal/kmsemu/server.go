@@ -0,0 +1,259 @@
+package kmsemu
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Server serves the Cloud KMS v1 REST API subset backed by a Keystore:
+//
+//	POST  /v1/{keyRing}/cryptoKeys?cryptoKeyId=ID
+//	GET   /v1/{key}
+//	POST  /v1/{key}:encrypt
+//	POST  /v1/{key}:decrypt
+//	POST  /v1/{key}:updatePrimaryVersion
+//	GET   /v1/{key}/cryptoKeyVersions
+//	POST  /v1/{key}/cryptoKeyVersions
+//	GET   /v1/{version}
+//	PATCH /v1/{version}?updateMask=state
+//	POST  /v1/{version}:destroy
+type Server struct {
+	ks *Keystore
+}
+
+// NewServer returns a Server serving the keys of ks.
+func NewServer(ks *Keystore) *Server {
+	return &Server{ks: ks}
+}
+
+// Keystore returns the keystore the server serves, to set up keys directly.
+func (s *Server) Keystore() *Keystore {
+	return s.ks
+}
+
+type encryptRequest struct {
+	Plaintext                   string `json:"plaintext"`
+	AdditionalAuthenticatedData string `json:"additionalAuthenticatedData,omitempty"`
+}
+
+type encryptResponse struct {
+	Name       string `json:"name"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+type decryptRequest struct {
+	Ciphertext                  string `json:"ciphertext"`
+	AdditionalAuthenticatedData string `json:"additionalAuthenticatedData,omitempty"`
+}
+
+type decryptResponse struct {
+	Plaintext   string `json:"plaintext"`
+	UsedPrimary bool   `json:"usedPrimary"`
+}
+
+type updatePrimaryVersionRequest struct {
+	CryptoKeyVersionID string `json:"cryptoKeyVersionId"`
+}
+
+type listVersionsResponse struct {
+	CryptoKeyVersions []*CryptoKeyVersion `json:"cryptoKeyVersions"`
+	TotalSize         int                 `json:"totalSize"`
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.route(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	// the status is sent with the first write, so an encoding error can not be reported
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) route(r *http.Request) (interface{}, error) {
+	if !strings.HasPrefix(r.URL.Path, "/v1/") {
+		return nil, errNotFound(r.URL.Path)
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/v1/")
+	verb := ""
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, verb = name[:i], name[i+1:]
+	}
+
+	switch {
+	case r.Method == http.MethodPost && verb == "" && strings.HasSuffix(name, "/cryptoKeys"):
+		id := r.URL.Query().Get("cryptoKeyId")
+		if id == "" {
+			return nil, errInvalidArgument("cryptoKeyId is required")
+		}
+		return s.ks.CreateKey(name + "/" + id)
+	case isKeyName(name):
+		return s.routeKey(r, name, verb)
+	case strings.HasSuffix(name, "/cryptoKeyVersions") && isKeyName(strings.TrimSuffix(name, "/cryptoKeyVersions")):
+		keyName := strings.TrimSuffix(name, "/cryptoKeyVersions")
+		switch {
+		case r.Method == http.MethodGet && verb == "":
+			versions, err := s.ks.ListVersions(keyName)
+			if err != nil {
+				return nil, err
+			}
+			return &listVersionsResponse{CryptoKeyVersions: versions, TotalSize: len(versions)}, nil
+		case r.Method == http.MethodPost && verb == "":
+			return s.ks.CreateVersion(keyName)
+		}
+	case strings.Contains(name, "/cryptoKeyVersions/"):
+		return s.routeVersion(r, name, verb)
+	}
+	return nil, errUnsupported(r)
+}
+
+func (s *Server) routeKey(r *http.Request, name string, verb string) (interface{}, error) {
+	switch {
+	case r.Method == http.MethodGet && verb == "":
+		return s.ks.GetKey(name)
+	case r.Method == http.MethodPost && verb == "encrypt":
+		var req encryptRequest
+		if err := decodeBody(r, &req); err != nil {
+			return nil, err
+		}
+		return s.encrypt(name, &req)
+	case r.Method == http.MethodPost && verb == "decrypt":
+		var req decryptRequest
+		if err := decodeBody(r, &req); err != nil {
+			return nil, err
+		}
+		return s.decrypt(name, &req)
+	case r.Method == http.MethodPost && verb == "updatePrimaryVersion":
+		var req updatePrimaryVersionRequest
+		if err := decodeBody(r, &req); err != nil {
+			return nil, err
+		}
+		return s.ks.UpdatePrimaryVersion(name, req.CryptoKeyVersionID)
+	}
+	return nil, errUnsupported(r)
+}
+
+func (s *Server) routeVersion(r *http.Request, name string, verb string) (interface{}, error) {
+	switch {
+	case r.Method == http.MethodGet && verb == "":
+		return s.ks.GetVersion(name)
+	case r.Method == http.MethodPatch && verb == "":
+		if mask := r.URL.Query().Get("updateMask"); mask != "state" {
+			return nil, errInvalidArgument("updateMask must be state but got %q", mask)
+		}
+		var req CryptoKeyVersion
+		if err := decodeBody(r, &req); err != nil {
+			return nil, err
+		}
+		return s.ks.SetVersionState(name, req.State)
+	case r.Method == http.MethodPost && verb == "encrypt":
+		var req encryptRequest
+		if err := decodeBody(r, &req); err != nil {
+			return nil, err
+		}
+		return s.encrypt(name, &req)
+	case r.Method == http.MethodPost && verb == "destroy":
+		return s.ks.DestroyVersion(name)
+	}
+	return nil, errUnsupported(r)
+}
+
+func (s *Server) encrypt(name string, req *encryptRequest) (*encryptResponse, error) {
+	plaintext, err := decodeBytes("plaintext", req.Plaintext)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := decodeBytes("additionalAuthenticatedData", req.AdditionalAuthenticatedData)
+	if err != nil {
+		return nil, err
+	}
+	versionName, ciphertext, err := s.ks.Encrypt(name, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptResponse{Name: versionName, Ciphertext: base64.StdEncoding.EncodeToString(ciphertext)}, nil
+}
+
+func (s *Server) decrypt(name string, req *decryptRequest) (*decryptResponse, error) {
+	ciphertext, err := decodeBytes("ciphertext", req.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	aad, err := decodeBytes("additionalAuthenticatedData", req.AdditionalAuthenticatedData)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, usedPrimary, err := s.ks.Decrypt(name, ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptResponse{Plaintext: base64.StdEncoding.EncodeToString(plaintext), UsedPrimary: usedPrimary}, nil
+}
+
+func errUnsupported(r *http.Request) error {
+	return &Error{Code: http.StatusNotFound, Status: "NOT_FOUND", Message: fmt.Sprintf("%s %s is not supported by the emulator.", r.Method, r.URL.Path)}
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errInvalidArgument("Invalid JSON payload received. %s", err)
+	}
+	return nil
+}
+
+// decodeBytes decodes a bytes field. Like the JSON mapping of protobuf, it accepts
+// both standard and URL safe base64.
+func decodeBytes(field string, s string) ([]byte, error) {
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidArgument("Invalid value at '%s' (TYPE_BYTES), Base64 decoding failed.", field)
+	}
+	return b, nil
+}
+
+// writeError writes err in the JSON error format of Google APIs, so that
+// googleapi.CheckResponse turns it into a *googleapi.Error with the same Code and Reason.
+func writeError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		e = &Error{Code: http.StatusInternalServerError, Status: "INTERNAL", Message: err.Error()}
+	}
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    e.Code,
+			"message": e.Message,
+			"status":  e.Status,
+			"errors": []map[string]string{{
+				"message": e.Message,
+				"domain":  "global",
+				"reason":  reason(e.Status),
+			}},
+		},
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(e.Code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// reason converts a status such as FAILED_PRECONDITION into the reason failedPrecondition.
+func reason(status string) string {
+	if status == "INVALID_ARGUMENT" {
+		return "badRequest"
+	}
+	parts := strings.Split(strings.ToLower(status), "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,220 @@
+// Package logging writes log entries in the Cloud Logging structured format,
+// correlated with the trace held by the context, or as plain text for local development.
+//
+// See https://cloud.google.com/logging/docs/structured-logging
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/internal/trace"
+)
+
+// Severity is the Cloud Logging severity of an entry.
+type Severity string
+
+const (
+	SeverityDebug    Severity = "DEBUG"
+	SeverityInfo     Severity = "INFO"
+	SeverityWarning  Severity = "WARNING"
+	SeverityError    Severity = "ERROR"
+	SeverityCritical Severity = "CRITICAL"
+)
+
+// Format is the output format of a Logger.
+type Format string
+
+const (
+	// FormatJSON writes one Cloud Logging structured JSON entry per line.
+	FormatJSON Format = "json"
+
+	// FormatText writes one human readable line per entry.
+	FormatText Format = "text"
+)
+
+// ParseFormat returns the Format named s.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSON, FormatText:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unsupported log format: %s", s)
+	}
+}
+
+const (
+	traceKey        = "logging.googleapis.com/trace"
+	spanIDKey       = "logging.googleapis.com/spanId"
+	traceSampledKey = "logging.googleapis.com/trace_sampled"
+)
+
+// Logger writes log entries to w.
+type Logger struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    Format
+	projectID string
+	now       func() time.Time
+}
+
+// New returns a Logger writing entries in format to w.
+// projectID is used to build the fully qualified trace name that Cloud Logging
+// requires to link an entry to Cloud Trace.
+func New(w io.Writer, format Format, projectID string) *Logger {
+	return &Logger{
+		w:         w,
+		format:    format,
+		projectID: projectID,
+		now:       time.Now,
+	}
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger = New(os.Stdout, FormatText, "")
+)
+
+// SetDefault replaces the Logger used by the package level functions.
+func SetDefault(l *Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultLogger = l
+}
+
+// Default returns the Logger used by the package level functions.
+func Default() *Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultLogger
+}
+
+type fieldsKey struct{}
+
+// WithFields returns a copy of ctx whose log entries all carry kv
+// in addition to the fields already held by ctx.
+func WithFields(ctx context.Context, kv map[string]interface{}) context.Context {
+	merged := map[string]interface{}{}
+	for k, v := range fieldsFromContext(ctx) {
+		merged[k] = v
+	}
+	for k, v := range kv {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// WithObject returns a copy of ctx whose log entries carry bucket and object.
+func WithObject(ctx context.Context, bucket string, object string) context.Context {
+	return WithFields(ctx, map[string]interface{}{
+		"bucket": bucket,
+		"object": object,
+	})
+}
+
+func fieldsFromContext(ctx context.Context) map[string]interface{} {
+	kv, _ := ctx.Value(fieldsKey{}).(map[string]interface{})
+	return kv
+}
+
+// Log writes an entry with the given severity.
+// The fields held by ctx and the span held by ctx are recorded with the message.
+func (l *Logger) Log(ctx context.Context, severity Severity, message string) {
+	entry := map[string]interface{}{}
+	for k, v := range fieldsFromContext(ctx) {
+		entry[k] = v
+	}
+	if sc, ok := trace.FromContext(ctx); ok && sc.TraceID != [16]byte{} {
+		entry[traceKey] = l.traceName(sc)
+		entry[spanIDKey] = sc.SpanIDString()
+		entry[traceSampledKey] = sc.Sampled
+	}
+
+	var line []byte
+	switch l.format {
+	case FormatText:
+		line = l.textLine(severity, message, entry)
+	default:
+		entry["severity"] = severity
+		entry["message"] = message
+		entry["time"] = l.now().Format(time.RFC3339Nano)
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b, _ = json.Marshal(map[string]interface{}{
+				"severity": severity,
+				"message":  fmt.Sprintf("%s (failed json.Marshal log fields: %s)", message, err),
+				"time":     l.now().Format(time.RFC3339Nano),
+			})
+		}
+		line = append(b, '\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.w.Write(line)
+}
+
+func (l *Logger) traceName(sc trace.SpanContext) string {
+	if l.projectID == "" {
+		return sc.TraceIDString()
+	}
+	return fmt.Sprintf("projects/%s/traces/%s", l.projectID, sc.TraceIDString())
+}
+
+func (l *Logger) textLine(severity Severity, message string, fields map[string]interface{}) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-8s %s", l.now().Format(time.RFC3339), severity, strings.TrimRight(message, "\n"))
+	for _, k := range keys {
+		name := k
+		switch k {
+		case traceKey:
+			name = "trace"
+		case spanIDKey:
+			name = "spanId"
+		case traceSampledKey:
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%v", name, fields[k])
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// Debugf logs a DEBUG entry with the default Logger.
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	Default().Log(ctx, SeverityDebug, fmt.Sprintf(format, args...))
+}
+
+// Infof logs an INFO entry with the default Logger.
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	Default().Log(ctx, SeverityInfo, fmt.Sprintf(format, args...))
+}
+
+// Warningf logs a WARNING entry with the default Logger.
+func Warningf(ctx context.Context, format string, args ...interface{}) {
+	Default().Log(ctx, SeverityWarning, fmt.Sprintf(format, args...))
+}
+
+// Errorf logs an ERROR entry with the default Logger.
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	Default().Log(ctx, SeverityError, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs a CRITICAL entry with the default Logger and exits the process.
+func Fatalf(ctx context.Context, format string, args ...interface{}) {
+	Default().Log(ctx, SeverityCritical, fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
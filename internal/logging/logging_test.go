@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatJSON, "my-project")
+	l.now = func() time.Time { return time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	ctx := WithFields(context.Background(), map[string]interface{}{"requestId": "req-1"})
+	ctx = WithObject(ctx, "bucket", "object")
+	l.Log(ctx, SeverityError, "failed upload")
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("failed json.Unmarshal %q: %s", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"severity":  "ERROR",
+		"message":   "failed upload",
+		"time":      "2022-01-02T03:04:05Z",
+		"requestId": "req-1",
+		"bucket":    "bucket",
+		"object":    "object",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: want %v but got %v", k, v, got[k])
+		}
+	}
+	if _, ok := got[traceKey]; ok {
+		t.Errorf("want no %s without a span but got %v", traceKey, got[traceKey])
+	}
+}
+
+func TestLogger_Text(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, FormatText, "")
+	l.now = func() time.Time { return time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	l.Log(WithObject(context.Background(), "bucket", "object"), SeverityInfo, "finish upload\n")
+
+	want := "2022-01-02T03:04:05Z INFO     finish upload bucket=bucket object=object\n"
+	if got := buf.String(); got != want {
+		t.Errorf("want %q but got %q", want, got)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	cases := []struct {
+		name   string
+		header string
+		reuse  bool
+	}{
+		{"caller id", "abc-123", true},
+		{"no id", "", false},
+		{"control characters", "abc\n123", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = RequestID(r.Context())
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if got == "" {
+				t.Fatal("want request id but empty")
+			}
+			if tt.reuse != (got == tt.header) {
+				t.Errorf("want reuse=%v but got %q for %q", tt.reuse, got, tt.header)
+			}
+			if w.Header().Get(RequestIDHeader) != got {
+				t.Errorf("want response header %q but got %q", got, w.Header().Get(RequestIDHeader))
+			}
+		})
+	}
+}
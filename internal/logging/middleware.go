@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/sinmetal/gcs_sample/internal/trace"
+)
+
+// RequestIDHeader carries the request ID in both requests and responses.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength bounds the length of a request ID accepted from the caller.
+const maxRequestIDLength = 128
+
+// requestIDField is the log field holding the request ID.
+const requestIDField = "requestId"
+
+// Middleware assigns a request ID to every request and records it on the log
+// entries and the span of the request. A valid ID sent by the caller in
+// X-Request-Id is reused, otherwise a new one is generated.
+// The ID is echoed back in the X-Request-Id response header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		ctx := WithFields(r.Context(), map[string]interface{}{requestIDField: id})
+		trace.SetAttributesKV(ctx, map[string]interface{}{"http.request_id": id})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestID returns the request ID assigned by Middleware, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := fieldsFromContext(ctx)[requestIDField].(string)
+	return id
+}
+
+// validRequestID reports whether id is short printable ASCII,
+// so that a caller can not inject arbitrary content into the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+const prefix = "github.com/sinmetal/gcs_sample/"
+
+// Encryption modes recorded in KeyMode.
+const (
+	ModeCSEK = "csek"
+	ModeCMEK = "cmek"
+)
+
+// Results recorded in KeyResult.
+const (
+	ResultOK    = "ok"
+	ResultError = "error"
+)
+
+var (
+	// KeyMode is the encryption mode, ModeCSEK or ModeCMEK.
+	KeyMode = tag.MustNewKey("mode")
+
+	// KeyOperation is the service operation, e.g. upload or kms.encrypt.
+	KeyOperation = tag.MustNewKey("operation")
+
+	// KeyBucket is the Cloud Storage bucket.
+	KeyBucket = tag.MustNewKey("bucket")
+
+	// KeyResult is ResultOK or ResultError.
+	KeyResult = tag.MustNewKey("result")
+)
+
+var (
+	mBytesUploaded   = stats.Int64(prefix+"bytes_uploaded", "Bytes written to Cloud Storage", stats.UnitBytes)
+	mBytesDownloaded = stats.Int64(prefix+"bytes_downloaded", "Bytes read from Cloud Storage", stats.UnitBytes)
+	mOperations      = stats.Int64(prefix+"operations", "Number of encryption service operations", stats.UnitDimensionless)
+	mKMSLatency      = stats.Float64(prefix+"kms_latency", "Latency of Cloud KMS calls including retries", stats.UnitMilliseconds)
+)
+
+var (
+	BytesUploadedView = &view.View{
+		Name:        prefix + "bytes_uploaded",
+		Description: "Total bytes written to Cloud Storage",
+		Measure:     mBytesUploaded,
+		TagKeys:     []tag.Key{KeyMode, KeyOperation, KeyBucket, KeyResult},
+		Aggregation: view.Sum(),
+	}
+
+	BytesDownloadedView = &view.View{
+		Name:        prefix + "bytes_downloaded",
+		Description: "Total bytes read from Cloud Storage",
+		Measure:     mBytesDownloaded,
+		TagKeys:     []tag.Key{KeyMode, KeyOperation, KeyBucket, KeyResult},
+		Aggregation: view.Sum(),
+	}
+
+	OperationCountView = &view.View{
+		Name:        prefix + "operation_count",
+		Description: "Count of encryption service operations",
+		Measure:     mOperations,
+		TagKeys:     []tag.Key{KeyMode, KeyOperation, KeyBucket, KeyResult},
+		Aggregation: view.Count(),
+	}
+
+	KMSLatencyView = &view.View{
+		Name:        prefix + "kms_latency",
+		Description: "Latency distribution of Cloud KMS calls",
+		Measure:     mKMSLatency,
+		TagKeys:     []tag.Key{KeyOperation, KeyResult},
+		Aggregation: view.Distribution(1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000),
+	}
+)
+
+// Views are all views provided by this package.
+var Views = []*view.View{
+	BytesUploadedView,
+	BytesDownloadedView,
+	OperationCountView,
+	KMSLatencyView,
+}
+
+// Register registers all Views.
+func Register() error {
+	return view.Register(Views...)
+}
+
+func result(err error) string {
+	if err != nil {
+		return ResultError
+	}
+	return ResultOK
+}
+
+func record(ctx context.Context, mode string, op string, bucket string, err error, ms ...stats.Measurement) {
+	// recording is best effort, a tag error must not fail the operation.
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{
+		tag.Upsert(KeyMode, mode),
+		tag.Upsert(KeyOperation, op),
+		tag.Upsert(KeyBucket, bucket),
+		tag.Upsert(KeyResult, result(err)),
+	}, ms...)
+}
+
+// RecordOperation counts one operation.
+func RecordOperation(ctx context.Context, mode string, op string, bucket string, err error) {
+	record(ctx, mode, op, bucket, err, mOperations.M(1))
+}
+
+// RecordUploadedBytes records n bytes written to bucket.
+func RecordUploadedBytes(ctx context.Context, mode string, op string, bucket string, n int64, err error) {
+	record(ctx, mode, op, bucket, err, mBytesUploaded.M(n))
+}
+
+// RecordDownloadedBytes records n bytes read from bucket.
+func RecordDownloadedBytes(ctx context.Context, mode string, op string, bucket string, n int64, err error) {
+	record(ctx, mode, op, bucket, err, mBytesDownloaded.M(n))
+}
+
+// RecordKMSLatency records the latency of a Cloud KMS call started at start.
+func RecordKMSLatency(ctx context.Context, op string, start time.Time, err error) {
+	_ = stats.RecordWithTags(ctx, []tag.Mutator{
+		tag.Upsert(KeyOperation, op),
+		tag.Upsert(KeyResult, result(err)),
+	}, mKMSLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
+
+// NewCountingReader wraps rc and records the bytes read from it when it is closed.
+func NewCountingReader(ctx context.Context, rc io.ReadCloser, mode string, op string, bucket string) io.ReadCloser {
+	return &countingReader{
+		ctx:    ctx,
+		rc:     rc,
+		mode:   mode,
+		op:     op,
+		bucket: bucket,
+	}
+}
+
+type countingReader struct {
+	ctx    context.Context
+	rc     io.ReadCloser
+	mode   string
+	op     string
+	bucket string
+	n      int64
+	err    error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rc.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	err := r.rc.Close()
+	RecordDownloadedBytes(r.ctx, r.mode, r.op, r.bucket, r.n, r.err)
+	return err
+}
@@ -0,0 +1,242 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+var (
+	// ErrDuplicate is returned by Acquire when the object generation has already been handled.
+	ErrDuplicate = errors.New("notification already handled")
+
+	// ErrInProgress is returned by Acquire when another delivery of the
+	// notification is being handled, and by Complete when the claim was taken
+	// over after it expired.
+	ErrInProgress = errors.New("notification being handled")
+)
+
+// ClaimState is the state of a claim.
+type ClaimState string
+
+const (
+	ClaimProcessing ClaimState = "PROCESSING"
+	ClaimDone       ClaimState = "DONE"
+)
+
+// Claim records that an object generation is being or has been handled.
+type Claim struct {
+	Event   *Event     `json:"event"`
+	State   ClaimState `json:"state"`
+	Expires time.Time  `json:"expires,omitempty"`
+	Updated time.Time  `json:"updated"`
+
+	// Result describes how the event was handled, once the claim is done.
+	Result map[string]string `json:"result,omitempty"`
+
+	name       string
+	generation int64
+}
+
+// Claims keeps a claim per object generation as objects under gs://bucket/prefix:
+//
+//	{prefix}{bucket}/{generation}/{name}
+//
+// A claim is created only if it does not exist, so that one delivery of a
+// notification handles the object generation and the others see it as a duplicate.
+type Claims struct {
+	objs   objstore.ObjectStore
+	bucket string
+	prefix string
+	lease  time.Duration
+	now    func() time.Time
+}
+
+// NewClaims returns Claims kept under gs://bucket/prefix of objs. A claim not
+// completed within lease is taken over by the next delivery of the notification.
+func NewClaims(objs objstore.ObjectStore, bucket string, prefix string, lease time.Duration) *Claims {
+	return &Claims{objs: objs, bucket: bucket, prefix: prefix, lease: lease, now: time.Now}
+}
+
+func (c *Claims) name(e *Event) string {
+	return fmt.Sprintf("%s%s/%d/%s", c.prefix, e.Bucket, e.Generation, e.Name)
+}
+
+// Acquire claims the object generation of e. It returns ErrDuplicate when it
+// has been handled, and ErrInProgress while another claim has not expired.
+func (c *Claims) Acquire(ctx context.Context, e *Event) (*Claim, error) {
+	claim := &Claim{Event: e, State: ClaimProcessing, name: c.name(e)}
+	err := c.write(ctx, claim, &objstore.Conditions{DoesNotExist: true})
+	if !isPreconditionFailed(err) {
+		if err != nil {
+			return nil, err
+		}
+		return claim, nil
+	}
+
+	existing, err := c.read(ctx, claim.name)
+	if errors.Is(err, objstore.ErrObjectNotExist) {
+		// released meanwhile. the notification is delivered again
+		return nil, fmt.Errorf("claim %s released: %w", claim.name, ErrInProgress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if existing.State == ClaimDone {
+		return existing, fmt.Errorf("%s: %w", claim.name, ErrDuplicate)
+	}
+	if c.now().Before(existing.Expires) {
+		return existing, fmt.Errorf("%s until %s: %w", claim.name, existing.Expires.Format(time.RFC3339), ErrInProgress)
+	}
+
+	// the previous claim was abandoned
+	claim.generation = existing.generation
+	err = c.write(ctx, claim, &objstore.Conditions{GenerationMatch: existing.generation})
+	if isPreconditionFailed(err) {
+		return nil, fmt.Errorf("claim %s taken over concurrently: %w", claim.name, ErrInProgress)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return claim, nil
+}
+
+// Complete marks claim as done with result.
+func (c *Claims) Complete(ctx context.Context, claim *Claim, result map[string]string) error {
+	claim.State = ClaimDone
+	claim.Result = result
+	err := c.write(ctx, claim, &objstore.Conditions{GenerationMatch: claim.generation})
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("claim %s taken over after it expired: %w", claim.name, ErrInProgress)
+	}
+	return err
+}
+
+// Keep renews the lease of claim until stop is closed, so that a long handling
+// is not taken over by the next delivery. It returns ErrInProgress as soon as the
+// claim was taken over anyway, and nil once stopped. stop is separate from ctx so
+// that a renewal is never interrupted after it was applied.
+func (c *Claims) Keep(ctx context.Context, claim *Claim, stop <-chan struct{}) error {
+	ticker := time.NewTicker(c.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		err := c.write(ctx, claim, &objstore.Conditions{GenerationMatch: claim.generation})
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("claim %s taken over: %w", claim.name, ErrInProgress)
+		}
+		// a transient failure is retried at the next tick, while the lease lasts
+	}
+}
+
+// Prune deletes the claims last updated before the given time, and returns how many it deleted.
+// Claims have to be kept at least as long as a notification may be delivered again.
+func (c *Claims) Prune(ctx context.Context, before time.Time) (int, error) {
+	var deleted int
+	q := &objstore.Query{Prefix: c.prefix}
+	token := ""
+	for {
+		page, err := c.objs.List(ctx, c.bucket, q, 0, token)
+		if err != nil {
+			return deleted, fmt.Errorf("failed list claims gs://%s/%s: %w", c.bucket, c.prefix, err)
+		}
+		for _, attrs := range page.Objects {
+			if !attrs.Updated.Before(before) {
+				continue
+			}
+			err := c.objs.Delete(ctx, c.bucket, attrs.Name, &objstore.ObjectOptions{
+				Conditions: &objstore.Conditions{GenerationMatch: attrs.Generation},
+			})
+			switch {
+			case err == nil:
+				deleted++
+			case isPreconditionFailed(err), errors.Is(err, objstore.ErrObjectNotExist):
+				// updated or deleted meanwhile
+			default:
+				return deleted, fmt.Errorf("failed delete claim gs://%s/%s: %w", c.bucket, attrs.Name, err)
+			}
+		}
+		if page.NextPageToken == "" {
+			return deleted, nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// Release deletes claim, so that the next delivery of the notification handles it again.
+func (c *Claims) Release(ctx context.Context, claim *Claim) error {
+	err := c.objs.Delete(ctx, c.bucket, claim.name, &objstore.ObjectOptions{
+		Conditions: &objstore.Conditions{GenerationMatch: claim.generation},
+	})
+	if err != nil && !isPreconditionFailed(err) && !errors.Is(err, objstore.ErrObjectNotExist) {
+		return fmt.Errorf("failed release claim gs://%s/%s: %w", c.bucket, claim.name, err)
+	}
+	return nil
+}
+
+func (c *Claims) write(ctx context.Context, claim *Claim, conds *objstore.Conditions) error {
+	now := c.now().UTC()
+	claim.Updated = now
+	claim.Expires = time.Time{}
+	if claim.State == ClaimProcessing {
+		claim.Expires = now.Add(c.lease)
+	}
+	b, err := json.Marshal(claim)
+	if err != nil {
+		return fmt.Errorf("failed json.Marshal claim: %w", err)
+	}
+	w := c.objs.NewWriter(ctx, c.bucket, claim.name, &objstore.WriteOptions{
+		Attrs:      objstore.ObjectAttrs{ContentType: "application/json"},
+		Conditions: conds,
+	})
+	if _, err := w.Write(b); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("failed write claim gs://%s/%s: %w", c.bucket, claim.name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed write claim gs://%s/%s: %w", c.bucket, claim.name, err)
+	}
+	claim.generation = w.Attrs().Generation
+	return nil
+}
+
+func (c *Claims) read(ctx context.Context, name string) (*Claim, error) {
+	attrs, err := c.objs.Attrs(ctx, c.bucket, name, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed read claim gs://%s/%s: %w", c.bucket, name, err)
+	}
+	r, err := c.objs.NewReader(ctx, c.bucket, name, &objstore.ObjectOptions{Generation: attrs.Generation})
+	if err != nil {
+		return nil, fmt.Errorf("failed read claim gs://%s/%s: %w", c.bucket, name, err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed read claim gs://%s/%s: %w", c.bucket, name, err)
+	}
+	var claim Claim
+	if err := json.Unmarshal(b, &claim); err != nil {
+		return nil, fmt.Errorf("failed json.Unmarshal claim gs://%s/%s: %w", c.bucket, name, err)
+	}
+	claim.name = name
+	claim.generation = attrs.Generation
+	return &claim, nil
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
@@ -0,0 +1,175 @@
+// Package notify decodes Cloud Storage object notifications delivered over HTTP,
+// and records which of them were handled so that each object generation is
+// handled once even when the notification is delivered again.
+package notify
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// EventTypeFinalized is the CloudEvents type of a new object generation.
+const EventTypeFinalized = "google.cloud.storage.object.v1.finalized"
+
+// maxBodySize bounds the notification body. Notifications carry the object
+// resource only, which is far smaller.
+const maxBodySize = 1 << 20
+
+// pubsubEventTypes maps the eventType attribute of Pub/Sub notifications to CloudEvents types.
+var pubsubEventTypes = map[string]string{
+	"OBJECT_FINALIZE":        EventTypeFinalized,
+	"OBJECT_DELETE":          "google.cloud.storage.object.v1.deleted",
+	"OBJECT_ARCHIVE":         "google.cloud.storage.object.v1.archived",
+	"OBJECT_METADATA_UPDATE": "google.cloud.storage.object.v1.metadataUpdated",
+}
+
+// ErrInvalidEvent is returned when the request is not a Cloud Storage notification.
+var ErrInvalidEvent = errors.New("invalid notification")
+
+// Event is a notification about an object generation.
+type Event struct {
+	// ID is the CloudEvents id or the Pub/Sub message id.
+	ID string `json:"id"`
+
+	// Type is the CloudEvents type. Pub/Sub event types are translated to it.
+	Type string `json:"type"`
+
+	Bucket     string `json:"bucket"`
+	Name       string `json:"name"`
+	Generation int64  `json:"generation"`
+}
+
+// Finalized reports whether the event notifies a new object generation.
+func (e *Event) Finalized() bool {
+	return e.Type == EventTypeFinalized
+}
+
+// objectData is the part of the object resource carried by notifications.
+type objectData struct {
+	Bucket     string      `json:"bucket"`
+	Name       string      `json:"name"`
+	Generation int64String `json:"generation"`
+}
+
+// int64String decodes int64 values, which the JSON API encodes as strings.
+type int64String int64
+
+func (v *int64String) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*v = 0
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s: %w", b, err)
+	}
+	*v = int64String(n)
+	return nil
+}
+
+// pushRequest is the body of a Pub/Sub push delivery.
+type pushRequest struct {
+	Message struct {
+		Attributes map[string]string `json:"attributes"`
+		Data       string            `json:"data"`
+		MessageID  string            `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// structuredEvent is a CloudEvent in the structured content mode.
+type structuredEvent struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Parse decodes the notification in r. It accepts CloudEvents in the binary
+// and the structured content mode, as delivered by Eventarc, and Pub/Sub push
+// deliveries of Cloud Storage Pub/Sub notifications.
+func Parse(r *http.Request) (*Event, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed read notification: %w", err)
+	}
+	if len(body) > maxBodySize {
+		return nil, fmt.Errorf("notification exceeds %d bytes: %w", maxBodySize, ErrInvalidEvent)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case r.Header.Get("Ce-Id") != "":
+		return parseObjectData(r.Header.Get("Ce-Id"), r.Header.Get("Ce-Type"), body)
+	case mediaType == "application/cloudevents+json":
+		var ce structuredEvent
+		if err := json.Unmarshal(body, &ce); err != nil {
+			return nil, fmt.Errorf("failed decode cloudevent: %s: %w", err, ErrInvalidEvent)
+		}
+		return parseObjectData(ce.ID, ce.Type, ce.Data)
+	default:
+		return parsePush(body)
+	}
+}
+
+func parseObjectData(id string, typ string, data []byte) (*Event, error) {
+	var obj objectData
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("failed decode object data of event %s: %s: %w", id, err, ErrInvalidEvent)
+	}
+	e := &Event{ID: id, Type: typ, Bucket: obj.Bucket, Name: obj.Name, Generation: int64(obj.Generation)}
+	return e, validate(e)
+}
+
+func parsePush(body []byte) (*Event, error) {
+	var req pushRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, fmt.Errorf("failed decode pubsub push: %s: %w", err, ErrInvalidEvent)
+	}
+	msg := req.Message
+	typ, ok := pubsubEventTypes[msg.Attributes["eventType"]]
+	if !ok {
+		return nil, fmt.Errorf("unknown eventType %q of message %s: %w", msg.Attributes["eventType"], msg.MessageID, ErrInvalidEvent)
+	}
+	e := &Event{
+		ID:     msg.MessageID,
+		Type:   typ,
+		Bucket: msg.Attributes["bucketId"],
+		Name:   msg.Attributes["objectId"],
+	}
+	if v := msg.Attributes["objectGeneration"]; v != "" {
+		generation, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid objectGeneration %q of message %s: %w", v, msg.MessageID, ErrInvalidEvent)
+		}
+		e.Generation = generation
+	}
+	if e.Generation == 0 && msg.Data != "" {
+		// notifications created with payload format JSON_API_V1 carry the object resource
+		data, err := base64.StdEncoding.DecodeString(msg.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed decode data of message %s: %s: %w", msg.MessageID, err, ErrInvalidEvent)
+		}
+		var obj objectData
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return nil, fmt.Errorf("failed decode data of message %s: %s: %w", msg.MessageID, err, ErrInvalidEvent)
+		}
+		e.Generation = int64(obj.Generation)
+	}
+	return e, validate(e)
+}
+
+func validate(e *Event) error {
+	if e.Bucket == "" || e.Name == "" || e.Generation < 1 {
+		return fmt.Errorf("event %s lacks bucket, name or generation: %w", e.ID, ErrInvalidEvent)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package notify
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+func TestParse(t *testing.T) {
+	pushData := base64.StdEncoding.EncodeToString([]byte(`{"bucket":"base","name":"a.txt","generation":"12"}`))
+	cases := []struct {
+		name    string
+		header  map[string]string
+		body    string
+		want    Event
+		wantErr bool
+	}{
+		{
+			name: "cloudevent binary",
+			header: map[string]string{
+				"Ce-Id":        "1",
+				"Ce-Type":      EventTypeFinalized,
+				"Content-Type": "application/json",
+			},
+			body: `{"bucket":"base","name":"dir/a.txt","generation":"1640000000000000"}`,
+			want: Event{ID: "1", Type: EventTypeFinalized, Bucket: "base", Name: "dir/a.txt", Generation: 1640000000000000},
+		},
+		{
+			name:   "cloudevent structured",
+			header: map[string]string{"Content-Type": "application/cloudevents+json; charset=utf-8"},
+			body:   `{"id":"2","type":"google.cloud.storage.object.v1.deleted","data":{"bucket":"base","name":"a.txt","generation":3}}`,
+			want:   Event{ID: "2", Type: "google.cloud.storage.object.v1.deleted", Bucket: "base", Name: "a.txt", Generation: 3},
+		},
+		{
+			name: "pubsub push attributes",
+			body: `{"message":{"messageId":"3","attributes":{"eventType":"OBJECT_FINALIZE","bucketId":"base","objectId":"a.txt","objectGeneration":"5"}},"subscription":"projects/p/subscriptions/s"}`,
+			want: Event{ID: "3", Type: EventTypeFinalized, Bucket: "base", Name: "a.txt", Generation: 5},
+		},
+		{
+			name: "pubsub push data",
+			body: `{"message":{"messageId":"4","attributes":{"eventType":"OBJECT_FINALIZE","bucketId":"base","objectId":"a.txt"},"data":"` + pushData + `"}}`,
+			want: Event{ID: "4", Type: EventTypeFinalized, Bucket: "base", Name: "a.txt", Generation: 12},
+		},
+		{
+			name:    "pubsub unknown event type",
+			body:    `{"message":{"messageId":"5","attributes":{"eventType":"OBJECT_RENAME"}}}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing generation",
+			header:  map[string]string{"Ce-Id": "6", "Ce-Type": EventTypeFinalized},
+			body:    `{"bucket":"base","name":"a.txt"}`,
+			wantErr: true,
+		},
+		{
+			name:    "not json",
+			body:    `hello`,
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			for k, v := range tc.header {
+				r.Header.Set(k, v)
+			}
+			got, err := Parse(r)
+			if tc.wantErr {
+				if !errors.Is(err, ErrInvalidEvent) {
+					t.Errorf("want ErrInvalidEvent but got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tc.want {
+				t.Errorf("want %+v but got %+v", tc.want, *got)
+			}
+		})
+	}
+}
+
+func TestClaims(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2021, 12, 27, 0, 0, 0, 0, time.UTC)
+	claims := NewClaims(objstore.NewMemory(), "state", "notifications/", time.Minute)
+	claims.now = func() time.Time { return now }
+	event := &Event{ID: "1", Type: EventTypeFinalized, Bucket: "base", Name: "a.txt", Generation: 1}
+
+	claim, err := claims.Acquire(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := claims.Acquire(ctx, event); !errors.Is(err, ErrInProgress) {
+		t.Fatalf("want ErrInProgress but got %v", err)
+	}
+
+	// a failed delivery releases the claim for the next one
+	if err := claims.Release(ctx, claim); err != nil {
+		t.Fatal(err)
+	}
+	claim, err = claims.Acquire(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an abandoned claim is taken over after it expired
+	now = now.Add(2 * time.Minute)
+	takeover, err := claims.Acquire(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.Complete(ctx, claim, nil); !errors.Is(err, ErrInProgress) {
+		t.Errorf("want ErrInProgress completing an expired claim but got %v", err)
+	}
+	if err := claims.Complete(ctx, takeover, map[string]string{"status": "encrypted"}); err != nil {
+		t.Fatal(err)
+	}
+
+	done, err := claims.Acquire(ctx, event)
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("want ErrDuplicate but got %v", err)
+	}
+	if done.Result["status"] != "encrypted" {
+		t.Errorf("want the result of the completed claim but got %+v", done)
+	}
+
+	// another generation of the same object is claimed separately
+	if _, err := claims.Acquire(ctx, &Event{Bucket: "base", Name: "a.txt", Generation: 2}); err != nil {
+		t.Errorf("want new generation claimed but got %v", err)
+	}
+}
+
+func TestClaims_Keep(t *testing.T) {
+	ctx := context.Background()
+	objs := objstore.NewMemory()
+	claims := NewClaims(objs, "state", "notifications/", 30*time.Millisecond)
+	event := &Event{ID: "1", Type: EventTypeFinalized, Bucket: "base", Name: "a.txt", Generation: 1}
+
+	claim, err := claims.Acquire(ctx, event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	kept := make(chan error, 1)
+	go func() { kept <- claims.Keep(ctx, claim, stop) }()
+
+	// the handling lasts several leases without being taken over
+	time.Sleep(100 * time.Millisecond)
+	if _, err := claims.Acquire(ctx, event); !errors.Is(err, ErrInProgress) {
+		t.Fatalf("want ErrInProgress while kept but got %v", err)
+	}
+	close(stop)
+	if err := <-kept; err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.Complete(ctx, claim, nil); err != nil {
+		t.Fatalf("want the kept claim completed but got %v", err)
+	}
+
+	// a claim taken over while kept is reported
+	event2 := &Event{ID: "2", Type: EventTypeFinalized, Bucket: "base", Name: "a.txt", Generation: 2}
+	claim, err = claims.Acquire(ctx, event2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := NewClaims(objs, "state", "notifications/", 30*time.Millisecond)
+	later.now = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := later.Acquire(ctx, event2); err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.Keep(ctx, claim, make(chan struct{})); !errors.Is(err, ErrInProgress) {
+		t.Errorf("want ErrInProgress keeping a claim taken over but got %v", err)
+	}
+}
+
+func TestClaims_Prune(t *testing.T) {
+	ctx := context.Background()
+	objs := objstore.NewMemory()
+	claims := NewClaims(objs, "state", "notifications/", time.Minute)
+	for i := int64(1); i <= 3; i++ {
+		claim, err := claims.Acquire(ctx, &Event{Bucket: "base", Name: "a.txt", Generation: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := claims.Complete(ctx, claim, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := claims.Prune(ctx, time.Now().Add(-time.Hour)); err != nil || n != 0 {
+		t.Errorf("want recent claims kept but deleted %d, %v", n, err)
+	}
+	if n, err := claims.Prune(ctx, time.Now().Add(time.Hour)); err != nil || n != 3 {
+		t.Errorf("want 3 claims deleted but got %d, %v", n, err)
+	}
+	if _, err := claims.Acquire(ctx, &Event{Bucket: "base", Name: "a.txt", Generation: 1}); err != nil {
+		t.Errorf("want a pruned claim acquired again but got %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/sinmetal/gcs_sample/internal/trace"
+	"google.golang.org/api/googleapi"
+)
+
+// Policy is an exponential backoff policy with full jitter.
+type Policy struct {
+	// MaxAttempts is the maximum number of calls, including the first one.
+	// A value less than 1 means a single attempt.
+	MaxAttempts int
+
+	// InitialBackoff is the upper bound of the wait before the second attempt.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the upper bound of each wait.
+	MaxBackoff time.Duration
+
+	// Multiplier grows the upper bound of the wait after each attempt.
+	Multiplier float64
+
+	// Deadline bounds the total time spent including waits.
+	// Zero means no overall deadline other than the one held by ctx.
+	Deadline time.Duration
+}
+
+// DefaultPolicy returns the Policy used when nothing is configured.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:    5,
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     2,
+		Deadline:       30 * time.Second,
+	}
+}
+
+var (
+	rndMu sync.Mutex
+	rnd   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// jitter returns a random duration in [0, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	rndMu.Lock()
+	defer rndMu.Unlock()
+	return time.Duration(rnd.Int63n(int64(d)))
+}
+
+// Do calls fn until it succeeds, returns an error which IsRetryable rejects,
+// or the policy is exhausted. Each retry is recorded as an annotation on the span held by ctx.
+//
+// ctx passed to fn carries the policy deadline, so that an attempt hanging past it
+// is canceled. fn must not return values tied to that ctx, such as readers; use Open for them.
+func (p Policy) Do(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	if p.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Deadline)
+		defer cancel()
+	}
+	return p.do(ctx, name, fn)
+}
+
+// Open is Do for fn opening a stream, such as a reader, which is read after Open returns.
+// ctx passed to fn is ctx itself, so that the stream is not tied to the policy
+// deadline, which then bounds only the waits between attempts.
+func (p Policy) Open(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	return p.do(ctx, name, fn)
+}
+
+func (p Policy) do(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	var deadline time.Time
+	if p.Deadline > 0 {
+		deadline = time.Now().Add(p.Deadline)
+	}
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.MaxAttempts || !IsRetryable(err) {
+			return err
+		}
+
+		wait := jitter(p.backoff(attempt))
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		trace.TracePrintf(ctx, map[string]interface{}{
+			"attempt": attempt,
+			"wait":    wait.String(),
+		}, "retry %s: %s", name, err)
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// backoff returns the upper bound of the wait after the attempt, which grows
+// by Multiplier from InitialBackoff up to MaxBackoff.
+func (p Policy) backoff(attempt int) time.Duration {
+	backoff := p.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff = time.Duration(float64(backoff) * p.Multiplier)
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// IsRetryable reports whether err is a transient error worth another attempt.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case 408, 429, 500, 502, 503, 504:
+			return true
+		}
+		return false
+	}
+
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		return isTransientTransport(uerr.Err)
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return nerr.Timeout()
+	}
+	return false
+}
+
+// isTransientTransport reports whether err from an HTTP client is a network failure
+// which may not happen again, such as a reset connection or a timeout.
+// Invalid URLs and TLS failures such as an untrusted certificate are permanent.
+func isTransientTransport(err error) bool {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// the server closed the connection
+		return true
+	}
+	var (
+		hostnameErr  x509.HostnameError
+		authorityErr x509.UnknownAuthorityError
+		invalidErr   x509.CertificateInvalidError
+		recordErr    tls.RecordHeaderError
+	)
+	if errors.As(err, &hostnameErr) || errors.As(err, &authorityErr) || errors.As(err, &invalidErr) || errors.As(err, &recordErr) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		// "local error" and "remote error" are TLS alerts
+		switch opErr.Op {
+		case "dial", "read", "write":
+			return true
+		}
+		return false
+	}
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return nerr.Timeout()
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package retry
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	urlErr := func(err error) error {
+		return &url.Error{Op: "Post", URL: "https://cloudkms.googleapis.com/v1/key:decrypt", Err: err}
+	}
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"canceled", fmt.Errorf("failed: %w", context.Canceled), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"unexpected eof", fmt.Errorf("failed read: %w", io.ErrUnexpectedEOF), true},
+		{"googleapi 503", fmt.Errorf("failed: %w", &googleapi.Error{Code: 503}), true},
+		{"googleapi 429", &googleapi.Error{Code: 429}, true},
+		{"googleapi 403", &googleapi.Error{Code: 403}, false},
+		{"googleapi 412", &googleapi.Error{Code: 412}, false},
+		{"connection reset", urlErr(&net.OpError{Op: "read", Err: syscall.ECONNRESET}), true},
+		{"connection refused", urlErr(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}), true},
+		{"server closed connection", urlErr(io.EOF), true},
+		{"client timeout", urlErr(timeoutError{}), true},
+		{"unsupported scheme", urlErr(errors.New(`unsupported protocol scheme ""`)), false},
+		{"untrusted certificate", urlErr(x509.UnknownAuthorityError{}), false},
+		{"wrong hostname", urlErr(x509.HostnameError{Host: "example.com"}), false},
+		{"tls alert", urlErr(&net.OpError{Op: "remote error", Err: errors.New("tls: bad certificate")}), false},
+		{"net timeout", &net.OpError{Op: "read", Err: timeoutError{}}, true},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("want %t but got %t for %v", tt.want, got, tt.err)
+			}
+		})
+	}
+}
+
+func TestPolicy_Backoff(t *testing.T) {
+	p := Policy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+	for _, tt := range cases {
+		if got := p.backoff(tt.attempt); got != tt.want {
+			t.Errorf("attempt %d: want %s but got %s", tt.attempt, tt.want, got)
+		}
+	}
+}
+
+func TestPolicy_Do(t *testing.T) {
+	unavailable := &googleapi.Error{Code: 503}
+	cases := []struct {
+		name         string
+		policy       Policy
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", Policy{MaxAttempts: 3}, nil, 1, nil},
+		{"retried until success", Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}, []error{unavailable, unavailable}, 3, nil},
+		{"exhausted", Policy{MaxAttempts: 2, InitialBackoff: time.Millisecond}, []error{unavailable, unavailable, unavailable}, 2, unavailable},
+		{"not retryable", Policy{MaxAttempts: 3}, []error{&googleapi.Error{Code: 404}}, 1, &googleapi.Error{Code: 404}},
+		{"single attempt", Policy{}, []error{unavailable}, 1, unavailable},
+		{"wait past deadline", Policy{MaxAttempts: 3, InitialBackoff: time.Hour, Deadline: time.Second}, []error{unavailable, unavailable}, 1, unavailable},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int
+			err := tt.policy.Do(context.Background(), "test", func(ctx context.Context) error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if attempts != tt.wantAttempts {
+				t.Errorf("want %d attempts but got %d", tt.wantAttempts, attempts)
+			}
+			if fmt.Sprint(err) != fmt.Sprint(tt.wantErr) {
+				t.Errorf("want %v but got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestPolicy_Deadline(t *testing.T) {
+	p := Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Deadline: 50 * time.Millisecond}
+
+	// an attempt hanging past the deadline is canceled
+	start := time.Now()
+	err := p.Do(context.Background(), "test", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Second {
+		t.Errorf("want DeadlineExceeded after the deadline but got %v after %s", err, time.Since(start))
+	}
+
+	// a stream opened by Open outlives the deadline
+	var opened context.Context
+	if err := p.Open(context.Background(), "test", func(ctx context.Context) error {
+		opened = ctx
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * p.Deadline)
+	if opened.Err() != nil {
+		t.Errorf("want the context of Open alive after the deadline but got %v", opened.Err())
+	}
+}
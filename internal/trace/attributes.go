@@ -0,0 +1,197 @@
+package trace
+
+import (
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Redacted replaces attribute values and annotation arguments which may hold key material or plaintext.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeyParts are lower-cased substrings of attribute keys whose values are never recorded.
+// e.g. wDEK holds a wrapped data encryption key.
+var sensitiveKeyParts = []string{
+	"dek",
+	"encryptionkey",
+	"secret",
+	"plaintext",
+	"ciphertext",
+	"password",
+	"token",
+	"apikey",
+}
+
+// isSensitiveKey reports whether the value of key must not be recorded.
+func isSensitiveKey(key string) bool {
+	k := strings.ToLower(key)
+	for _, part := range sensitiveKeyParts {
+		if strings.Contains(k, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// looksLikeKeyMaterial reports whether s has the shape of a value of the CSEK envelope:
+// a base64 encoded AES-256 key, the same key encoded twice as it is sent to Cloud KMS,
+// or a wDEK, the Cloud KMS ciphertext of the key. A SHA-256 digest has the same shape
+// as a key and is also redacted. Other base64 values, such as IDs and page tokens, are kept.
+func looksLikeKeyMaterial(s string) bool {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return false
+	}
+	if len(b) == keySize || isKMSCiphertext(b) {
+		return true
+	}
+	inner, err := base64.StdEncoding.DecodeString(string(b))
+	return err == nil && len(inner) == keySize
+}
+
+// keySize is the size of an AES-256 key.
+const keySize = 32
+
+// encodedKeySize is the size of a base64 encoded AES-256 key, which is the plaintext of a wDEK.
+const encodedKeySize = 44
+
+// emulatorCiphertextSize is the size of a wDEK made by cmd/kms-emulator:
+// a format byte, the key version, a 12 bytes nonce, the plaintext and a 16 bytes tag.
+const emulatorCiphertextSize = 1 + 4 + 12 + encodedKeySize + 16
+
+// isKMSCiphertext reports whether b is the ciphertext of a wDEK. A Cloud KMS ciphertext
+// starts with the 36 bytes ID of the key version as its first protobuf field.
+func isKMSCiphertext(b []byte) bool {
+	switch {
+	case len(b) > 2+36+encodedKeySize && b[0] == 0x0a && b[1] == 0x24:
+		return true
+	case len(b) == emulatorCiphertextSize && b[0] == 1:
+		return true
+	}
+	return false
+}
+
+// base64Run matches the runs of base64 characters long enough to hold key material.
+var base64Run = regexp.MustCompile(`[A-Za-z0-9+/]{43,}={0,2}`)
+
+// redactText redacts the key material found in s, such as in an error message
+// which quotes the request that failed.
+func redactText(s string) string {
+	return base64Run.ReplaceAllStringFunc(s, func(run string) string {
+		if looksLikeKeyMaterial(run) {
+			return Redacted
+		}
+		return run
+	})
+}
+
+// redactedError is err with its message passed through redactText.
+// It unwraps to err, so that backends still classify the status by err.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError returns err with the key material in its message redacted.
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{msg: redactText(err.Error()), err: err}
+}
+
+// normalize redacts sensitive values and converts the rest to the types every Backend supports:
+// string, bool, int64, float64, []string, []int64, []float64 and []bool.
+// time.Duration is recorded as milliseconds.
+func normalize(kv map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(kv))
+	for k, v := range kv {
+		if isSensitiveKey(k) {
+			out[k] = Redacted
+			continue
+		}
+		out[k] = normalizeValue(v)
+	}
+	return out
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return redactText(v)
+	case []byte:
+		// raw bytes may be a key or plaintext, so they are never recorded
+		return Redacted
+	case bool, int64, float64:
+		return v
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case time.Duration:
+		return float64(v) / float64(time.Millisecond)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []string:
+		ss := make([]string, len(v))
+		for i, s := range v {
+			ss[i] = normalizeValue(s).(string)
+		}
+		return ss
+	case []int:
+		is := make([]int64, len(v))
+		for i, n := range v {
+			is[i] = int64(n)
+		}
+		return is
+	case []int64, []float64, []bool:
+		return v
+	case []time.Duration:
+		fs := make([]float64, len(v))
+		for i, d := range v {
+			fs[i] = float64(d) / float64(time.Millisecond)
+		}
+		return fs
+	case fmt.Stringer:
+		return normalizeValue(v.String())
+	case error:
+		return normalizeValue(v.Error())
+	default:
+		return normalizeValue(fmt.Sprintf("%#v", v))
+	}
+}
+
+// redactArgs redacts annotation arguments which may hold key material or plaintext.
+func redactArgs(args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, a := range args {
+		switch a := a.(type) {
+		case []byte:
+			out[i] = Redacted
+		case string:
+			out[i] = redactText(a)
+		case error:
+			// KMS and GCS errors may quote the request
+			out[i] = redactText(a.Error())
+		default:
+			out[i] = a
+		}
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestNormalize(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+	keyName := "projects/sinmetal-playground-20211225/locations/asia-northeast1/keyRings/gcs/cryptoKeys/sample/cryptoKeyVersions/1"
+
+	got := normalize(map[string]interface{}{
+		"wDEK":           "CiQA",
+		"encryptionKey":  "hoge",
+		"gcs.object":     encodedKey,
+		"gcs.bucket":     "bucket",
+		"kms.keyVersion": keyName,
+		"raw":            key,
+		"gcs.bytes":      10,
+		"latency":        1500 * time.Millisecond,
+		"buckets":        []string{"a", encodedKey},
+	})
+
+	cases := map[string]interface{}{
+		"wDEK":           Redacted,
+		"encryptionKey":  Redacted,
+		"gcs.object":     Redacted,
+		"gcs.bucket":     "bucket",
+		"kms.keyVersion": keyName,
+		"raw":            Redacted,
+		"gcs.bytes":      int64(10),
+		"latency":        float64(1500),
+	}
+	for k, want := range cases {
+		if got[k] != want {
+			t.Errorf("%s: want %v but got %v", k, want, got[k])
+		}
+	}
+	buckets, ok := got["buckets"].([]string)
+	if !ok || len(buckets) != 2 || buckets[0] != "a" || buckets[1] != Redacted {
+		t.Errorf("buckets: got %v", got["buckets"])
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	key := make([]byte, 32)
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+
+	err := fmt.Errorf("failed decrypt: %w", errors.New("invalid plaintext "+encodedKey))
+
+	got := redactArgs([]interface{}{"object", key, encodedKey, 3, err})
+	if got[0] != "object" || got[1] != Redacted || got[2] != Redacted || got[3] != 3 || got[4] != "failed decrypt: invalid plaintext "+Redacted {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestLooksLikeKeyMaterial(t *testing.T) {
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := rand.Read(b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	key := base64.StdEncoding.EncodeToString(random(32))
+	emulatorCiphertext := append([]byte{1}, random(emulatorCiphertextSize-1)...)
+	cloudKMSCiphertext := append([]byte{0x0a, 0x24}, random(36+encodedKeySize+40)...)
+
+	cases := []struct {
+		name string
+		s    string
+		want bool
+	}{
+		{"key", key, true},
+		{"key sent to kms", base64.StdEncoding.EncodeToString([]byte(key)), true},
+		{"emulator wDEK", base64.StdEncoding.EncodeToString(emulatorCiphertext), true},
+		{"cloud kms wDEK", base64.StdEncoding.EncodeToString(cloudKMSCiphertext), true},
+		{"unpadded key", base64.RawURLEncoding.EncodeToString(random(32)), false},
+		{"page token", base64.StdEncoding.EncodeToString(random(48)), false},
+		{"upload id", base64.RawURLEncoding.EncodeToString(random(60)), false},
+		{"key name", "projects/p/locations/global/keyRings/gcs/cryptoKeys/sample/cryptoKeyVersions/1", false},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := looksLikeKeyMaterial(tt.s); got != tt.want {
+				t.Errorf("want %t but got %t for %s", tt.want, got, tt.s)
+			}
+		})
+	}
+}
+
+// recordingBackend records the errors passed to EndSpan.
+type recordingBackend struct {
+	OpenCensusBackend
+	errs []error
+}
+
+func (b *recordingBackend) EndSpan(ctx context.Context, err error) {
+	b.errs = append(b.errs, err)
+}
+
+func TestEndSpan_RedactsError(t *testing.T) {
+	b := &recordingBackend{}
+	SetBackend(b)
+	defer SetBackend(OpenCensusBackend{})
+
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	apiErr := &googleapi.Error{Code: 400, Message: "invalid ciphertext " + key}
+	EndSpan(context.Background(), fmt.Errorf("failed decrypt: %w", apiErr))
+	EndSpan(context.Background(), nil)
+
+	if len(b.errs) != 2 || b.errs[1] != nil {
+		t.Fatalf("got %v", b.errs)
+	}
+	err := b.errs[0]
+	if strings.Contains(err.Error(), key) || !strings.Contains(err.Error(), Redacted) {
+		t.Errorf("want key redacted but got %q", err.Error())
+	}
+	var got *googleapi.Error
+	if !errors.As(err, &got) || got.Code != 400 {
+		t.Errorf("want the redacted error to unwrap to the googleapi.Error but got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package trace
+
+import (
+	"context"
+	"sync"
+)
+
+// Backend is a tracing implementation behind StartSpan, EndSpan and the attribute helpers.
+// Call sites only depend on this package, so the backend can be switched by configuration.
+type Backend interface {
+	// StartSpan starts a span named name as a child of the span held by ctx.
+	StartSpan(ctx context.Context, name string) context.Context
+
+	// EndSpan ends the span held by ctx, recording err as its status.
+	EndSpan(ctx context.Context, err error)
+
+	// SetAttributes adds kv to the span held by ctx.
+	SetAttributes(ctx context.Context, kv map[string]interface{})
+
+	// Annotate adds a timestamped message with attributes to the span held by ctx.
+	Annotate(ctx context.Context, attrs map[string]interface{}, message string)
+
+	// StartServerSpan starts a server span for an incoming request.
+	// When hasParent is true the span becomes a child of the remote parent.
+	// sampled is the decision made by Middleware and overrides the parent's flag.
+	StartServerSpan(ctx context.Context, name string, parent SpanContext, hasParent bool, sampled bool) context.Context
+
+	// SpanContext returns the identity of the span held by ctx.
+	SpanContext(ctx context.Context) (SpanContext, bool)
+}
+
+var (
+	backendMu sync.RWMutex
+	backend   Backend = OpenCensusBackend{}
+)
+
+// SetBackend replaces the Backend. The default is OpenCensusBackend.
+// It is meant to be called once at startup before any span is started.
+func SetBackend(b Backend) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	backend = b
+}
+
+func currentBackend() Backend {
+	backendMu.RLock()
+	defer backendMu.RUnlock()
+	return backend
+}
@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// traceparentHeader is the W3C Trace Context header.
+	traceparentHeader = "traceparent"
+
+	// cloudTraceContextHeader is the header used by Google Cloud load balancers and Cloud Run.
+	// format: TRACE_ID/SPAN_ID;o=TRACE_TRUE
+	cloudTraceContextHeader = "X-Cloud-Trace-Context"
+)
+
+// SpanContext identifies a span across process boundaries.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// TraceIDString returns TraceID as 32 lowercase hex characters.
+func (sc SpanContext) TraceIDString() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+// SpanIDString returns SpanID as 16 lowercase hex characters.
+func (sc SpanContext) SpanIDString() string {
+	return hex.EncodeToString(sc.SpanID[:])
+}
+
+// FromContext returns the SpanContext of the span held by ctx.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	return currentBackend().SpanContext(ctx)
+}
+
+// Middleware starts a server span named route for every request, as a child of the
+// span propagated by the caller in traceparent or X-Cloud-Trace-Context.
+// Whether the span is sampled follows the Sampling set by SetSampling.
+// The span records the route, method and response status.
+func Middleware(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, hasParent := extract(r.Header)
+		sampled := currentSampling().shouldSample(route, r.Header, parent, hasParent)
+		ctx := withSamplingDecision(r.Context(), sampled)
+		ctx = currentBackend().StartServerSpan(ctx, route, parent, hasParent, sampled)
+
+		sw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		var err error
+		defer func() {
+			SetAttributesKV(ctx, map[string]interface{}{
+				"http.route":       route,
+				"http.method":      r.Method,
+				"http.status_code": sw.status,
+			})
+			EndSpan(ctx, err)
+		}()
+
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%s %s: %d %s", r.Method, route, sw.status, http.StatusText(sw.status))
+		}
+	})
+}
+
+// statusRecorder remembers the status code written by the handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Transport returns a RoundTripper which propagates the span held by the request
+// context in both traceparent and X-Cloud-Trace-Context before delegating to base.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	sc, ok := FromContext(req.Context())
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTripper must not modify the given request
+	req = req.Clone(req.Context())
+	inject(req.Header, sc)
+	return t.base.RoundTrip(req)
+}
+
+// extract reads the caller's span from traceparent, falling back to X-Cloud-Trace-Context.
+func extract(h http.Header) (SpanContext, bool) {
+	if sc, ok := parseTraceparent(h.Get(traceparentHeader)); ok {
+		return sc, true
+	}
+	return parseCloudTraceContext(h.Get(cloudTraceContextHeader))
+}
+
+// inject writes sc to both traceparent and X-Cloud-Trace-Context.
+func inject(h http.Header, sc SpanContext) {
+	flags := "00"
+	o := 0
+	if sc.Sampled {
+		flags = "01"
+		o = 1
+	}
+	h.Set(traceparentHeader, fmt.Sprintf("00-%s-%s-%s", sc.TraceIDString(), sc.SpanIDString(), flags))
+	h.Set(cloudTraceContextHeader, fmt.Sprintf("%s/%d;o=%d", sc.TraceIDString(), binary.BigEndian.Uint64(sc.SpanID[:]), o))
+}
+
+// parseTraceparent parses "00-<trace-id>-<parent-id>-<flags>".
+func parseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], parts[3]) {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+	return sc, sc.valid()
+}
+
+// parseCloudTraceContext parses "TRACE_ID/SPAN_ID;o=TRACE_TRUE" whose SPAN_ID is decimal.
+func parseCloudTraceContext(v string) (SpanContext, bool) {
+	var sc SpanContext
+	slash := strings.Index(v, "/")
+	if slash < 0 {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], v[:slash]) {
+		return sc, false
+	}
+	rest := v[slash+1:]
+	options := ""
+	if semi := strings.Index(rest, ";"); semi >= 0 {
+		rest, options = rest[:semi], rest[semi+1:]
+	}
+	spanID, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil {
+		return sc, false
+	}
+	binary.BigEndian.PutUint64(sc.SpanID[:], spanID)
+	sc.Sampled = options == "o=1"
+	return sc, sc.valid()
+}
+
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+func (sc SpanContext) valid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
@@ -0,0 +1,97 @@
+package trace
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	cases := []struct {
+		name    string
+		header  map[string]string
+		ok      bool
+		traceID string
+		spanID  string
+		sampled bool
+	}{
+		{
+			name:    "traceparent",
+			header:  map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+			ok:      true,
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			spanID:  "00f067aa0ba902b7",
+			sampled: true,
+		},
+		{
+			name:    "cloud trace context",
+			header:  map[string]string{"X-Cloud-Trace-Context": "105445aa7843bc8bf206b12000100000/1;o=1"},
+			ok:      true,
+			traceID: "105445aa7843bc8bf206b12000100000",
+			spanID:  "0000000000000001",
+			sampled: true,
+		},
+		{
+			name: "traceparent wins",
+			header: map[string]string{
+				"traceparent":           "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+				"X-Cloud-Trace-Context": "105445aa7843bc8bf206b12000100000/1;o=1",
+			},
+			ok:      true,
+			traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			spanID:  "00f067aa0ba902b7",
+			sampled: false,
+		},
+		{
+			name:   "zero trace id",
+			header: map[string]string{"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		},
+		{
+			name:   "broken",
+			header: map[string]string{"X-Cloud-Trace-Context": "hoge"},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			sc, ok := extract(h)
+			if e, g := tt.ok, ok; e != g {
+				t.Fatalf("want ok=%v but got %v", e, g)
+			}
+			if !ok {
+				return
+			}
+			if e, g := tt.traceID, sc.TraceIDString(); e != g {
+				t.Errorf("want traceID %s but got %s", e, g)
+			}
+			if e, g := tt.spanID, sc.SpanIDString(); e != g {
+				t.Errorf("want spanID %s but got %s", e, g)
+			}
+			if e, g := tt.sampled, sc.Sampled; e != g {
+				t.Errorf("want sampled %v but got %v", e, g)
+			}
+		})
+	}
+}
+
+func TestInject(t *testing.T) {
+	want, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok {
+		t.Fatal("failed parse traceparent")
+	}
+	h := http.Header{}
+	inject(h, want)
+
+	got, ok := parseCloudTraceContext(h.Get(cloudTraceContextHeader))
+	if !ok {
+		t.Fatalf("failed parse %s", h.Get(cloudTraceContextHeader))
+	}
+	if want != got {
+		t.Errorf("want %+v but got %+v", want, got)
+	}
+	if e, g := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", h.Get(traceparentHeader); e != g {
+		t.Errorf("want %s but got %s", e, g)
+	}
+}
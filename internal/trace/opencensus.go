@@ -0,0 +1,175 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"go.opencensus.io/trace"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/status"
+)
+
+// OpenCensusBackend records spans with go.opencensus.io/trace.
+// Exporters are registered with trace.RegisterExporter as usual.
+type OpenCensusBackend struct{}
+
+// StartSpan implements Backend.
+func (OpenCensusBackend) StartSpan(ctx context.Context, name string) context.Context {
+	ctx, _ = trace.StartSpan(ctx, name)
+	return ctx
+}
+
+// StartServerSpan implements Backend.
+func (OpenCensusBackend) StartServerSpan(ctx context.Context, name string, parent SpanContext, hasParent bool, sampled bool) context.Context {
+	sampler := trace.NeverSample()
+	if sampled {
+		sampler = trace.AlwaysSample()
+	}
+	if !hasParent {
+		ctx, _ = trace.StartSpan(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithSampler(sampler))
+		return ctx
+	}
+	var opts trace.TraceOptions
+	if parent.Sampled {
+		opts = 1
+	}
+	ctx, _ = trace.StartSpanWithRemoteParent(ctx, name, trace.SpanContext{
+		TraceID:      parent.TraceID,
+		SpanID:       parent.SpanID,
+		TraceOptions: opts,
+	}, trace.WithSpanKind(trace.SpanKindServer), trace.WithSampler(sampler))
+	return ctx
+}
+
+// OpenCensusSampler returns the default sampler for spans which are not started by Middleware.
+func OpenCensusSampler(s Sampling) trace.Sampler {
+	return trace.ProbabilitySampler(s.Rate)
+}
+
+// SpanContext implements Backend.
+func (OpenCensusBackend) SpanContext(ctx context.Context) (SpanContext, bool) {
+	span := trace.FromContext(ctx)
+	if span == nil {
+		return SpanContext{}, false
+	}
+	sc := span.SpanContext()
+	return SpanContext{
+		TraceID: sc.TraceID,
+		SpanID:  sc.SpanID,
+		Sampled: sc.IsSampled(),
+	}, true
+}
+
+// EndSpan implements Backend.
+func (OpenCensusBackend) EndSpan(ctx context.Context, err error) {
+	span := trace.FromContext(ctx)
+	if err != nil {
+		span.SetStatus(toStatus(err))
+	}
+	span.End()
+}
+
+// toStatus interrogates an error and converts it to an appropriate
+// OpenCensus status. Errors wrapped with %w are unwrapped with errors.As.
+func toStatus(err error) trace.Status {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return trace.Status{Code: httpStatusCodeToOCCode(apiErr.Code), Message: err.Error()}
+	}
+	var grpcErr interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &grpcErr) {
+		s := grpcErr.GRPCStatus()
+		return trace.Status{Code: int32(s.Code()), Message: err.Error()}
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return trace.Status{Code: int32(code.Code_CANCELLED), Message: err.Error()}
+	case errors.Is(err, context.DeadlineExceeded):
+		return trace.Status{Code: int32(code.Code_DEADLINE_EXCEEDED), Message: err.Error()}
+	}
+	return trace.Status{Code: int32(code.Code_UNKNOWN), Message: err.Error()}
+}
+
+// Reference: https://github.com/googleapis/googleapis/blob/26b634d2724ac5dd30ae0b0cbfb01f07f2e4050e/google/rpc/code.proto
+func httpStatusCodeToOCCode(httpStatusCode int) int32 {
+	switch httpStatusCode {
+	case 200:
+		return int32(code.Code_OK)
+	case 499:
+		return int32(code.Code_CANCELLED)
+	case 500:
+		return int32(code.Code_UNKNOWN) // Could also be Code_INTERNAL, Code_DATA_LOSS
+	case 400:
+		return int32(code.Code_INVALID_ARGUMENT) // Could also be Code_OUT_OF_RANGE
+	case 504:
+		return int32(code.Code_DEADLINE_EXCEEDED)
+	case 404:
+		return int32(code.Code_NOT_FOUND)
+	case 409:
+		return int32(code.Code_ALREADY_EXISTS) // Could also be Code_ABORTED
+	case 403:
+		return int32(code.Code_PERMISSION_DENIED)
+	case 412:
+		return int32(code.Code_FAILED_PRECONDITION)
+	case 401:
+		return int32(code.Code_UNAUTHENTICATED)
+	case 429:
+		return int32(code.Code_RESOURCE_EXHAUSTED)
+	case 501:
+		return int32(code.Code_UNIMPLEMENTED)
+	case 503:
+		return int32(code.Code_UNAVAILABLE)
+	default:
+		return int32(code.Code_UNKNOWN)
+	}
+}
+
+// Annotate implements Backend.
+func (OpenCensusBackend) Annotate(ctx context.Context, attrMap map[string]interface{}, message string) {
+	var attrs []trace.Attribute
+	for k, v := range attrMap {
+		var a trace.Attribute
+		switch v := v.(type) {
+		case string:
+			a = trace.StringAttribute(k, v)
+		case bool:
+			a = trace.BoolAttribute(k, v)
+		case int:
+			a = trace.Int64Attribute(k, int64(v))
+		case int64:
+			a = trace.Int64Attribute(k, v)
+		case float64:
+			a = trace.Float64Attribute(k, v)
+		default:
+			a = trace.StringAttribute(k, fmt.Sprintf("%v", v))
+		}
+		attrs = append(attrs, a)
+	}
+	trace.FromContext(ctx).Annotate(attrs, message)
+}
+
+// SetAttributes implements Backend.
+func (OpenCensusBackend) SetAttributes(ctx context.Context, kv map[string]interface{}) {
+	span := trace.FromContext(ctx)
+	for k, v := range kv {
+		switch v := v.(type) {
+		case string:
+			span.AddAttributes(trace.StringAttribute(k, v))
+		case bool:
+			span.AddAttributes(trace.BoolAttribute(k, v))
+		case int:
+			span.AddAttributes(trace.Int64Attribute(k, int64(v)))
+		case int64:
+			span.AddAttributes(trace.Int64Attribute(k, v))
+		case float32:
+			span.AddAttributes(trace.Float64Attribute(k, float64(v)))
+		case float64:
+			span.AddAttributes(trace.Float64Attribute(k, float64(v)))
+		default:
+			// OpenCensus has no slice attribute
+			span.AddAttributes(trace.StringAttribute(k, fmt.Sprintf("%v", v)))
+		}
+	}
+}
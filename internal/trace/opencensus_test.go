@@ -0,0 +1,37 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+func TestToStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want code.Code
+	}{
+		{"googleapi", &googleapi.Error{Code: 404}, code.Code_NOT_FOUND},
+		{"wrapped googleapi", fmt.Errorf("failed read object.Attrs: %w", &googleapi.Error{Code: 403}), code.Code_PERMISSION_DENIED},
+		{"double wrapped googleapi", fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", &googleapi.Error{Code: 412})), code.Code_FAILED_PRECONDITION},
+		{"canceled", fmt.Errorf("failed gcs.write: %w", context.Canceled), code.Code_CANCELLED},
+		{"deadline", fmt.Errorf("failed gcs.write: %w", context.DeadlineExceeded), code.Code_DEADLINE_EXCEEDED},
+		{"unknown", errors.New("boom"), code.Code_UNKNOWN},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toStatus(tt.err)
+			if got.Code != int32(tt.want) {
+				t.Errorf("want code %d but got %d", tt.want, got.Code)
+			}
+			if got.Message != tt.err.Error() {
+				t.Errorf("want message %q but got %q", tt.err.Error(), got.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// instrumentationName is the name of the tracer used by OpenTelemetryBackend.
+const instrumentationName = "github.com/sinmetal/gcs_sample"
+
+// serviceName is recorded as service.name resource of OpenTelemetry spans.
+const serviceName = "gcs_sample"
+
+// OpenTelemetryBackend records spans with an OpenTelemetry TracerProvider.
+type OpenTelemetryBackend struct {
+	tracer oteltrace.Tracer
+}
+
+// NewOpenTelemetryBackend returns a Backend which starts spans from tp.
+func NewOpenTelemetryBackend(tp oteltrace.TracerProvider) *OpenTelemetryBackend {
+	return &OpenTelemetryBackend{
+		tracer: tp.Tracer(instrumentationName),
+	}
+}
+
+// NewOTLPTracerProvider returns a TracerProvider which exports spans over OTLP/gRPC to endpoint.
+// Shutdown the returned provider to flush buffered spans.
+func NewOTLPTracerProvider(ctx context.Context, endpoint string, insecure bool) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed create otlp exporter: %w", err)
+	}
+	return newTracerProvider(exporter), nil
+}
+
+// NewStdoutTracerProvider returns a TracerProvider which prints spans to stdout for local debugging.
+// Shutdown the returned provider to flush buffered spans.
+func NewStdoutTracerProvider() (*sdktrace.TracerProvider, error) {
+	exporter, err := stdouttrace.New(stdouttrace.WithPrettyPrint())
+	if err != nil {
+		return nil, fmt.Errorf("failed create stdout exporter: %w", err)
+	}
+	return newTracerProvider(exporter), nil
+}
+
+func newTracerProvider(exporter sdktrace.SpanExporter) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(otelSampler{}),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+// otelSampler follows the decision made by Middleware and falls back to
+// the parent's flag or Sampling.Rate for other spans.
+type otelSampler struct{}
+
+// ShouldSample implements sdktrace.Sampler.
+func (otelSampler) ShouldSample(p sdktrace.SamplingParameters) sdktrace.SamplingResult {
+	psc := oteltrace.SpanContextFromContext(p.ParentContext)
+	// the server span started by Middleware has either no parent or a remote one
+	if sampled, ok := samplingDecision(p.ParentContext); ok && (!psc.IsValid() || psc.IsRemote()) {
+		decision := sdktrace.Drop
+		if sampled {
+			decision = sdktrace.RecordAndSample
+		}
+		return sdktrace.SamplingResult{Decision: decision, Tracestate: psc.TraceState()}
+	}
+	return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(currentSampling().Rate)).ShouldSample(p)
+}
+
+// Description implements sdktrace.Sampler.
+func (otelSampler) Description() string {
+	return "gcs_sample/Sampling"
+}
+
+// StartSpan implements Backend.
+func (b *OpenTelemetryBackend) StartSpan(ctx context.Context, name string) context.Context {
+	ctx, _ = b.tracer.Start(ctx, name)
+	return ctx
+}
+
+// StartServerSpan implements Backend.
+func (b *OpenTelemetryBackend) StartServerSpan(ctx context.Context, name string, parent SpanContext, hasParent bool, sampled bool) context.Context {
+	if hasParent {
+		var flags oteltrace.TraceFlags
+		if parent.Sampled {
+			flags = oteltrace.FlagsSampled
+		}
+		ctx = oteltrace.ContextWithRemoteSpanContext(ctx, oteltrace.NewSpanContext(oteltrace.SpanContextConfig{
+			TraceID:    parent.TraceID,
+			SpanID:     parent.SpanID,
+			TraceFlags: flags,
+			Remote:     true,
+		}))
+	}
+	ctx, _ = b.tracer.Start(ctx, name, oteltrace.WithSpanKind(oteltrace.SpanKindServer))
+	return ctx
+}
+
+// SpanContext implements Backend.
+func (b *OpenTelemetryBackend) SpanContext(ctx context.Context) (SpanContext, bool) {
+	sc := oteltrace.SpanFromContext(ctx).SpanContext()
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	return SpanContext{
+		TraceID: sc.TraceID(),
+		SpanID:  sc.SpanID(),
+		Sampled: sc.IsSampled(),
+	}, true
+}
+
+// EndSpan implements Backend.
+func (b *OpenTelemetryBackend) EndSpan(ctx context.Context, err error) {
+	span := oteltrace.SpanFromContext(ctx)
+	if err != nil {
+		span.RecordError(err)
+		span.SetAttributes(attribute.String("error.code", code.Code(toStatus(err).Code).String()))
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// SetAttributes implements Backend.
+func (b *OpenTelemetryBackend) SetAttributes(ctx context.Context, kv map[string]interface{}) {
+	oteltrace.SpanFromContext(ctx).SetAttributes(toOTelAttributes(kv)...)
+}
+
+// Annotate implements Backend.
+func (b *OpenTelemetryBackend) Annotate(ctx context.Context, attrs map[string]interface{}, message string) {
+	oteltrace.SpanFromContext(ctx).AddEvent(message, oteltrace.WithAttributes(toOTelAttributes(attrs)...))
+}
+
+func toOTelAttributes(kv map[string]interface{}) []attribute.KeyValue {
+	attrs := make([]attribute.KeyValue, 0, len(kv))
+	for k, v := range kv {
+		switch v := v.(type) {
+		case string:
+			attrs = append(attrs, attribute.String(k, v))
+		case bool:
+			attrs = append(attrs, attribute.Bool(k, v))
+		case int:
+			attrs = append(attrs, attribute.Int(k, v))
+		case int64:
+			attrs = append(attrs, attribute.Int64(k, v))
+		case float32:
+			attrs = append(attrs, attribute.Float64(k, float64(v)))
+		case float64:
+			attrs = append(attrs, attribute.Float64(k, v))
+		case []string:
+			attrs = append(attrs, attribute.StringSlice(k, v))
+		case []int64:
+			attrs = append(attrs, attribute.Int64Slice(k, v))
+		case []float64:
+			attrs = append(attrs, attribute.Float64Slice(k, v))
+		case []bool:
+			attrs = append(attrs, attribute.BoolSlice(k, v))
+		default:
+			attrs = append(attrs, attribute.String(k, fmt.Sprintf("%#v", v)))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,112 @@
+package trace
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sampling decides which requests are traced.
+type Sampling struct {
+	// Rate is the probability in [0, 1] that a trace is sampled.
+	Rate float64
+
+	// RouteRates overrides Rate for the routes passed to Middleware.
+	// Unlike Rate, it also applies to requests sampled by the caller.
+	RouteRates map[string]float64
+
+	// ForceHeader is a request header which forces the request to be sampled
+	// when its value is "1" or "true". Empty disables forcing.
+	ForceHeader string
+}
+
+var (
+	samplingMu sync.RWMutex
+	sampling   = Sampling{Rate: 1}
+
+	rndMu sync.Mutex
+	rnd   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetSampling replaces the Sampling. The default samples every request.
+// It is meant to be called once at startup.
+func SetSampling(s Sampling) {
+	samplingMu.Lock()
+	defer samplingMu.Unlock()
+	sampling = s
+}
+
+func currentSampling() Sampling {
+	samplingMu.RLock()
+	defer samplingMu.RUnlock()
+	return sampling
+}
+
+// shouldSample decides whether a request to route is sampled. The first rule which applies wins:
+//
+//  1. the force header samples the request.
+//  2. a rate in RouteRates applies even to a sampled caller, so a route configured with 0 is never traced.
+//  3. a sampled caller samples the request.
+//  4. Rate applies.
+//
+// With a caller the rate is applied to its trace ID, so all services agree on the decision.
+func (s Sampling) shouldSample(route string, h http.Header, parent SpanContext, hasParent bool) bool {
+	if s.ForceHeader != "" {
+		switch strings.ToLower(h.Get(s.ForceHeader)) {
+		case "1", "true":
+			return true
+		}
+	}
+	rate, ok := s.RouteRates[route]
+	if !ok {
+		if hasParent && parent.Sampled {
+			return true
+		}
+		rate = s.Rate
+	}
+	if hasParent {
+		return traceIDBelow(parent.TraceID, rate)
+	}
+	return randomBelow(rate)
+}
+
+// traceIDBelow samples consistently for all services which see the same trace ID.
+func traceIDBelow(traceID [16]byte, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	v := binary.BigEndian.Uint64(traceID[8:16]) >> 1
+	return v < uint64(rate*(1<<63))
+}
+
+func randomBelow(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	rndMu.Lock()
+	defer rndMu.Unlock()
+	return rnd.Float64() < rate
+}
+
+type samplingDecisionKey struct{}
+
+// withSamplingDecision stores the decision made by Middleware for backends
+// which consult a sampler when the span starts.
+func withSamplingDecision(ctx context.Context, sampled bool) context.Context {
+	return context.WithValue(ctx, samplingDecisionKey{}, sampled)
+}
+
+func samplingDecision(ctx context.Context) (sampled bool, ok bool) {
+	sampled, ok = ctx.Value(samplingDecisionKey{}).(bool)
+	return sampled, ok
+}
@@ -0,0 +1,54 @@
+package trace
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSampling_ShouldSample(t *testing.T) {
+	s := Sampling{
+		Rate:        1,
+		RouteRates:  map[string]float64{"/readyz": 0, "/download": 0.5},
+		ForceHeader: "X-Force-Trace",
+	}
+	force := http.Header{"X-Force-Trace": []string{"true"}}
+	// the rate is applied to the low 64 bits, so low is sampled by any rate above 0 and high by none below 1
+	low := SpanContext{TraceID: [16]byte{0: 0xff}}
+	high := SpanContext{TraceID: [16]byte{8: 0xff, 9: 0xff, 10: 0xff, 11: 0xff, 12: 0xff, 13: 0xff, 14: 0xff, 15: 0xff}}
+	sampled := func(sc SpanContext) SpanContext {
+		sc.Sampled = true
+		return sc
+	}
+
+	cases := []struct {
+		name      string
+		sampling  Sampling
+		route     string
+		header    http.Header
+		parent    SpanContext
+		hasParent bool
+		want      bool
+	}{
+		{"default rate", s, "/upload", nil, SpanContext{}, false, true},
+		{"default rate 0", Sampling{Rate: 0}, "/upload", nil, SpanContext{}, false, false},
+		{"route rate 0", s, "/readyz", nil, SpanContext{}, false, false},
+		{"force header", Sampling{Rate: 0, ForceHeader: "X-Force-Trace"}, "/upload", force, SpanContext{}, false, true},
+		{"force header over route rate 0", s, "/readyz", force, SpanContext{}, false, true},
+		{"force header disabled", Sampling{Rate: 0}, "/upload", http.Header{"X-Force-Trace": []string{"1"}}, SpanContext{}, false, false},
+		{"force header false", s, "/readyz", http.Header{"X-Force-Trace": []string{"0"}}, SpanContext{}, false, false},
+		{"sampled parent over default rate 0", Sampling{Rate: 0}, "/upload", nil, sampled(high), true, true},
+		{"unsampled parent with default rate", Sampling{Rate: 0.5}, "/upload", nil, high, true, false},
+		{"unsampled parent below default rate", Sampling{Rate: 0.5}, "/upload", nil, low, true, true},
+		{"route rate 0 over sampled parent", s, "/readyz", nil, sampled(low), true, false},
+		{"route rate over sampled parent", s, "/download", nil, sampled(high), true, false},
+		{"route rate with sampled parent below", s, "/download", nil, sampled(low), true, true},
+		{"force header over route rate 0 with parent", s, "/readyz", force, high, true, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.sampling.shouldSample(tt.route, tt.header, tt.parent, tt.hasParent); got != tt.want {
+				t.Errorf("want %t but got %t", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/jobs"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/objstore"
+)
+
+// objectJob is Bucketのprefix以下のObjectを1つずつ処理するJobの種類
+// 1つのObjectに対する処理は、同期で処理するHandlerと同じServiceのMethodを呼ぶ
+type objectJob struct {
+	store objstore.ObjectStore
+
+	// Bucket is 処理するObjectがあるBucket
+	Bucket string
+
+	// DstBucket is Copy先のBucket. Copyしない場合は空
+	DstBucket string
+
+	// Operation is Jobを投入するPrincipalに必要なOperation
+	Operation auth.Operation
+
+	process func(ctx context.Context, object string) (map[string]string, error)
+}
+
+// Next is cursorより後のObjectの名前を返す
+func (j *objectJob) Next(ctx context.Context, job *jobs.Job, cursor string, limit int) ([]string, error) {
+	return jobs.ListObjects(ctx, j.store, j.Bucket, job.Params["prefix"], cursor, limit)
+}
+
+// Process is 1つのObjectを処理する
+func (j *objectJob) Process(ctx context.Context, job *jobs.Job, object string) *jobs.Result {
+	details, err := j.process(logging.WithObject(ctx, j.Bucket, object), object)
+	if err != nil {
+		logging.Warningf(ctx, "failed %s %s: %s", job.Kind, object, err)
+		return &jobs.Result{Item: object, Error: err.Error()}
+	}
+	return &jobs.Result{Item: object, Details: details}
+}
+
+// newJobWorkers is Jobの種類ごとのWorkerを作成する
+//
+//	csek.rewrap: CSEKEncryptBucket1のObjectのwDEKを、Cloud KMS Keyの現在のPrimary Versionで暗号化し直す
+//	csek.copy: CSEKEncryptBucket1のObjectを、同じCSEKのままCSEKEncryptBucket2にCopyする
+//	cmek.re-encrypt: CMEKEncryptBucketのObjectを、Bucket Default Keyの現在のPrimary Versionで暗号化し直す
+//	csek.inventory: CSEKEncryptBucket1のObjectの暗号化の情報を記録する
+//	cmek.inventory: CMEKEncryptBucketのObjectの暗号化の情報を記録する
+func newJobWorkers(handlers *Handlers) map[string]*objectJob {
+	cfg := handlers.Config
+	return map[string]*objectJob{
+		"csek.rewrap": {
+			store:     handlers.Store,
+			Bucket:    cfg.CSEKEncryptBucket1(),
+			Operation: auth.OperationReEncrypt,
+			process: func(ctx context.Context, object string) (map[string]string, error) {
+				attrs, err := handlers.CSEKService.Rewrap(ctx, cfg.CloudKMSKeyName, cfg.CSEKEncryptBucket1(), object, 0)
+				if err != nil {
+					return nil, err
+				}
+				return map[string]string{"generation": strconv.FormatInt(attrs.Generation, 10)}, nil
+			},
+		},
+		"csek.copy": {
+			store:     handlers.Store,
+			Bucket:    cfg.CSEKEncryptBucket1(),
+			DstBucket: cfg.CSEKEncryptBucket2(),
+			Operation: auth.OperationCopy,
+			process: func(ctx context.Context, object string) (map[string]string, error) {
+				return nil, handlers.CSEKService.Copy(ctx, cfg.CSEKEncryptBucket2(), cfg.CSEKEncryptBucket1(), object, cfg.CloudKMSKeyName)
+			},
+		},
+		"cmek.re-encrypt": {
+			store:     handlers.Store,
+			Bucket:    cfg.CMEKEncryptBucket(),
+			Operation: auth.OperationReEncrypt,
+			process: func(ctx context.Context, object string) (map[string]string, error) {
+				return nil, handlers.CMEKService.ReEncrypt(ctx, cfg.CMEKEncryptBucket(), object)
+			},
+		},
+		"csek.inventory": {
+			store:     handlers.Store,
+			Bucket:    cfg.CSEKEncryptBucket1(),
+			Operation: auth.OperationList,
+			process: func(ctx context.Context, object string) (map[string]string, error) {
+				info, err := handlers.CSEKService.Stat(ctx, cfg.CSEKEncryptBucket1(), object)
+				if err != nil {
+					return nil, err
+				}
+				return inventoryDetails(info), nil
+			},
+		},
+		"cmek.inventory": {
+			store:     handlers.Store,
+			Bucket:    cfg.CMEKEncryptBucket(),
+			Operation: auth.OperationList,
+			process: func(ctx context.Context, object string) (map[string]string, error) {
+				info, err := handlers.CMEKService.Stat(ctx, cfg.CMEKEncryptBucket(), object)
+				if err != nil {
+					return nil, err
+				}
+				return inventoryDetails(info), nil
+			},
+		},
+	}
+}
+
+// inventoryDetails is inventoryのJobの結果に記録するObjectの暗号化の情報
+func inventoryDetails(info *encryption.ObjectInfo) map[string]string {
+	details := map[string]string{
+		"mode":       info.Mode,
+		"wrappedKey": strconv.FormatBool(info.WrappedKey),
+		"size":       strconv.FormatInt(info.Size, 10),
+		"generation": strconv.FormatInt(info.Generation, 10),
+	}
+	if info.KeyVersion != "" {
+		details["keyVersion"] = info.KeyVersion
+	}
+	if info.CustomerKeySHA256 != "" {
+		details["customerKeySha256"] = info.CustomerKeySHA256
+	}
+	return details
+}
+
+// authorizeJob is RequestのPrincipalが、Jobの種類のOperationをprefix以下に実行できるかを確認する
+func (handlers *Handlers) authorizeJob(w http.ResponseWriter, r *http.Request, kind string, prefix string) bool {
+	worker, ok := handlers.Jobs.Worker(kind)
+	j, isObjectJob := worker.(*objectJob)
+	if !ok || !isObjectJob {
+		logging.Warningf(r.Context(), "unknown job kind: %s", kind)
+		w.WriteHeader(http.StatusBadRequest)
+		return false
+	}
+	if !handlers.authorize(w, r, j.Bucket, prefix, j.Operation) {
+		return false
+	}
+	if j.DstBucket != "" && !handlers.authorize(w, r, j.DstBucket, prefix, j.Operation) {
+		return false
+	}
+	return true
+}
+
+// SubmitJobHandler
+// kindのJobをprefix以下のObjectに対して投入し、JobをJSONで返す
+// Jobはbackgroundで実行されるので、進捗は/jobs/statusで確認する
+func (handlers *Handlers) SubmitJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	kind := r.FormValue("kind")
+	prefix := r.FormValue("prefix")
+	if prefix == "" {
+		logging.Warningf(ctx, "invalid request: prefix is required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorizeJob(w, r, kind, prefix) {
+		return
+	}
+
+	var principal string
+	if p, ok := auth.FromContext(ctx); ok {
+		principal = p.ID
+	}
+	job, err := handlers.Jobs.Submit(ctx, kind, map[string]string{"prefix": prefix}, principal)
+	if err != nil {
+		logging.Errorf(ctx, "failed submit job: %s", err)
+		w.WriteHeader(jobErrorStatus(err))
+		return
+	}
+	logging.Infof(ctx, "submitted job %s: kind=%s prefix=%s", job.ID, kind, prefix)
+	writeJSON(ctx, w, http.StatusAccepted, job)
+}
+
+// JobStatusHandler
+// Jobの状態と進捗をJSONで返す
+func (handlers *Handlers) JobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	job, ok := handlers.getJob(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, job)
+}
+
+// CancelJobHandler
+// Jobをcancelする. 実行中のJobは次のObjectに進む前に止まり、それまでの結果は残る
+func (handlers *Handlers) CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	job, ok := handlers.getJob(w, r)
+	if !ok {
+		return
+	}
+	job, err := handlers.Jobs.Cancel(ctx, job.ID)
+	if err != nil {
+		logging.Warningf(ctx, "failed cancel job: %s", err)
+		w.WriteHeader(jobErrorStatus(err))
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, job)
+}
+
+// JobResultsHandler
+// Jobの最後のCheckpointまでのObjectごとの結果を {"job": ..., "results": [...]} のJSONで返す
+// 結果の多いJobでもmemoryに載せないように、結果は1件ずつ書き込む
+// 書き込み始めた後に読み込みに失敗した場合は、途中までのResponseになる
+func (handlers *Handlers) JobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	job, ok := handlers.getJob(w, r)
+	if !ok {
+		return
+	}
+	jobJSON, err := json.Marshal(job)
+	if err != nil {
+		logging.Errorf(ctx, "failed json.Marshal job: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(w, `{"job":%s,"results":[`, jobJSON); err != nil {
+		logging.Warningf(ctx, "failed write response: %s", err)
+		return
+	}
+	sep := ""
+	err = handlers.Jobs.EachResult(ctx, job, func(result *jobs.Result) error {
+		b, err := json.Marshal(result)
+		if err != nil {
+			return fmt.Errorf("failed json.Marshal result: %w", err)
+		}
+		if _, err := fmt.Fprintf(w, "%s%s", sep, b); err != nil {
+			return fmt.Errorf("failed write response: %w", err)
+		}
+		sep = ","
+		return nil
+	})
+	if err != nil {
+		logging.Errorf(ctx, "failed read job results: %s", err)
+		return
+	}
+	if _, err := io.WriteString(w, "]}\n"); err != nil {
+		logging.Warningf(ctx, "failed write response: %s", err)
+	}
+}
+
+// getJob is id parameterのJobを読み込み、RequestのPrincipalがJobを投入できるかを確認する
+// 読み込めない場合はResponseを書き込んでfalseを返す
+func (handlers *Handlers) getJob(w http.ResponseWriter, r *http.Request) (*jobs.Job, bool) {
+	ctx := r.Context()
+
+	job, err := handlers.Jobs.Get(ctx, r.FormValue("id"))
+	if err != nil {
+		logging.Warningf(ctx, "failed get job: %s", err)
+		w.WriteHeader(jobErrorStatus(err))
+		return nil, false
+	}
+	if !handlers.authorizeJob(w, r, job.Kind, job.Params["prefix"]) {
+		return nil, false
+	}
+	return job, true
+}
+
+// jobErrorStatus is jobsから返ってきたerrからResponseのStatus Codeを決める
+func jobErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, jobs.ErrUnknownKind):
+		return http.StatusBadRequest
+	case errors.Is(err, jobs.ErrFinished):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -3,17 +3,24 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"cloud.google.com/go/storage"
-	"contrib.go.opencensus.io/exporter/stackdriver"
+	"contrib.go.opencensus.io/exporter/prometheus"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/sinmetal/gcs_sample/encryption"
-	metadatabox "github.com/sinmetalcraft/gcpbox/metadata"
-	"go.opencensus.io/trace"
-	"google.golang.org/api/cloudkms/v1"
+	"github.com/sinmetal/gcs_sample/internal/audit"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/jobs"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/notify"
+	apptrace "github.com/sinmetal/gcs_sample/internal/trace"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"go.opencensus.io/stats/view"
 )
 
 type Config struct {
@@ -23,6 +30,197 @@ type Config struct {
 	// CloudKMSKeyName is CSEKで扱うCloud KMS Key Name
 	// format: projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s
 	CloudKMSKeyName string
+
+	// ProjectID is Project ID
+	// 指定しない場合はMetadata Serverから取得する。GCP外で動かす時は指定する
+	ProjectID string
+
+	// StorageBackend is Objectを保存する先
+	// gcs, memory (Localでの確認用), filesystem (Localでの確認用) のいずれか
+	StorageBackend string `default:"gcs"`
+
+	// StorageRoot is StorageBackend=filesystemの時にObjectを保存するDirectory
+	StorageRoot string `default:"storage"`
+
+	// GCSEndpoint is Cloud Storage JSON APIのEndpoint
+	// fake-gcs-serverなどのEmulatorを使う時に指定する。http://のEndpointには認証を行わずに接続する
+	// 指定しない場合はSTORAGE_EMULATOR_HOSTを見て、それもなければCloud Storageに接続する
+	GCSEndpoint string
+
+	// GCSCredentialsFile is Cloud Storageへの接続に使うService AccountのKey File
+	// 指定しない場合はApplication Default Credentialsを使う
+	GCSCredentialsFile string
+
+	// KMSEndpoint is Cloud KMS APIのEndpoint
+	// KMSのEmulatorを使う時に指定する。http://のEndpointには認証を行わずに接続する
+	KMSEndpoint string
+
+	// KMSCredentialsFile is Cloud KMSへの接続に使うService AccountのKey File
+	// 指定しない場合はApplication Default Credentialsを使う
+	KMSCredentialsFile string
+
+	// PreserveStorageClass is Upload, Copy, ReEncryptでCopy元のStorage Classを引き継ぐかどうか
+	// 引き継がない場合は書き込み先のBucketのDefault Storage Classになる
+	PreserveStorageClass bool
+
+	// MaxUploadSize is Request BodyをそのままUploadする時の最大サイズ (byte)
+	// 0以下を指定すると無制限になる
+	MaxUploadSize int64 `default:"104857600"`
+
+	// AuthMode is 認証方式
+	// none, idtoken, iap, apikey のいずれか
+	// 設定し忘れたまま公開しないように、認証を行わない場合もnoneを明示する
+	AuthMode string
+
+	// AuthAudience is AuthMode=idtoken, iapの時に検証するaudience
+	// AuthMode=idtoken, iapの場合は必須
+	AuthAudience string
+
+	// APIKeys is AuthMode=apikeyの時に受け付けるAPI KeyとPrincipalの組
+	// format: key1:principal1,key2:principal2
+	APIKeys map[string]string
+
+	// AuthPolicyFile is 認可Policyを書いたJSON File
+	// 指定しない場合は、AuthAllowAll=trueでない限り起動しない
+	AuthPolicyFile string
+
+	// AuthAllowAll is AuthPolicyFileを指定せずに、認証を通ったPrincipalに全ての操作を許可する
+	// ローカルでの開発など、明示的に全て許可したい場合だけ指定する
+	AuthAllowAll bool
+
+	// RetryMaxAttempts is KMS, Cloud Storageの呼び出しを試行する最大回数
+	RetryMaxAttempts int `default:"5"`
+
+	// RetryInitialBackoff is 最初の再試行までの待ち時間の上限
+	RetryInitialBackoff time.Duration `default:"100ms"`
+
+	// RetryMaxBackoff is 再試行までの待ち時間の上限
+	RetryMaxBackoff time.Duration `default:"5s"`
+
+	// RetryMultiplier is 再試行する度に待ち時間の上限を何倍にするか
+	RetryMultiplier float64 `default:"2"`
+
+	// RetryDeadline is 再試行を含めて1つの呼び出しにかける時間の上限. 超えた呼び出しはcancelする
+	// 大きなObjectのCopyも打ち切られるので、扱うObjectの大きさに合わせて長くする. 0の場合は上限なし
+	RetryDeadline time.Duration `default:"30s"`
+
+	// JobsBucket is Jobの状態と結果を保存するBucket
+	// 指定しない場合は/jobs/以下のRouteを公開しない
+	JobsBucket string
+
+	// JobsPrefix is JobsBucketに保存するObjectのPrefix
+	JobsPrefix string `default:"jobs/"`
+
+	// JobsLease is 実行中のJobを、Checkpointを記録せずに1つのInstanceが持ち続けられる時間
+	// 過ぎると他のInstanceが最後のCheckpointから再開する
+	JobsLease time.Duration `default:"1m"`
+
+	// JobsBatchSize is Checkpointを記録する間に処理するObjectの数
+	JobsBatchSize int `default:"100"`
+
+	// JobsPollInterval is 待機中のJob, 止まったJobを探す間隔
+	JobsPollInterval time.Duration `default:"10s"`
+
+	// NotificationBucket is 処理したCloud Storage Notificationを記録するBucket
+	// 指定しない場合は/notifications/gcsを公開しない
+	NotificationBucket string
+
+	// NotificationPrefix is NotificationBucketに保存するObjectのPrefix
+	NotificationPrefix string `default:"notifications/"`
+
+	// NotificationMode is Notificationを受け取ったBaseBucketのObjectの暗号化方式
+	// csek (CSEKEncryptBucket1にUploadする), cmek (CMEKEncryptBucketにUploadする) のいずれか
+	NotificationMode string `default:"csek"`
+
+	// NotificationDeleteSource is 暗号化した後にBaseBucketの平文のObjectを削除するかどうか
+	NotificationDeleteSource bool
+
+	// NotificationLease is Notificationの処理が終わらない時に、再送されたNotificationで処理し直すまでの時間
+	NotificationLease time.Duration `default:"10m"`
+
+	// NotificationRetention is 処理したNotificationのClaimを残す期間
+	// Pub/Sub, Eventarcが再送する期間 (最大7日) より長くする. 削除した後に再送されても、暗号化したObjectのsourceGenerationで重複は防がれる
+	NotificationRetention time.Duration `default:"192h"`
+
+	// ShutdownDelay is SIGTERMを受け取ってreadinessを落としてから、Shutdownを始めるまでの待ち時間
+	ShutdownDelay time.Duration `default:"0s"`
+
+	// DrainTimeout is Shutdown時に処理中のRequestの完了を待つ時間
+	// 過ぎた場合は処理中のCopy, Uploadをcancelする
+	// Cloud RunはSIGTERMから10秒でSIGKILLするので、それより短くしておく
+	DrainTimeout time.Duration `default:"8s"`
+
+	// ReadyCacheTTL is /readyzでBucket, Cloud KMS KeyをCheckした結果をキャッシュする時間
+	ReadyCacheTTL time.Duration `default:"30s"`
+
+	// ReadyTimeout is /readyzで依存先をCheckする時のTimeout
+	ReadyTimeout time.Duration `default:"5s"`
+
+	// PrometheusEnabled is /metricsでPrometheus形式のMetricsを公開するかどうか
+	// Local実行時にMetricsを確認するためのもの
+	PrometheusEnabled bool
+
+	// LogFormat is Logの出力形式
+	// json (Cloud LoggingのStructured Logging), text (Localでの確認用) のいずれか
+	LogFormat string `default:"json"`
+
+	// AuditSink is Cloud KMS Key, CSEKの利用を記録するAudit Logの書き込み先
+	// none, stdout, file, gcs のいずれか
+	AuditSink string `default:"none"`
+
+	// AuditFile is AuditSink=fileの時に書き込むFile
+	AuditFile string `default:"audit.log"`
+
+	// AuditBucket is AuditSink=gcsの時に書き込むBucket
+	AuditBucket string
+
+	// AuditPrefix is AuditSink=gcsの時に書き込むObjectのPrefix
+	AuditPrefix string `default:"audit/"`
+
+	// TraceBackend is Traceを記録するBackend
+	// opencensus (GCP上ではCloud Traceに送る), otel (OTLPで送る), stdout (Localでの確認用) のいずれか
+	TraceBackend string `default:"opencensus"`
+
+	// OTLPEndpoint is TraceBackend=otelの時にTraceを送るOTLP/gRPCのEndpoint
+	OTLPEndpoint string `default:"localhost:4317"`
+
+	// OTLPInsecure is OTLPEndpointにTLSを使わずに接続するかどうか
+	OTLPInsecure bool
+
+	// TraceSampleRate is Traceを記録する割合 (0 - 1)
+	// 呼び出し元でSampleされているRequestは常に記録する
+	TraceSampleRate float64 `default:"1"`
+
+	// TraceRouteSampleRates is RouteごとにTraceSampleRateを上書きする
+	// 呼び出し元でSampleされているRequestにも適用するので、0を指定したRouteは記録しない
+	// format: /readyz:0,/encryption/csek/download:0.1
+	TraceRouteSampleRates map[string]float64
+
+	// TraceForceHeader is 値が1 or trueの時に、必ずTraceを記録するRequest Header
+	// TraceRouteSampleRatesよりも優先する
+	TraceForceHeader string `default:"X-Force-Trace"`
+
+	// TraceExporter is TraceBackend=opencensusの時のTraceの送り先
+	// 指定しない場合はGCP上ではstackdriver, それ以外ではどこにも送らない
+	// stackdriver, stdout, zipkin, jaeger, none のいずれか
+	TraceExporter string
+
+	// ZipkinEndpoint is TraceExporter=zipkinの時にSpanを送るEndpoint
+	ZipkinEndpoint string `default:"http://localhost:9411/api/v2/spans"`
+
+	// JaegerEndpoint is TraceExporter=jaegerの時にSpanを送るJaeger CollectorのEndpoint
+	JaegerEndpoint string `default:"http://localhost:14268/api/traces"`
+}
+
+// RetryPolicy is Configから作成したKMS, Cloud Storageの呼び出しのRetryPolicy
+func (c *Config) RetryPolicy() encryption.RetryPolicy {
+	return encryption.RetryPolicy{
+		MaxAttempts:    c.RetryMaxAttempts,
+		InitialBackoff: c.RetryInitialBackoff,
+		MaxBackoff:     c.RetryMaxBackoff,
+		Multiplier:     c.RetryMultiplier,
+		Deadline:       c.RetryDeadline,
+	}
 }
 
 // CSEKEncryptBucket1 is 暗号化したファイルを置くBucket
@@ -43,78 +241,325 @@ func (c *Config) CMEKEncryptBucket() string {
 func main() {
 	ctx := context.Background()
 
-	log.Print("starting server...")
+	sigCtx, stop := signal.NotifyContext(ctx, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	logging.Infof(ctx, "starting server...")
 	http.HandleFunc("/", helloHandler)
 
-	projectID, err := metadatabox.ProjectID()
+	var cfg Config
+	err := envconfig.Process("SINMETAL", &cfg)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatalf(ctx, "failed process config: %s", err)
 	}
+	projectID, err := resolveProjectID(&cfg)
+	if err != nil {
+		logging.Fatalf(ctx, "%s", err)
+	}
+	logFormat, err := logging.ParseFormat(cfg.LogFormat)
+	if err != nil {
+		logging.Fatalf(ctx, "%s", err)
+	}
+	logging.SetDefault(logging.New(os.Stdout, logFormat, projectID))
+	logging.Infof(ctx, "BaseBucketName:%s", cfg.BaseBucket)
+	logging.Infof(ctx, "CloudKMSKeyName:%s", cfg.CloudKMSKeyName)
+	logging.Infof(ctx, "AuthMode:%s", cfg.AuthMode)
+	logging.Infof(ctx, "AuthPolicyFile:%s AuthAllowAll:%t", cfg.AuthPolicyFile, cfg.AuthAllowAll)
+	logging.Infof(ctx, "TraceBackend:%s", cfg.TraceBackend)
 
-	if metadatabox.OnGCP() {
-		// Create and register a OpenCensus Stackdriver Trace exporter.
-		exporter, err := stackdriver.NewExporter(stackdriver.Options{
-			ProjectID: projectID,
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-		trace.RegisterExporter(exporter)
-		trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	tel, err := setupTelemetry(ctx, &cfg, projectID)
+	if err != nil {
+		logging.Fatalf(ctx, "failed setup telemetry: %s", err)
 	}
 
-	var cfg Config
-	err = envconfig.Process("SINMETAL", &cfg)
+	store, err := newObjectStore(ctx, &cfg)
+	if err != nil {
+		logging.Fatalf(ctx, "failed create object store: %s", err)
+	}
+	kms, err := newKMSService(ctx, &cfg)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatalf(ctx, "%s", err)
 	}
-	fmt.Printf("BaseBucketName:%s\n", cfg.BaseBucket)
-	fmt.Printf("CloudKMSKeyName:%s\n", cfg.CloudKMSKeyName)
 
-	gcs, err := storage.NewClient(ctx)
+	auditLog, closeAudit, err := newAuditLogger(ctx, &cfg, store)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatalf(ctx, "failed create audit logger: %s", err)
 	}
-	kms, err := cloudkms.NewService(ctx)
+	defer func() {
+		if err := closeAudit(); err != nil {
+			logging.Errorf(ctx, "failed close audit log: %s", err)
+		}
+	}()
+
+	serviceOpts := []encryption.Option{encryption.WithRetryPolicy(cfg.RetryPolicy())}
+	if cfg.PreserveStorageClass {
+		serviceOpts = append(serviceOpts, encryption.WithPreserveStorageClass())
+	}
+	csekService, err := encryption.NewCSEKService(ctx, store, kms, append(serviceOpts, encryption.WithAuditLogger(auditLog))...)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatalf(ctx, "failed NewCSEKService: %s", err)
+	}
+	cmekService, err := encryption.NewCMEKService(ctx, store, serviceOpts...)
+	if err != nil {
+		logging.Fatalf(ctx, "failed NewCMEKService: %s", err)
+	}
+
+	var ready readiness
+	healthChecker := &HealthChecker{
+		Store:       store,
+		CSEKService: csekService,
+		Buckets: []string{
+			cfg.BaseBucket,
+			cfg.CSEKEncryptBucket1(),
+			cfg.CSEKEncryptBucket2(),
+			cfg.CMEKEncryptBucket(),
+		},
+		KeyName:   cfg.CloudKMSKeyName,
+		TTL:       cfg.ReadyCacheTTL,
+		Timeout:   cfg.ReadyTimeout,
+		Readiness: &ready,
+	}
+	if cfg.PrometheusEnabled {
+		pe, err := prometheus.NewExporter(prometheus.Options{
+			Namespace: "gcs_sample",
+		})
+		if err != nil {
+			logging.Fatalf(ctx, "failed create prometheus exporter: %s", err)
+		}
+		view.RegisterExporter(pe)
+		http.Handle("/metrics", pe)
 	}
+	http.HandleFunc("/healthz", healthChecker.LiveHandler)
+	http.HandleFunc("/readyz", healthChecker.ReadyHandler)
 
-	csekService, err := encryption.NewCSEKService(ctx, gcs, kms)
+	authenticator, err := newAuthenticator(&cfg)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatalf(ctx, "failed create authenticator: %s", err)
 	}
-	cmekService, err := encryption.NewCMEKService(ctx, gcs)
+	policy, err := newPolicy(&cfg)
 	if err != nil {
-		log.Fatal(err.Error())
+		logging.Fatalf(ctx, "failed load auth policy: %s", err)
 	}
+	authn := auth.Middleware(authenticator)
 
 	handlers := Handlers{
 		Config:      &cfg,
-		GCS:         gcs,
+		Store:       store,
 		CSEKService: csekService,
 		CMEKService: cmekService,
+		Policy:      policy,
+	}
+	// Requestごとに呼び出し元のTraceを引き継いだServer Spanを開始し、Request IDを振ってから、認証を行う
+	handle := func(route string, h http.HandlerFunc) {
+		http.Handle(route, apptrace.Middleware(route, logging.Middleware(authn(h))))
+	}
+	handle("/encryption/csek/upload", handlers.UploadCSEKHandler)
+	handle("/encryption/csek/download", handlers.DownloadCSEKHandler)
+	handle("/encryption/csek/copy", handlers.CopyCSEKHandler)
+	handle("/encryption/csek/generations", handlers.ListCSEKGenerationsHandler)
+	handle("/encryption/csek/rewrap", handlers.RewrapCSEKHandler)
+	handle("/encryption/csek/restore", handlers.RestoreCSEKHandler)
+	handle("/encryption/csek/copy-prefix", handlers.CopyPrefixCSEKHandler)
+	handle("/encryption/csek/list", handlers.ListCSEKHandler)
+	handle("/encryption/csek/delete", handlers.DeleteCSEKHandler)
+	handle("/encryption/csek/diagnose", handlers.DiagnoseCSEKHandler)
+
+	handle("/encryption/cmek/upload", handlers.UploadCMEKHandler)
+	handle("/encryption/cmek/download", handlers.DownloadCMEKHandler)
+	handle("/encryption/cmek/re-encrypt", handlers.ReEncryptCMEKHandler)
+	handle("/encryption/cmek/generations", handlers.ListCMEKGenerationsHandler)
+	handle("/encryption/cmek/restore", handlers.RestoreCMEKHandler)
+	handle("/encryption/cmek/copy-prefix", handlers.CopyPrefixCMEKHandler)
+	handle("/encryption/cmek/list", handlers.ListCMEKHandler)
+	handle("/encryption/cmek/delete", handlers.DeleteCMEKHandler)
+
+	if cfg.NotificationBucket != "" {
+		switch cfg.NotificationMode {
+		case "csek", "cmek":
+		default:
+			logging.Fatalf(ctx, "unsupported NotificationMode: %s", cfg.NotificationMode)
+		}
+		handlers.Claims = notify.NewClaims(store, cfg.NotificationBucket, cfg.NotificationPrefix, cfg.NotificationLease)
+		handle("/notifications/gcs", handlers.ObjectFinalizeHandler)
+		go pruneClaims(sigCtx, handlers.Claims, cfg.NotificationRetention)
 	}
-	http.HandleFunc("/encryption/csek/upload", handlers.UploadCSEKHandler)
-	http.HandleFunc("/encryption/csek/download", handlers.DownloadCSEKHandler)
-	http.HandleFunc("/encryption/csek/copy", handlers.CopyCSEKHandler)
 
-	http.HandleFunc("/encryption/cmek/upload", handlers.UploadCMEKHandler)
-	http.HandleFunc("/encryption/cmek/download", handlers.DownloadCMEKHandler)
-	http.HandleFunc("/encryption/cmek/re-encrypt", handlers.ReEncryptCMEKHandler)
+	// Jobは実行中のRequestとは別に、Shutdownまで動かし続ける
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	jobsDone := make(chan struct{})
+	if cfg.JobsBucket != "" {
+		handlers.Jobs = jobs.NewManager(jobs.NewStore(store, cfg.JobsBucket, cfg.JobsPrefix),
+			jobs.WithLease(cfg.JobsLease),
+			jobs.WithBatchSize(cfg.JobsBatchSize),
+			jobs.WithPollInterval(cfg.JobsPollInterval),
+			jobs.WithRetry(cfg.RetryPolicy()))
+		for kind, w := range newJobWorkers(&handlers) {
+			handlers.Jobs.Register(kind, w)
+		}
+		handle("/jobs/submit", handlers.SubmitJobHandler)
+		handle("/jobs/status", handlers.JobStatusHandler)
+		handle("/jobs/cancel", handlers.CancelJobHandler)
+		handle("/jobs/results", handlers.JobResultsHandler)
+		go func() {
+			handlers.Jobs.Run(jobsCtx)
+			close(jobsDone)
+		}()
+	} else {
+		close(jobsDone)
+	}
 
 	// Determine port for HTTP service.
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
-		log.Printf("defaulting to port %s", port)
+		logging.Infof(ctx, "defaulting to port %s", port)
+	}
+
+	// Requestの処理中に行うCopy, Uploadは全てこのContextから派生させ、Drainしきれなかった時にまとめてcancelする
+	opCtx, cancelOps := context.WithCancel(context.Background())
+	defer cancelOps()
+	server := &http.Server{
+		Addr: ":" + port,
+		BaseContext: func(net.Listener) context.Context {
+			return opCtx
+		},
 	}
 
 	// Start HTTP server.
-	log.Printf("listening on port %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	logging.Infof(ctx, "listening on port %s", port)
+	serverErr := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
+		}
+		close(serverErr)
+	}()
+
+	select {
+	case err := <-serverErr:
+		logging.Fatalf(ctx, "failed listen and serve: %s", err)
+	case <-sigCtx.Done():
+	}
+
+	logging.Infof(ctx, "shutting down server...")
+	ready.SetShuttingDown()
+	time.Sleep(cfg.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logging.Warningf(ctx, "failed drain in-flight requests. cancel outstanding operations: %s", err)
+		cancelOps()
+		if err := server.Close(); err != nil {
+			logging.Errorf(ctx, "failed server.Close: %s", err)
+		}
+	}
+
+	// 実行中のJobは処理を終えたObjectまでをCheckpointに記録して止まり、Lease切れの後に他のInstanceが再開する
+	stopJobs()
+	<-jobsDone
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), telemetryFlushTimeout)
+	defer cancelFlush()
+	tel.Close(flushCtx)
+	logging.Infof(ctx, "server stopped")
+}
+
+// newAuthenticator is Config.AuthModeに応じたAuthenticatorを作成する
+func newAuthenticator(cfg *Config) (auth.Authenticator, error) {
+	switch cfg.AuthMode {
+	case "":
+		return nil, fmt.Errorf("AuthMode is required. set AuthMode=none explicitly to disable authentication")
+	case "none":
+		return auth.AnonymousAuthenticator{}, nil
+	case "idtoken", "iap":
+		// audienceが空の場合はaudを検証しないので、他の宛先に発行されたID Tokenでも認証できてしまう
+		if cfg.AuthAudience == "" {
+			return nil, fmt.Errorf("AuthAudience is required when AuthMode=%s", cfg.AuthMode)
+		}
+		if cfg.AuthMode == "iap" {
+			return &auth.IAPAuthenticator{Audience: cfg.AuthAudience}, nil
+		}
+		return &auth.IDTokenAuthenticator{Audience: cfg.AuthAudience}, nil
+	case "apikey":
+		if len(cfg.APIKeys) < 1 {
+			return nil, fmt.Errorf("APIKeys is required when AuthMode=apikey")
+		}
+		return &auth.APIKeyAuthenticator{Keys: cfg.APIKeys}, nil
+	default:
+		return nil, fmt.Errorf("unsupported AuthMode: %s", cfg.AuthMode)
+	}
+}
+
+// newPolicy is Config.AuthPolicyFileから認可Policyを読み込む
+// AuthPolicyFileを指定しない場合は、AuthAllowAll=trueの時だけ全ての操作を許可する
+func newPolicy(cfg *Config) (*auth.Policy, error) {
+	if cfg.AuthPolicyFile != "" {
+		return auth.LoadPolicy(cfg.AuthPolicyFile)
+	}
+	if !cfg.AuthAllowAll {
+		return nil, fmt.Errorf("AuthPolicyFile is required. set AuthAllowAll=true explicitly to allow every operation")
+	}
+	return auth.AllowAll(), nil
+}
+
+// pruneClaimsInterval is 古いClaimを削除する間隔
+const pruneClaimsInterval = time.Hour
+
+// pruneClaims is ctxが終わるまで、retentionより前に処理したNotificationのClaimを定期的に削除する
+func pruneClaims(ctx context.Context, claims *notify.Claims, retention time.Duration) {
+	ticker := time.NewTicker(pruneClaimsInterval)
+	defer ticker.Stop()
+	for {
+		n, err := claims.Prune(ctx, time.Now().Add(-retention))
+		if err != nil {
+			logging.Warningf(ctx, "failed prune claims: %s", err)
+		} else if n > 0 {
+			logging.Infof(ctx, "pruned %d claims", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// newAuditLogger is Config.AuditSinkに応じたAudit Loggerを作成する
+// 返すfuncは終了時にSinkを閉じる
+func newAuditLogger(ctx context.Context, cfg *Config, store objstore.ObjectStore) (*audit.Logger, func() error, error) {
+	noop := func() error { return nil }
+
+	var sink audit.Sink
+	closeSink := noop
+	switch cfg.AuditSink {
+	case "", "none":
+		return nil, noop, nil
+	case "stdout":
+		sink = audit.NewWriterSink(os.Stdout)
+	case "file":
+		fs, err := audit.OpenFileSink(cfg.AuditFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		sink = fs
+		closeSink = fs.Close
+	case "gcs":
+		if cfg.AuditBucket == "" {
+			return nil, nil, fmt.Errorf("AuditBucket is required when AuditSink=gcs")
+		}
+		sink = audit.NewGCSSink(store, cfg.AuditBucket, cfg.AuditPrefix)
+	default:
+		return nil, nil, fmt.Errorf("unsupported AuditSink: %s", cfg.AuditSink)
+	}
+
+	l, err := audit.New(ctx, sink)
+	if err != nil {
+		_ = closeSink()
+		return nil, nil, err
 	}
+	return l, closeSink, nil
 }
 
 func helloHandler(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/internal/auth"
+)
+
+func TestNewAuthenticator(t *testing.T) {
+	cases := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{"empty mode", Config{}, true},
+		{"explicit none", Config{AuthMode: "none"}, false},
+		{"idtoken without audience", Config{AuthMode: "idtoken"}, true},
+		{"idtoken", Config{AuthMode: "idtoken", AuthAudience: "https://gcs-sample.example.com"}, false},
+		{"iap without audience", Config{AuthMode: "iap"}, true},
+		{"iap", Config{AuthMode: "iap", AuthAudience: "/projects/1/global/backendServices/2"}, false},
+		{"apikey without keys", Config{AuthMode: "apikey"}, true},
+		{"apikey", Config{AuthMode: "apikey", APIKeys: map[string]string{"key": "alice@example.com"}}, false},
+		{"unknown", Config{AuthMode: "basic"}, true},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newAuthenticator(&tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("want error %t but got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	alice := &auth.Principal{ID: "alice@example.com"}
+
+	if _, err := newPolicy(&Config{}); err == nil {
+		t.Error("want error without AuthPolicyFile but got nil")
+	}
+
+	policy, err := newPolicy(&Config{AuthAllowAll: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Authorize(alice, "bucket", "a.txt", auth.OperationDelete); err != nil {
+		t.Errorf("want allowed with AuthAllowAll but got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(path, []byte(`{"rules":[{"principals":["alice@example.com"],"bucket":"bucket","operations":["download"]}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// AuthPolicyFileを指定した場合はAuthAllowAllより優先する
+	policy, err = newPolicy(&Config{AuthPolicyFile: path, AuthAllowAll: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.Authorize(alice, "bucket", "a.txt", auth.OperationDownload); err != nil {
+		t.Errorf("want download allowed but got %v", err)
+	}
+	if err := policy.Authorize(alice, "bucket", "a.txt", auth.OperationDelete); err == nil {
+		t.Error("want delete denied but got nil")
+	}
+}
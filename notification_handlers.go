@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/notify"
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+// ObjectFinalizeHandler
+// BaseBucketにObjectが作成されたNotification (CloudEvents or Pub/Sub push) を受け取り、
+// そのGenerationをNotificationModeに応じてCSEKEncryptBucket1 or CMEKEncryptBucketに暗号化してUploadする
+// NotificationDeleteSourceの場合はUploadした後に平文のObjectを削除する
+//
+// 同じGenerationのNotificationが何度届いても処理するのは1回だけで、2回目以降は処理せずに2xxを返す
+// 処理に失敗した場合は5xxを返し、Pub/Sub, Eventarcが再送したNotificationで処理し直す
+// 処理している間はClaimのLeaseを延長し、他のDeliveryに奪われた場合は処理を止める
+func (handlers *Handlers) ObjectFinalizeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	event, err := notify.Parse(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid notification: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx = logging.WithObject(ctx, event.Bucket, event.Name)
+	if !event.Finalized() || event.Bucket != handlers.Config.BaseBucket {
+		// 再送されないように受け取ったことにする
+		logging.Infof(ctx, "ignore notification %s: type=%s", event.ID, event.Type)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	dstBucket := handlers.notificationDstBucket()
+	if !handlers.authorize(w, r, dstBucket, event.Name, auth.OperationUpload) {
+		return
+	}
+	if handlers.Config.NotificationDeleteSource && !handlers.authorize(w, r, event.Bucket, event.Name, auth.OperationMove) {
+		return
+	}
+
+	claim, err := handlers.Claims.Acquire(ctx, event)
+	if errors.Is(err, notify.ErrDuplicate) {
+		logging.Infof(ctx, "skip duplicate notification %s: generation=%d", event.ID, event.Generation)
+		writeJSON(ctx, w, http.StatusOK, claim.Result)
+		return
+	}
+	if errors.Is(err, notify.ErrInProgress) {
+		// 処理中のNotificationが終わった後に、再送されたNotificationで確認する
+		logging.Infof(ctx, "notification %s in progress: %s", event.ID, err)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logging.Errorf(ctx, "failed acquire claim: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result, err := handlers.encryptClaimed(ctx, claim, dstBucket)
+	if err != nil {
+		logging.Errorf(ctx, "failed encrypt generation %d: %s", event.Generation, err)
+		if err := handlers.Claims.Release(ctx, claim); err != nil {
+			logging.Errorf(ctx, "%s", err)
+		}
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	if err := handlers.Claims.Complete(ctx, claim, result); err != nil {
+		// 暗号化は終わっているので、Claimを記録できなくても再送はさせない
+		logging.Warningf(ctx, "failed complete claim: %s", err)
+	}
+	logging.Infof(ctx, "handled notification %s: %v", event.ID, result)
+	writeJSON(ctx, w, http.StatusOK, result)
+}
+
+// notificationDstBucket is NotificationModeに応じた暗号化したObjectを置くBucket
+func (handlers *Handlers) notificationDstBucket() string {
+	if handlers.Config.NotificationMode == "cmek" {
+		return handlers.Config.CMEKEncryptBucket()
+	}
+	return handlers.Config.CSEKEncryptBucket1()
+}
+
+// encryptClaimed is claimのLeaseを延長しながらencryptFinalizedを実行する
+// 他のDeliveryにClaimを奪われた場合は、Uploadを中断してErrInProgressを返す
+func (handlers *Handlers) encryptClaimed(ctx context.Context, claim *notify.Claim, dstBucket string) (map[string]string, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := make(chan struct{})
+	kept := make(chan error, 1)
+	go func() {
+		err := handlers.Claims.Keep(ctx, claim, stop)
+		if err != nil {
+			cancel()
+		}
+		kept <- err
+	}()
+
+	result, err := handlers.encryptFinalized(wctx, claim.Event, dstBucket)
+	close(stop)
+	if keepErr := <-kept; keepErr != nil {
+		return nil, keepErr
+	}
+	return result, err
+}
+
+// sourceGenerationKey is 暗号化したObjectのMetadataに記録する、BaseBucketのObjectのGeneration
+const sourceGenerationKey = "sourceGeneration"
+
+// encryptFinalized is eventのGenerationを暗号化してdstBucketにUploadし、結果を返す
+// Generationが既に削除されている場合や、dstBucketに同じか新しいGenerationが既にUploadされている場合は何もしない
+// Notificationの順番が前後しても古いGenerationで上書きしないように、dstBucketのObjectが確認した時から変わっていない時だけUploadする
+func (handlers *Handlers) encryptFinalized(ctx context.Context, event *notify.Event, dstBucket string) (map[string]string, error) {
+	result := map[string]string{
+		"bucket":     event.Bucket,
+		"object":     event.Name,
+		"generation": strconv.FormatInt(event.Generation, 10),
+		"dstBucket":  dstBucket,
+	}
+
+	conds := &objstore.Conditions{DoesNotExist: true}
+	dst, err := handlers.Store.Attrs(ctx, dstBucket, event.Name, nil)
+	switch {
+	case errors.Is(err, objstore.ErrObjectNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed read destination: %w", err)
+	default:
+		uploaded, _ := strconv.ParseInt(dst.Metadata[sourceGenerationKey], 10, 64)
+		if uploaded >= event.Generation {
+			logging.Infof(ctx, "generation %d is superseded by uploaded generation %d", event.Generation, uploaded)
+			result["status"] = "superseded"
+			return result, nil
+		}
+		conds = &objstore.Conditions{GenerationMatch: dst.Generation}
+	}
+
+	file, opts, err := handlers.openBaseGeneration(ctx, event.Name, event.Generation)
+	if errors.Is(err, objstore.ErrObjectNotExist) {
+		logging.Infof(ctx, "generation %d no longer exists", event.Generation)
+		result["status"] = "skipped"
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed open source: %w", err)
+	}
+	defer func() {
+		if err := file.Close(); err != nil {
+			logging.Warningf(ctx, "failed objectReader.Close: %s", err)
+		}
+	}()
+	if opts.Metadata == nil {
+		opts.Metadata = map[string]string{}
+	}
+	opts.Metadata[sourceGenerationKey] = strconv.FormatInt(event.Generation, 10)
+	opts.Conditions = conds
+
+	var size int64
+	if handlers.Config.NotificationMode == "cmek" {
+		size, err = handlers.CMEKService.UploadFrom(ctx, dstBucket, event.Name, file, opts)
+	} else {
+		var encKey []byte
+		encKey, err = encryption.GenerateEncryptionKey(ctx)
+		if err != nil {
+			return nil, err
+		}
+		size, err = handlers.CSEKService.UploadFrom(ctx, handlers.Config.CloudKMSKeyName, dstBucket, event.Name, encKey, file, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result["status"] = "encrypted"
+	result["size"] = strconv.FormatInt(size, 10)
+
+	if !handlers.Config.NotificationDeleteSource {
+		return result, nil
+	}
+	// 新しいGenerationが作成されていた場合は、そのGenerationのNotificationで処理するので残す
+	err = handlers.Store.Delete(ctx, event.Bucket, event.Name, &objstore.ObjectOptions{
+		Conditions: &objstore.Conditions{GenerationMatch: event.Generation},
+	})
+	var apiErr *googleapi.Error
+	switch {
+	case err == nil:
+		result["sourceDeleted"] = "true"
+	case errors.Is(err, objstore.ErrObjectNotExist), errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed:
+		logging.Infof(ctx, "keep source: generation %d is no longer live", event.Generation)
+		result["sourceDeleted"] = "false"
+	default:
+		return nil, fmt.Errorf("failed delete source: %w", err)
+	}
+	return result, nil
+}
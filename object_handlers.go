@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+	"github.com/sinmetal/gcs_sample/internal/auth"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+)
+
+// parseListOptions is Listの条件をRequest parameterから読み込む
+//
+//	prefix: 返すObjectの名前のprefix
+//	delimiter: 指定した場合は、prefixの後にdelimiterを含むObjectをprefixesにまとめる
+//	pageSize: 1回で返すObjectの数
+//	pageToken: 前回のResponseのnextPageToken
+func parseListOptions(r *http.Request) (*encryption.ListOptions, error) {
+	opts := &encryption.ListOptions{
+		Prefix:    r.FormValue("prefix"),
+		Delimiter: r.FormValue("delimiter"),
+		PageToken: r.FormValue("pageToken"),
+	}
+	if v := r.FormValue("pageSize"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("pageSize must be a positive integer but got %q", v)
+		}
+		opts.PageSize = n
+	}
+	return opts, nil
+}
+
+// ListCSEKHandler
+// CSEKEncryptBucket1のObjectを、暗号化の情報と共にJSONで返す
+func (handlers *Handlers) ListCSEKHandler(w http.ResponseWriter, r *http.Request) {
+	handlers.listObjects(w, r, handlers.Config.CSEKEncryptBucket1(), handlers.CSEKService.List)
+}
+
+// ListCMEKHandler
+// CMEKEncryptBucketのObjectを、暗号化の情報と共にJSONで返す
+func (handlers *Handlers) ListCMEKHandler(w http.ResponseWriter, r *http.Request) {
+	handlers.listObjects(w, r, handlers.Config.CMEKEncryptBucket(), handlers.CMEKService.List)
+}
+
+type listFunc func(ctx context.Context, bucketName string, opts *encryption.ListOptions) (*encryption.ObjectList, error)
+
+func (handlers *Handlers) listObjects(w http.ResponseWriter, r *http.Request, bucket string, list listFunc) {
+	ctx := r.Context()
+
+	opts, err := parseListOptions(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	ctx = logging.WithObject(ctx, bucket, opts.Prefix)
+	if !handlers.authorize(w, r, bucket, opts.Prefix, auth.OperationList) {
+		return
+	}
+
+	objects, err := list(ctx, bucket, opts)
+	if err != nil {
+		logging.Errorf(ctx, "failed list objects: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	writeJSON(ctx, w, http.StatusOK, objects)
+}
+
+// DeleteCSEKHandler
+// CSEKEncryptBucket1のObjectを削除する
+// recursive=trueの場合はprefix以下のObjectを全て削除して、Objectごとの結果をJSONで返す
+func (handlers *Handlers) DeleteCSEKHandler(w http.ResponseWriter, r *http.Request) {
+	handlers.deleteObjects(w, r, handlers.Config.CSEKEncryptBucket1(), handlers.CSEKService.Delete, handlers.CSEKService.DeletePrefix)
+}
+
+// DeleteCMEKHandler
+// CMEKEncryptBucketのObjectを削除する
+// recursive=trueの場合はprefix以下のObjectを全て削除して、Objectごとの結果をJSONで返す
+func (handlers *Handlers) DeleteCMEKHandler(w http.ResponseWriter, r *http.Request) {
+	handlers.deleteObjects(w, r, handlers.Config.CMEKEncryptBucket(), handlers.CMEKService.Delete, handlers.CMEKService.DeletePrefix)
+}
+
+type deleteFunc func(ctx context.Context, bucketName string, objectName string, generation int64) error
+
+type deletePrefixFunc func(ctx context.Context, bucketName string, prefix string, parallelism int) (*encryption.DeleteReport, error)
+
+// deleteObjects is Request parameterに応じてObjectを削除する
+//
+//	object: 削除するObject
+//	generation: 指定した場合は、最新のGenerationが一致する時だけ削除する。異なる場合は412を返す
+//	recursive: trueの場合はobjectの代わりにprefix以下のObjectを全て削除する
+//	prefix: recursive=trueの時に削除するObjectのprefix (必須)
+//	parallelism: recursive=trueの時に同時に削除するObjectの数 (最大32)
+func (handlers *Handlers) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string, deleteObject deleteFunc, deletePrefix deletePrefixFunc) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	recursive, err := parseBool(r, "recursive")
+	if err != nil {
+		logging.Warningf(ctx, "invalid request: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if recursive {
+		handlers.deletePrefix(w, r, bucket, deletePrefix)
+		return
+	}
+
+	object := r.FormValue("object")
+	ctx = logging.WithObject(ctx, bucket, object)
+	if object == "" {
+		logging.Warningf(ctx, "object is required")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	generation, err := parseGeneration(r)
+	if err != nil {
+		logging.Warningf(ctx, "invalid generation: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !handlers.authorize(w, r, bucket, object, auth.OperationDelete) {
+		return
+	}
+
+	if err := deleteObject(ctx, bucket, object, generation); err != nil {
+		logging.Errorf(ctx, "failed delete object: %s", err)
+		w.WriteHeader(errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (handlers *Handlers) deletePrefix(w http.ResponseWriter, r *http.Request, bucket string, deletePrefix deletePrefixFunc) {
+	ctx := r.Context()
+
+	prefix := r.FormValue("prefix")
+	ctx = logging.WithObject(ctx, bucket, prefix)
+	if prefix == "" {
+		// Bucketの全てのObjectを消してしまわないように必須にする
+		logging.Warningf(ctx, "prefix is required when recursive=true")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var parallelism int
+	if v := r.FormValue("parallelism"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			logging.Warningf(ctx, "parallelism must be a positive integer but got %q", v)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parallelism = n
+	}
+	if !handlers.authorize(w, r, bucket, prefix, auth.OperationDelete) {
+		return
+	}
+
+	report, err := deletePrefix(ctx, bucket, prefix, parallelism)
+	if err != nil {
+		logging.Errorf(ctx, "failed delete prefix: %s", err)
+		if report == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		writeJSON(ctx, w, errorStatus(err), report)
+		return
+	}
+	for _, result := range report.Results {
+		if result.Status == encryption.DeleteFailed {
+			logging.Warningf(ctx, "failed delete %s: %s", result.Object, result.Error)
+		}
+	}
+	writeJSON(ctx, w, http.StatusOK, report)
+}
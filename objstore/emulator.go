@@ -0,0 +1,631 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxComposeSources is Cloud StorageのComposeで指定できるObjectの上限
+const maxComposeSources = 32
+
+// version is Memory, Filesystemが保持するObjectの1つのGeneration
+// 最新のGeneration以外はAttrs.Deletedが設定されたnoncurrentなGenerationとして残る (Object Versioningが有効なBucketと同じ)
+type version struct {
+	Attrs ObjectAttrs `json:"attrs"`
+
+	// data is Memoryの場合のObjectの内容
+	data []byte
+}
+
+func (v *version) live() bool {
+	return v.Attrs.Deleted.IsZero()
+}
+
+func (v *version) attrs() *ObjectAttrs {
+	attrs := v.Attrs
+	if v.Attrs.Metadata != nil {
+		attrs.Metadata = make(map[string]string, len(v.Attrs.Metadata))
+		for k, val := range v.Attrs.Metadata {
+			attrs.Metadata[k] = val
+		}
+	}
+	return &attrs
+}
+
+// attrsWithKey is Attrs, Listが返す属性
+// Cloud Storageと同じく、CSEKで暗号化されたObjectは鍵を指定しない限りCRC32C, MD5を返さない
+func (v *version) attrsWithKey(key []byte) *ObjectAttrs {
+	attrs := v.attrs()
+	if attrs.CustomerKeySHA256 != "" && len(key) == 0 {
+		attrs.CRC32C = 0
+		attrs.MD5 = nil
+	}
+	return attrs
+}
+
+// persister is emulatorが保持するObjectの内容を保存する先
+type persister interface {
+	// save is 新しいGenerationを保存する
+	save(v *version, data []byte) error
+
+	// update is vのAttrsの変更を保存する
+	update(v *version) error
+
+	// read is vの内容を返す
+	read(v *version) ([]byte, error)
+
+	// remove is vを削除する
+	remove(v *version) error
+}
+
+// emulator is Cloud StorageのGeneration, Precondition, CSEKの鍵のCheckを真似たObjectStoreの実装
+// Objectの内容の保存はpersisterに任せる
+type emulator struct {
+	mu      sync.Mutex
+	buckets map[string]map[string][]*version
+	lastGen int64
+	persist persister
+	now     func() time.Time
+}
+
+func newEmulator(p persister) *emulator {
+	return &emulator{
+		buckets: map[string]map[string][]*version{},
+		persist: p,
+		now:     time.Now,
+	}
+}
+
+// add is 保存済みのGenerationを登録する
+func (e *emulator) add(v *version) {
+	objects, ok := e.buckets[v.Attrs.Bucket]
+	if !ok {
+		objects = map[string][]*version{}
+		e.buckets[v.Attrs.Bucket] = objects
+	}
+	versions := append(objects[v.Attrs.Name], v)
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Attrs.Generation < versions[j].Attrs.Generation
+	})
+	objects[v.Attrs.Name] = versions
+	if v.Attrs.Generation > e.lastGen {
+		e.lastGen = v.Attrs.Generation
+	}
+}
+
+// nextGeneration is Cloud Storageと同じくmicrosecond単位の時刻を元に、単調増加するGenerationを返す
+func (e *emulator) nextGeneration(now time.Time) int64 {
+	gen := now.UnixNano() / int64(time.Microsecond)
+	if gen <= e.lastGen {
+		gen = e.lastGen + 1
+	}
+	e.lastGen = gen
+	return gen
+}
+
+func (e *emulator) liveVersion(bucket string, name string) *version {
+	versions := e.buckets[bucket][name]
+	if len(versions) < 1 {
+		return nil
+	}
+	if v := versions[len(versions)-1]; v.live() {
+		return v
+	}
+	return nil
+}
+
+// find is generationが0の場合は最新のGenerationを、それ以外は指定したGenerationを返す
+func (e *emulator) find(bucket string, name string, generation int64) *version {
+	if generation == 0 {
+		return e.liveVersion(bucket, name)
+	}
+	for _, v := range e.buckets[bucket][name] {
+		if v.Attrs.Generation == generation {
+			return v
+		}
+	}
+	return nil
+}
+
+func checkConditions(v *version, c *Conditions) error {
+	if c == nil {
+		return nil
+	}
+	switch {
+	case c.DoesNotExist && v != nil:
+		return errPreconditionFailed()
+	case c.GenerationMatch != 0 && (v == nil || v.Attrs.Generation != c.GenerationMatch):
+		return errPreconditionFailed()
+	case c.GenerationNotMatch != 0 && v != nil && v.Attrs.Generation == c.GenerationNotMatch:
+		return errPreconditionFailed()
+	case c.MetagenerationMatch != 0 && (v == nil || v.Attrs.Metageneration != c.MetagenerationMatch):
+		return errPreconditionFailed()
+	case c.MetagenerationNotMatch != 0 && v != nil && v.Attrs.Metageneration == c.MetagenerationNotMatch:
+		return errPreconditionFailed()
+	}
+	return nil
+}
+
+// validateKey is CSEKとして指定された鍵がAES-256の鍵であることを確認する
+func validateKey(key []byte) error {
+	if len(key) != 0 && len(key) != 32 {
+		return errBadRequest("customerEncryptionKeyFormatIsInvalid",
+			"Missing an encryption key, or it is not base64 encoded, or it does not meet the required length of the encryption algorithm.")
+	}
+	return nil
+}
+
+// checkKey is vを読むのにkeyが正しいかを、Cloud Storageと同じく鍵のSHA-256で確認する
+func checkKey(v *version, key []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	sha := v.Attrs.CustomerKeySHA256
+	switch {
+	case sha != "" && len(key) == 0:
+		return errBadRequest("resourceIsEncryptedWithCustomerEncryptionKey",
+			"The target object is encrypted by a customer-supplied encryption key.")
+	case sha == "" && len(key) != 0:
+		return errBadRequest("resourceNotEncryptedWithCustomerEncryptionKey",
+			"The target object is not encrypted by a customer-supplied encryption key.")
+	case sha != "" && sha != KeySHA256(key):
+		return errBadRequest("customerEncryptionKeySha256IsInvalid",
+			"The provided encryption key is incorrect.")
+	}
+	return nil
+}
+
+func (e *emulator) read(bucket string, name string, generation int64, conds *Conditions, key []byte) (*version, []byte, error) {
+	v := e.find(bucket, name, generation)
+	if v == nil {
+		return nil, nil, ErrObjectNotExist
+	}
+	if err := checkConditions(v, conds); err != nil {
+		return nil, nil, err
+	}
+	if err := checkKey(v, key); err != nil {
+		return nil, nil, err
+	}
+	data, err := e.persist.read(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return v, data, nil
+}
+
+// create is 新しいGenerationを作成し、それまでの最新のGenerationをnoncurrentにする
+func (e *emulator) create(bucket string, name string, src ObjectAttrs, data []byte, key []byte, conds *Conditions) (*ObjectAttrs, error) {
+	if bucket == "" || name == "" {
+		return nil, fmt.Errorf("bucket and object name are required")
+	}
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	live := e.liveVersion(bucket, name)
+	if err := checkConditions(live, conds); err != nil {
+		return nil, err
+	}
+
+	now := e.now().UTC()
+	md5sum := md5.Sum(data)
+	v := &version{Attrs: ObjectAttrs{
+		Bucket:             bucket,
+		Name:               name,
+		ContentType:        src.ContentType,
+		ContentLanguage:    src.ContentLanguage,
+		ContentEncoding:    src.ContentEncoding,
+		ContentDisposition: src.ContentDisposition,
+		CacheControl:       src.CacheControl,
+		KMSKeyName:         src.KMSKeyName,
+		Size:               int64(len(data)),
+		MD5:                md5sum[:],
+		CRC32C:             crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)),
+		Generation:         e.nextGeneration(now),
+		Metageneration:     1,
+		StorageClass:       src.StorageClass,
+		Created:            now,
+		Updated:            now,
+	}}
+	if v.Attrs.StorageClass == "" {
+		v.Attrs.StorageClass = "STANDARD"
+	}
+	if len(src.Metadata) > 0 {
+		v.Attrs.Metadata = make(map[string]string, len(src.Metadata))
+		for k, val := range src.Metadata {
+			v.Attrs.Metadata[k] = val
+		}
+	}
+	if len(key) > 0 {
+		v.Attrs.CustomerKeySHA256 = KeySHA256(key)
+	}
+	v.Attrs.Etag = base64.StdEncoding.EncodeToString([]byte(strconv.FormatInt(v.Attrs.Generation, 10)))
+
+	if err := e.persist.save(v, data); err != nil {
+		return nil, err
+	}
+	if live != nil {
+		live.Attrs.Deleted = now
+		if err := e.persist.update(live); err != nil {
+			return nil, err
+		}
+	}
+	e.add(v)
+	return v.attrs(), nil
+}
+
+// NewReader implements ObjectStore.
+func (e *emulator) NewReader(ctx context.Context, bucket string, name string, opts *ObjectOptions) (io.ReadCloser, error) {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, data, err := e.read(bucket, name, opts.Generation, opts.Conditions, opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// NewWriter implements ObjectStore.
+func (e *emulator) NewWriter(ctx context.Context, bucket string, name string, opts *WriteOptions) Writer {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	return &emulatorWriter{ctx: ctx, e: e, bucket: bucket, name: name, opts: *opts}
+}
+
+// Attrs implements ObjectStore.
+func (e *emulator) Attrs(ctx context.Context, bucket string, name string, opts *ObjectOptions) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v := e.find(bucket, name, opts.Generation)
+	if v == nil {
+		return nil, ErrObjectNotExist
+	}
+	if err := checkConditions(v, opts.Conditions); err != nil {
+		return nil, err
+	}
+	if len(opts.EncryptionKey) > 0 {
+		if err := checkKey(v, opts.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+	return v.attrsWithKey(opts.EncryptionKey), nil
+}
+
+// Copy implements ObjectStore.
+func (e *emulator) Copy(ctx context.Context, dst ObjectRef, src ObjectRef, opts *CopyOptions) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	sv, data, err := e.read(src.Bucket, src.Name, src.Generation, nil, opts.SrcEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	attrs := sv.Attrs
+	attrs.KMSKeyName = ""
+	if opts.Attrs != nil {
+		attrs = *opts.Attrs
+	}
+	if opts.DstKMSKeyName != "" {
+		attrs.KMSKeyName = opts.DstKMSKeyName
+	}
+	return e.create(dst.Bucket, dst.Name, attrs, data, opts.DstEncryptionKey, opts.DstConditions)
+}
+
+// Compose implements ObjectStore.
+func (e *emulator) Compose(ctx context.Context, dst ObjectRef, srcs []ObjectRef, opts *ComposeOptions) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &ComposeOptions{}
+	}
+	if len(srcs) < 1 || len(srcs) > maxComposeSources {
+		return nil, errBadRequest("invalid", fmt.Sprintf("The number of source components provided (%d) must be between 1 and %d.", len(srcs), maxComposeSources))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var buf bytes.Buffer
+	for _, src := range srcs {
+		if src.Bucket != dst.Bucket {
+			return nil, errBadRequest("invalid", "Source and destination objects must be in the same bucket.")
+		}
+		_, data, err := e.read(src.Bucket, src.Name, src.Generation, nil, opts.EncryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+	}
+	var attrs ObjectAttrs
+	if opts.Attrs != nil {
+		attrs = *opts.Attrs
+	}
+	return e.create(dst.Bucket, dst.Name, attrs, buf.Bytes(), opts.EncryptionKey, opts.Conditions)
+}
+
+// List implements ObjectStore.
+func (e *emulator) List(ctx context.Context, bucket string, q *Query, pageSize int, pageToken string) (*ListPage, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	var after *listKey
+	if pageToken != "" {
+		k, err := decodePageToken(pageToken)
+		if err != nil {
+			return nil, errBadRequest("invalid", fmt.Sprintf("Invalid page token: %s", err))
+		}
+		after = &k
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	names := make([]string, 0, len(e.buckets[bucket]))
+	for name := range e.buckets[bucket] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var entries []*ObjectAttrs
+	prefixes := map[string]bool{}
+	for _, name := range names {
+		if !strings.HasPrefix(name, q.Prefix) ||
+			(q.StartOffset != "" && name < q.StartOffset) ||
+			(q.EndOffset != "" && name >= q.EndOffset) {
+			continue
+		}
+		if q.Delimiter != "" {
+			rest := name[len(q.Prefix):]
+			if i := strings.Index(rest, q.Delimiter); i >= 0 {
+				p := q.Prefix + rest[:i+len(q.Delimiter)]
+				if !prefixes[p] && e.hasVersion(bucket, name, q.Versions) {
+					prefixes[p] = true
+					entries = append(entries, &ObjectAttrs{Prefix: p})
+				}
+				continue
+			}
+		}
+		for _, v := range e.buckets[bucket][name] {
+			if q.Versions || v.live() {
+				entries = append(entries, v.attrsWithKey(nil))
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return keyOf(entries[i]).less(keyOf(entries[j]))
+	})
+
+	page := &ListPage{}
+	for _, attrs := range entries {
+		k := keyOf(attrs)
+		if after != nil && !after.less(k) {
+			continue
+		}
+		if len(page.Objects) == pageSize {
+			page.NextPageToken = encodePageToken(keyOf(page.Objects[len(page.Objects)-1]))
+			break
+		}
+		page.Objects = append(page.Objects, attrs)
+	}
+	return page, nil
+}
+
+func (e *emulator) hasVersion(bucket string, name string, versions bool) bool {
+	if versions {
+		return len(e.buckets[bucket][name]) > 0
+	}
+	return e.liveVersion(bucket, name) != nil
+}
+
+// Update implements ObjectStore.
+func (e *emulator) Update(ctx context.Context, bucket string, name string, opts *ObjectOptions, attrs ObjectAttrsToUpdate) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v := e.find(bucket, name, opts.Generation)
+	if v == nil {
+		return nil, ErrObjectNotExist
+	}
+	if err := checkConditions(v, opts.Conditions); err != nil {
+		return nil, err
+	}
+
+	prev := v.attrs()
+	for _, f := range []struct {
+		value interface{}
+		dst   *string
+	}{
+		{attrs.ContentType, &v.Attrs.ContentType},
+		{attrs.ContentEncoding, &v.Attrs.ContentEncoding},
+		{attrs.ContentLanguage, &v.Attrs.ContentLanguage},
+		{attrs.ContentDisposition, &v.Attrs.ContentDisposition},
+		{attrs.CacheControl, &v.Attrs.CacheControl},
+	} {
+		if s, ok := f.value.(string); ok {
+			*f.dst = s
+		}
+	}
+	switch {
+	case attrs.Metadata == nil:
+	case len(attrs.Metadata) == 0:
+		v.Attrs.Metadata = nil
+	default:
+		if v.Attrs.Metadata == nil {
+			v.Attrs.Metadata = map[string]string{}
+		}
+		for k, val := range attrs.Metadata {
+			v.Attrs.Metadata[k] = val
+		}
+	}
+	v.Attrs.Metageneration++
+	v.Attrs.Updated = e.now().UTC()
+	if err := e.persist.update(v); err != nil {
+		v.Attrs = *prev
+		return nil, err
+	}
+	return v.attrs(), nil
+}
+
+// Delete implements ObjectStore.
+func (e *emulator) Delete(ctx context.Context, bucket string, name string, opts *ObjectOptions) error {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	v := e.find(bucket, name, opts.Generation)
+	if v == nil {
+		return ErrObjectNotExist
+	}
+	if err := checkConditions(v, opts.Conditions); err != nil {
+		return err
+	}
+	if opts.Generation == 0 {
+		// 最新のGenerationはnoncurrentとして残す
+		v.Attrs.Deleted = e.now().UTC()
+		return e.persist.update(v)
+	}
+
+	if err := e.persist.remove(v); err != nil {
+		return err
+	}
+	versions := e.buckets[bucket][name]
+	for i := range versions {
+		if versions[i] == v {
+			versions = append(versions[:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) < 1 {
+		delete(e.buckets[bucket], name)
+		return nil
+	}
+	e.buckets[bucket][name] = versions
+	return nil
+}
+
+// listKey is Listの並び順とpageTokenに利用する位置
+type listKey struct {
+	name       string
+	generation int64
+}
+
+func keyOf(attrs *ObjectAttrs) listKey {
+	if attrs.Prefix != "" {
+		return listKey{name: attrs.Prefix}
+	}
+	return listKey{name: attrs.Name, generation: attrs.Generation}
+}
+
+func (k listKey) less(o listKey) bool {
+	if k.name != o.name {
+		return k.name < o.name
+	}
+	return k.generation < o.generation
+}
+
+func encodePageToken(k listKey) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%s", k.generation, k.name)))
+}
+
+func decodePageToken(token string) (listKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return listKey{}, err
+	}
+	s := string(b)
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return listKey{}, fmt.Errorf("malformed")
+	}
+	gen, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return listKey{}, err
+	}
+	return listKey{name: s[i+1:], generation: gen}, nil
+}
+
+// emulatorWriter is 書き込まれた内容をCloseまで保持し、Closeした時にObjectを作成するWriter
+type emulatorWriter struct {
+	ctx    context.Context
+	e      *emulator
+	bucket string
+	name   string
+	opts   WriteOptions
+	buf    bytes.Buffer
+	attrs  *ObjectAttrs
+	closed bool
+}
+
+func (w *emulatorWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("objstore: writer is closed")
+	}
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+func (w *emulatorWriter) Close() error {
+	if w.closed {
+		return fmt.Errorf("objstore: writer is already closed")
+	}
+	w.closed = true
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	w.e.mu.Lock()
+	defer w.e.mu.Unlock()
+	attrs, err := w.e.create(w.bucket, w.name, w.opts.Attrs, w.buf.Bytes(), w.opts.EncryptionKey, w.opts.Conditions)
+	if err != nil {
+		return err
+	}
+	w.attrs = attrs
+	return nil
+}
+
+func (w *emulatorWriter) Attrs() *ObjectAttrs {
+	return w.attrs
+}
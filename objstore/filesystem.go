@@ -0,0 +1,124 @@
+package objstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Filesystem is Objectをlocalのdirectoryに保存するObjectStore
+// 再起動してもObjectとGenerationが残るので、Localでの動作確認に利用する
+// CSEKの鍵はSHA-256だけを保持して読み込み時にCheckする。内容を暗号化はしない
+//
+// Layout: {root}/{bucket}/{sha256(object name)}/{generation}.json, {generation}.data
+type Filesystem struct {
+	*emulator
+}
+
+// NewFilesystem is rootにObjectを保存するFilesystemを返す
+// rootに保存済みのObjectがあれば読み込む
+func NewFilesystem(root string) (*Filesystem, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, fmt.Errorf("failed create objstore root %s: %w", root, err)
+	}
+	e := newEmulator(&filesystemPersister{root: root})
+	metas, err := filepath.Glob(filepath.Join(root, "*", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range metas {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed read %s: %w", path, err)
+		}
+		var v version
+		if err := json.Unmarshal(b, &v); err != nil {
+			return nil, fmt.Errorf("failed json.Unmarshal %s: %w", path, err)
+		}
+		e.add(&v)
+	}
+	return &Filesystem{emulator: e}, nil
+}
+
+type filesystemPersister struct {
+	root string
+}
+
+func (p *filesystemPersister) path(v *version, ext string) (string, error) {
+	bucket := v.Attrs.Bucket
+	if bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", errBadRequest("invalid", fmt.Sprintf("Invalid bucket name: %s", bucket))
+	}
+	sum := sha256.Sum256([]byte(v.Attrs.Name))
+	return filepath.Join(p.root, bucket, hex.EncodeToString(sum[:]), fmt.Sprintf("%020d%s", v.Attrs.Generation, ext)), nil
+}
+
+func (p *filesystemPersister) save(v *version, data []byte) error {
+	path, err := p.path(v, ".data")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	return p.update(v)
+}
+
+func (p *filesystemPersister) update(v *version) error {
+	path, err := p.path(v, ".json")
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b)
+}
+
+func (p *filesystemPersister) read(v *version) ([]byte, error) {
+	path, err := p.path(v, ".data")
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (p *filesystemPersister) remove(v *version) error {
+	for _, ext := range []string{".json", ".data"} {
+		path, err := p.path(v, ext)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic is 途中で失敗しても中途半端なFileが残らないように、一時Fileに書いてからrenameする
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
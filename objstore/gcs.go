@@ -0,0 +1,131 @@
+package objstore
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// GCS is Cloud Storageを利用するObjectStore
+type GCS struct {
+	client *storage.Client
+}
+
+// NewGCS is clientを利用するObjectStoreを返す
+func NewGCS(client *storage.Client) *GCS {
+	return &GCS{client: client}
+}
+
+// Client is 利用しているstorage.Clientを返す
+func (s *GCS) Client() *storage.Client {
+	return s.client
+}
+
+func (s *GCS) object(bucket string, name string, generation int64, conds *Conditions, key []byte) *storage.ObjectHandle {
+	obj := s.client.Bucket(bucket).Object(name)
+	if generation != 0 {
+		obj = obj.Generation(generation)
+	}
+	if conds != nil {
+		obj = obj.If(*conds)
+	}
+	if len(key) > 0 {
+		obj = obj.Key(key)
+	}
+	return obj
+}
+
+// NewReader implements ObjectStore.
+func (s *GCS) NewReader(ctx context.Context, bucket string, name string, opts *ObjectOptions) (io.ReadCloser, error) {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	return s.object(bucket, name, opts.Generation, opts.Conditions, opts.EncryptionKey).NewReader(ctx)
+}
+
+// NewWriter implements ObjectStore.
+func (s *GCS) NewWriter(ctx context.Context, bucket string, name string, opts *WriteOptions) Writer {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	w := s.object(bucket, name, 0, opts.Conditions, opts.EncryptionKey).NewWriter(ctx)
+	w.ContentType = opts.Attrs.ContentType
+	w.ContentEncoding = opts.Attrs.ContentEncoding
+	w.ContentLanguage = opts.Attrs.ContentLanguage
+	w.ContentDisposition = opts.Attrs.ContentDisposition
+	w.CacheControl = opts.Attrs.CacheControl
+	w.Metadata = opts.Attrs.Metadata
+	w.KMSKeyName = opts.Attrs.KMSKeyName
+	return w
+}
+
+// Attrs implements ObjectStore.
+func (s *GCS) Attrs(ctx context.Context, bucket string, name string, opts *ObjectOptions) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	return s.object(bucket, name, opts.Generation, opts.Conditions, opts.EncryptionKey).Attrs(ctx)
+}
+
+// Copy implements ObjectStore.
+func (s *GCS) Copy(ctx context.Context, dst ObjectRef, src ObjectRef, opts *CopyOptions) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	srcObj := s.object(src.Bucket, src.Name, src.Generation, nil, opts.SrcEncryptionKey)
+	dstObj := s.object(dst.Bucket, dst.Name, 0, opts.DstConditions, opts.DstEncryptionKey)
+	copier := dstObj.CopierFrom(srcObj)
+	if opts.Attrs != nil {
+		copier.ObjectAttrs = *opts.Attrs
+	}
+	copier.DestinationKMSKeyName = opts.DstKMSKeyName
+	return copier.Run(ctx)
+}
+
+// Compose implements ObjectStore.
+func (s *GCS) Compose(ctx context.Context, dst ObjectRef, srcs []ObjectRef, opts *ComposeOptions) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &ComposeOptions{}
+	}
+	handles := make([]*storage.ObjectHandle, 0, len(srcs))
+	for _, src := range srcs {
+		handles = append(handles, s.object(src.Bucket, src.Name, src.Generation, nil, opts.EncryptionKey))
+	}
+	composer := s.object(dst.Bucket, dst.Name, 0, opts.Conditions, opts.EncryptionKey).ComposerFrom(handles...)
+	if opts.Attrs != nil {
+		composer.ObjectAttrs = *opts.Attrs
+	}
+	return composer.Run(ctx)
+}
+
+// List implements ObjectStore.
+func (s *GCS) List(ctx context.Context, bucket string, q *Query, pageSize int, pageToken string) (*ListPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	it := s.client.Bucket(bucket).Objects(ctx, q)
+	var objects []*storage.ObjectAttrs
+	next, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&objects)
+	if err != nil {
+		return nil, err
+	}
+	return &ListPage{Objects: objects, NextPageToken: next}, nil
+}
+
+// Update implements ObjectStore.
+func (s *GCS) Update(ctx context.Context, bucket string, name string, opts *ObjectOptions, attrs ObjectAttrsToUpdate) (*ObjectAttrs, error) {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	return s.object(bucket, name, opts.Generation, opts.Conditions, nil).Update(ctx, attrs)
+}
+
+// Delete implements ObjectStore.
+func (s *GCS) Delete(ctx context.Context, bucket string, name string, opts *ObjectOptions) error {
+	if opts == nil {
+		opts = &ObjectOptions{}
+	}
+	return s.object(bucket, name, opts.Generation, opts.Conditions, nil).Delete(ctx)
+}
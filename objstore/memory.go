@@ -0,0 +1,31 @@
+package objstore
+
+// Memory is Objectをmemory上に保持するObjectStore
+// CSEKの鍵はSHA-256だけを保持して読み込み時にCheckする。内容を暗号化はしない
+type Memory struct {
+	*emulator
+}
+
+// NewMemory is 空のMemoryを返す
+func NewMemory() *Memory {
+	return &Memory{emulator: newEmulator(memoryPersister{})}
+}
+
+type memoryPersister struct{}
+
+func (memoryPersister) save(v *version, data []byte) error {
+	v.data = append([]byte(nil), data...)
+	return nil
+}
+
+func (memoryPersister) update(v *version) error {
+	return nil
+}
+
+func (memoryPersister) read(v *version) ([]byte, error) {
+	return v.data, nil
+}
+
+func (memoryPersister) remove(v *version) error {
+	return nil
+}
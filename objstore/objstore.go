@@ -0,0 +1,184 @@
+// Package objstore is Cloud Storageを抽象化したObjectStoreと、その実装
+//
+// GCSはCloud Storageをそのまま利用する
+// Memory, FilesystemはCloud StorageのCSEKの鍵のCheck, Generation, Preconditionを真似たもので、
+// Cloud Storageに接続せずにServiceやHandlerを動かすために利用する
+package objstore
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// ObjectAttrs is Objectの属性
+type ObjectAttrs = storage.ObjectAttrs
+
+// ObjectAttrsToUpdate is Updateで変更する属性
+// ContentType, ContentEncoding, ContentLanguage, ContentDisposition, CacheControl, Metadataを利用する
+type ObjectAttrsToUpdate = storage.ObjectAttrsToUpdate
+
+// Conditions is 操作の前提条件 (Precondition)
+type Conditions = storage.Conditions
+
+// Query is Listで返すObjectの条件
+// Prefix, Delimiter, Versions, StartOffset, EndOffsetを利用する
+type Query = storage.Query
+
+var (
+	// ErrObjectNotExist is 対象のObjectが存在しない
+	ErrObjectNotExist = storage.ErrObjectNotExist
+
+	// ErrBucketNotExist is 対象のBucketが存在しない
+	ErrBucketNotExist = storage.ErrBucketNotExist
+)
+
+// ObjectStore is Objectの読み書きを行うStorage
+type ObjectStore interface {
+	// NewReader is Objectの内容を読み込むReaderを返す
+	NewReader(ctx context.Context, bucket string, name string, opts *ObjectOptions) (io.ReadCloser, error)
+
+	// NewWriter is Objectを書き込むWriterを返す
+	// Closeが成功した時点でObjectが作成される。Close前にctxがcancelされた場合、Objectは作成されない
+	NewWriter(ctx context.Context, bucket string, name string, opts *WriteOptions) Writer
+
+	// Attrs is Objectの属性を返す
+	// CSEKで暗号化されたObjectでも鍵無しで取得できるが、CRC32C, MD5はopts.EncryptionKeyを指定した時だけ返す
+	Attrs(ctx context.Context, bucket string, name string, opts *ObjectOptions) (*ObjectAttrs, error)
+
+	// Copy is srcの内容をdstにCopyする
+	Copy(ctx context.Context, dst ObjectRef, src ObjectRef, opts *CopyOptions) (*ObjectAttrs, error)
+
+	// Compose is srcsの内容を順につなげてdstを作成する
+	// srcsは全てdstと同じBucketのObjectである必要がある
+	Compose(ctx context.Context, dst ObjectRef, srcs []ObjectRef, opts *ComposeOptions) (*ObjectAttrs, error)
+
+	// List is qに一致するObjectを名前順に最大pageSize件返す
+	// 続きがある場合はListPage.NextPageTokenを次のpageTokenに指定する
+	List(ctx context.Context, bucket string, q *Query, pageSize int, pageToken string) (*ListPage, error)
+
+	// Update is Objectの属性を変更する
+	// Generationは変わらず、Metagenerationが増える。opts.Generationを指定した場合は、そのGenerationを変更する
+	// Metadataは指定したKeyだけを変更し、他のKeyは残す。空のmapを指定した場合は全て削除する
+	Update(ctx context.Context, bucket string, name string, opts *ObjectOptions, attrs ObjectAttrsToUpdate) (*ObjectAttrs, error)
+
+	// Delete is Objectを削除する
+	// opts.Generationを指定した場合は、そのGenerationを削除する
+	Delete(ctx context.Context, bucket string, name string, opts *ObjectOptions) error
+}
+
+// Writer is ObjectStore.NewWriterが返すWriter
+type Writer interface {
+	io.WriteCloser
+
+	// Attrs is Closeに成功した後、作成されたObjectの属性を返す
+	Attrs() *ObjectAttrs
+}
+
+// ObjectRef is 操作対象のObject
+// Generationが0の場合は最新のGenerationを指す
+type ObjectRef struct {
+	Bucket     string
+	Name       string
+	Generation int64
+}
+
+// ObjectOptions is Objectを読む, 削除する時のOption
+type ObjectOptions struct {
+	// Generation is 対象のGeneration. 0の場合は最新のGeneration
+	Generation int64
+
+	// Conditions is 操作の前提条件
+	Conditions *Conditions
+
+	// EncryptionKey is CSEKで暗号化されたObjectを読む時の鍵 (AES-256)
+	// Attrsでは、指定した場合だけCSEKで暗号化されたObjectのCRC32C, MD5を返す
+	EncryptionKey []byte
+}
+
+// WriteOptions is Objectを書き込む時のOption
+type WriteOptions struct {
+	// Attrs is 作成するObjectの属性
+	// ContentType, ContentEncoding, ContentLanguage, ContentDisposition, CacheControl, Metadata, KMSKeyNameを利用する
+	Attrs ObjectAttrs
+
+	// Conditions is 書き込みの前提条件
+	Conditions *Conditions
+
+	// EncryptionKey is CSEKとして利用する鍵 (AES-256)
+	EncryptionKey []byte
+}
+
+// CopyOptions is Copy時のOption
+type CopyOptions struct {
+	// SrcEncryptionKey is Copy元がCSEKで暗号化されている場合の鍵
+	SrcEncryptionKey []byte
+
+	// DstEncryptionKey is Copy先をCSEKで暗号化する場合の鍵
+	DstEncryptionKey []byte
+
+	// DstKMSKeyName is Copy先をCMEKで暗号化する場合のCloud KMS Key
+	DstKMSKeyName string
+
+	// DstConditions is Copy先の前提条件
+	DstConditions *Conditions
+
+	// Attrs is Copy先の属性
+	// nilの場合はCopy元の属性を引き継ぐ。指定した場合はCopy元の属性は引き継がない
+	Attrs *ObjectAttrs
+}
+
+// ComposeOptions is Compose時のOption
+type ComposeOptions struct {
+	// EncryptionKey is srcsとdstのCSEK. Composeでは全て同じ鍵である必要がある
+	EncryptionKey []byte
+
+	// Conditions is dstの前提条件
+	Conditions *Conditions
+
+	// Attrs is dstの属性
+	Attrs *ObjectAttrs
+}
+
+// ListPage is Listの結果
+type ListPage struct {
+	// Objects is 名前順のObject
+	// Query.Delimiterを指定した場合、Delimiterで区切られたPrefixはPrefixだけを持つObjectAttrsとして含まれる
+	Objects []*ObjectAttrs
+
+	// NextPageToken is 続きを取得する時に指定するToken. 最後のPageでは空
+	NextPageToken string
+}
+
+// DefaultPageSize is Listで0以下のpageSizeを指定した時の件数
+const DefaultPageSize = 1000
+
+// KeySHA256 is CSEKの鍵のSHA-256をbase64で返す
+// Cloud StorageのObjectAttrs.CustomerKeySHA256と同じ形式
+func KeySHA256(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// errPreconditionFailed is Cloud StorageがPreconditionを満たさなかった時に返すErrorと同じもの
+func errPreconditionFailed() error {
+	return &googleapi.Error{
+		Code:    http.StatusPreconditionFailed,
+		Message: "At least one of the pre-conditions you specified did not hold.",
+		Errors:  []googleapi.ErrorItem{{Reason: "conditionNotMet", Message: "Precondition Failed"}},
+	}
+}
+
+// errBadRequest is Cloud StorageがCSEKの鍵の誤りなどで返すErrorと同じもの
+func errBadRequest(reason string, message string) error {
+	return &googleapi.Error{
+		Code:    http.StatusBadRequest,
+		Message: message,
+		Errors:  []googleapi.ErrorItem{{Reason: reason, Message: message}},
+	}
+}
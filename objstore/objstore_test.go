@@ -0,0 +1,258 @@
+package objstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/sinmetal/gcs_sample/objstore"
+	"google.golang.org/api/googleapi"
+)
+
+const bucket = "bucket"
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func stores(t *testing.T) map[string]objstore.ObjectStore {
+	fs, err := objstore.NewFilesystem(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]objstore.ObjectStore{
+		"memory":     objstore.NewMemory(),
+		"filesystem": fs,
+	}
+}
+
+func write(t *testing.T, ctx context.Context, s objstore.ObjectStore, name string, data string, opts *objstore.WriteOptions) *objstore.ObjectAttrs {
+	t.Helper()
+	w := s.NewWriter(ctx, bucket, name, opts)
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return w.Attrs()
+}
+
+func read(ctx context.Context, s objstore.ObjectStore, name string, opts *objstore.ObjectOptions) (string, error) {
+	r, err := s.NewReader(ctx, bucket, name, opts)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return string(b), err
+}
+
+func statusOf(err error) int {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
+
+func TestObjectStore_CSEK(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			attrs := write(t, ctx, s, "secret", "hello", &objstore.WriteOptions{
+				Attrs:         objstore.ObjectAttrs{ContentType: "text/plain", Metadata: map[string]string{"k": "v"}},
+				EncryptionKey: key1,
+			})
+			if attrs.CustomerKeySHA256 != objstore.KeySHA256(key1) {
+				t.Errorf("want CustomerKeySHA256 %s but got %s", objstore.KeySHA256(key1), attrs.CustomerKeySHA256)
+			}
+			if attrs.Size != 5 || attrs.ContentType != "text/plain" || attrs.Metadata["k"] != "v" {
+				t.Errorf("unexpected attrs %+v", attrs)
+			}
+
+			if got, err := read(ctx, s, "secret", &objstore.ObjectOptions{EncryptionKey: key1}); err != nil || got != "hello" {
+				t.Errorf("want hello but got %q, %v", got, err)
+			}
+			if _, err := read(ctx, s, "secret", nil); statusOf(err) != http.StatusBadRequest {
+				t.Errorf("want 400 without key but got %v", err)
+			}
+			if _, err := read(ctx, s, "secret", &objstore.ObjectOptions{EncryptionKey: key2}); statusOf(err) != http.StatusBadRequest {
+				t.Errorf("want 400 with wrong key but got %v", err)
+			}
+			// 鍵無しでもAttrsは読めるが、Cloud Storageと同じくCRC32Cは返さない
+			if got, err := s.Attrs(ctx, bucket, "secret", nil); err != nil || got.CRC32C != 0 {
+				t.Errorf("want attrs without crc32c but got %+v, %v", got, err)
+			}
+			if got, err := s.Attrs(ctx, bucket, "secret", &objstore.ObjectOptions{EncryptionKey: key1}); err != nil || got.CRC32C != attrs.CRC32C {
+				t.Errorf("want crc32c %d with key but got %+v, %v", attrs.CRC32C, got, err)
+			}
+
+			copied, err := s.Copy(ctx, objstore.ObjectRef{Bucket: bucket, Name: "copied"}, objstore.ObjectRef{Bucket: bucket, Name: "secret"},
+				&objstore.CopyOptions{SrcEncryptionKey: key1, DstEncryptionKey: key2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied.ContentType != "text/plain" || copied.Metadata["k"] != "v" {
+				t.Errorf("want attrs copied from src but got %+v", copied)
+			}
+			if got, err := read(ctx, s, "copied", &objstore.ObjectOptions{EncryptionKey: key2}); err != nil || got != "hello" {
+				t.Errorf("want hello but got %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func TestObjectStore_GenerationsAndPreconditions(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			v1 := write(t, ctx, s, "obj", "v1", nil)
+			v2 := write(t, ctx, s, "obj", "v2", &objstore.WriteOptions{Conditions: &objstore.Conditions{GenerationMatch: v1.Generation}})
+			if v2.Generation <= v1.Generation {
+				t.Errorf("want generation greater than %d but got %d", v1.Generation, v2.Generation)
+			}
+
+			w := s.NewWriter(ctx, bucket, "obj", &objstore.WriteOptions{Conditions: &objstore.Conditions{DoesNotExist: true}})
+			w.Write([]byte("v3"))
+			if err := w.Close(); statusOf(err) != http.StatusPreconditionFailed {
+				t.Errorf("want 412 but got %v", err)
+			}
+
+			if got, _ := read(ctx, s, "obj", nil); got != "v2" {
+				t.Errorf("want v2 but got %q", got)
+			}
+			if got, _ := read(ctx, s, "obj", &objstore.ObjectOptions{Generation: v1.Generation}); got != "v1" {
+				t.Errorf("want v1 but got %q", got)
+			}
+
+			page, err := s.List(ctx, bucket, &objstore.Query{Versions: true}, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Objects) != 2 {
+				t.Errorf("want 2 generations but got %d", len(page.Objects))
+			}
+
+			updated, err := s.Update(ctx, bucket, "obj", &objstore.ObjectOptions{Generation: v1.Generation, Conditions: &objstore.Conditions{MetagenerationMatch: 1}},
+				objstore.ObjectAttrsToUpdate{ContentType: "text/plain", Metadata: map[string]string{"k": "v"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Generation != v1.Generation || updated.Metageneration != 2 || updated.ContentType != "text/plain" || updated.Metadata["k"] != "v" {
+				t.Errorf("unexpected updated attrs %+v", updated)
+			}
+			if _, err := s.Update(ctx, bucket, "obj", &objstore.ObjectOptions{Generation: v1.Generation, Conditions: &objstore.Conditions{MetagenerationMatch: 1}},
+				objstore.ObjectAttrsToUpdate{ContentType: "text/html"}); statusOf(err) != http.StatusPreconditionFailed {
+				t.Errorf("want 412 but got %v", err)
+			}
+
+			if err := s.Delete(ctx, bucket, "obj", &objstore.ObjectOptions{Conditions: &objstore.Conditions{GenerationMatch: v1.Generation}}); statusOf(err) != http.StatusPreconditionFailed {
+				t.Errorf("want 412 but got %v", err)
+			}
+			if err := s.Delete(ctx, bucket, "obj", nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := read(ctx, s, "obj", nil); !errors.Is(err, objstore.ErrObjectNotExist) {
+				t.Errorf("want ErrObjectNotExist but got %v", err)
+			}
+			if got, _ := read(ctx, s, "obj", &objstore.ObjectOptions{Generation: v2.Generation}); got != "v2" {
+				t.Errorf("want noncurrent v2 but got %q", got)
+			}
+		})
+	}
+}
+
+func TestObjectStore_CanceledWriter(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			w := s.NewWriter(ctx, bucket, "canceled", nil)
+			w.Write([]byte("partial"))
+			cancel()
+			if err := w.Close(); err == nil {
+				t.Error("want error but got nil")
+			}
+			if _, err := s.Attrs(context.Background(), bucket, "canceled", nil); !errors.Is(err, objstore.ErrObjectNotExist) {
+				t.Errorf("want ErrObjectNotExist but got %v", err)
+			}
+		})
+	}
+}
+
+func TestObjectStore_ListAndCompose(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			for _, n := range []string{"a/1", "a/2", "a/3", "b/1", "c"} {
+				write(t, ctx, s, n, n, nil)
+			}
+
+			var names []string
+			token := ""
+			for {
+				page, err := s.List(ctx, bucket, &objstore.Query{Prefix: "a/"}, 2, token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, o := range page.Objects {
+					names = append(names, o.Name)
+				}
+				if page.NextPageToken == "" {
+					break
+				}
+				token = page.NextPageToken
+			}
+			if len(names) != 3 || names[0] != "a/1" || names[2] != "a/3" {
+				t.Errorf("want [a/1 a/2 a/3] but got %v", names)
+			}
+
+			page, err := s.List(ctx, bucket, &objstore.Query{Delimiter: "/"}, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Objects) != 3 || page.Objects[0].Prefix != "a/" || page.Objects[1].Prefix != "b/" || page.Objects[2].Name != "c" {
+				t.Errorf("want [a/ b/ c] but got %+v", page.Objects)
+			}
+
+			_, err = s.Compose(ctx, objstore.ObjectRef{Bucket: bucket, Name: "composed"},
+				[]objstore.ObjectRef{{Bucket: bucket, Name: "a/1"}, {Bucket: bucket, Name: "c"}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := read(ctx, s, "composed", nil); got != "a/1c" {
+				t.Errorf("want a/1c but got %q", got)
+			}
+		})
+	}
+}
+
+func TestFilesystem_Reopen(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s, err := objstore.NewFilesystem(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := write(t, ctx, s, "obj", "v1", &objstore.WriteOptions{EncryptionKey: key1})
+	v2 := write(t, ctx, s, "obj", "v2", &objstore.WriteOptions{EncryptionKey: key1})
+
+	s, err = objstore.NewFilesystem(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(ctx, s, "obj", &objstore.ObjectOptions{EncryptionKey: key1}); err != nil || got != "v2" {
+		t.Errorf("want v2 but got %q, %v", got, err)
+	}
+	if got, err := read(ctx, s, "obj", &objstore.ObjectOptions{Generation: v1.Generation, EncryptionKey: key1}); err != nil || got != "v1" {
+		t.Errorf("want v1 but got %q, %v", got, err)
+	}
+	v3 := write(t, ctx, s, "obj", "v3", nil)
+	if v3.Generation <= v2.Generation {
+		t.Errorf("want generation greater than %d but got %d", v2.Generation, v3.Generation)
+	}
+}
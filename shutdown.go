@@ -0,0 +1,21 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// readiness is Requestを受け付けられる状態かどうかを保持する
+// SIGTERMを受け取った後はShutdown中としてreadinessを落とす
+type readiness struct {
+	shuttingDown int32
+}
+
+// SetShuttingDown is Shutdownを開始したことを記録する
+func (r *readiness) SetShuttingDown() {
+	atomic.StoreInt32(&r.shuttingDown, 1)
+}
+
+// ShuttingDown is Shutdown中かどうか
+func (r *readiness) ShuttingDown() bool {
+	return atomic.LoadInt32(&r.shuttingDown) == 1
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/jaeger"
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	"contrib.go.opencensus.io/exporter/zipkin"
+	openzipkin "github.com/openzipkin/zipkin-go"
+	"github.com/openzipkin/zipkin-go/reporter"
+	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
+	"github.com/sinmetal/gcs_sample/internal/logging"
+	"github.com/sinmetal/gcs_sample/internal/metrics"
+	apptrace "github.com/sinmetal/gcs_sample/internal/trace"
+	metadatabox "github.com/sinmetalcraft/gcpbox/metadata"
+	"go.opencensus.io/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// serviceName is Trace Exporterに渡すService名
+const serviceName = "gcs_sample"
+
+// Trace Backends selectable by Config.TraceBackend
+const (
+	traceBackendOpenCensus    = "opencensus"
+	traceBackendOpenTelemetry = "otel"
+	traceBackendStdout        = "stdout"
+)
+
+// Trace Exporters selectable by Config.TraceExporter when TraceBackend=opencensus
+const (
+	traceExporterAuto        = ""
+	traceExporterStackdriver = "stackdriver"
+	traceExporterStdout      = "stdout"
+	traceExporterZipkin      = "zipkin"
+	traceExporterJaeger      = "jaeger"
+	traceExporterNone        = "none"
+)
+
+// telemetryFlushTimeout is 終了時にバッファしているTraceを送り出すのを待つ時間
+const telemetryFlushTimeout = 2 * time.Second
+
+// telemetry is Trace, Metricsの出力先と、終了時に後始末するものを保持する
+type telemetry struct {
+	stackdriver    *stackdriver.Exporter
+	tracerProvider *sdktrace.TracerProvider
+	jaeger         *jaeger.Exporter
+	zipkinReporter reporter.Reporter
+}
+
+// setupTelemetry is Config.TraceBackendに応じたTrace Backendを設定し、GCP上ではMetricsをCloud Monitoringに送る
+func setupTelemetry(ctx context.Context, cfg *Config, projectID string) (*telemetry, error) {
+	t := &telemetry{}
+
+	if metadatabox.OnGCP() {
+		// Create and register a OpenCensus Stackdriver Trace exporter.
+		exporter, err := stackdriver.NewExporter(stackdriver.Options{
+			ProjectID: projectID,
+			OnError:   reportExporterError("stackdriver"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed create stackdriver exporter: %w", err)
+		}
+		if err := exporter.StartMetricsExporter(); err != nil {
+			return nil, fmt.Errorf("failed start metrics exporter: %w", err)
+		}
+		t.stackdriver = exporter
+	}
+	if err := metrics.Register(); err != nil {
+		return nil, fmt.Errorf("failed register metrics views: %w", err)
+	}
+
+	sampling := apptrace.Sampling{
+		Rate:        cfg.TraceSampleRate,
+		RouteRates:  cfg.TraceRouteSampleRates,
+		ForceHeader: cfg.TraceForceHeader,
+	}
+	apptrace.SetSampling(sampling)
+
+	switch cfg.TraceBackend {
+	case traceBackendOpenCensus:
+		if err := t.registerOpenCensusExporter(cfg); err != nil {
+			return nil, err
+		}
+		trace.ApplyConfig(trace.Config{DefaultSampler: apptrace.OpenCensusSampler(sampling)})
+	case traceBackendOpenTelemetry:
+		tp, err := apptrace.NewOTLPTracerProvider(ctx, cfg.OTLPEndpoint, cfg.OTLPInsecure)
+		if err != nil {
+			return nil, err
+		}
+		t.tracerProvider = tp
+		apptrace.SetBackend(apptrace.NewOpenTelemetryBackend(tp))
+	case traceBackendStdout:
+		tp, err := apptrace.NewStdoutTracerProvider()
+		if err != nil {
+			return nil, err
+		}
+		t.tracerProvider = tp
+		apptrace.SetBackend(apptrace.NewOpenTelemetryBackend(tp))
+	default:
+		return nil, fmt.Errorf("unsupported TraceBackend: %s", cfg.TraceBackend)
+	}
+	return t, nil
+}
+
+// registerOpenCensusExporter is Config.TraceExporterに応じたOpenCensusのTrace Exporterを登録する
+// 指定しない場合はGCP上ではCloud Traceに送り、それ以外では送らない
+func (t *telemetry) registerOpenCensusExporter(cfg *Config) error {
+	switch cfg.TraceExporter {
+	case traceExporterAuto, traceExporterStackdriver:
+		if t.stackdriver != nil {
+			trace.RegisterExporter(t.stackdriver)
+			return nil
+		}
+		if cfg.TraceExporter == traceExporterStackdriver {
+			return fmt.Errorf("TraceExporter=stackdriver is only available on GCP")
+		}
+	case traceExporterStdout:
+		trace.RegisterExporter(&stdoutExporter{})
+	case traceExporterZipkin:
+		endpoint, err := openzipkin.NewEndpoint(serviceName, "")
+		if err != nil {
+			return fmt.Errorf("failed create zipkin endpoint: %w", err)
+		}
+		t.zipkinReporter = zipkinhttp.NewReporter(cfg.ZipkinEndpoint,
+			zipkinhttp.Logger(log.New(os.Stderr, "zipkin exporter: ", log.LstdFlags)))
+		trace.RegisterExporter(zipkin.NewExporter(t.zipkinReporter, endpoint))
+	case traceExporterJaeger:
+		exporter, err := jaeger.NewExporter(jaeger.Options{
+			CollectorEndpoint: cfg.JaegerEndpoint,
+			Process:           jaeger.Process{ServiceName: serviceName},
+			OnError:           reportExporterError("jaeger"),
+		})
+		if err != nil {
+			return fmt.Errorf("failed create jaeger exporter: %w", err)
+		}
+		t.jaeger = exporter
+		trace.RegisterExporter(exporter)
+	case traceExporterNone:
+	default:
+		return fmt.Errorf("unsupported TraceExporter: %s", cfg.TraceExporter)
+	}
+	return nil
+}
+
+// reportExporterError is Exporterが送信に失敗した時に呼ばれるhook
+func reportExporterError(name string) func(err error) {
+	return func(err error) {
+		logging.Warningf(context.Background(), "failed export to %s: %s", name, err)
+	}
+}
+
+// stdoutExporter is Localでの確認用にSpanを1行ずつstdoutに出力するOpenCensusのExporter
+type stdoutExporter struct{}
+
+// ExportSpan implements trace.Exporter.
+func (e *stdoutExporter) ExportSpan(sd *trace.SpanData) {
+	fmt.Printf("span: name=%s trace=%s span=%s parent=%s duration=%s status=%d %s attributes=%v\n",
+		sd.Name, sd.TraceID, sd.SpanID, sd.ParentSpanID, sd.EndTime.Sub(sd.StartTime), sd.Code, sd.Message, sd.Attributes)
+}
+
+// Close is バッファしているTrace, Metricsを送り出してから、Exporterを止める
+func (t *telemetry) Close(ctx context.Context) {
+	if t.tracerProvider != nil {
+		if err := t.tracerProvider.Shutdown(ctx); err != nil {
+			logging.Errorf(ctx, "failed shutdown tracer provider: %s", err)
+		}
+	}
+	if t.jaeger != nil {
+		t.jaeger.Flush()
+	}
+	if t.zipkinReporter != nil {
+		if err := t.zipkinReporter.Close(); err != nil {
+			logging.Errorf(ctx, "failed close zipkin reporter: %s", err)
+		}
+	}
+	if t.stackdriver != nil {
+		t.stackdriver.StopMetricsExporter()
+		t.stackdriver.Flush()
+	}
+}
+
+// newTracingHTTPClient is Cloud Storage, Cloud KMSへのRequestに使うHTTP Client
+// optsに従った認証に加えて、Request ContextのSpanをtraceparent, X-Cloud-Trace-Contextで伝播する
+func newTracingHTTPClient(ctx context.Context, opts ...option.ClientOption) (*http.Client, error) {
+	t, err := htransport.NewTransport(ctx, apptrace.Transport(http.DefaultTransport), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed create http transport: %w", err)
+	}
+	return &http.Client{Transport: t}, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/sinmetal/gcs_sample/encryption"
+)
+
+// customMetadataHeaderPrefix is Custom Metadataとして扱うRequest Headerのprefix
+// Cloud Storage XML APIに合わせている
+const customMetadataHeaderPrefix = "X-Goog-Meta-"
+
+// formURLEncoded is form POSTのContent-Type
+const formURLEncoded = "application/x-www-form-urlencoded"
+
+// multipartFileField is multipart/form-dataでファイルを送る時のField名
+const multipartFileField = "file"
+
+var errUploadTooLarge = errors.New("upload body too large")
+
+// uploadBody is Clientから直接送られてきたUpload対象
+type uploadBody struct {
+	// Reader is Objectの中身
+	Reader io.Reader
+
+	// Filename is multipart/form-dataで送られてきた時のファイル名
+	Filename string
+
+	Options *encryption.UploadOptions
+}
+
+// isDirectUpload is Request BodyをそのままUploadするRequestかどうか
+// PUTは常にRequest BodyをUploadする
+// POSTはapplication/x-www-form-urlencodedの場合はobject=を送るform POSTとして扱い、
+// GETと同じく従来どおりBaseBucketのObjectを暗号化する
+func isDirectUpload(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPut:
+		return true
+	case http.MethodPost:
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			return true
+		}
+		return mediaType != formURLEncoded
+	default:
+		return false
+	}
+}
+
+// readUploadBody is Request BodyからUpload対象を取り出す
+// raw streamとmultipart/form-dataの両方に対応していて、maxSizeを超えた場合はerrUploadTooLargeを返す
+func readUploadBody(r *http.Request, maxSize int64) (*uploadBody, error) {
+	opts := &encryption.UploadOptions{
+		Metadata: customMetadata(r.Header),
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = ""
+	}
+	if mediaType != "multipart/form-data" {
+		opts.ContentType = r.Header.Get("Content-Type")
+		return &uploadBody{
+			Reader:  newLimitedReader(r.Body, maxSize),
+			Options: opts,
+		}, nil
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("failed read multipart: %w", err)
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("not found %s field in multipart", multipartFileField)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed read multipart: %w", err)
+		}
+		if part.FormName() != multipartFileField {
+			continue
+		}
+		opts.ContentType = part.Header.Get("Content-Type")
+		return &uploadBody{
+			Reader:   newLimitedReader(part, maxSize),
+			Filename: part.FileName(),
+			Options:  opts,
+		}, nil
+	}
+}
+
+// customMetadata is X-Goog-Meta-* HeaderをCustom Metadataに変換する
+func customMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for k, v := range header {
+		if !strings.HasPrefix(k, customMetadataHeaderPrefix) || len(v) < 1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(k, customMetadataHeaderPrefix))
+		if key == "" {
+			continue
+		}
+		metadata[key] = v[0]
+	}
+	return metadata
+}
+
+// limitedReader is maxSizeを超えて読み込もうとした時にerrUploadTooLargeを返すReader
+type limitedReader struct {
+	r       io.Reader
+	remains int64
+}
+
+func newLimitedReader(r io.Reader, maxSize int64) io.Reader {
+	if maxSize <= 0 {
+		return r
+	}
+	// maxSizeちょうどのBodyを受け付けるために、1byte余分に読めるようにしておく
+	return &limitedReader{r: r, remains: maxSize + 1}
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.remains {
+		p = p[:l.remains]
+	}
+	n, err := l.r.Read(p)
+	l.remains -= int64(n)
+	if l.remains <= 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// uploadErrorStatus is Upload失敗時のerrからResponseのStatus Codeを決める
+func uploadErrorStatus(err error) int {
+	if errors.Is(err, errUploadTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return errorStatus(err)
+}